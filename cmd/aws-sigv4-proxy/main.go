@@ -16,15 +16,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"reflect"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"aws-sigv4-proxy/handler"
+	"github.com/awslabs/aws-sigv4-proxy/handler"
+	"github.com/awslabs/aws-sigv4-proxy/lambda"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -32,29 +43,184 @@ import (
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/sts"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 var (
 	debug                  = kingpin.Flag("verbose", "Enable additional logging, implies all the log-* options").Short('v').Bool()
+	logFormat              = kingpin.Flag("log-format", "Format of the logs, text or json").Default("text").Enum("text", "json")
+	accessLog              = kingpin.Flag("access-log", "Log a line per request to stdout, apart from the other logs written to stderr").Bool()
 	logFailedResponse      = kingpin.Flag("log-failed-requests", "Log 4xx and 5xx response body").Bool()
+	logFailedMaxBytes      = kingpin.Flag("log-failed-requests-max-bytes", "Maximum number of bytes of the 4xx and 5xx response bodies logged").Default("4096").Int()
+	logHeaderSampleRate    = kingpin.Flag("log-header-changes-sample-rate", "Fraction of the requests whose headers stripped, duplicated, added, dropped or left unsigned are logged at info level, between 0 and 1, they are logged at debug level for every request").Float64()
 	logSinging             = kingpin.Flag("log-signing-process", "Log sigv4 signing process").Bool()
+	configFile             = kingpin.Flag("config", "YAML file of config sets, to proxy to several upstreams with different signing settings").String()
+	reloadProbation        = kingpin.Flag("reload.probation", "How long the config of a reload is monitored before it becomes the last-known-good config").Default("5m").Duration()
+	reloadMaxErrorRate     = kingpin.Flag("reload.max-error-rate", "How much higher than the one of the last-known-good config the signing error rate of a reloaded config on probation can be before rolling back, 0.05 for 5 points by default, 1 disables rolling back").Default("0.05").Float64()
+	reloadMinRequests      = kingpin.Flag("reload.min-requests", "Requests a reloaded config on probation serves before its signing error rate is compared").Default("20").Int64()
+	endpointsFile          = kingpin.Flag("endpoints-file", "endpoints.json file, in the format of the endpoints model of the AWS SDKs, to look the signing name and region of the hosts up in before the built-in endpoints").String()
+	endpointsFileReplace   = kingpin.Flag("endpoints-file-replace", "Only look the hosts up in --endpoints-file, not in the built-in endpoints").Bool()
+	partitions             = kingpin.Flag("partition", "AWS partition whose built-in endpoints are detected, e.g. aws, aws-cn or aws-us-gov, all when unset (repeatable)").Strings()
+	noHostHeuristics       = kingpin.Flag("no-host-heuristics", "Do not derive the service and region of the regional AWS hosts missing from the endpoints, e.g. <service>.<region>.amazonaws.com, from their name").Bool()
+	pathRoutes             = kingpin.Flag("path-route", "Route the requests under a path prefix to an upstream host, removing the prefix and signing for the service and region of the host, in PREFIX=HOST format, e.g. /s3=s3.eu-west-1.amazonaws.com (repeatable)").StringMap()
+	stripPathPrefixes      = kingpin.Flag("strip-path-prefix", "Remove a prefix from the path of the requests before signing them, e.g. /proxy for /proxy/bucket/key (repeatable)").Strings()
+	targetInPath           = kingpin.Flag("target-in-path", "Send the requests whose path starts with /SCHEME/HOST to that upstream, without them, e.g. /https/dynamodb.us-east-1.amazonaws.com/").Bool()
 	port                   = kingpin.Flag("port", "Port to serve http on").Default(":8080").String()
-	strip                  = kingpin.Flag("strip", "Headers to strip from incoming request").Short('s').Strings()
+	listenAddrs            = kingpin.Flag("listen", "Address to serve on instead of --port, in [http(s)://][HOST]:PORT format, HTTPS when a certificate is configured unless http:// is set, e.g. 127.0.0.1:8080 (repeatable)").Strings()
+	shutdownTimeout        = kingpin.Flag("shutdown-timeout", "Time to wait for in-flight requests to complete on SIGTERM or SIGINT before exiting").Default("30s").Duration()
+	adminPort              = kingpin.Flag("admin-port", "Port to serve the admin endpoints on, disabled when empty").String()
+	adminTokenFile         = kingpin.Flag("admin-token-file", "File of the bearer token of the admin endpoints changing the proxy, which are only served to local clients without it").ExistingFile()
+	adminAllowDebug        = kingpin.Flag("admin-allow-debug-log-level", "Allow PUT /log-level to set the debug and trace levels, which log the headers and bodies of the failed requests").Bool()
+	adminAllowExpiry       = kingpin.Flag("admin-allow-credentials-expiry", "Allow POST /credentials/expire to force the cached credentials to expire").Bool()
+	readinessAssumeRoles   = kingpin.Flag("readiness-assume-roles", "Also check in /readyz that the roles of --method-role-arn and the config sets can be assumed").Bool()
+	waitCredentialsTimeout = kingpin.Flag("wait-for-credentials-timeout", "Wait up to this long for the credentials to be retrieved before serving requests, e.g. from a sidecar starting after the proxy, 0 does not wait").Duration()
+	waitUpstreams          = kingpin.Flag("wait-for-upstream", "URL of an upstream to connect to before serving requests, e.g. https://aps-workspaces.us-east-1.amazonaws.com (repeatable)").Strings()
+	waitUpstreamTimeout    = kingpin.Flag("wait-for-upstream-timeout", "Time to wait for the upstreams of --wait-for-upstream to accept connections").Default("2m").Duration()
+	tlsCert                = kingpin.Flag("tls-cert", "PEM certificate file (with its chain) to serve HTTPS on --port, along with --tls-key").ExistingFile()
+	tlsKey                 = kingpin.Flag("tls-key", "PEM private key file of --tls-cert").ExistingFile()
+	tlsClientCA            = kingpin.Flag("tls-client-ca", "PEM file of the CA certificates the clients must present a certificate issued by, for mutual TLS with --tls-cert").ExistingFile()
+	clientCertHeader       = kingpin.Flag("client-cert-header", "Header to forward the identity of the verified certificate of the clients in, signed, with --tls-client-ca").String()
+	clientCertIdentity     = kingpin.Flag("client-cert-identity", "Identity of the client certificates forwarded in --client-cert-header, the distinguished name of their subject or their subject alternative names").Default("subject").Enum("subject", "san")
+	h2c                    = kingpin.Flag("h2c", "Accept HTTP/2 without TLS (h2c, with prior knowledge) on --port, e.g. from gRPC clients").Bool()
+	listenerForceHTTP1     = kingpin.Flag("listener-force-http1", "Serve HTTP/1.1 only on --port, even to the TLS clients able to negotiate HTTP/2").Bool()
+	listenerForceHTTP2     = kingpin.Flag("listener-force-http2", "Serve HTTP/2 only on --port, h2c without TLS").Bool()
+	tlsMinVersion          = kingpin.Flag("tls-min-version", "Minimum TLS version accepted from clients, 1.0 and 1.1 are deprecated").Default("1.2").Enum("1.0", "1.1", "1.2", "1.3")
+	acmeDomains            = kingpin.Flag("acme-domain", "Domain to obtain a certificate for with ACME (Let's Encrypt) and serve HTTPS on --port (repeatable)").Strings()
+	acmeEmail              = kingpin.Flag("acme-email", "Contact email of the ACME account").String()
+	acmeCacheDir           = kingpin.Flag("acme-cache-dir", "Directory ACME account keys and certificates are cached in").Default("acme-cache").String()
+	acmeDirectoryURL       = kingpin.Flag("acme-directory-url", "ACME directory URL, e.g. Let's Encrypt staging for testing").Default(autocert.DefaultACMEDirectory).String()
+	acmeHTTPPort           = kingpin.Flag("acme-http-port", "Port to answer ACME HTTP-01 challenges on, only TLS-ALPN-01 challenges are answered when empty").Default(":80").String()
+	forwardProxy           = kingpin.Flag("forward-proxy", "Also act as an HTTP forward proxy, set in HTTP_PROXY and HTTPS_PROXY, intercepting the TLS connections to --forward-proxy-host with certificates issued by --forward-proxy-ca-cert").Bool()
+	forwardProxyCACert     = kingpin.Flag("forward-proxy-ca-cert", "PEM certificate of the CA issuing the certificates of the hosts intercepted by --forward-proxy, which the clients must trust").ExistingFile()
+	forwardProxyCAKey      = kingpin.Flag("forward-proxy-ca-key", "PEM private key of --forward-proxy-ca-cert").ExistingFile()
+	forwardProxyHosts      = kingpin.Flag("forward-proxy-host", "Host the clients of --forward-proxy may reach, * matching any characters, the AWS domains by default (repeatable)").Default(handler.DefaultForwardProxyHosts...).Strings()
+	lambdaMode             = kingpin.Flag("lambda", "Serve Lambda function URL and ALB invocations through the Lambda Runtime API instead of listening on --port").Bool()
+	strip                  = kingpin.Flag("strip", "Headers to strip from incoming request, * matches any characters, e.g. X-Internal-*").Short('s').Strings()
 	customHeaders          = kingpin.Flag("custom-headers", "Comma-separated list of custom headers in key=value format").String()
+	identityHeaders        = kingpin.Flag("identity-header", "Header identifying the proxy to the upstreams, e.g. its environment or team, signed and replacing the one of the clients, in NAME=VALUE format, e.g. X-Environment=production (repeatable)").StringMap()
 	duplicateHeaders       = kingpin.Flag("duplicate-headers", "Duplicate headers to an X-Original- prefix name").Strings()
+	preserveHeaderCase     = kingpin.Flag("preserve-header-case", "Header name to send upstream in this exact casing instead of the canonical form (repeatable)").Strings()
+	preserveRequestURI     = kingpin.Flag("preserve-request-uri", "Forward the path of the requests exactly as received, with its escaping, e.g. %2F, instead of escaping it again").Bool()
+	preserveQueryString    = kingpin.Flag("preserve-query-string", "Forward the query string of the requests exactly as received, with its order and escaping, instead of encoding its parameters again").Bool()
 	roleArn                = kingpin.Flag("role-arn", "Amazon Resource Name (ARN) of the role to assume").String()
+	externalID             = kingpin.Flag("external-id", "External ID to assume the role of --role-arn with, as required by cross-account trust policies").String()
+	sourceIdentity         = kingpin.Flag("source-identity", "Source identity set when assuming the role of --role-arn").String()
+	assumeRoleDuration     = kingpin.Flag("assume-role-duration", "Duration of the sessions of the role of --role-arn, from 15m to the maximum session duration of the role").Default("15m").Duration()
+	sessionTags            = kingpin.Flag("session-tag", "Session tag to set when assuming the role, in key=value format (repeatable)").StringMap()
+	sessionTagHeaders      = kingpin.Flag("session-tag-header", "Session tag sourced from an incoming request header, in key=Header-Name format (repeatable)").StringMap()
+	roleHeader             = kingpin.Flag("role-header", "Header of the incoming requests naming the role to assume to sign them, among --allowed-role-arn, e.g. X-Assume-Role-Arn").String()
+	allowedRoleArns        = kingpin.Flag("allowed-role-arn", "Role that --role-header may name, * matching any characters, e.g. arn:aws:iam::123456789012:role/tenant-* (repeatable)").Strings()
+	methodRoleArns         = kingpin.Flag("method-role-arn", "Role to assume to sign the requests with the given comma separated HTTP methods, or * for the others, in METHODS=arn format, e.g. GET,HEAD=arn:aws:iam::123456789012:role/read-only (repeatable)").StringMap()
+	accountRoleArns        = kingpin.Flag("account-role", "Role to assume to sign the requests for an AWS account, in account=arn format, also read from the "+handler.AccountRoleEnvPrefix+"<account> environment variables (repeatable)").StringMap()
+	accountHeader          = kingpin.Flag("account-header", "Header of the incoming requests naming the AWS account of --account-role they target, e.g. X-Sigv4-Proxy-Account-Id").String()
+	transitiveTagKeys      = kingpin.Flag("transitive-tag-key", "Session tag key that persists through role chaining (repeatable)").Strings()
+	allowedOverrides       = kingpin.Flag("allow-signing-override", "Signing parameter clients may override per request with the X-Sigv4-Proxy-Service, X-Sigv4-Proxy-Region or X-Sigv4-Proxy-Host headers: service, region or host (repeatable)").Enums(handler.OverrideService, handler.OverrideRegion, handler.OverrideHost)
+	requireExplicitConfig  = kingpin.Flag("require-explicit-signing-config", "Disable the detection of the service and region from the Host header, requests must match --name and --region, a config set or allowed overrides").Bool()
+	signingAlgorithm       = kingpin.Flag("signing-algorithm", "Signing algorithm, v4 or v4a to sign with SigV4A for the comma separated region set of --region, e.g. * for S3 Multi-Region Access Points").Default(handler.SigningAlgorithmV4).Enum(handler.SigningAlgorithmV4, handler.SigningAlgorithmV4A)
 	signingNameOverride    = kingpin.Flag("name", "AWS Service to sign for").String()
 	signingHostOverride    = kingpin.Flag("sign-host", "Host to sign for").String()
 	hostOverride           = kingpin.Flag("host", "Host to proxy to").String()
+	forwardHostHeader      = kingpin.Flag("forward-host-header", "Host header sent upstream and signed: original of the client, override of --host (or the host picked by the client) or signing of --sign-host, by default signing with --sign-host and override otherwise").Enum(handler.ForwardHostOriginal, handler.ForwardHostOverride, handler.ForwardHostSigning)
+	allowedUpstreamHosts   = kingpin.Flag("allowed-upstream-hosts", "Host the requests may be sent to when the client picks it with the Host header, where * matches any characters, e.g. *.amazonaws.com (repeatable)").Strings()
+	noLoopDetection        = kingpin.Flag("no-loop-detection", "Neither mark the upstream requests as signed by the proxy nor reject the requests already signed by a proxy with a 508").Bool()
+	strictResponseHeaders  = kingpin.Flag("strict-response-headers", "Only pass the essential headers of the upstream responses, such as Content-Type and ETag, and those of --allowed-response-header downstream").Bool()
+	allowedResponseHeaders = kingpin.Flag("allowed-response-header", "Header of the upstream responses passed downstream with --strict-response-headers, * matching any characters, e.g. X-Amz-Meta-* (repeatable)").Strings()
 	regionOverride         = kingpin.Flag("region", "AWS region to sign for").String()
+	defaultService         = kingpin.Flag("default-service", "AWS service to sign for, along with --default-region, when it cannot be detected from the host, unlike --name").String()
+	defaultRegion          = kingpin.Flag("default-region", "AWS region to sign for, along with --default-service, when it cannot be detected from the host, unlike --region").String()
 	disableSSLVerification = kingpin.Flag("no-verify-ssl", "Disable peer SSL certificate validation").Bool()
 	idleConnTimeout        = kingpin.Flag("transport.idle-conn-timeout", "Idle timeout to the upstream service").Default("40s").Duration()
+	h2ReadIdleTimeout      = kingpin.Flag("transport.h2-read-idle-timeout", "Health check HTTP/2 upstream connections with a PING after this long without frames, 0 disables").Default("30s").Duration()
+	forceHTTP1             = kingpin.Flag("upstream-force-http1", "Send the upstream requests over HTTP/1.1 only, for upstreams misbehaving on HTTP/2").Bool()
+	forceHTTP2             = kingpin.Flag("upstream-force-http2", "Send the upstream requests over HTTP/2 only, h2c for the http upstreams, e.g. gRPC services").Bool()
+	h2PingTimeout          = kingpin.Flag("transport.h2-ping-timeout", "Close HTTP/2 upstream connections that do not answer a PING within this timeout").Default("15s").Duration()
+	maxConnAge             = kingpin.Flag("transport.max-conn-age", "Close upstream connections older than this once their request completes, to pick up DNS changes and get rebalanced by load balancers, 0 disables").Duration()
+	dynamoDBSimpleJSON     = kingpin.Flag("dynamodb-simple-json", "Convert the items of the DynamoDB requests sent with Content-Type: application/json from plain JSON to attribute values, and the items of their responses back").Bool()
+	streamingUploadSize    = kingpin.Flag("s3-streaming-upload-threshold", "Stream the bodies of S3 PUT requests of at least this many bytes upstream with chunked payload signing instead of buffering them, such uploads are not retried, 0 disables").Int64()
+	maxBodyMemory          = kingpin.Flag("max-request-body-memory", "Buffer request bodies in memory up to this many bytes, larger bodies are spilled to --request-body-spill-dir or rejected with a 413, 0 disables").Int64()
+	bodySpillDir           = kingpin.Flag("request-body-spill-dir", "Directory of the temporary files of the request bodies larger than --max-request-body-memory, empty rejects them").String()
+	maxTotalBodyMemory     = kingpin.Flag("max-total-request-body-memory", "Buffer at most this many bytes of request bodies in memory across the requests in flight, the requests not fitting are rejected with a 503, 0 is unlimited").Int64()
+	upstreamTimeout        = kingpin.Flag("upstream-timeout", "Fail upstream requests not complete within this timeout with a 504, streaming responses only until their headers are received, 0 disables").Duration()
+	streamingIdleTimeout   = kingpin.Flag("upstream-streaming-idle-timeout", "Fail streaming upstream responses, such as server-sent events, idle for longer than this timeout, 0 disables").Duration()
+	retryMaxAttempts       = kingpin.Flag("retry.max-attempts", "Attempts of the upstream requests failing with a 429, a 5xx or a network error, 1 disables retries").Default("1").Int()
+	retryBaseDelay         = kingpin.Flag("retry.base-delay", "Upper bound of the random delay before the second attempt, doubled for each further attempt").Default("100ms").Duration()
+	retryMaxDelay          = kingpin.Flag("retry.max-delay", "Maximum delay between attempts, longer Retry-After headers are returned to the client").Default("5s").Duration()
+	redirectMaxHops        = kingpin.Flag("redirect.max-hops", "Follow up to this many redirects of the upstream responses to GET and HEAD requests, e.g. to presigned S3 URLs, instead of returning them to the client, 0 disables").Int()
+	redirectDomains        = kingpin.Flag("redirect.allowed-domain", "Domain, with its subdomains, followed redirects may target besides the host of the original request").Strings()
+	followRegionRedirects  = kingpin.Flag("follow-region-redirects", "Send the S3 requests redirected to the region of their bucket again, signed for that region, instead of returning the redirect to the client").Bool()
+	maxInFlight            = kingpin.Flag("upstream.max-in-flight", "Maximum requests in flight to each upstream host, further requests wait for --upstream.max-in-flight-wait and fail with a 503, 0 disables").Int()
+	maxInFlightWait        = kingpin.Flag("upstream.max-in-flight-wait", "Time a request waits for another one to complete when its upstream host has --upstream.max-in-flight requests in flight").Default("1s").Duration()
+	stsRefreshAhead        = kingpin.Flag("sts-refresh-ahead", "Refresh the credentials of the assumed roles this long before they expire, so that requests are never signed with credentials about to expire").Duration()
+	stsKeepAlive           = kingpin.Flag("sts-keep-alive-interval", "Keep a connection to the STS endpoint warm when assuming roles with a request at this interval, below --transport.idle-conn-timeout, 0 disables").Default("30s").Duration()
+	probes                 = kingpin.Flag("probe", "Signed request sent to an upstream at every --probe-interval to check it is reachable, in [METHOD ]URL format, e.g. 'HEAD https://my-bucket.s3.us-east-1.amazonaws.com/' (repeatable)").Strings()
+	probeInterval          = kingpin.Flag("probe-interval", "Interval between two probes of the upstreams of --probe").Default("30s").Duration()
+	probeTimeout           = kingpin.Flag("probe-timeout", "Timeout of each probe of the upstreams of --probe").Default("5s").Duration()
 	schemeOverride         = kingpin.Flag("upstream-url-scheme", "Protocol to proxy with").String()
 	unsignedPayload        = kingpin.Flag("unsigned-payload", "Prevent signing of the payload").Default("false").Bool()
+	unsignedPayloadHeader  = kingpin.Flag("unsigned-payload-header", "Header trusted callers set to true to prevent signing of the payload of a single request, disabled when empty").String()
+	maxHeaderBytes         = kingpin.Flag("max-upstream-header-bytes", "Reject signed requests whose request line and headers exceed this size with a 431, defaults to the known limit of the service (10240 for API Gateway), -1 disables").Int()
+	maxURLLength           = kingpin.Flag("max-upstream-url-length", "Reject signed requests whose URL, including presigned query parameters, exceeds this length with a 414, 0 disables").Int()
+	throttlingRetryAfter   = kingpin.Flag("throttling.retry-after", "Retry-After to set on upstream throttling responses without one, 0 disables").Duration()
+	throttlingStatusCode   = kingpin.Flag("throttling.status-code", "Status code replacing the status of upstream throttling responses, e.g. 503 for Prometheus remote write, 0 disables").Int()
+	teeSink                = kingpin.Flag("tee.sink", "Copy a sample of the responses to file:///path (JSON lines) or s3://bucket/prefix for inspection").String()
+	teeSampleRate          = kingpin.Flag("tee.sample-rate", "Fraction of the responses copied to --tee.sink, between 0 and 1").Default("1").Float64()
+	teeMaxBodyBytes        = kingpin.Flag("tee.max-body-bytes", "Maximum bytes of a response body copied to --tee.sink, the longer ones are truncated").Default("1048576").Int()
+	teeQueueSize           = kingpin.Flag("tee.queue-size", "Maximum responses waiting to be copied to --tee.sink, the others are dropped").Default("64").Int()
+	noUpgrades             = kingpin.Flag("no-upgrades", "Remove the Upgrade header of the requests instead of proxying the upgraded connections, such as WebSocket connections").Bool()
+	webSocketBridge        = kingpin.Flag("websocket-bridge", "Bridge WebSocket connections to upstream response streams, e.g. Bedrock InvokeModelWithResponseStream").Bool()
+	webSocketOrigins       = kingpin.Flag("websocket-origin", "Origin of the pages allowed to open WebSocket connections, * for any, same origin only when unset (repeatable)").Strings()
+	extractFields          = kingpin.Flag("extract-field", "Field to break statistics and logs down by, <service>:<request|response|path>:<name>=<JSONPath or regexp>, e.g. bedrock:path:model=^/model/([^/]+)/ (repeatable)").Strings()
+	classRules             = kingpin.Flag("classify", "Class of the requests whose body starts with a regular expression, <class>=<regexp>, e.g. bulk=^\\s*\\{\\s*\"(index|create|update|delete)\" for OpenSearch bulk requests (repeatable)").Strings()
+	classContentTypes      = kingpin.Flag("classify-content-type", "Content type of the request bodies sniffed by --classify (repeatable)").Default(handler.DefaultClassifiedContentTypes...).Strings()
+	classRateLimits        = kingpin.Flag("class-rate-limit", "Rate limit of the requests of a --classify class, <class>=<requests per second>, e.g. bulk=10 (repeatable)").Strings()
+	rateLimitMaxWait       = kingpin.Flag("rate-limit-max-wait", "Time the requests above a rate limit wait for their turn before being rejected with a 429, 0 rejects them right away").Duration()
+	quotas                 = kingpin.Flag("quota", "Usage quota per tenant, e.g. requests/day=10000 or bytes/month=1073741824 (repeatable)").Strings()
+	quotaTenantHeader      = kingpin.Flag("quota-tenant-header", "Header identifying the tenant quotas apply to, the client IP is used when unset. It must be authenticated, or set by a trusted proxy, as clients could send another tenant").String()
+	quotaStateFile         = kingpin.Flag("quota-state-file", "File quota usage is persisted to across restarts").String()
+	logLegacyClients       = kingpin.Flag("log-legacy-clients", "Log the requests of the clients connected with HTTP/1.0 or TLS below 1.2").Bool()
+	strictFraming          = kingpin.Flag("strict-framing", "Reject requests with conflicting Content-Length headers, or both Content-Length and Transfer-Encoding, with a 400").Bool()
+	strictFramingLogOnly   = kingpin.Flag("strict-framing-log-only", "Log the requests --strict-framing would reject instead of rejecting them").Bool()
+	allowCIDRs             = kingpin.Flag("allow-cidr", "Network allowed to use the proxy, in CIDR notation or a single IP address, all networks are allowed when unset (repeatable)").Strings()
+	apiKeys                = kingpin.Flag("auth-api-key", "API key clients must present in --auth-api-key-header for their requests to be signed (repeatable)").Strings()
+	apiKeysFile            = kingpin.Flag("auth-api-key-file", "File of the API keys clients must present, one per line").ExistingFile()
+	apiKeyHeader           = kingpin.Flag("auth-api-key-header", "Header clients present their API key in").Default(handler.DefaultAPIKeyHeader).String()
+	jwtIssuer              = kingpin.Flag("auth-jwt-issuer", "Issuer of the JWT bearer tokens clients must present for their requests to be signed, e.g. https://cognito-idp.us-east-1.amazonaws.com/us-east-1_Example").String()
+	jwtAudience            = kingpin.Flag("auth-jwt-audience", "Audience the JWT bearer tokens must be issued for").String()
+	jwtJWKSURL             = kingpin.Flag("auth-jwt-jwks-url", "URL of the JSON Web Key Set of --auth-jwt-issuer, discovered from its OpenID configuration when unset").String()
+	jwtLeeway              = kingpin.Flag("auth-jwt-leeway", "Clock skew tolerated on the expiry of the JWT bearer tokens").Default("1m").Duration()
+	jwtRoleClaim           = kingpin.Flag("auth-jwt-role-claim", "Claim of the JWT bearer tokens picking the role to assume among --auth-jwt-claim-role, e.g. groups").String()
+	jwtClaimRoles          = kingpin.Flag("auth-jwt-claim-role", "Role to assume for a value of --auth-jwt-role-claim, in value=arn format (repeatable)").StringMap()
+	sigv4AccessKeysFile    = kingpin.Flag("auth-sigv4-access-keys-file", "File of the access keys clients must sign their requests with, one <access key id>:<secret access key> per line, before they are signed again with the credentials of the proxy").ExistingFile()
+	callerIdentityARNs     = kingpin.Flag("auth-caller-identity-arn", "ARN of the IAM identities allowed to present a presigned STS GetCallerIdentity request in --auth-caller-identity-header, where * matches any characters (repeatable)").Strings()
+	callerIdentityHeader   = kingpin.Flag("auth-caller-identity-header", "Header clients present their presigned STS GetCallerIdentity request in").Default(handler.DefaultCallerIdentityHeader).String()
+	callerIdentityAudience = kingpin.Flag("auth-caller-identity-audience", "Value identifying this proxy the presigned STS GetCallerIdentity requests must sign in --auth-caller-identity-audience-header, required with --auth-caller-identity-arn").String()
+	callerAudienceHeader   = kingpin.Flag("auth-caller-identity-audience-header", "Header the presigned STS GetCallerIdentity requests sign --auth-caller-identity-audience in").Default(handler.DefaultCallerIdentityAudienceHeader).String()
 )
 
+// The commands of the proxy, serve by default. The signing flags above also
+// apply to sign.
+var (
+	serveCommand = kingpin.Command("serve", "Run the proxy").Default()
+	signCommand  = kingpin.Command("sign", "Sign a single request and print it as a curl command, without starting the proxy")
+	signMethod   = signCommand.Flag("method", "HTTP method of the request").Default(http.MethodGet).String()
+	signURL      = signCommand.Flag("url", "URL of the request, e.g. https://sqs.us-east-1.amazonaws.com/?Action=ListQueues").Required().URL()
+	signBody     = signCommand.Flag("body", "File of the request body").ExistingFile()
+	signHeaders  = signCommand.Flag("header", "Header of the request, in name: value format (repeatable)").Strings()
+	signOutput   = signCommand.Flag("output", "Print a curl command, or the signed headers").Default("curl").Enum("curl", "headers")
+)
+
+// tlsVersions are the values of --tls-min-version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
 type awsLoggerAdapter struct {
 }
 
@@ -64,12 +230,34 @@ func (awsLoggerAdapter) Log(args ...interface{}) {
 }
 
 func main() {
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	log.SetLevel(log.InfoLevel)
 	if *debug {
 		log.SetLevel(log.DebugLevel)
 	}
+	if *logFormat == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+
+	if *endpointsFile != "" {
+		hosts, err := handler.LoadEndpointsFile(*endpointsFile, *endpointsFileReplace)
+		if err != nil {
+			log.WithError(err).Fatal("unable to load the endpoints file")
+		}
+		log.WithFields(log.Fields{"EndpointsFile": *endpointsFile, "Hosts": hosts, "Replace": *endpointsFileReplace}).Infof("Loaded the endpoints of %d hosts from %s", hosts, *endpointsFile)
+	} else if *endpointsFileReplace {
+		log.Fatal("--endpoints-file-replace requires --endpoints-file")
+	}
+	if *noHostHeuristics {
+		handler.DisableHostHeuristics()
+	}
+	if len(*partitions) > 0 {
+		if err := handler.LimitPartitions(*partitions); err != nil {
+			log.Fatalf("--partition: %s", err)
+		}
+		log.WithField("Partitions", *partitions).Info("Only detecting the endpoints of the partitions")
+	}
 
 	// Initialize an http.Header object for custom headers
 	customHeadersParsed := make(http.Header)
@@ -104,7 +292,8 @@ func main() {
 		log.Fatal(err)
 	}
 
-	if *regionOverride != "" {
+	// A SigV4A region set such as "*" is not a region STS can be called in.
+	if *regionOverride != "" && !strings.ContainsAny(*regionOverride, "*,") {
 		session.Config.Region = regionOverride
 	}
 
@@ -121,50 +310,1066 @@ func main() {
 
 	http.DefaultTransport.(*http.Transport).IdleConnTimeout = *idleConnTimeout
 
+	// Detect half-open HTTP/2 connections (e.g. after a NAT timeout) instead of
+	// stalling requests multiplexed on them until the kernel gives up.
+	http.DefaultTransport.(*http.Transport).HTTP2 = &http.HTTP2Config{
+		SendPingTimeout: *h2ReadIdleTimeout,
+		PingTimeout:     *h2PingTimeout,
+	}
+
+	// Every connection is tracked, only the upstream ones are recycled.
+	connections := &handler.ConnRecycler{MaxAge: *maxConnAge}
+	http.DefaultTransport.(*http.Transport).DialContext = connections.Dial(http.DefaultTransport.(*http.Transport).DialContext)
+	if *maxConnAge > 0 {
+		log.WithFields(log.Fields{"MaxConnAge": *maxConnAge}).Infof("Recycling upstream connections older than %s", *maxConnAge)
+	}
+
+	stats := handler.NewStats()
+	handler.InstrumentAssumeRole(&session.Handlers, stats)
+
+	// Every credentials are derived from those of the credential chain.
+	credentialsChain := handler.NewCredentialsChain()
+	session.Config.Credentials = credentialsChain.Track(session.Config.Credentials)
+
 	var credentials *credentials.Credentials
+	var credentialsProvider handler.CredentialsProvider
+	readinessCredentials := readinessChecks{}
+	assumesRoles := *roleArn != "" || len(*methodRoleArns) > 0
 	if *roleArn != "" {
-		credentials = stscreds.NewCredentials(session, *roleArn, func(p *stscreds.AssumeRoleProvider) {
+		assumeRoleOptions := func(p *stscreds.AssumeRoleProvider) {
 			p.RoleSessionName = roleSessionName()
+			p.ExpiryWindow = *stsRefreshAhead
+			p.Duration = *assumeRoleDuration
+			if *externalID != "" {
+				p.ExternalID = aws.String(*externalID)
+			}
+			if *sourceIdentity != "" {
+				p.SourceIdentity = aws.String(*sourceIdentity)
+			}
+		}
+		credentials = stscreds.NewCredentials(session, *roleArn, assumeRoleOptions, func(p *stscreds.AssumeRoleProvider) {
+			p.Tags = handler.SessionTags(*sessionTags)
+			p.TransitiveTagKeys = aws.StringSlice(*transitiveTagKeys)
 		})
+
+		if len(*sessionTagHeaders) > 0 {
+			log.WithFields(log.Fields{"SessionTagHeaders": *sessionTagHeaders}).Infof("Sourcing session tags from headers %v", *sessionTagHeaders)
+			credentialsProvider = &handler.SessionTagCredentials{
+				Client:            session,
+				RoleARN:           *roleArn,
+				Tags:              *sessionTags,
+				HeaderTags:        *sessionTagHeaders,
+				TransitiveTagKeys: *transitiveTagKeys,
+				Options:           []func(*stscreds.AssumeRoleProvider){assumeRoleOptions},
+			}
+		}
 	} else {
+		if len(*sessionTags) > 0 || len(*sessionTagHeaders) > 0 {
+			log.Warn("Session tags are only applied when assuming a role with --role-arn, ignoring them")
+		}
+		if *externalID != "" || *sourceIdentity != "" {
+			log.Warn("--external-id and --source-identity are only applied when assuming a role with --role-arn, ignoring them")
+		}
 		credentials = session.Config.Credentials
 	}
 
-	signer := v4.NewSigner(credentials, func(s *v4.Signer) {
+	if len(*methodRoleArns) > 0 {
+		if credentialsProvider != nil {
+			log.Fatal("--method-role-arn and --session-tag-header are mutually exclusive")
+		}
+		methodCredentials, err := handler.NewMethodCredentials(*methodRoleArns, roleAssumer(session))
+		if err != nil {
+			log.Fatal(err)
+		}
+		credentialsProvider = methodCredentials
+		readinessCredentials.addMethods("", methodCredentials)
+		log.WithFields(log.Fields{"MethodRoleArns": *methodRoleArns}).Infof("Signing with the roles of the HTTP methods %v", *methodRoleArns)
+	}
+
+	if *jwtRoleClaim != "" {
+		if *jwtIssuer == "" {
+			log.Fatal("--auth-jwt-role-claim requires --auth-jwt-issuer")
+		}
+		if credentialsProvider != nil {
+			log.Fatal("--auth-jwt-role-claim, --method-role-arn and --session-tag-header are mutually exclusive")
+		}
+		if len(*jwtClaimRoles) == 0 {
+			log.Fatal("--auth-jwt-role-claim requires at least one --auth-jwt-claim-role")
+		}
+		assumesRoles = true
+		credentialsProvider = handler.NewClaimRoleCredentials(*jwtRoleClaim, *jwtClaimRoles, roleAssumer(session))
+		log.WithFields(log.Fields{"Claim": *jwtRoleClaim, "ClaimRoles": *jwtClaimRoles}).Infof("Signing with the roles of the %s claim of the JWT", *jwtRoleClaim)
+	}
+
+	if *roleHeader != "" {
+		if credentialsProvider != nil {
+			log.Fatal("--role-header, --auth-jwt-role-claim, --method-role-arn and --session-tag-header are mutually exclusive")
+		}
+		if len(*allowedRoleArns) == 0 {
+			log.Fatal("--role-header requires at least one --allowed-role-arn")
+		}
+		assumesRoles = true
+		credentialsProvider = &handler.HeaderRoleCredentials{
+			Header:         *roleHeader,
+			AllowedRoles:   *allowedRoleArns,
+			NewCredentials: roleAssumer(session),
+		}
+		log.WithFields(log.Fields{"RoleHeader": *roleHeader, "AllowedRoleArns": *allowedRoleArns}).Infof("Signing with the roles named by the %s header", *roleHeader)
+	}
+
+	accountRoles := handler.AccountRolesFromEnv(os.Environ())
+	for account, arn := range *accountRoleArns {
+		accountRoles[account] = arn
+	}
+	if len(accountRoles) > 0 {
+		if credentialsProvider != nil {
+			log.Fatal("--account-role, --role-header, --auth-jwt-role-claim, --method-role-arn and --session-tag-header are mutually exclusive")
+		}
+		accountCredentials, err := handler.NewAccountRoleCredentials(*accountHeader, accountRoles, roleAssumer(session))
+		if err != nil {
+			log.Fatal(err)
+		}
+		accountCredentials.Default = credentials
+		assumesRoles = true
+		credentialsProvider = accountCredentials
+		log.WithFields(log.Fields{"AccountRoles": accountRoles, "AccountHeader": *accountHeader}).Infof("Signing with the roles of the %d accounts targeted by the requests", len(accountRoles))
+	} else if *accountHeader != "" {
+		log.Fatal("--account-header requires at least one --account-role")
+	}
+
+	identity, err := handler.NewIdentityHeaders(*identityHeaders)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(identity) > 0 {
+		log.WithFields(log.Fields{"IdentityHeaders": identity}).Info("Stamping the upstream requests with identity headers")
+	}
+	if (*defaultService == "") != (*defaultRegion == "") {
+		log.Fatal("--default-service and --default-region must be set together")
+	}
+	if *defaultService != "" {
+		if *requireExplicitConfig {
+			log.Fatal("--default-service and --default-region are not used with --require-explicit-signing-config, set --name and --region")
+		}
+		log.WithFields(log.Fields{"DefaultService": *defaultService, "DefaultRegion": *defaultRegion}).Info("Signing for the default service and region when they cannot be detected from the host")
+	}
+	if err := handler.ValidateForwardHostHeader(*forwardHostHeader, *signingHostOverride); err != nil {
+		log.Fatalf("--forward-host-header: %s", err)
+	}
+	var certHeader *handler.ClientCertHeader
+	if *clientCertHeader != "" {
+		if *tlsClientCA == "" {
+			log.Fatal("--client-cert-header requires --tls-client-ca")
+		}
+		certHeader, err = handler.NewClientCertHeader(*clientCertHeader, *clientCertIdentity)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.WithFields(log.Fields{"ClientCertHeader": certHeader.Name, "Identity": certHeader.Identity}).Infof("Forwarding the %s of the client certificates in %s", certHeader.Identity, certHeader.Name)
+	}
+
+	signer := newSigner(credentials)
+	if command == signCommand.FullCommand() {
+		signAndPrint(signer)
+		return
+	}
+	redirects := &handler.RedirectPolicy{MaxHops: *redirectMaxHops, AllowedDomains: *redirectDomains}
+	// The upstream transport is dedicated, HTTP/1.1 only for the hosts
+	// forced to it.
+	upstreamTransport := &handler.HostTransport{Transport: http.DefaultTransport}
+	if *forceHTTP1 && *forceHTTP2 {
+		log.Fatal("--upstream-force-http1 and --upstream-force-http2 are mutually exclusive")
+	}
+	if *forceHTTP1 {
+		upstreamTransport.Transport = handler.HTTP1Transport(http.DefaultTransport.(*http.Transport))
+		log.Info("Sending upstream requests over HTTP/1.1 only")
+	}
+	if *forceHTTP2 {
+		upstreamTransport.Transport = handler.HTTP2Transport(http.DefaultTransport.(*http.Transport))
+		log.Info("Sending upstream requests over HTTP/2 only")
+	}
+	connections.Transport = upstreamTransport
+	client := &http.Client{Transport: connections, CheckRedirect: redirects.CheckRedirect}
+	if *redirectMaxHops > 0 {
+		log.WithFields(log.Fields{"MaxHops": *redirectMaxHops, "AllowedDomains": *redirectDomains}).Infof("Following up to %d redirects of downloads", *redirectMaxHops)
+	}
+
+	// Shared by the policies hashing the request bodies and the proxy client.
+	bodyMemory := &handler.BodyMemory{Limit: *maxTotalBodyMemory}
+
+	var policies []handler.Policy
+	if *strictFraming || *strictFramingLogOnly {
+		// Checked first, before any other policy trusts the request.
+		policies = append(policies, &handler.Framing{LogOnly: *strictFramingLogOnly})
+		log.WithFields(log.Fields{"LogOnly": *strictFramingLogOnly}).Info("Checking the framing of the requests")
+	}
+	if !*noLoopDetection {
+		policies = append(policies, &handler.LoopDetection{})
+	}
+	if len(*allowCIDRs) > 0 {
+		allowlist, err := handler.NewSourceAllowlist(*allowCIDRs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		policies = append(policies, allowlist)
+		log.WithFields(log.Fields{"AllowedCIDRs": *allowCIDRs}).Info("Only allowing clients from the allowed networks")
+	}
+	if len(*apiKeys) > 0 || *apiKeysFile != "" {
+		keys := *apiKeys
+		if *apiKeysFile != "" {
+			fileKeys, err := handler.LoadAPIKeys(*apiKeysFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			keys = append(keys, fileKeys...)
+		}
+		authentication, err := handler.NewAPIKeys(*apiKeyHeader, keys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		policies = append(policies, authentication)
+		log.WithFields(log.Fields{"Header": authentication.Header, "Keys": len(keys)}).Info("Requiring API keys")
+	}
+	if *jwtIssuer != "" {
+		if *jwtAudience == "" {
+			log.Fatal("--auth-jwt-issuer requires --auth-jwt-audience")
+		}
+		policies = append(policies, &handler.JWTAuth{
+			Issuer:   *jwtIssuer,
+			Audience: *jwtAudience,
+			JWKSURL:  *jwtJWKSURL,
+			Leeway:   *jwtLeeway,
+			Client:   &http.Client{Timeout: 10 * time.Second},
+		})
+		log.WithFields(log.Fields{"Issuer": *jwtIssuer, "Audience": *jwtAudience}).Info("Requiring JWT bearer tokens")
+	}
+	if *sigv4AccessKeysFile != "" {
+		keys, err := handler.LoadAccessKeys(*sigv4AccessKeysFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		policies = append(policies, &handler.SignatureAuth{
+			Credentials:          keys,
+			MaxRequestBodyMemory: *maxBodyMemory,
+			RequestBodySpillDir:  *bodySpillDir,
+			BodyMemory:           bodyMemory,
+		})
+		log.WithFields(log.Fields{"AccessKeys": len(keys)}).Info("Requiring requests signed by the clients")
+	}
+	if len(*callerIdentityARNs) > 0 {
+		if *callerIdentityAudience == "" {
+			log.Fatal("--auth-caller-identity-arn requires --auth-caller-identity-audience")
+		}
+		policies = append(policies, &handler.CallerIdentityAuth{
+			Header:         *callerIdentityHeader,
+			AudienceHeader: *callerAudienceHeader,
+			Audience:       *callerIdentityAudience,
+			AllowedARNs:    *callerIdentityARNs,
+			Client:         &http.Client{Timeout: 10 * time.Second},
+		})
+		log.WithFields(log.Fields{"Header": *callerIdentityHeader, "AudienceHeader": *callerAudienceHeader, "AllowedARNs": *callerIdentityARNs}).Info("Requiring the IAM identity of the clients")
+	}
+	var classifier *handler.Classifier
+	if len(*classRules) > 0 {
+		classifier = &handler.Classifier{ContentTypes: *classContentTypes}
+		for _, c := range *classRules {
+			rule, err := handler.ParseClassRule(c)
+			if err != nil {
+				log.Fatal(err)
+			}
+			classifier.Rules = append(classifier.Rules, rule)
+		}
+		log.WithFields(log.Fields{"Classes": *classRules, "ContentTypes": *classContentTypes}).Infof("Classifying requests %s", *classRules)
+	}
+	for _, l := range *classRateLimits {
+		if classifier == nil {
+			log.Fatal("--class-rate-limit requires --classify")
+		}
+		limit, err := handler.ParseClassRateLimit(l)
+		if err != nil {
+			log.Fatal(err)
+		}
+		limit.MaxWait = *rateLimitMaxWait
+		policies = append(policies, limit)
+		log.WithFields(log.Fields{"Class": limit.Class, "Rate": limit.Rate}).Infof("Limiting %s requests to %g per second", limit.Class, limit.Rate)
+	}
+
+	var quota *handler.Quota
+	if len(*quotas) > 0 {
+		quota = &handler.Quota{TenantHeader: *quotaTenantHeader, StatePath: *quotaStateFile}
+		for _, q := range *quotas {
+			limit, err := handler.ParseQuotaLimit(q)
+			if err != nil {
+				log.Fatal(err)
+			}
+			quota.Limits = append(quota.Limits, limit)
+		}
+		if quota.StatePath != "" {
+			if err := quota.Load(); err != nil {
+				log.Fatal(err)
+			}
+			go quota.PersistEvery(30*time.Second, nil)
+		}
+		log.WithFields(log.Fields{"Quotas": *quotas}).Infof("Enforcing quotas %s", *quotas)
+	}
+
+	var throttling *handler.Throttling
+	if *throttlingRetryAfter > 0 || *throttlingStatusCode != 0 {
+		throttling = &handler.Throttling{RetryAfter: *throttlingRetryAfter, StatusCode: *throttlingStatusCode}
+		log.WithFields(log.Fields{"RetryAfter": *throttlingRetryAfter, "StatusCode": *throttlingStatusCode}).Info("Translating upstream throttling responses")
+	}
+
+	var tee *handler.Tee
+	if *teeSink != "" {
+		sink, err := handler.NewTeeSink(*teeSink, signer, *session.Config.Region, client)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tee = &handler.Tee{Sink: sink, SampleRate: *teeSampleRate, MaxBodyBytes: *teeMaxBodyBytes, QueueSize: *teeQueueSize}
+		log.WithFields(log.Fields{"TeeSink": *teeSink, "SampleRate": *teeSampleRate}).Infof("Copying responses to %s", *teeSink)
+	}
+
+	log.WithFields(log.Fields{"CcustomHeadersParsed": reflect.ValueOf(customHeadersParsed).MapKeys()}).Infof("Custom headers, values are redacted: %s", reflect.ValueOf(customHeadersParsed).MapKeys())
+	log.WithFields(log.Fields{"StripHeaders": *strip}).Infof("Stripping headers %s", *strip)
+	log.WithFields(log.Fields{"DuplicateHeaders": *duplicateHeaders}).Infof("Duplicating headers %s", *duplicateHeaders)
+
+	expirers := []handler.CredentialsExpirer{handler.CredentialsSet{credentials}}
+	if expirer, ok := credentialsProvider.(handler.CredentialsExpirer); ok {
+		expirers = append(expirers, expirer)
+	}
+
+	limiter := &handler.HostLimiter{Client: client, MaxInFlight: *maxInFlight, Wait: *maxInFlightWait}
+
+	proxyClient := &handler.ProxyClient{
+		Signer:                       signer,
+		Client:                       limiter,
+		StripRequestHeaders:          *strip,
+		CustomHeaders:                customHeadersParsed,
+		DuplicateRequestHeaders:      *duplicateHeaders,
+		SigningNameOverride:          *signingNameOverride,
+		SigningHostOverride:          *signingHostOverride,
+		HostOverride:                 *hostOverride,
+		ForwardHostHeader:            *forwardHostHeader,
+		RegionOverride:               *regionOverride,
+		LogFailedRequest:             *logFailedResponse,
+		LogFailedRequestMaxBytes:     *logFailedMaxBytes,
+		HeaderLogSampleRate:          *logHeaderSampleRate,
+		SchemeOverride:               *schemeOverride,
+		CredentialsProvider:          credentialsProvider,
+		PreserveHeaderCasing:         *preserveHeaderCase,
+		PreserveRequestURI:           *preserveRequestURI,
+		PreserveQueryString:          *preserveQueryString,
+		IdentityHeaders:              identity,
+		ClientCertHeader:             certHeader,
+		UnsignedPayloadHeader:        *unsignedPayloadHeader,
+		AllowedOverrides:             *allowedOverrides,
+		RequireExplicitSigningConfig: *requireExplicitConfig,
+		DefaultSigningName:           *defaultService,
+		DefaultRegion:                *defaultRegion,
+		SigningAlgorithm:             *signingAlgorithm,
+		MaxHeaderBytes:               *maxHeaderBytes,
+		MaxURLLength:                 *maxURLLength,
+		Timeout:                      *upstreamTimeout,
+		StreamingIdleTimeout:         *streamingIdleTimeout,
+		ForwardUpgrades:              !*noUpgrades,
+		DynamoDBSimpleJSON:           *dynamoDBSimpleJSON,
+		StreamingUploadThreshold:     *streamingUploadSize,
+		MaxRequestBodyMemory:         *maxBodyMemory,
+		RequestBodySpillDir:          *bodySpillDir,
+		BodyMemory:                   bodyMemory,
+		AllowedUpstreamHosts:         *allowedUpstreamHosts,
+		FollowRegionRedirects:        *followRegionRedirects,
+	}
+	if !*noLoopDetection {
+		proxyClient.LoopMarker = roleSessionName()
+	}
+	for _, prefix := range *stripPathPrefixes {
+		rewrite, err := handler.NewStripPathPrefix(prefix)
+		if err != nil {
+			log.Fatal(err)
+		}
+		proxyClient.PathRewrites = append(proxyClient.PathRewrites, rewrite)
+	}
+	if len(*stripPathPrefixes) > 0 {
+		log.WithFields(log.Fields{"StripPathPrefixes": *stripPathPrefixes}).Infof("Stripping path prefixes %s", *stripPathPrefixes)
+	}
+	if len(*allowedUpstreamHosts) > 0 {
+		log.WithFields(log.Fields{"AllowedUpstreamHosts": *allowedUpstreamHosts}).Info("Only sending requests to the allowed upstream hosts")
+	} else if *hostOverride == "" {
+		log.Warn("Requests are signed for and sent to any host the clients pick, restrict them with --allowed-upstream-hosts")
+	}
+	if *maxBodyMemory > 0 {
+		log.WithFields(log.Fields{"MaxRequestBodyMemory": *maxBodyMemory, "RequestBodySpillDir": *bodySpillDir}).Info("Capping request bodies buffered in memory")
+	}
+	if *maxTotalBodyMemory > 0 {
+		log.WithField("MaxTotalRequestBodyMemory", *maxTotalBodyMemory).Info("Shedding the requests whose body does not fit the memory left")
+	}
+	if *followRegionRedirects {
+		log.Info("Following the S3 redirects to the region of the buckets")
+	}
+	if *streamingUploadSize > 0 {
+		log.WithField("Threshold", *streamingUploadSize).Info("Streaming large S3 uploads with chunked payload signing")
+	}
+	if *upstreamTimeout > 0 || *streamingIdleTimeout > 0 {
+		log.WithFields(log.Fields{"Timeout": *upstreamTimeout, "StreamingIdleTimeout": *streamingIdleTimeout}).Info("Timing out upstream requests")
+	}
+	if *retryMaxAttempts > 1 {
+		proxyClient.Retry = &handler.RetryPolicy{MaxAttempts: *retryMaxAttempts, BaseDelay: *retryBaseDelay, MaxDelay: *retryMaxDelay}
+		log.WithFields(log.Fields{"MaxAttempts": *retryMaxAttempts, "BaseDelay": *retryBaseDelay, "MaxDelay": *retryMaxDelay}).Infof("Retrying failed upstream requests up to %d attempts", *retryMaxAttempts)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// routeConfig returns the Router of the config sets of config. The roles
+	// of the sets are checked by /readyz and expired by the admin endpoint
+	// when register is set, at startup only.
+	routeConfig := func(config *handler.Config, register bool) (*handler.Router, error) {
+		router := handler.NewRouter(proxyClient)
+		for _, name := range config.Names() {
+			set := config.ConfigSets[name]
+			setSigner := signer
+			setRoleAssumer := roleAssumer(session, setRoleOptions(set))
+			if set.RoleARN != "" {
+				setSigner = newSigner(setRoleAssumer(set.RoleARN))
+				if register {
+					assumesRoles = true
+					expirers = append(expirers, handler.CredentialsSet{setSigner.Credentials})
+					readinessCredentials["config set "+name] = setSigner.Credentials
+				}
+			}
+			setClient := set.ProxyClient(proxyClient, setSigner)
+			if len(set.MethodRoleARNs) > 0 {
+				methodCredentials, err := handler.NewMethodCredentials(set.MethodRoleARNs, setRoleAssumer)
+				if err != nil {
+					return nil, fmt.Errorf("config set %s: %w", name, err)
+				}
+				setClient.CredentialsProvider = methodCredentials
+				if register {
+					assumesRoles = true
+					expirers = append(expirers, methodCredentials)
+					readinessCredentials.addMethods("config set "+name+" ", methodCredentials)
+				}
+			}
+			for _, host := range set.Hosts {
+				router.Route(host, setClient)
+			}
+			for _, prefix := range set.PathPrefixes {
+				router.RoutePath(prefix, !set.KeepPathPrefix, setClient)
+			}
+			log.WithFields(log.Fields{"ConfigSet": name, "Hosts": set.Hosts, "PathPrefixes": set.PathPrefixes}).Infof("Routing %v %v with config set %s", set.Hosts, set.PathPrefixes, name)
+		}
+		return router, nil
+	}
+
+	var upstream handler.Client = proxyClient
+	var reloadConfig, rollbackConfig func() error
+	if config != nil {
+		router, err := routeConfig(config, true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// The limits and transports of the config sets are not reloaded.
+		for _, name := range config.Names() {
+			set := config.ConfigSets[name]
+			if set.MaxInFlight > 0 {
+				limiter.Limit(set.Host, set.MaxInFlight)
+			}
+			if set.ForceHTTP1 && !*forceHTTP1 {
+				http1 := handler.HTTP1Transport(http.DefaultTransport.(*http.Transport))
+				hosts := set.Hosts
+				if set.Host != "" {
+					hosts = []string{set.Host}
+				}
+				for _, host := range hosts {
+					upstreamTransport.Route(host, http1)
+				}
+				log.WithFields(log.Fields{"ConfigSet": name, "Hosts": hosts}).Info("Sending upstream requests over HTTP/1.1 only")
+			}
+		}
+		upstream = router
+
+		if *configFile != "" {
+			rollout := handler.NewRollout(router, *reloadProbation, *reloadMaxErrorRate)
+			rollout.MinRequests = *reloadMinRequests
+			rollout.Validate = func() (handler.Client, error) {
+				config, err := loadConfig()
+				if err != nil {
+					return nil, err
+				}
+				router, err := routeConfig(config, false)
+				if err != nil {
+					return nil, err
+				}
+				log.WithFields(log.Fields{"Config": *configFile, "ConfigSets": config.Names()}).Infof("Reloaded config %s", *configFile)
+				return router, nil
+			}
+			upstream = rollout
+			reloadConfig, rollbackConfig = rollout.Reload, rollout.Rollback
+		}
+	}
+
+	if *targetInPath {
+		// Wraps the config sets, which route by the host of the path.
+		upstream = &handler.TargetInPath{Client: upstream}
+		log.Info("Sending the requests to the upstream their path starts with, e.g. /https/dynamodb.us-east-1.amazonaws.com/")
+	}
+
+	if config != nil {
+		for _, limit := range config.RateLimits {
+			if resolver, ok := upstream.(handler.ServiceResolver); ok {
+				limit.Services = resolver
+			}
+			limit.MaxWait = *rateLimitMaxWait
+			policies = append(policies, limit)
+			per := ""
+			if limit.Key != handler.RateLimitGlobal {
+				per = " per " + string(limit.Key)
+			}
+			log.WithFields(log.Fields{"Key": limit.Key, "Header": limit.Header, "Rate": limit.Rate, "Burst": limit.Burst}).Infof("Limiting the requests to %g per second%s", limit.Rate, per)
+		}
+	}
+	if *rateLimitMaxWait > 0 {
+		log.WithFields(log.Fields{"MaxWait": *rateLimitMaxWait}).Infof("Delaying the requests above the rate limits up to %s", *rateLimitMaxWait)
+	}
+	// Requests rejected by the rate limits do not count towards the quotas.
+	if quota != nil {
+		policies = append(policies, quota)
+	}
+
+	if assumesRoles && *stsKeepAlive > 0 {
+		keepAlive := &handler.STSKeepAlive{
+			Endpoint: session.ClientConfig(sts.EndpointsID).Endpoint,
+			Client: &http.Client{
+				Transport: session.Config.HTTPClient.Transport,
+				CheckRedirect: func(req *http.Request, via []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			},
+			Interval: *stsKeepAlive,
+		}
+		log.WithFields(log.Fields{"Endpoint": keepAlive.Endpoint, "Interval": *stsKeepAlive}).Infof("Keeping the connection to %s warm", keepAlive.Endpoint)
+		go keepAlive.Run(nil)
+	}
+
+	var prober *handler.Prober
+	if len(*probes) > 0 {
+		if *probeInterval <= 0 {
+			log.Fatal("--probe-interval must be positive")
+		}
+		prober = &handler.Prober{Client: upstream, Interval: *probeInterval, Timeout: *probeTimeout}
+		for _, p := range *probes {
+			target, err := handler.ParseProbeTarget(p)
+			if err != nil {
+				log.Fatal(err)
+			}
+			prober.Targets = append(prober.Targets, target)
+		}
+		log.WithFields(log.Fields{"Probes": *probes, "Interval": *probeInterval}).Infof("Probing %d upstreams every %s", len(prober.Targets), *probeInterval)
+	}
+
+	startup := &handler.Startup{}
+	if *adminPort != "" {
+		admin := &handler.Admin{Stats: stats, Credentials: credentials, Limiter: limiter, Startup: startup, CredentialsChain: credentialsChain, Prober: prober, Connections: connections, BodyMemory: proxyClient.BodyMemory, Upstream: upstream, Reload: reloadConfig, Rollback: rollbackConfig, AllowDebugLogLevel: *adminAllowDebug}
+		if *adminAllowExpiry {
+			admin.Expirers = expirers
+		}
+		if *adminTokenFile != "" {
+			token, err := os.ReadFile(*adminTokenFile)
+			if err != nil {
+				log.Fatalf("--admin-token-file: %s", err)
+			}
+			if admin.Token = strings.TrimSpace(string(token)); admin.Token == "" {
+				log.Fatalf("--admin-token-file: %s is empty", *adminTokenFile)
+			}
+		}
+		if *readinessAssumeRoles {
+			admin.ReadinessCredentials = readinessCredentials
+		}
+		log.WithFields(log.Fields{"admin_port": *adminPort}).Infof("Serving admin endpoints on %s", *adminPort)
+		go func() {
+			log.Fatal(http.ListenAndServe(*adminPort, admin))
+		}()
+	}
+
+	resetCredentials := func() error {
+		creds, err := sessionCredentials(sessionConfig)
+		if err != nil {
+			return err
+		}
+		credentialsChain.Reset(creds)
+		return nil
+	}
+	reloadOnSignal(reloadConfig, resetCredentials, expirers)
+
+	var extractor *handler.Extractor
+	if len(*extractFields) > 0 {
+		extractor = &handler.Extractor{}
+		for _, f := range *extractFields {
+			extraction, err := handler.ParseExtraction(f)
+			if err != nil {
+				log.Fatal(err)
+			}
+			extractor.Extractions = append(extractor.Extractions, extraction)
+		}
+		log.WithFields(log.Fields{"ExtractFields": *extractFields}).Infof("Extracting fields %s", *extractFields)
+	}
+
+	var webSocket *handler.WebSocketBridge
+	if *webSocketBridge {
+		webSocket = &handler.WebSocketBridge{AllowedOrigins: *webSocketOrigins}
+		log.WithFields(log.Fields{"WebSocketOrigins": *webSocketOrigins}).Info("Bridging WebSocket connections to upstream response streams")
+	}
+
+	var responseHeaders *handler.ResponseHeaderAllowlist
+	if *strictResponseHeaders {
+		responseHeaders = &handler.ResponseHeaderAllowlist{Allowed: *allowedResponseHeaders}
+		log.WithFields(log.Fields{"AllowedResponseHeaders": *allowedResponseHeaders}).Info("Only passing the essential and allowed response headers downstream")
+	} else if len(*allowedResponseHeaders) > 0 {
+		log.Fatal("--allowed-response-header requires --strict-response-headers")
+	}
+
+	var accessLogger *log.Logger
+	if *accessLog {
+		accessLogger = log.New()
+		accessLogger.SetOutput(os.Stdout)
+		accessLogger.SetFormatter(log.StandardLogger().Formatter)
+	}
+
+	proxy := &handler.Handler{
+		ProxyClient:      upstream,
+		Policies:         policies,
+		Stats:            stats,
+		Throttling:       throttling,
+		Tee:              tee,
+		WebSocket:        webSocket,
+		Extractor:        extractor,
+		Classifier:       classifier,
+		ResponseHeaders:  responseHeaders,
+		AccessLog:        accessLogger,
+		LogLegacyClients: *logLegacyClients,
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("--tls-cert and --tls-key must be set together")
+	}
+	if *tlsCert != "" && len(*acmeDomains) > 0 {
+		log.Fatal("--tls-cert and --acme-domain are mutually exclusive")
+	}
+	if *tlsClientCA != "" && *tlsCert == "" {
+		// The ACME servers present no certificate to answer the challenges.
+		log.Fatal("--tls-client-ca requires --tls-cert")
+	}
+	if *listenerForceHTTP1 && (*listenerForceHTTP2 || *h2c) {
+		log.Fatal("--listener-force-http1 is mutually exclusive with --listener-force-http2 and --h2c")
+	}
+	if *forwardProxy && (*forwardProxyCACert == "" || *forwardProxyCAKey == "") {
+		log.Fatal("--forward-proxy requires --forward-proxy-ca-cert and --forward-proxy-ca-key")
+	}
+	if *forwardProxy && *lambdaMode {
+		log.Fatal("--forward-proxy cannot be used with --lambda")
+	}
+	addresses := listenAddresses()
+	if (*h2c || *listenerForceHTTP2) && (*strictFraming || *strictFramingLogOnly) {
+		for _, address := range addresses {
+			if address.Scheme == "http" {
+				log.Fatal("--strict-framing only checks HTTP/1 connections, it cannot be used with h2c")
+			}
+		}
+	}
+
+	if *lambdaMode {
+		log.Info("Serving Lambda invocations")
+		log.Fatal(lambda.Start(proxy))
+	}
+
+	waitForDependencies(startup, credentials)
+	// Lambda functions are frozen between invocations, the upstreams are only
+	// probed once the dependencies of the proxy are available.
+	if prober != nil {
+		go prober.Run(nil)
+	}
+
+	server := &http.Server{Handler: proxy, Protocols: listenerProtocols()}
+	var forward *handler.ForwardProxy
+	if *forwardProxy {
+		ca, err := tls.LoadX509KeyPair(*forwardProxyCACert, *forwardProxyCAKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		forward, err = handler.NewForwardProxy(proxy, ca, *forwardProxyHosts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.Handler = forward
+		log.WithFields(log.Fields{"hosts": *forwardProxyHosts}).Info("Acting as a forward proxy")
+	}
+	tlsFields := log.Fields{}
+	if len(*acmeDomains) > 0 {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(*acmeCacheDir),
+			HostPolicy: autocert.HostWhitelist(*acmeDomains...),
+			Email:      *acmeEmail,
+			Client:     &acme.Client{DirectoryURL: *acmeDirectoryURL},
+		}
+		if *acmeHTTPPort != "" {
+			log.WithFields(log.Fields{"acme_http_port": *acmeHTTPPort}).Infof("Answering ACME HTTP-01 challenges on %s", *acmeHTTPPort)
+			go func() {
+				log.Fatal(http.ListenAndServe(*acmeHTTPPort, manager.HTTPHandler(nil)))
+			}()
+		}
+
+		server.TLSConfig = manager.TLSConfig()
+		tlsFields["acme_domains"] = *acmeDomains
+	} else if *tlsCert != "" {
+		server.TLSConfig = &tls.Config{}
+		if *tlsClientCA != "" {
+			pool, err := loadCertPool(*tlsClientCA)
+			if err != nil {
+				log.Fatal(err)
+			}
+			server.TLSConfig.ClientCAs = pool
+			server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			log.WithFields(log.Fields{"tls_client_ca": *tlsClientCA}).Info("Requiring client certificates for mutual TLS")
+		}
+		tlsFields["tls_cert"] = *tlsCert
+	}
+
+	if server.TLSConfig != nil {
+		server.TLSConfig.MinVersion = tlsVersions[*tlsMinVersion]
+	}
+	if *strictFraming || *strictFramingLogOnly {
+		server.ConnContext = handler.FramingConnContext
+	}
+
+	// Every address is bound before any is served, so a taken port fails the
+	// startup instead of leaving the proxy half listening.
+	serve := make([]func() error, 0, len(addresses))
+	for _, address := range addresses {
+		listener, err := net.Listen("tcp", address.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if address.Scheme == "https" {
+			serve = append(serve, func() error { return server.ServeTLS(listener, *tlsCert, *tlsKey) })
+			log.WithFields(tlsFields).WithField("address", address.Addr).Infof("Listening with TLS on %s", address.Addr)
+			continue
+		}
+		if *strictFraming || *strictFramingLogOnly {
+			// Only plain HTTP/1 connections can be tracked: net/http needs
+			// TLS connections as is to negotiate HTTP/2.
+			listener = handler.FramingListener(listener)
+		}
+		serve = append(serve, func() error { return server.Serve(listener) })
+		log.WithFields(log.Fields{"address": address.Addr}).Infof("Listening on %s", address.Addr)
+	}
+
+	drained := shutdownOnSignal(server, forward)
+	errs := make(chan error, len(serve))
+	for _, s := range serve {
+		go func() { errs <- s() }()
+	}
+	for range serve {
+		if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}
+	<-drained
+
+	if quota != nil && quota.StatePath != "" {
+		if err := quota.Save(); err != nil {
+			log.WithError(err).Error("unable to persist quota usage")
+		}
+	}
+	log.Info("Shut down")
+}
+
+// listenAddresses returns the addresses of --listen, or else --port, with
+// their scheme resolved: HTTPS when a certificate is configured, unless the
+// address is explicitly http://.
+func listenAddresses() []handler.ListenAddress {
+	addresses := []handler.ListenAddress{{Addr: *port}}
+	if len(*listenAddrs) > 0 {
+		addresses = nil
+		for _, a := range *listenAddrs {
+			address, err := handler.ParseListenAddress(a)
+			if err != nil {
+				log.Fatal(err)
+			}
+			addresses = append(addresses, address)
+		}
+	}
+
+	certificate := *tlsCert != "" || len(*acmeDomains) > 0
+	for i, address := range addresses {
+		switch {
+		case address.Scheme == "https" && !certificate:
+			log.Fatalf("--listen %s requires --tls-cert or --acme-domain", address)
+		case address.Scheme == "" && certificate:
+			addresses[i].Scheme = "https"
+		case address.Scheme == "":
+			addresses[i].Scheme = "http"
+		}
+	}
+	return addresses
+}
+
+// listenerProtocols returns the protocols served on --port, HTTP/1.1 and
+// HTTP/2 over TLS by default.
+func listenerProtocols() *http.Protocols {
+	protocols := new(http.Protocols)
+	switch {
+	case *listenerForceHTTP1:
+		protocols.SetHTTP1(true)
+		log.Info("Serving HTTP/1.1 only")
+	case *listenerForceHTTP2:
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		log.Info("Serving HTTP/2 only")
+	default:
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(*h2c)
+		if *h2c {
+			log.Info("Accepting HTTP/2 without TLS (h2c)")
+		}
+	}
+	return protocols
+}
+
+// waitForDependencies waits for the credentials and the upstreams of the
+// --wait-for flags, and exits when they are not available in time.
+func waitForDependencies(startup *handler.Startup, creds *credentials.Credentials) {
+	ctx := context.Background()
+	if *waitCredentialsTimeout > 0 {
+		if err := startup.Wait(ctx, "credentials", *waitCredentialsTimeout, handler.CredentialsCheck(creds)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, upstream := range *waitUpstreams {
+		check, err := handler.UpstreamCheck(upstream, http.DefaultTransport.(*http.Transport).TLSClientConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := startup.Wait(ctx, upstream, *waitUpstreamTimeout, check); err != nil {
+			log.Fatal(err)
+		}
+	}
+	startup.Done()
+}
+
+// shutdownOnSignal stops server from accepting connections on SIGTERM or
+// SIGINT, and waits up to --shutdown-timeout for the in-flight requests to
+// complete, those of the tunnels of forward as well when set. A second signal
+// exits immediately. The returned channel is closed once the requests are
+// drained.
+func shutdownOnSignal(server *http.Server, forward *handler.ForwardProxy) <-chan struct{} {
+	drained := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		defer close(drained)
+		drain(server, forward, signals)
+	}()
+	return drained
+}
+
+// reloadOnSignal reloads the config with reload, when set, resets the
+// credential chain and expires the credentials of expirers on SIGHUP, so that
+// the next requests retrieve them again, e.g. from a rotated
+// ~/.aws/credentials. An invalid config is logged and the current one kept.
+func reloadOnSignal(reload, resetCredentials func() error, expirers []handler.CredentialsExpirer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			log.WithFields(log.Fields{"signal": sig.String()}).Infof("Received %s, reloading the config and the credentials", sig)
+			if reload != nil {
+				if err := reload(); err != nil {
+					log.WithError(err).Error("unable to reload the config, keeping the current one")
+				}
+			}
+			if err := resetCredentials(); err != nil {
+				log.WithError(err).Error("unable to reset the credential chain, keeping the current one")
+			}
+			expired := 0
+			for _, expirer := range expirers {
+				expired += expirer.ExpireCredentials()
+			}
+			log.WithField("credentials", expired).Info("credentials expired, they are retrieved again on their next use")
+		}
+	}()
+}
+
+// loadCertPool returns the pool of the PEM certificates of the file at path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificate in %s", path)
+	}
+	return pool, nil
+}
+
+// sessionCredentials returns the credential chain of a new session of config,
+// resolved from the environment and the shared files as they are now.
+func sessionCredentials(config aws.Config) (*credentials.Credentials, error) {
+	s, err := session.NewSession(&config)
+	if err != nil {
+		return nil, err
+	}
+	return s.Config.Credentials, nil
+}
+
+func drain(server *http.Server, forward *handler.ForwardProxy, signals <-chan os.Signal) {
+	sig := <-signals
+	log.WithFields(log.Fields{"signal": sig.String(), "shutdown_timeout": *shutdownTimeout}).Infof("Received %s, draining in-flight requests", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Fatalf("Received %s while draining, exiting", sig)
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("in-flight requests did not complete before --shutdown-timeout")
+		server.Close()
+	}
+	// The tunnels are hijacked from server, which does not wait for them.
+	if forward != nil {
+		if err := forward.Shutdown(ctx); err != nil {
+			log.WithError(err).Warn("in-flight requests of the forward proxy tunnels did not complete before --shutdown-timeout")
+		}
+	}
+}
+
+// signAndPrint signs the request of the sign command with signer, and prints
+// it as the proxy would send it.
+func signAndPrint(signer *v4.Signer) {
+	if (*signURL).Host == "" {
+		log.Fatalf("invalid URL %s, expected an absolute URL", *signURL)
+	}
+	header := http.Header{}
+	for _, h := range *signHeaders {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			log.Fatalf("invalid header %q, expected name: value", h)
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	req := &http.Request{
+		Method: *signMethod,
+		URL:    &url.URL{Path: (*signURL).Path, RawPath: (*signURL).RawPath, RawQuery: (*signURL).RawQuery},
+		Host:   (*signURL).Host,
+		Header: header,
+		Body:   http.NoBody,
+	}
+	if *signBody != "" {
+		body, err := os.ReadFile(*signBody)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+
+	proxyClient := &handler.ProxyClient{
+		Signer:              signer,
+		SigningNameOverride: *signingNameOverride,
+		SigningHostOverride: *signingHostOverride,
+		RegionOverride:      *regionOverride,
+		SchemeOverride:      (*signURL).Scheme,
+		SigningAlgorithm:    *signingAlgorithm,
+	}
+	signed, err := handler.SignRequest(proxyClient, req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *signOutput == "headers" {
+		fmt.Print(handler.SignedHeaders(signed))
+		return
+	}
+	fmt.Println(handler.CurlCommand(signed, *signBody))
+}
+
+// loadConfig loads the config sets of --config and --path-route, nil without
+// any.
+func loadConfig() (*handler.Config, error) {
+	var config *handler.Config
+	if *configFile != "" {
+		var err error
+		config, err = handler.LoadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(*pathRoutes) > 0 {
+		if config == nil {
+			config = &handler.Config{}
+		}
+		for prefix, host := range *pathRoutes {
+			if err := config.AddPathRoute(prefix, host); err != nil {
+				return nil, fmt.Errorf("--path-route %s=%s: %w", prefix, host, err)
+			}
+		}
+	}
+	return config, nil
+}
+
+func newSigner(credentials *credentials.Credentials) *v4.Signer {
+	return v4.NewSigner(credentials, func(s *v4.Signer) {
 		if shouldLogSigning() {
 			s.Logger = awsLoggerAdapter{}
 			s.Debug = aws.LogDebugWithSigning
 		}
 		s.UnsignedPayload = *unsignedPayload
 	})
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
+}
+
+// readinessChecks are the credentials of the assumed roles, by readiness
+// check name.
+type readinessChecks map[string]*credentials.Credentials
+
+// addMethods adds the role of each method of m, prefixing the check names.
+func (c readinessChecks) addMethods(prefix string, m *handler.MethodCredentials) {
+	for method, creds := range m.Methods {
+		c[prefix+"method "+method] = creds
 	}
+}
 
-	log.WithFields(log.Fields{"CcustomHeadersParsed": reflect.ValueOf(customHeadersParsed).MapKeys()}).Infof("Custom headers, values are redacted: %s", reflect.ValueOf(customHeadersParsed).MapKeys())
-	log.WithFields(log.Fields{"StripHeaders": *strip}).Infof("Stripping headers %s", *strip)
-	log.WithFields(log.Fields{"DuplicateHeaders": *duplicateHeaders}).Infof("Duplicating headers %s", *duplicateHeaders)
-	log.WithFields(log.Fields{"port": *port}).Infof("Listening on %s", *port)
-
-	log.Fatal(
-		http.ListenAndServe(*port, &handler.Handler{
-			ProxyClient: &handler.ProxyClient{
-				Signer:                  signer,
-				Client:                  client,
-				StripRequestHeaders:     *strip,
-				CustomHeaders:           customHeadersParsed,
-				DuplicateRequestHeaders: *duplicateHeaders,
-				SigningNameOverride:     *signingNameOverride,
-				SigningHostOverride:     *signingHostOverride,
-				HostOverride:            *hostOverride,
-				RegionOverride:          *regionOverride,
-				LogFailedRequest:        *logFailedResponse,
-				SchemeOverride:          *schemeOverride,
-			},
-		}),
-	)
+// roleAssumer returns a function returning the credentials of a role,
+// assumed with the credentials of session and the given options. Each role
+// caches its own credentials.
+func roleAssumer(session *session.Session, options ...func(*stscreds.AssumeRoleProvider)) func(roleARN string) *credentials.Credentials {
+	return func(roleARN string) *credentials.Credentials {
+		options := append([]func(*stscreds.AssumeRoleProvider){func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = roleSessionName()
+			p.ExpiryWindow = *stsRefreshAhead
+		}}, options...)
+		return stscreds.NewCredentials(session, roleARN, options...)
+	}
+}
+
+// setRoleOptions returns the options assuming the roles of a config set.
+func setRoleOptions(set *handler.ConfigSet) func(*stscreds.AssumeRoleProvider) {
+	return func(p *stscreds.AssumeRoleProvider) {
+		if set.ExternalID != "" {
+			p.ExternalID = aws.String(set.ExternalID)
+		}
+		if set.SessionDuration > 0 {
+			p.Duration = set.SessionDuration
+		}
+	}
 }
 
 func shouldLogSigning() bool {
@@ -0,0 +1,47 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/awslabs/aws-sigv4-proxy/sigv4verifier"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	port        = kingpin.Flag("port", "Port to serve http on").Default(":8081").String()
+	credentials = kingpin.Flag("credential", "Access key ID and secret access key accepted by the verifier, in AKID=SECRET format").StringMap()
+	maxBodySize = kingpin.Flag("max-body-size", "Size of the largest body hashed for the requests without X-Amz-Content-Sha256, larger ones are rejected with a 413").Default("67108864").Int64()
+)
+
+func main() {
+	kingpin.Parse()
+
+	creds := *credentials
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		creds[id] = secret
+	}
+	if len(creds) == 0 {
+		log.Fatal("no credentials configured, use --credential or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	log.WithFields(log.Fields{"port": *port}).Infof("Verifying SigV4 signatures on %s", *port)
+	log.Fatal(http.ListenAndServe(*port, &sigv4verifier.Verifier{Credentials: creds, MaxBodySize: *maxBodySize}))
+}
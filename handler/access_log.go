@@ -0,0 +1,88 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// accessLogWriter is a http.ResponseWriter recording the status and the size
+// of the response, for the access log.
+type accessLogWriter struct {
+	http.ResponseWriter
+	statusCode int
+	n          int64
+}
+
+func (w *accessLogWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *accessLogWriter) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Hijack lets the WebSocketBridge take over the connection.
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logAccess writes the access log line of r, once it was responded to.
+func (h *Handler) logAccess(w *accessLogWriter, r *http.Request, body *countingBody, start time.Time) {
+	fields := log.Fields{
+		"method":      r.Method,
+		"path":        "",
+		"status_code": w.statusCode,
+		"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+		"bytes_in":    body.n,
+		"bytes_out":   w.n,
+		"client_ip":   clientIP(r),
+	}
+	if r.URL != nil {
+		fields["path"] = r.URL.Path
+	}
+	if info := RequestInfoFromContext(r.Context()); info != nil {
+		fields["service"] = info.Service
+		fields["region"] = info.Region
+		fields["upstream_host"] = info.Host
+	}
+	h.AccessLog.WithFields(fields).Info("access")
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler_AccessLog(t *testing.T) {
+	tests := []struct {
+		name   string
+		client Client
+		policy Policy
+		want   map[string]interface{}
+	}{
+		{
+			name: "proxied request",
+			client: clientFunc(func(req *http.Request) (*http.Response, error) {
+				io.ReadAll(req.Body)
+				info := RequestInfoFromContext(req.Context())
+				info.Service, info.Region, info.Host = "sqs", "us-east-1", "sqs.us-east-1.amazonaws.com"
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("<ok/>"))}, nil
+			}),
+			want: map[string]interface{}{
+				"msg":           "access",
+				"method":        "POST",
+				"path":          "/queue",
+				"status_code":   float64(200),
+				"bytes_in":      float64(14),
+				"bytes_out":     float64(5),
+				"client_ip":     "192.0.2.1",
+				"service":       "sqs",
+				"region":        "us-east-1",
+				"upstream_host": "sqs.us-east-1.amazonaws.com",
+			},
+		},
+		{
+			name:   "rejected request",
+			policy: &mockPolicy{Rejection: &Rejection{StatusCode: http.StatusForbidden, Message: "denied"}},
+			want: map[string]interface{}{
+				"msg":           "access",
+				"method":        "POST",
+				"path":          "/queue",
+				"status_code":   float64(403),
+				"bytes_in":      float64(0),
+				"client_ip":     "192.0.2.1",
+				"service":       "",
+				"region":        "",
+				"upstream_host": "",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			accessLog := log.New()
+			accessLog.SetOutput(&buf)
+			accessLog.SetFormatter(&log.JSONFormatter{})
+
+			h := &Handler{ProxyClient: tt.client, AccessLog: accessLog}
+			if tt.policy != nil {
+				h.Policies = []Policy{tt.policy}
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/queue", strings.NewReader("Action=Receive")))
+
+			var line map[string]interface{}
+			if !assert.NoError(t, json.Unmarshal(buf.Bytes(), &line)) {
+				return
+			}
+			assert.Contains(t, line, "duration_ms")
+			assert.Contains(t, line, "time")
+			for name, value := range tt.want {
+				assert.Equal(t, value, line[name], name)
+			}
+			if tt.policy != nil {
+				assert.Equal(t, float64(w.Body.Len()), line["bytes_out"])
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// AccountRoleEnvPrefix prefixes the environment variables mapping an account
+// ID to a role, e.g. AWS_SIGV4_PROXY_ACCOUNT_ROLE_123456789012.
+const AccountRoleEnvPrefix = "AWS_SIGV4_PROXY_ACCOUNT_ROLE_"
+
+var (
+	accountID = regexp.MustCompile(`^[0-9]{12}$`)
+	// arnAccountID matches the account ID of an ARN, such as the ARN of a
+	// Lambda function or an SNS topic in a path.
+	arnAccountID = regexp.MustCompile(`arn:aws[a-z-]*:[a-z0-9-]+:[a-z0-9-]*:([0-9]{12}):`)
+	// hostAccountID matches the account ID of the hosts of S3 access points,
+	// Object Lambda access points and S3 Control.
+	hostAccountID = regexp.MustCompile(`^(?:[a-z0-9-]+-)?([0-9]{12})\.s3-(?:accesspoint|object-lambda|control)(?:-fips)?[.-]`)
+)
+
+// AccountRoleCredentials signs requests with the credentials of the role
+// mapped to the AWS account they target, so one proxy fronts the resources of
+// several accounts, e.g. cross-account S3 buckets. The account is read from
+// Header when set, or else from the first ARN of the path, or the host of S3
+// access points and S3 Control. Requests for an account without a role are
+// forbidden, requests without an account are signed with Default.
+type AccountRoleCredentials struct {
+	// Header, when set, holds the ID of the target account. The header is
+	// never sent upstream.
+	Header string
+	// Roles are the credentials of the roles by account ID.
+	Roles map[string]*credentials.Credentials
+	// Default signs the requests whose account cannot be determined, such
+	// requests are forbidden when nil.
+	Default *credentials.Credentials
+}
+
+// NewAccountRoleCredentials returns the AccountRoleCredentials of roles,
+// which maps account IDs to role ARNs. newCredentials returns the
+// credentials of a role, and is called once per distinct role.
+func NewAccountRoleCredentials(header string, roles map[string]string, newCredentials func(roleARN string) *credentials.Credentials) (*AccountRoleCredentials, error) {
+	if len(roles) == 0 {
+		return nil, errors.New("no account roles")
+	}
+	a := &AccountRoleCredentials{Header: header, Roles: map[string]*credentials.Credentials{}}
+	byRole := map[string]*credentials.Credentials{}
+	for account, arn := range roles {
+		if !accountID.MatchString(account) {
+			return nil, fmt.Errorf("invalid account ID %q, expected 12 digits", account)
+		}
+		if !roleARN.MatchString(arn) {
+			return nil, fmt.Errorf("invalid role ARN %q for account %s", arn, account)
+		}
+		creds, ok := byRole[arn]
+		if !ok {
+			creds = newCredentials(arn)
+			byRole[arn] = creds
+		}
+		a.Roles[account] = creds
+	}
+	return a, nil
+}
+
+// AccountRolesFromEnv returns the roles of the environment variables of
+// environ, in the format of os.Environ, named after AccountRoleEnvPrefix and
+// the account ID.
+func AccountRolesFromEnv(environ []string) map[string]string {
+	roles := map[string]string{}
+	for _, v := range environ {
+		name, value, _ := strings.Cut(v, "=")
+		if account := strings.TrimPrefix(name, AccountRoleEnvPrefix); account != name && value != "" {
+			roles[account] = value
+		}
+	}
+	return roles
+}
+
+// Credentials returns the credentials of the role of the account req
+// targets.
+func (a *AccountRoleCredentials) Credentials(req *http.Request) (*credentials.Credentials, error) {
+	account, source := a.account(req)
+	if account == "" {
+		if a.Default == nil {
+			return nil, &StatusError{StatusCode: http.StatusForbidden, Err: fmt.Errorf("unable to determine the target account of the request")}
+		}
+		return a.Default, nil
+	}
+	if !accountID.MatchString(account) {
+		return nil, badRequest(fmt.Errorf("invalid account ID %q in %s", account, source))
+	}
+	creds, ok := a.Roles[account]
+	if !ok {
+		return nil, &StatusError{StatusCode: http.StatusForbidden, Err: fmt.Errorf("no role is mapped to account %s of %s", account, source)}
+	}
+	return creds, nil
+}
+
+// account returns the ID of the account req targets, and where it was found.
+func (a *AccountRoleCredentials) account(req *http.Request) (account, source string) {
+	if a.Header != "" {
+		account := strings.TrimSpace(req.Header.Get(a.Header))
+		req.Header.Del(a.Header)
+		if account != "" {
+			return account, "header " + a.Header
+		}
+	}
+	if req.URL != nil {
+		path, err := url.PathUnescape(req.URL.EscapedPath())
+		if err != nil {
+			path = req.URL.Path
+		}
+		if m := arnAccountID.FindStringSubmatch(path); m != nil {
+			return m[1], "the path"
+		}
+	}
+	if m := hostAccountID.FindStringSubmatch(strings.ToLower(req.Host)); m != nil {
+		return m[1], "the host"
+	}
+	return "", ""
+}
+
+func (a *AccountRoleCredentials) ExpireCredentials() int {
+	expired := map[*credentials.Credentials]bool{}
+	for _, creds := range a.Roles {
+		if !expired[creds] {
+			creds.Expire()
+			expired[creds] = true
+		}
+	}
+	return len(expired)
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountRoleCredentials(t *testing.T) {
+	newCredentials := func(roleARN string) *credentials.Credentials {
+		return credentials.NewStaticCredentials(roleARN, "SECRET", "")
+	}
+	provider, err := NewAccountRoleCredentials("X-Sigv4-Proxy-Account-Id", map[string]string{
+		"111122223333": "arn:aws:iam::111122223333:role/proxy",
+		"444455556666": "arn:aws:iam::444455556666:role/proxy",
+	}, newCredentials)
+	if !assert.NoError(t, err) {
+		return
+	}
+	provider.Default = credentials.NewStaticCredentials("DEFAULT", "SECRET", "")
+
+	tests := []struct {
+		name       string
+		url        string
+		header     string
+		wantKey    string
+		statusCode int
+	}{
+		{
+			name:    "header",
+			url:     "https://s3.us-east-1.amazonaws.com/bucket/key",
+			header:  "444455556666",
+			wantKey: "arn:aws:iam::444455556666:role/proxy",
+		},
+		{
+			name:    "header wins over the path",
+			url:     "https://lambda.us-east-1.amazonaws.com/2015-03-31/functions/arn:aws:lambda:us-east-1:111122223333:function:f/invocations",
+			header:  "444455556666",
+			wantKey: "arn:aws:iam::444455556666:role/proxy",
+		},
+		{
+			name:    "ARN in the path",
+			url:     "https://lambda.us-east-1.amazonaws.com/2015-03-31/functions/arn:aws:lambda:us-east-1:111122223333:function:f/invocations",
+			wantKey: "arn:aws:iam::111122223333:role/proxy",
+		},
+		{
+			name:    "escaped ARN in the path",
+			url:     "https://lambda.us-east-1.amazonaws.com/2015-03-31/functions/arn%3Aaws%3Alambda%3Aus-east-1%3A444455556666%3Afunction%3Af/invocations",
+			wantKey: "arn:aws:iam::444455556666:role/proxy",
+		},
+		{
+			name:    "access point host",
+			url:     "https://reports-111122223333.s3-accesspoint.us-east-1.amazonaws.com/key",
+			wantKey: "arn:aws:iam::111122223333:role/proxy",
+		},
+		{
+			name:    "S3 Control host",
+			url:     "https://444455556666.s3-control.us-east-1.amazonaws.com/v20180820/jobs",
+			wantKey: "arn:aws:iam::444455556666:role/proxy",
+		},
+		{
+			name:    "no account",
+			url:     "https://dynamodb.us-east-1.amazonaws.com/",
+			wantKey: "DEFAULT",
+		},
+		{
+			name:       "unmapped account",
+			url:        "https://777788889999.s3-control.us-east-1.amazonaws.com/v20180820/jobs",
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "invalid account",
+			url:        "https://s3.us-east-1.amazonaws.com/bucket/key",
+			header:     "prod",
+			statusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.header != "" {
+				r.Header.Set("X-Sigv4-Proxy-Account-Id", tt.header)
+			}
+			creds, err := provider.Credentials(r)
+			assert.Empty(t, r.Header.Get("X-Sigv4-Proxy-Account-Id"))
+			if tt.statusCode != 0 {
+				assert.Equal(t, tt.statusCode, errorStatusCode(err))
+				return
+			}
+			if assert.NoError(t, err) {
+				value, _ := creds.Get()
+				assert.Equal(t, tt.wantKey, value.AccessKeyID)
+			}
+		})
+	}
+
+	assert.Equal(t, 2, provider.ExpireCredentials())
+}
+
+func TestAccountRoleCredentials_NoDefault(t *testing.T) {
+	provider, err := NewAccountRoleCredentials("", map[string]string{"111122223333": "arn:aws:iam::111122223333:role/proxy"}, func(roleARN string) *credentials.Credentials {
+		return credentials.NewStaticCredentials(roleARN, "SECRET", "")
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Without Header, the header is ignored.
+	r := httptest.NewRequest(http.MethodGet, "https://dynamodb.us-east-1.amazonaws.com/", nil)
+	r.Header.Set("X-Sigv4-Proxy-Account-Id", "111122223333")
+	_, err = provider.Credentials(r)
+	assert.Equal(t, http.StatusForbidden, errorStatusCode(err))
+}
+
+func TestNewAccountRoleCredentials(t *testing.T) {
+	calls := 0
+	newCredentials := func(roleARN string) *credentials.Credentials {
+		calls++
+		return credentials.NewStaticCredentials(roleARN, "SECRET", "")
+	}
+
+	_, err := NewAccountRoleCredentials("", map[string]string{
+		"111122223333": "arn:aws:iam::111122223333:role/proxy",
+		"444455556666": "arn:aws:iam::111122223333:role/proxy",
+	}, newCredentials)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	_, err = NewAccountRoleCredentials("", nil, newCredentials)
+	assert.EqualError(t, err, "no account roles")
+	_, err = NewAccountRoleCredentials("", map[string]string{"1111": "arn:aws:iam::111122223333:role/proxy"}, newCredentials)
+	assert.EqualError(t, err, `invalid account ID "1111", expected 12 digits`)
+	_, err = NewAccountRoleCredentials("", map[string]string{"111122223333": "proxy"}, newCredentials)
+	assert.EqualError(t, err, `invalid role ARN "proxy" for account 111122223333`)
+}
+
+func TestAccountRolesFromEnv(t *testing.T) {
+	roles := AccountRolesFromEnv([]string{
+		"HOME=/root",
+		"AWS_SIGV4_PROXY_ACCOUNT_ROLE_111122223333=arn:aws:iam::111122223333:role/proxy",
+		"AWS_SIGV4_PROXY_ACCOUNT_ROLE_444455556666=",
+	})
+	assert.Equal(t, map[string]string{"111122223333": "arn:aws:iam::111122223333:role/proxy"}, roles)
+}
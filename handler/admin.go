@@ -0,0 +1,600 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	log "github.com/sirupsen/logrus"
+)
+
+// Admin serves the operational endpoints of the proxy. It is meant to be
+// exposed on a dedicated listener, separate from the proxied traffic. The
+// endpoints changing the proxy, all but the GET ones, require Token, or are
+// only served to the clients on the same host without it.
+type Admin struct {
+	Stats       *Stats
+	Credentials *credentials.Credentials
+	// Limiter, when set, has its requests in flight shown on the status page.
+	Limiter *HostLimiter
+	// Expirers, when set, hold the credentials expired on demand by POST
+	// /credentials/expire, to rehearse their rotation.
+	Expirers []CredentialsExpirer
+	// ReadinessCredentials are retrieved by /readyz besides Credentials,
+	// such as the roles assumed for config sets, by check name.
+	ReadinessCredentials map[string]*credentials.Credentials
+	// Startup, when set, fails /readyz while the proxy waits for its
+	// dependencies.
+	Startup *Startup
+	// CredentialsChain, when set, is shown by /credentials.
+	CredentialsChain *CredentialsChain
+	// Prober, when set, has its results shown on the status page and
+	// /metrics.
+	Prober *Prober
+	// Connections, when set, has the upstream connections of each address
+	// exported by /metrics.
+	Connections *ConnRecycler
+	// BodyMemory, when set, has the bytes of the buffered request bodies
+	// shown on the status page and exported by /metrics.
+	BodyMemory *BodyMemory
+	// Upstream, when set, has its routing table shown by /config/routes.
+	Upstream Client
+	// Reload, when set, reloads the config file on POST /config/reload.
+	Reload func() error
+	// Rollback, when set, reinstalls the last-known-good config on POST
+	// /config/rollback.
+	Rollback func() error
+	// Token is the bearer token of the endpoints changing the proxy.
+	Token string
+	// AllowDebugLogLevel allows PUT /log-level to set the debug and trace
+	// levels, which log the headers and bodies of the failed requests.
+	AllowDebugLogLevel bool
+
+	once sync.Once
+	mux  *http.ServeMux
+}
+
+// adminRoute is an admin endpoint, served and documented in the OpenAPI
+// document of /-/openapi.json from the same table.
+type adminRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	// ContentType is the content type of the responses of the endpoint.
+	ContentType string
+	// Responses describes the status codes of the endpoint.
+	Responses map[int]string
+	Handler   http.HandlerFunc
+}
+
+func (a *Admin) routes() []adminRoute {
+	return []adminRoute{
+		{Method: http.MethodGet, Path: "/status", Summary: "Human-readable status page", ContentType: "text/html",
+			Responses: map[int]string{http.StatusOK: "Status page"}, Handler: a.status},
+		{Method: http.MethodGet, Path: "/healthz", Summary: "Liveness probe", ContentType: "text/plain",
+			Responses: map[int]string{http.StatusOK: "The proxy serves requests"}, Handler: a.healthz},
+		{Method: http.MethodGet, Path: "/readyz", Summary: "Readiness probe, retrieving the signing credentials", ContentType: "text/plain",
+			Responses: map[int]string{http.StatusOK: "Every credentials can be retrieved", http.StatusServiceUnavailable: "Some credentials cannot be retrieved, listed in the body"}, Handler: a.readyz},
+		{Method: http.MethodGet, Path: "/credentials", Summary: "Provider of the credential chain the credentials come from, and their latest refreshes", ContentType: "application/json",
+			Responses: map[int]string{http.StatusOK: "Credential chain", http.StatusNotFound: "The credentials do not come from the credential chain"}, Handler: a.credentialsChain},
+		{Method: http.MethodPost, Path: "/credentials/expire", Summary: "Force the cached credentials to expire", ContentType: "text/plain",
+			Responses: map[int]string{http.StatusOK: "Number of credentials expired", http.StatusNotFound: "Expiring the credentials is not enabled"}, Handler: a.expireCredentials},
+		{Method: http.MethodGet, Path: "/config/routes", Summary: "Routing table of the upstream requests", ContentType: "application/json",
+			Responses: map[int]string{http.StatusOK: "Routes by host, then by path prefix, and the default route", http.StatusNotFound: "The proxy has no routing table"}, Handler: a.routingTable},
+		{Method: http.MethodPost, Path: "/config/reload", Summary: "Reload the config file", ContentType: "text/plain",
+			Responses: map[int]string{http.StatusOK: "Config reloaded", http.StatusNotFound: "The proxy has no config file", http.StatusInternalServerError: "The config is invalid and the current one is kept"}, Handler: a.reload},
+		{Method: http.MethodPost, Path: "/config/rollback", Summary: "Reinstall the last-known-good config", ContentType: "text/plain",
+			Responses: map[int]string{http.StatusOK: "Config rolled back", http.StatusNotFound: "The proxy has no config file", http.StatusConflict: "The current config is the last-known-good one"}, Handler: a.rollback},
+		{Method: http.MethodGet, Path: "/log-level", Summary: "Level of the logs", ContentType: "text/plain",
+			Responses: map[int]string{http.StatusOK: "Log level"}, Handler: a.logLevel},
+		{Method: http.MethodPut, Path: "/log-level", Summary: "Set the level of the logs, e.g. debug", ContentType: "text/plain",
+			Responses: map[int]string{http.StatusOK: "Log level set", http.StatusBadRequest: "Unknown log level", http.StatusForbidden: "The debug and trace levels are not allowed, or not a local client without an admin token"}, Handler: a.setLogLevel},
+		{Method: http.MethodGet, Path: "/metrics", Summary: "Metrics in the Prometheus text format", ContentType: "text/plain",
+			Responses: map[int]string{http.StatusOK: "Histograms of the request and response body sizes per route, results of the upstream probes, upstream connections, and buffered request bodies"}, Handler: a.metrics},
+		{Method: http.MethodGet, Path: "/-/openapi.json", Summary: "OpenAPI document of the admin endpoints", ContentType: "application/json",
+			Responses: map[int]string{http.StatusOK: "OpenAPI 3.0 document"}, Handler: a.openAPI},
+	}
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.once.Do(func() {
+		a.mux = http.NewServeMux()
+		for _, route := range a.routes() {
+			handler := route.Handler
+			if route.Method != http.MethodGet {
+				handler = a.authorize(handler)
+			}
+			a.mux.Handle(route.Method+" "+route.Path, handler)
+		}
+		a.mux.Handle("GET /{$}", http.RedirectHandler("/status", http.StatusFound))
+	})
+	a.mux.ServeHTTP(w, r)
+}
+
+// authorize serves the requests of the clients presenting Token as a bearer
+// token, or of the clients on the same host without Token.
+func (a *Admin) authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.Token == "" {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+				http.Error(w, "only served to local clients without an admin token", http.StatusForbidden)
+				return
+			}
+		} else {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="aws-sigv4-proxy admin"`)
+				http.Error(w, "missing or invalid admin token", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>aws-sigv4-proxy status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>aws-sigv4-proxy</h1>
+<table>
+<tr><th>Uptime</th><td>{{.Uptime}}</td></tr>
+<tr><th>Requests/s (1m)</th><td>{{printf "%.2f" .RequestRate}}</td></tr>
+<tr><th>Errors/s (1m)</th><td>{{printf "%.2f" .ErrorRate}}</td></tr>
+<tr><th>Client aborts</th><td>{{.ClientAborts}}</td></tr>
+{{if .BodyMemory}}<tr><th>Buffered request bodies</th><td>{{.BodyMemory.Used}} bytes{{if .BodyMemory.Limit}} of {{.BodyMemory.Limit}}{{end}}, {{.BodyMemory.Shed}} shed</td></tr>
+{{end}}<tr><th>Credentials</th><td>{{.Credentials}}</td></tr>
+{{if .CredentialsProvider}}<tr><th>Credentials provider</th><td>{{.CredentialsProvider}}</td></tr>
+{{end}}</table>
+<h2>Routes</h2>
+<table>
+<tr><th>Route</th><th>Requests</th><th>Errors</th><th>2xx</th><th>3xx</th><th>4xx</th><th>5xx</th><th>Avg latency</th></tr>
+{{range .Routes}}<tr><td>{{.Route}}</td><td>{{.Requests}}</td><td>{{.Errors}}</td><td>{{index .StatusClass 2}}</td><td>{{index .StatusClass 3}}</td><td>{{index .StatusClass 4}}</td><td>{{index .StatusClass 5}}</td><td>{{.AverageLatency}}</td></tr>
+{{end}}</table>
+{{if .Fields}}<h2>Extracted fields</h2>
+<table>
+<tr><th>Route</th><th>Requests</th><th>Errors</th><th>2xx</th><th>3xx</th><th>4xx</th><th>5xx</th><th>Avg latency</th></tr>
+{{range .Fields}}<tr><td>{{.Route}}</td><td>{{.Requests}}</td><td>{{.Errors}}</td><td>{{index .StatusClass 2}}</td><td>{{index .StatusClass 3}}</td><td>{{index .StatusClass 4}}</td><td>{{index .StatusClass 5}}</td><td>{{.AverageLatency}}</td></tr>
+{{end}}</table>
+{{end}}{{if .Clients}}<h2>Client protocols</h2>
+<table>
+<tr><th>Protocol</th><th>TLS</th><th>ALPN</th><th>Requests</th></tr>
+{{range .Clients}}<tr><td>{{.Proto}}</td><td>{{or .TLSVersion "none"}}</td><td>{{or .ALPN "none"}}</td><td>{{.Requests}}</td></tr>
+{{end}}</table>
+{{end}}{{if .InFlight}}<h2>Requests in flight</h2>
+<table>
+<tr><th>Host</th><th>In flight</th></tr>
+{{range $host, $count := .InFlight}}<tr><td>{{$host}}</td><td>{{$count}}</td></tr>
+{{end}}</table>
+{{end}}{{if .AssumeRole.Count}}<h2>Assume role latency</h2>
+<table>
+<tr><th>Calls</th><td>{{.AssumeRole.Count}}</td></tr>
+<tr><th>Errors</th><td>{{.AssumeRole.Errors}}</td></tr>
+<tr><th>Avg latency</th><td>{{.AssumeRole.AverageLatency}}</td></tr>
+<tr><th>Max latency</th><td>{{.AssumeRole.Max}}</td></tr>
+{{range .AssumeRole.Buckets}}<tr><th>{{.Label}}</th><td>{{.Count}}</td></tr>
+{{end}}</table>
+{{end}}{{if .Probes}}<h2>Upstream probes</h2>
+<table>
+<tr><th>Target</th><th>Up</th><th>Status</th><th>Latency</th><th>Failures</th><th>Last probe</th><th>Error</th></tr>
+{{range .Probes}}<tr><td>{{.Target}}</td><td>{{.Up}}</td><td>{{.StatusCode}}</td><td>{{.Latency}}</td><td>{{.Failures}}/{{.Probes}}</td><td>{{.Time.Format "2006-01-02T15:04:05Z07:00"}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+{{end}}<h2>Recent errors</h2>
+<table>
+<tr><th>Time</th><th>Request</th><th>Route</th><th>Status</th><th>Message</th></tr>
+{{range .Errors}}<tr><td>{{.Time.Format "2006-01-02T15:04:05Z07:00"}}</td><td>{{.Method}} {{.Path}}</td><td>{{.Service}}</td><td>{{.StatusCode}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func (a *Admin) status(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Uptime              time.Duration
+		RequestRate         float64
+		ErrorRate           float64
+		ClientAborts        int64
+		BodyMemory          *BodyMemory
+		Credentials         string
+		CredentialsProvider string
+		Routes              []RouteStats
+		Fields              []RouteStats
+		Clients             []ClientProtocolStats
+		InFlight            map[string]int
+		AssumeRole          LatencyHistogram
+		Probes              []ProbeResult
+		Errors              []ErrorSample
+	}{
+		Credentials: a.credentialsStatus(),
+		BodyMemory:  a.BodyMemory,
+	}
+	if a.CredentialsChain != nil {
+		data.CredentialsProvider = a.CredentialsChain.Provider()
+	}
+	if a.Limiter != nil {
+		data.InFlight = a.Limiter.InFlight()
+	}
+	if a.Prober != nil {
+		data.Probes = a.Prober.Results()
+	}
+	if a.Stats != nil {
+		data.Uptime = time.Since(a.Stats.Started).Round(time.Second)
+		data.RequestRate, data.ErrorRate = a.Stats.Rates()
+		data.ClientAborts = a.Stats.ClientAborts()
+		data.Routes = a.Stats.Routes()
+		data.Fields = a.Stats.Fields()
+		data.Clients = a.Stats.ClientProtocols()
+		data.AssumeRole = a.Stats.AssumeRoleLatency()
+		data.Errors = a.Stats.RecentErrors()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, data); err != nil {
+		log.WithError(err).Error("unable to render status page")
+	}
+}
+
+// metrics serves the body size histograms, and the results of the upstream
+// probes, in the Prometheus text format.
+func (a *Admin) metrics(w http.ResponseWriter, r *http.Request) {
+	var sizes []RouteSizes
+	var headerRules []HeaderRuleCount
+	if a.Stats != nil {
+		sizes = a.Stats.Sizes()
+		headerRules = a.Stats.HeaderRules()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeSizeHistograms(w, "sigv4_proxy_request_body_bytes", "Size of the request bodies proxied, per route.", sizes, func(s RouteSizes) SizeHistogram { return s.Request })
+	writeSizeHistograms(w, "sigv4_proxy_response_body_bytes", "Size of the response bodies proxied, per route.", sizes, func(s RouteSizes) SizeHistogram { return s.Response })
+	writeHeaderRuleMetrics(w, headerRules)
+	if a.Prober != nil {
+		writeProbeMetrics(w, a.Prober.Results())
+	}
+	if a.Connections != nil {
+		writeConnMetrics(w, a.Connections.Stats())
+	}
+	if a.BodyMemory != nil {
+		writeBodyMemoryMetrics(w, a.BodyMemory)
+	}
+}
+
+func writeBodyMemoryMetrics(w io.Writer, m *BodyMemory) {
+	metrics := []struct {
+		name, help, kind string
+		value            int64
+	}{
+		{"sigv4_proxy_request_body_memory_bytes", "Bytes of the request bodies buffered in memory.", "gauge", m.Used()},
+		{"sigv4_proxy_request_body_memory_limit_bytes", "Most bytes of request bodies buffered in memory at once, 0 when unlimited.", "gauge", m.Limit},
+		{"sigv4_proxy_request_body_memory_shed_total", "Requests rejected because their body did not fit the memory left.", "counter", m.Shed()},
+	}
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+}
+
+func writeHeaderRuleMetrics(w io.Writer, counts []HeaderRuleCount) {
+	const name = "sigv4_proxy_header_changes_total"
+	fmt.Fprintf(w, "# HELP %s Headers of the requests changed by the header rule.\n# TYPE %s counter\n", name, name)
+	for _, c := range counts {
+		fmt.Fprintf(w, "%s{rule=%s,pattern=%s} %d\n", name, strconv.Quote(c.Rule), strconv.Quote(c.Pattern), c.Headers)
+	}
+}
+
+func writeConnMetrics(w io.Writer, stats []ConnStats) {
+	metrics := []struct {
+		name, help, kind string
+		value            func(ConnStats) string
+	}{
+		{"sigv4_proxy_upstream_connections", "Connections open to the upstream address.", "gauge", func(s ConnStats) string {
+			return strconv.Itoa(s.Open)
+		}},
+		{"sigv4_proxy_upstream_connection_oldest_age_seconds", "Age of the oldest connection open to the upstream address.", "gauge", func(s ConnStats) string {
+			return strconv.FormatFloat(s.OldestAge.Seconds(), 'f', -1, 64)
+		}},
+		{"sigv4_proxy_upstream_connections_opened_total", "Connections opened to the upstream address.", "counter", func(s ConnStats) string {
+			return strconv.FormatInt(s.Opened, 10)
+		}},
+		{"sigv4_proxy_upstream_connections_recycled_total", "Connections to the upstream address closed for being older than the maximum age.", "counter", func(s ConnStats) string {
+			return strconv.FormatInt(s.Recycled, 10)
+		}},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, s := range stats {
+			fmt.Fprintf(w, "%s{address=%s} %s\n", m.name, strconv.Quote(s.Address), m.value(s))
+		}
+	}
+}
+
+func writeProbeMetrics(w io.Writer, results []ProbeResult) {
+	metrics := []struct {
+		name, help, kind string
+		value            func(ProbeResult) string
+	}{
+		{"sigv4_proxy_probe_up", "Whether the last probe of the upstream succeeded.", "gauge", func(r ProbeResult) string {
+			if r.Up {
+				return "1"
+			}
+			return "0"
+		}},
+		{"sigv4_proxy_probe_duration_seconds", "Latency of the last probe of the upstream.", "gauge", func(r ProbeResult) string {
+			return strconv.FormatFloat(r.Latency.Seconds(), 'f', -1, 64)
+		}},
+		{"sigv4_proxy_probe_status_code", "Status code of the last probe of the upstream, 0 without response.", "gauge", func(r ProbeResult) string {
+			return strconv.Itoa(r.StatusCode)
+		}},
+		{"sigv4_proxy_probes_total", "Probes of the upstream.", "counter", func(r ProbeResult) string {
+			return strconv.FormatInt(r.Probes, 10)
+		}},
+		{"sigv4_proxy_probe_failures_total", "Failed probes of the upstream.", "counter", func(r ProbeResult) string {
+			return strconv.FormatInt(r.Failures, 10)
+		}},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, r := range results {
+			fmt.Fprintf(w, "%s{target=%s} %s\n", m.name, strconv.Quote(r.Target), m.value(r))
+		}
+	}
+}
+
+func writeSizeHistograms(w io.Writer, name, help string, sizes []RouteSizes, histogram func(RouteSizes) SizeHistogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, s := range sizes {
+		h := histogram(s)
+		route := strconv.Quote(s.Route)
+		var cumulative int64
+		for i, count := range h.Counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.Bounds) {
+				le = strconv.FormatInt(h.Bounds[i], 10)
+			}
+			fmt.Fprintf(w, "%s_bucket{route=%s,le=\"%s\"} %d\n", name, route, le, cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum{route=%s} %d\n%s_count{route=%s} %d\n", name, route, h.Sum, name, route, h.Count)
+	}
+}
+
+// openAPI serves the OpenAPI document of the admin endpoints.
+func (a *Admin) openAPI(w http.ResponseWriter, r *http.Request) {
+	paths := map[string]map[string]interface{}{}
+	for _, route := range a.routes() {
+		responses := map[string]interface{}{}
+		if route.Method != http.MethodGet {
+			responses["401"] = map[string]interface{}{"description": "Missing or invalid admin token"}
+			responses["403"] = map[string]interface{}{"description": "Not a local client, without an admin token"}
+		}
+		for code, description := range route.Responses {
+			responses[strconv.Itoa(code)] = map[string]interface{}{
+				"description": description,
+				"content":     map[string]interface{}{route.ContentType: map[string]interface{}{}},
+			}
+		}
+		if paths[route.Path] == nil {
+			paths[route.Path] = map[string]interface{}{}
+		}
+		paths[route.Path][strings.ToLower(route.Method)] = map[string]interface{}{
+			"summary":   route.Summary,
+			"responses": responses,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": "aws-sigv4-proxy admin endpoints", "version": "1"},
+		"paths":   paths,
+	})
+}
+
+// credentialsChain serves the provider of the credential chain the
+// credentials come from.
+func (a *Admin) credentialsChain(w http.ResponseWriter, r *http.Request) {
+	if a.CredentialsChain == nil {
+		http.Error(w, "the credentials do not come from the credential chain", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Provider    string               `json:"provider"`
+		Environment map[string]string    `json:"environment"`
+		Refreshes   []CredentialsRefresh `json:"refreshes"`
+	}{
+		Provider:    a.CredentialsChain.Provider(),
+		Environment: a.CredentialsChain.Environment,
+		Refreshes:   a.CredentialsChain.Refreshes(),
+	})
+}
+
+// expireCredentials forces every cached credentials to expire, as if they
+// had reached their expiry, so the next requests exercise the refresh path.
+func (a *Admin) expireCredentials(w http.ResponseWriter, r *http.Request) {
+	if a.Expirers == nil {
+		http.Error(w, "expiring the credentials is not enabled", http.StatusNotFound)
+		return
+	}
+	expired := 0
+	for _, expirer := range a.Expirers {
+		expired += expirer.ExpireCredentials()
+	}
+	log.WithField("credentials", expired).Warn("credentials forced to expire from the admin endpoint")
+	fmt.Fprintf(w, "expired %d credentials\n", expired)
+}
+
+// routingTable lists the routes of the upstream requests.
+func (a *Admin) routingTable(w http.ResponseWriter, r *http.Request) {
+	routes := RoutingTable(a.Upstream)
+	if routes == nil {
+		http.Error(w, "the proxy has no routing table", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(routes)
+}
+
+// reload reloads the config file, the current config is kept when the new
+// one is invalid.
+func (a *Admin) reload(w http.ResponseWriter, r *http.Request) {
+	if a.Reload == nil {
+		http.Error(w, "the proxy has no config file", http.StatusNotFound)
+		return
+	}
+	if err := a.Reload(); err != nil {
+		log.WithError(err).Error("unable to reload the config from the admin endpoint, keeping the current one")
+		http.Error(w, fmt.Sprintf("unable to reload the config, keeping the current one: %v", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "config reloaded")
+}
+
+// rollback reinstalls the last-known-good config, the config of a reload
+// still on probation.
+func (a *Admin) rollback(w http.ResponseWriter, r *http.Request) {
+	if a.Rollback == nil {
+		http.Error(w, "the proxy has no config file", http.StatusNotFound)
+		return
+	}
+	if err := a.Rollback(); err != nil {
+		http.Error(w, fmt.Sprintf("unable to roll back the config: %v", err), http.StatusConflict)
+		return
+	}
+	fmt.Fprintln(w, "config rolled back")
+}
+
+func (a *Admin) logLevel(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, log.GetLevel())
+}
+
+// setLogLevel sets the level of the logs to the one of the body, e.g. debug
+// to troubleshoot a running proxy, which also logs the failed requests. The
+// debug and trace levels must be allowed by AllowDebugLogLevel.
+func (a *Admin) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	level, err := log.ParseLevel(strings.TrimSpace(string(body)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if level > log.InfoLevel && !a.AllowDebugLogLevel {
+		http.Error(w, fmt.Sprintf("the %s level is not allowed", level), http.StatusForbidden)
+		return
+	}
+	previous := log.GetLevel()
+	log.SetLevel(level)
+	log.WithFields(log.Fields{"log_level": level, "previous_log_level": previous}).Warn("log level set from the admin endpoint")
+	fmt.Fprintln(w, level)
+}
+
+// healthz reports the proxy is alive, as long as it serves requests.
+func (a *Admin) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz reports whether the proxy can sign requests: every credentials must
+// be retrieved, which assumes the roles whose credentials are not cached.
+func (a *Admin) readyz(w http.ResponseWriter, r *http.Request) {
+	if a.Startup != nil {
+		if waiting := a.Startup.Waiting(); waiting != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "starting: waiting for %s\n", waiting)
+			return
+		}
+	}
+
+	checks := map[string]*credentials.Credentials{"credentials": a.Credentials}
+	for name, creds := range a.ReadinessCredentials {
+		checks[name] = creds
+	}
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var results []string
+	ready := true
+	for _, name := range names {
+		if err := checkCredentials(r.Context(), checks[name]); err != nil {
+			ready = false
+			results = append(results, fmt.Sprintf("%s: %v", name, err))
+			log.WithError(err).WithField("check", name).Warn("readiness check failed")
+			continue
+		}
+		results = append(results, name+": ok")
+	}
+
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, strings.Join(results, "\n"))
+}
+
+// checkCredentials retrieves creds, failing unless they can sign requests.
+func checkCredentials(ctx credentials.Context, creds *credentials.Credentials) error {
+	if creds == nil {
+		return fmt.Errorf("not configured")
+	}
+	if creds == credentials.AnonymousCredentials {
+		return nil
+	}
+	value, err := creds.GetWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	if value.AccessKeyID == "" || value.SecretAccessKey == "" {
+		return fmt.Errorf("empty access key from %s", value.ProviderName)
+	}
+	return nil
+}
+
+func (a *Admin) credentialsStatus() string {
+	if a.Credentials == nil {
+		return "not configured"
+	}
+	if a.Credentials.IsExpired() {
+		return "expired or not yet retrieved"
+	}
+	expiresAt, err := a.Credentials.ExpiresAt()
+	if err != nil {
+		return "valid, no expiry"
+	}
+	return "valid, expires at " + expiresAt.Format(time.RFC3339) + " (in " + time.Until(expiresAt).Round(time.Second).String() + ")"
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// DefaultAPIKeyHeader is the header clients present their API key in.
+const DefaultAPIKeyHeader = "X-Sigv4-Proxy-Api-Key"
+
+// APIKeys is a Policy requiring clients to present one of a set of static
+// keys before their requests are signed, since whoever can reach the proxy
+// otherwise signs with its credentials. The key header is never sent
+// upstream.
+type APIKeys struct {
+	// Header holds the key, DefaultAPIKeyHeader when empty.
+	Header string
+
+	hashes [][sha256.Size]byte
+}
+
+// NewAPIKeys returns the policy accepting keys in header.
+func NewAPIKeys(header string, keys []string) (*APIKeys, error) {
+	if header == "" {
+		header = DefaultAPIKeyHeader
+	}
+	a := &APIKeys{Header: header}
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("empty API key")
+		}
+		// The hashes are compared in constant time whatever the key lengths.
+		a.hashes = append(a.hashes, sha256.Sum256([]byte(key)))
+	}
+	if len(a.hashes) == 0 {
+		return nil, fmt.Errorf("no API keys")
+	}
+	return a, nil
+}
+
+// LoadAPIKeys reads the keys of the file at path, one per line. Blank lines
+// and lines starting with # are ignored.
+func LoadAPIKeys(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read API keys %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+func (a *APIKeys) Name() string {
+	return "api-key"
+}
+
+func (a *APIKeys) Check(r *http.Request) *Rejection {
+	key := r.Header.Get(a.Header)
+	r.Header.Del(a.Header)
+	if key == "" {
+		return &Rejection{StatusCode: http.StatusUnauthorized, Message: fmt.Sprintf("missing API key in header %s", a.Header)}
+	}
+
+	hash := sha256.Sum256([]byte(key))
+	valid := 0
+	for _, h := range a.hashes {
+		valid |= subtle.ConstantTimeCompare(hash[:], h[:])
+	}
+	if valid != 1 {
+		return &Rejection{StatusCode: http.StatusUnauthorized, Message: "invalid API key"}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeys_Check(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{
+			name:   "valid key",
+			header: http.Header{DefaultAPIKeyHeader: {"key-2"}},
+		},
+		{
+			name: "missing key",
+			want: "missing API key in header X-Sigv4-Proxy-Api-Key",
+		},
+		{
+			name:   "invalid key",
+			header: http.Header{DefaultAPIKeyHeader: {"key-3"}},
+			want:   "invalid API key",
+		},
+		{
+			name:   "key prefix",
+			header: http.Header{DefaultAPIKeyHeader: {"key"}},
+			want:   "invalid API key",
+		},
+	}
+
+	keys, err := NewAPIKeys("", []string{"key-1", "key-2"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+
+			rejection := keys.Check(r)
+			if tt.want == "" {
+				assert.Nil(t, rejection)
+			} else if assert.NotNil(t, rejection) {
+				assert.Equal(t, http.StatusUnauthorized, rejection.StatusCode)
+				assert.Equal(t, tt.want, rejection.Message)
+			}
+			assert.Empty(t, r.Header.Get(DefaultAPIKeyHeader))
+		})
+	}
+}
+
+func TestNewAPIKeys(t *testing.T) {
+	_, err := NewAPIKeys("", nil)
+	assert.EqualError(t, err, "no API keys")
+	_, err = NewAPIKeys("", []string{"key", ""})
+	assert.EqualError(t, err, "empty API key")
+
+	keys, err := NewAPIKeys("X-Api-Key", []string{"key"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "X-Api-Key", keys.Header)
+	}
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(path, []byte("# team a\nkey-1\n\n  key-2  \n"), 0600)
+
+	keys, err := LoadAPIKeys(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"key-1", "key-2"}, keys)
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/gorilla/websocket"
+)
+
+// appSyncRealtime signs the WebSocket connection of a client to the realtime
+// endpoint of an AppSync GraphQL API, which does not authenticate the headers
+// of the handshake: the authorization of the connection is sent in its header
+// query parameter, and the one of each subscription in its start message. The
+// requests authorized are signed for the GraphQL endpoint of the API.
+type appSyncRealtime struct {
+	signer *v4.Signer
+	region string
+	// host is the host of the GraphQL endpoint of the API.
+	host string
+}
+
+// newAppSyncRealtime returns the appSyncRealtime of the upgrade request req
+// to host, nil when it is not a WebSocket connection to the realtime endpoint
+// of an AppSync API, e.g. <id>.appsync-realtime-api.us-east-1.amazonaws.com.
+func newAppSyncRealtime(req *http.Request, host string, signer *v4.Signer, region string) *appSyncRealtime {
+	id, domain, ok := strings.Cut(host, ".")
+	domain, isRealtime := strings.CutPrefix(domain, "appsync-realtime-api.")
+	if !ok || !isRealtime || !websocket.IsWebSocketUpgrade(req) {
+		return nil
+	}
+	return &appSyncRealtime{signer: signer, region: region, host: id + ".appsync-api." + domain}
+}
+
+// authorization returns the signed headers of a POST request of body to the
+// path of the GraphQL endpoint, in the form AppSync expects them.
+func (a *appSyncRealtime) authorization(path, body string) (map[string]string, error) {
+	req, err := http.NewRequest(http.MethodPost, "https://"+a.host+path, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json, text/javascript")
+	req.Header.Set("Content-Encoding", "amz-1.0")
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if _, err := a.signer.Sign(req, strings.NewReader(body), "appsync", a.region, time.Now()); err != nil {
+		return nil, err
+	}
+
+	auth := map[string]string{
+		"accept":           req.Header.Get("Accept"),
+		"content-encoding": req.Header.Get("Content-Encoding"),
+		"content-type":     req.Header.Get("Content-Type"),
+		"host":             a.host,
+		"x-amz-date":       req.Header.Get("X-Amz-Date"),
+		"Authorization":    req.Header.Get("Authorization"),
+	}
+	if token := req.Header.Get("X-Amz-Security-Token"); token != "" {
+		auth["X-Amz-Security-Token"] = token
+	}
+	return auth, nil
+}
+
+// connectQuery returns query with the header and payload parameters of the
+// connection, replacing the ones of the client.
+func (a *appSyncRealtime) connectQuery(query url.Values) (string, error) {
+	auth, err := a.authorization("/graphql/connect", "{}")
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	query.Set("header", base64.StdEncoding.EncodeToString(header))
+	query.Set("payload", base64.StdEncoding.EncodeToString([]byte("{}")))
+	return query.Encode(), nil
+}
+
+// conn returns the upgraded connection upstream, adding the authorization
+// of the subscriptions to the start messages written to it.
+func (a *appSyncRealtime) conn(upstream io.ReadWriteCloser) io.ReadWriteCloser {
+	return &appSyncRealtimeConn{ReadWriteCloser: upstream, appSync: a}
+}
+
+// authorizeStart returns the start message of a subscription, a JSON object
+// such as {"id":"1","type":"start","payload":{"data":"{...}"}}, with the
+// authorization of its data in its extensions, nil for the other messages.
+func (a *appSyncRealtime) authorizeStart(message []byte) ([]byte, error) {
+	var start struct {
+		Type    string                     `json:"type"`
+		Payload map[string]json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(message, &start); err != nil || start.Type != "start" {
+		return nil, nil
+	}
+	var data string
+	if err := json.Unmarshal(start.Payload["data"], &data); err != nil {
+		return nil, fmt.Errorf("invalid data in the start message of the subscription: %w", err)
+	}
+
+	auth, err := a.authorization("/graphql", data)
+	if err != nil {
+		return nil, err
+	}
+	extensions, err := json.Marshal(map[string]any{"authorization": auth})
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return nil, err
+	}
+	start.Payload["extensions"] = extensions
+	if fields["payload"], err = json.Marshal(start.Payload); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// appSyncRealtimeConn is the upgraded connection to the realtime endpoint of
+// an AppSync API. The frames written to it, by the client, are buffered until
+// complete to authorize the start messages. The other frames, and the
+// fragmented or compressed messages, are written as they are.
+type appSyncRealtimeConn struct {
+	io.ReadWriteCloser
+	appSync *appSyncRealtime
+	buf     []byte
+}
+
+func (c *appSyncRealtimeConn) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	for {
+		frame, n, err := parseClientFrame(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return len(p), nil
+		}
+
+		out := c.buf[:n]
+		if frame.unfragmentedText() {
+			message, err := c.appSync.authorizeStart(frame.payload)
+			if err != nil {
+				return 0, err
+			}
+			if message != nil {
+				out = frame.withPayload(message)
+			}
+		}
+		if _, err := c.ReadWriteCloser.Write(out); err != nil {
+			return 0, err
+		}
+		c.buf = c.buf[n:]
+	}
+}
+
+// clientFrame is a WebSocket frame sent by a client, see RFC 6455 section
+// 5.2, whose payload is unmasked.
+type clientFrame struct {
+	header  byte
+	maskKey [4]byte
+	payload []byte
+}
+
+// unfragmentedText reports whether the frame is a whole, uncompressed, text
+// message.
+func (f *clientFrame) unfragmentedText() bool {
+	// FIN, no RSV bits, text opcode.
+	return f.header == 0x81
+}
+
+// withPayload returns the frame with payload, masked with the key of f.
+func (f *clientFrame) withPayload(payload []byte) []byte {
+	frame := []byte{f.header}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 0x80|127), uint64(n))
+	}
+	frame = append(frame, f.maskKey[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^f.maskKey[i%4])
+	}
+	return frame
+}
+
+// parseClientFrame parses the first frame of b, n is the size of the frame,
+// zero when b does not hold the whole frame yet.
+func parseClientFrame(b []byte) (frame *clientFrame, n int, err error) {
+	if len(b) < 2 {
+		return nil, 0, nil
+	}
+	if b[1]&0x80 == 0 {
+		return nil, 0, errors.New("websocket client sent an unmasked frame")
+	}
+	size, n := uint64(b[1]&0x7f), 2
+	switch size {
+	case 126:
+		if len(b) < n+2 {
+			return nil, 0, nil
+		}
+		size, n = uint64(binary.BigEndian.Uint16(b[n:])), n+2
+	case 127:
+		if len(b) < n+8 {
+			return nil, 0, nil
+		}
+		size, n = binary.BigEndian.Uint64(b[n:]), n+8
+	}
+	if size > webSocketReadLimit {
+		return nil, 0, fmt.Errorf("websocket client sent a frame of %d bytes, more than %d", size, webSocketReadLimit)
+	}
+	if uint64(len(b)) < uint64(n)+4+size {
+		return nil, 0, nil
+	}
+
+	frame = &clientFrame{header: b[0], payload: make([]byte, size)}
+	n += copy(frame.maskKey[:], b[n:])
+	for i := range frame.payload {
+		frame.payload[i] = b[n+i] ^ frame.maskKey[i%4]
+	}
+	return frame, n + int(size), nil
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppSyncRealtime(t *testing.T) {
+	var connectHeader, connectPayload string
+	conn := dialWebSocketThroughProxy(t, "abc123.appsync-realtime-api.us-east-1.amazonaws.com", "/graphql?header=e30%3D&payload=e30%3D", func(w http.ResponseWriter, r *http.Request) {
+		connectHeader, connectPayload = r.URL.Query().Get("header"), r.URL.Query().Get("payload")
+		upstream, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		for {
+			messageType, message, err := upstream.ReadMessage()
+			if err != nil {
+				return
+			}
+			upstream.WriteMessage(messageType, message)
+		}
+	})
+
+	assertAuthorization := func(auth map[string]string) {
+		assert.Equal(t, "abc123.appsync-api.us-east-1.amazonaws.com", auth["host"])
+		assert.Equal(t, "amz-1.0", auth["content-encoding"])
+		assert.NotEmpty(t, auth["x-amz-date"])
+		assert.Contains(t, auth["Authorization"], "Credential=AKID/")
+		assert.Contains(t, auth["Authorization"], "/us-east-1/appsync/aws4_request")
+	}
+
+	var auth map[string]string
+	header, err := base64.StdEncoding.DecodeString(connectHeader)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(header, &auth))
+	assertAuthorization(auth)
+	assert.Equal(t, "e30=", connectPayload)
+
+	init := `{"type":"connection_init"}`
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(init)))
+	_, message, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, init, string(message))
+
+	data := `{"query":"subscription { onCreateTodo { id } }","variables":{}}`
+	start, _ := json.Marshal(map[string]any{"id": "1", "type": "start", "payload": map[string]any{"data": data, "extensions": map[string]any{}}})
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, start))
+	_, message, err = conn.ReadMessage()
+	assert.NoError(t, err)
+
+	var authorized struct {
+		ID      string `json:"id"`
+		Type    string `json:"type"`
+		Payload struct {
+			Data       string `json:"data"`
+			Extensions struct {
+				Authorization map[string]string `json:"authorization"`
+			} `json:"extensions"`
+		} `json:"payload"`
+	}
+	assert.NoError(t, json.Unmarshal(message, &authorized))
+	assert.Equal(t, "1", authorized.ID)
+	assert.Equal(t, "start", authorized.Type)
+	assert.Equal(t, data, authorized.Payload.Data)
+	assertAuthorization(authorized.Payload.Extensions.Authorization)
+}
+
+func TestNewAppSyncRealtime(t *testing.T) {
+	upgrade := http.Header{"Connection": []string{"Upgrade"}, "Upgrade": []string{"websocket"}}
+	tests := []struct {
+		host     string
+		header   http.Header
+		wantHost string
+	}{
+		{host: "abc123.appsync-realtime-api.us-east-1.amazonaws.com", header: upgrade, wantHost: "abc123.appsync-api.us-east-1.amazonaws.com"},
+		{host: "abc123.appsync-realtime-api.cn-north-1.amazonaws.com.cn", header: upgrade, wantHost: "abc123.appsync-api.cn-north-1.amazonaws.com.cn"},
+		{host: "abc123.appsync-realtime-api.us-east-1.amazonaws.com", header: http.Header{}},
+		{host: "abc123.appsync-api.us-east-1.amazonaws.com", header: upgrade},
+		{host: "appsync-realtime-api.us-east-1.amazonaws.com", header: upgrade},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			appSync := newAppSyncRealtime(&http.Request{Header: tt.header}, tt.host, nil, "us-east-1")
+			if tt.wantHost == "" {
+				assert.Nil(t, appSync)
+			} else if assert.NotNil(t, appSync) {
+				assert.Equal(t, tt.wantHost, appSync.host)
+			}
+		})
+	}
+}
+
+func TestParseClientFrame(t *testing.T) {
+	frame := &clientFrame{header: 0x81, maskKey: [4]byte{1, 2, 3, 4}}
+	for _, size := range []int{5, 200, 70000} {
+		payload := []byte(strings.Repeat("x", size))
+		b := frame.withPayload(payload)
+
+		parsed, n, err := parseClientFrame(b[:len(b)-1])
+		assert.NoError(t, err)
+		assert.Zero(t, n)
+		assert.Nil(t, parsed)
+
+		parsed, n, err = parseClientFrame(append(b, 0x88))
+		assert.NoError(t, err)
+		assert.Equal(t, len(b), n)
+		if assert.NotNil(t, parsed) {
+			assert.True(t, parsed.unfragmentedText())
+			assert.Equal(t, payload, parsed.payload)
+		}
+	}
+
+	_, _, err := parseClientFrame([]byte{0x81, 0x05, 'h', 'e', 'l', 'l', 'o'})
+	assert.EqualError(t, err, "websocket client sent an unmasked frame")
+}
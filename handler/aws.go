@@ -15,53 +15,278 @@
 
 package handler
 
+//go:generate go run ./internal/genendpoints -output endpoints_gen.go
+
 import (
 	"fmt"
+	"net"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 )
 
-var services = map[string]endpoints.ResolvedEndpoint{}
+// generatedEndpoint is an endpoint of the SDK model resolved at generation
+// time, see endpoints_gen.go. Its URL is always https://<host>.
+type generatedEndpoint struct {
+	PartitionID        string
+	SigningRegion      string
+	SigningName        string
+	SigningMethod      string
+	SigningNameDerived bool
+}
+
+// synthesizedHosts are the hosts, by the format of their name, of the
+// regional endpoints the SDK model does not know about, or gets wrong for
+// proxying, and the signing names of the services they serve. The formats
+// take the region and the DNS suffix of the partition.
+var synthesizedHosts = map[string]string{
+	"execute-api.%s.%s":    "execute-api",
+	"%s.es.%s":             "es",
+	"aps.%s.%s":            "aps",
+	"aps-workspaces.%s.%s": "aps",
+}
+
+// defaultPartitions are the partitions of the SDK model.
+var defaultPartitions = endpoints.DefaultPartitions()
+
+// synthesizedDomains are the domains, by the format of their name like
+// synthesizedHosts, whose subdomains are the endpoints of the resources of a
+// service, e.g. the collections of OpenSearch Serverless at
+// <id>.us-east-1.aoss.amazonaws.com, the pipelines of OpenSearch Ingestion,
+// the GraphQL APIs of AppSync, or the S3 access points.
+var synthesizedDomains = map[string]string{
+	"%s.es.%s":                   "es",
+	"%s.aoss.%s":                 "aoss",
+	"%s.osis.%s":                 "osis",
+	"appsync-api.%s.%s":          "appsync",
+	"appsync-realtime-api.%s.%s": "appsync",
+	// The access points of S3, named after their account, are signed for S3.
+	"s3-accesspoint.%s.%s":                "s3",
+	"s3-accesspoint.dualstack.%s.%s":      "s3",
+	"s3-accesspoint-fips.%s.%s":           "s3",
+	"s3-accesspoint-fips.dualstack.%s.%s": "s3",
+	"s3-object-lambda.%s.%s":              "s3-object-lambda",
+	"s3-object-lambda-fips.%s.%s":         "s3-object-lambda",
+	// The clusters and instances of Neptune, with the ID of the cluster or
+	// of the account before the region.
+	"%s.neptune.%s": "neptune-db",
+	// The data endpoints of IoT Core, e.g. abc123-ats.iot.us-east-1.amazonaws.com.
+	"iot.%s.%s": "iotdevicegateway",
+}
+
+var (
+	servicesOnce sync.Once
+	// services overlays the generated endpoints with the synthesizedHosts of
+	// the regions of the partitions, and domains the parents of the hosts of
+	// the synthesizedDomains, built on first use.
+	services map[string]endpoints.ResolvedEndpoint
+	domains  map[string]endpoints.ResolvedEndpoint
+	// partitions are the IDs of the partitions the built-in endpoints are
+	// limited to by LimitPartitions, all when nil.
+	partitions map[string]bool
+)
+
+// LimitPartitions limits the built-in endpoints to the partitions with the
+// given IDs, e.g. aws or aws-us-gov, so the hosts of the other partitions are
+// neither synthesized nor detected. It must be called before any request is
+// proxied.
+func LimitPartitions(ids []string) error {
+	known := map[string]bool{}
+	var names []string
+	for _, partition := range defaultPartitions {
+		known[partition.ID()] = true
+		names = append(names, partition.ID())
+	}
+	limited := map[string]bool{}
+	for _, id := range ids {
+		if !known[id] {
+			return fmt.Errorf("unknown partition %q, expected one of %s", id, strings.Join(names, ", "))
+		}
+		limited[id] = true
+	}
+	partitions = limited
+	return nil
+}
+
+// partitionAllowed returns whether the endpoints of the partition with the
+// ID are detected.
+func partitionAllowed(id string) bool {
+	return partitions == nil || partitions[id]
+}
 
-func init() {
-	// Triple nested loop - 😭
-	for _, partition := range endpoints.DefaultPartitions() {
+// synthesizeServices returns the endpoints of the synthesizedHosts, and of
+// the synthesizedDomains, in the regions of the partitions allowed.
+func synthesizeServices() (hosts, domains map[string]endpoints.ResolvedEndpoint) {
+	return synthesizeEndpoints(synthesizedHosts), synthesizeEndpoints(synthesizedDomains)
+}
 
-		for _, service := range partition.Services() {
-			for _, endpoint := range service.Endpoints() {
-				resolvedEndpoint, _ := endpoint.ResolveEndpoint()
-				host := strings.Replace(resolvedEndpoint.URL, "https://", "", 1)
-				services[host] = resolvedEndpoint
+// synthesizeEndpoints returns the endpoints of the hosts of formats, by the
+// format of the name of the host, in the regions of the partitions allowed.
+func synthesizeEndpoints(formats map[string]string) map[string]endpoints.ResolvedEndpoint {
+	synthesized := map[string]endpoints.ResolvedEndpoint{}
+	for _, partition := range defaultPartitions {
+		if !partitionAllowed(partition.ID()) {
+			continue
+		}
+		for region := range partition.Regions() {
+			for format, signingName := range formats {
+				host := fmt.Sprintf(format, region, partition.DNSSuffix())
+				synthesized[host] = endpoints.ResolvedEndpoint{URL: "https://" + host, SigningMethod: "v4", SigningRegion: region, SigningName: signingName, PartitionID: partition.ID()}
 			}
 		}
 	}
+	return synthesized
+}
+
+// globalRegions are the regions requests to the global pseudo-region of each
+// partition are signed for.
+var globalRegions = map[string]string{
+	"aws-global":        "us-east-1",
+	"aws-cn-global":     "cn-north-1",
+	"aws-us-gov-global": "us-gov-west-1",
+	"aws-iso-global":    "us-iso-east-1",
+	"aws-iso-b-global":  "us-isob-east-1",
+	"aws-iso-e-global":  "eu-isoe-west-1",
+	"aws-iso-f-global":  "us-isof-south-1",
+}
 
-	// Add api gateway endpoints
-	for region := range endpoints.AwsPartition().Regions() {
-		host := fmt.Sprintf("execute-api.%s.amazonaws.com", region)
-		services[host] = endpoints.ResolvedEndpoint{URL: fmt.Sprintf("https://%s", host), SigningMethod: "v4", SigningRegion: region, SigningName: "execute-api", PartitionID: "aws"}
+// signingRegion maps the pseudo-regions of the endpoints model, like
+// aws-global, fips-us-east-1 or us-east-1-fips, to the region requests must
+// be signed for. Other regions are returned unchanged.
+func signingRegion(region string) string {
+	if global, ok := globalRegions[region]; ok {
+		return global
 	}
-	// Add elasticsearch endpoints
-	for region := range endpoints.AwsPartition().Regions() {
-		host := fmt.Sprintf("%s.es.amazonaws.com", region)
-		services[host] = endpoints.ResolvedEndpoint{URL: fmt.Sprintf("https://%s", host), SigningMethod: "v4", SigningRegion: region, SigningName: "es", PartitionID: "aws"}
+	if strings.HasPrefix(region, "fips-") {
+		return strings.TrimPrefix(region, "fips-")
 	}
-	// Add managed prometheus + workspace endpoints
-	for region := range endpoints.AwsPartition().Regions() {
-		hostAps := fmt.Sprintf("aps.%s.amazonaws.com", region)
-		services[hostAps] = endpoints.ResolvedEndpoint{URL: fmt.Sprintf("https://%s", hostAps), SigningMethod: "v4", SigningRegion: region, SigningName: "aps", PartitionID: "aws"}
-
-		hostApsws := fmt.Sprintf("aps-workspaces.%s.amazonaws.com", region)
-		services[hostApsws] = endpoints.ResolvedEndpoint{URL: fmt.Sprintf("https://%s", hostApsws), SigningMethod: "v4", SigningRegion: region, SigningName: "aps", PartitionID: "aws"}
+	if strings.HasSuffix(region, "-fips") {
+		return strings.TrimSuffix(region, "-fips")
 	}
+	return region
 }
 
 func determineAWSServiceFromHost(host string) *endpoints.ResolvedEndpoint {
-	for endpoint, service := range services {
-		if host == endpoint {
+	host = normalizeHost(host, "")
+	if service, ok := fileEndpoints[host]; ok {
+		service.SigningRegion = signingRegion(service.SigningRegion)
+		return &service
+	}
+	if builtinEndpointsReplaced {
+		return nil
+	}
+	service := builtinService(host)
+	if service == nil || !partitionAllowed(service.PartitionID) {
+		return nil
+	}
+	return service
+}
+
+// builtinService returns the service of host in the built-in endpoints, nil
+// when it is unknown.
+func builtinService(host string) *endpoints.ResolvedEndpoint {
+	servicesOnce.Do(func() { services, domains = synthesizeServices() })
+	if service, ok := services[host]; ok {
+		service.SigningRegion = signingRegion(service.SigningRegion)
+		return &service
+	}
+	if e, ok := generatedEndpoints[host]; ok {
+		return &endpoints.ResolvedEndpoint{
+			URL:                "https://" + host,
+			PartitionID:        e.PartitionID,
+			SigningRegion:      signingRegion(e.SigningRegion),
+			SigningName:        e.SigningName,
+			SigningNameDerived: e.SigningNameDerived,
+			SigningMethod:      e.SigningMethod,
+		}
+	}
+	if service := domainService(host); service != nil {
+		return service
+	}
+	if service := determineLatticeService(host); service != nil {
+		return service
+	}
+	if service := determineVPCEndpointService(host); service != nil {
+		return service
+	}
+	return deriveServiceFromHost(host)
+}
+
+// domainService returns the service of host when it is a subdomain of one of
+// the synthesizedDomains, on any port, e.g. the 8182 of Neptune clusters at
+// my-cluster.cluster-abc123.us-east-1.neptune.amazonaws.com.
+func domainService(host string) *endpoints.ResolvedEndpoint {
+	name := host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		name = hostname
+	}
+	for {
+		var ok bool
+		if _, name, ok = strings.Cut(name, "."); !ok {
+			return nil
+		}
+		if service, ok := domains[name]; ok {
+			service.URL = "https://" + host
+			service.SigningRegion = signingRegion(service.SigningRegion)
 			return &service
 		}
 	}
-	return nil
+}
+
+// defaultPorts are the default ports of the schemes of the upstream URLs.
+var defaultPorts = map[string]string{"https": "443", "http": "80"}
+
+// normalizeHost lowercases host, as sent by a client, and removes its default
+// port for scheme, or for any scheme when it is empty, e.g. the :443 some load
+// balancers add, which the endpoints do not have.
+func normalizeHost(host, scheme string) string {
+	host = strings.ToLower(host)
+	i := strings.LastIndexByte(host, ':')
+	if i <= strings.LastIndexByte(host, ']') {
+		return host
+	}
+	port := host[i+1:]
+	for s, defaultPort := range defaultPorts {
+		if port == defaultPort && (scheme == "" || scheme == s) {
+			return host[:i]
+		}
+	}
+	return host
+}
+
+// suffixIndex matches the longest of its DNS suffixes a host ends with, so
+// that overlapping suffixes, like .vpce.amazonaws.com and .amazonaws.com,
+// match deterministically, whatever the order of the map they come from.
+type suffixIndex[V any] struct {
+	// suffixes are sorted longest first.
+	suffixes []string
+	values   map[string]V
+}
+
+func newSuffixIndex[V any](values map[string]V) *suffixIndex[V] {
+	suffixes := make([]string, 0, len(values))
+	for suffix := range values {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Slice(suffixes, func(i, j int) bool {
+		if len(suffixes[i]) != len(suffixes[j]) {
+			return len(suffixes[i]) > len(suffixes[j])
+		}
+		return suffixes[i] < suffixes[j]
+	})
+	return &suffixIndex[V]{suffixes: suffixes, values: values}
+}
+
+// cut returns host without the longest suffix it ends with, and the value of
+// the suffix, false when it ends with none.
+func (x *suffixIndex[V]) cut(host string) (string, V, bool) {
+	for _, suffix := range x.suffixes {
+		if name, ok := strings.CutSuffix(host, suffix); ok {
+			return name, x.values[suffix], true
+		}
+	}
+	var zero V
+	return "", zero, false
 }
@@ -0,0 +1,231 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+func TestDetermineAWSServiceFromHost(t *testing.T) {
+	tests := []struct {
+		host          string
+		signingName   string
+		signingRegion string
+	}{
+		{host: "s3.us-west-2.amazonaws.com", signingName: "s3", signingRegion: "us-west-2"},
+		{host: "s3-fips.us-east-1.amazonaws.com", signingName: "s3", signingRegion: "us-east-1"},
+		{host: "sts-fips.us-west-2.amazonaws.com", signingName: "sts", signingRegion: "us-west-2"},
+		{host: "sts.amazonaws.com", signingName: "sts", signingRegion: "us-east-1"},
+		{host: "iam.amazonaws.com", signingName: "iam", signingRegion: "us-east-1"},
+		{host: "iot-fips.us-east-1.amazonaws.com", signingName: "iot", signingRegion: "us-east-1"},
+		{host: "secretsmanager.us-west-2-fips.amazonaws.com", signingName: "secretsmanager", signingRegion: "us-west-2"},
+		{host: "codecatalyst.global.api.aws", signingName: "codecatalyst", signingRegion: "us-east-1"},
+		{host: "execute-api.eu-west-1.amazonaws.com", signingName: "execute-api", signingRegion: "eu-west-1"},
+		{host: "s3.us-east-1.amazonaws.com:443", signingName: "s3", signingRegion: "us-east-1"},
+		{host: "lambda-fips.us-west-2.amazonaws.com", signingName: "lambda", signingRegion: "us-west-2"},
+		{host: "lambda.eu-west-1.api.aws", signingName: "lambda", signingRegion: "eu-west-1"},
+		{host: "dynamodb-fips.us-east-1.api.aws", signingName: "dynamodb", signingRegion: "us-east-1"},
+		{host: "s3.dualstack.us-west-2.amazonaws.com", signingName: "s3", signingRegion: "us-west-2"},
+		{host: "s3-fips.dualstack.us-west-2.amazonaws.com", signingName: "s3", signingRegion: "us-west-2"},
+		{host: "SQS.EU-WEST-1.amazonaws.com:80", signingName: "sqs", signingRegion: "eu-west-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			service := determineAWSServiceFromHost(tt.host)
+			if assert.NotNil(t, service) {
+				assert.Equal(t, tt.signingName, service.SigningName)
+				assert.Equal(t, tt.signingRegion, service.SigningRegion)
+			}
+		})
+	}
+
+	assert.Nil(t, determineAWSServiceFromHost("example.com"))
+	assert.Nil(t, determineAWSServiceFromHost(""))
+	assert.Nil(t, determineAWSServiceFromHost(":443"))
+}
+
+func TestSigningRegion(t *testing.T) {
+	tests := map[string]string{
+		"us-east-1":          "us-east-1",
+		"aws-global":         "us-east-1",
+		"aws-us-gov-global":  "us-gov-west-1",
+		"aws-cn-global":      "cn-north-1",
+		"fips-us-gov-west-1": "us-gov-west-1",
+		"us-east-2-fips":     "us-east-2",
+		"":                   "",
+	}
+
+	for region, want := range tests {
+		assert.Equal(t, want, signingRegion(region), region)
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host   string
+		scheme string
+		want   string
+	}{
+		{host: "S3.us-east-1.amazonaws.com", want: "s3.us-east-1.amazonaws.com"},
+		{host: "s3.us-east-1.amazonaws.com:443", want: "s3.us-east-1.amazonaws.com"},
+		{host: "s3.us-east-1.amazonaws.com:80", want: "s3.us-east-1.amazonaws.com"},
+		{host: "s3.us-east-1.amazonaws.com:443", scheme: "https", want: "s3.us-east-1.amazonaws.com"},
+		{host: "s3.us-east-1.amazonaws.com:443", scheme: "http", want: "s3.us-east-1.amazonaws.com:443"},
+		{host: "localhost:4566", want: "localhost:4566"},
+		{host: "[::1]:443", scheme: "https", want: "[::1]"},
+		{host: "[::443]", want: "[::443]"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, normalizeHost(tt.host, tt.scheme), tt.host+" "+tt.scheme)
+	}
+}
+
+func TestSuffixIndex(t *testing.T) {
+	index := newSuffixIndex(map[string]string{
+		".amazonaws.com":      "public",
+		".vpce.amazonaws.com": "vpce",
+		".com":                "com",
+	})
+
+	for i := 0; i < 10; i++ {
+		name, value, ok := index.cut("vpce-123.sqs.us-east-1.vpce.amazonaws.com")
+		assert.True(t, ok)
+		assert.Equal(t, "vpce-123.sqs.us-east-1", name)
+		assert.Equal(t, "vpce", value)
+	}
+
+	name, value, ok := index.cut("sqs.us-east-1.amazonaws.com")
+	assert.Equal(t, []any{"sqs.us-east-1", "public", true}, []any{name, value, ok})
+
+	_, _, ok = index.cut("example.org")
+	assert.False(t, ok)
+}
+
+func BenchmarkDetermineAWSServiceFromHost(b *testing.B) {
+	for _, host := range []string{
+		"s3.us-west-2.amazonaws.com",
+		"execute-api.eu-west-1.amazonaws.com",
+		"S3.US-EAST-1.amazonaws.com:443",
+		"bucket.vpce-0abc123-xyz.s3.us-west-2.vpce.amazonaws.com",
+		"newservice.us-east-1.amazonaws.com",
+		"example.com",
+	} {
+		b.Run(host, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				determineAWSServiceFromHost(host)
+			}
+		})
+	}
+}
+
+func TestDetermineAWSServiceFromHost_Partitions(t *testing.T) {
+	tests := []struct {
+		host          string
+		partition     string
+		signingName   string
+		signingRegion string
+	}{
+		{host: "execute-api.cn-north-1.amazonaws.com.cn", partition: "aws-cn", signingName: "execute-api", signingRegion: "cn-north-1"},
+		{host: "cn-northwest-1.es.amazonaws.com.cn", partition: "aws-cn", signingName: "es", signingRegion: "cn-northwest-1"},
+		{host: "execute-api.us-gov-west-1.amazonaws.com", partition: "aws-us-gov", signingName: "execute-api", signingRegion: "us-gov-west-1"},
+		{host: "aps-workspaces.us-gov-east-1.amazonaws.com", partition: "aws-us-gov", signingName: "aps", signingRegion: "us-gov-east-1"},
+		{host: "execute-api.us-iso-east-1.c2s.ic.gov", partition: "aws-iso", signingName: "execute-api", signingRegion: "us-iso-east-1"},
+		{host: "us-isob-east-1.es.sc2s.sgov.gov", partition: "aws-iso-b", signingName: "es", signingRegion: "us-isob-east-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			service := determineAWSServiceFromHost(tt.host)
+			if assert.NotNil(t, service) {
+				assert.Equal(t, tt.partition, service.PartitionID)
+				assert.Equal(t, tt.signingName, service.SigningName)
+				assert.Equal(t, tt.signingRegion, service.SigningRegion)
+			}
+		})
+	}
+}
+
+func TestDetermineAWSServiceFromHost_Domains(t *testing.T) {
+	defer func() { hostHeuristicsDisabled = false }()
+	DisableHostHeuristics()
+
+	tests := []struct {
+		host          string
+		partition     string
+		signingName   string
+		signingRegion string
+	}{
+		{host: "abc123def456.us-east-1.aoss.amazonaws.com", partition: "aws", signingName: "aoss", signingRegion: "us-east-1"},
+		{host: "abc123def456.us-gov-west-1.aoss.amazonaws.com", partition: "aws-us-gov", signingName: "aoss", signingRegion: "us-gov-west-1"},
+		{host: "logs-pipeline-abc123.eu-west-1.osis.amazonaws.com", partition: "aws", signingName: "osis", signingRegion: "eu-west-1"},
+		{host: "search-logs-abc123.eu-west-1.es.amazonaws.com", partition: "aws", signingName: "es", signingRegion: "eu-west-1"},
+		{host: "vpc-logs-abc123.cn-north-1.es.amazonaws.com.cn", partition: "aws-cn", signingName: "es", signingRegion: "cn-north-1"},
+		{host: "abc123.appsync-api.us-east-1.amazonaws.com", partition: "aws", signingName: "appsync", signingRegion: "us-east-1"},
+		{host: "abc123.appsync-realtime-api.eu-west-1.amazonaws.com", partition: "aws", signingName: "appsync", signingRegion: "eu-west-1"},
+		{host: "myap-123456789012.s3-accesspoint.us-east-1.amazonaws.com", partition: "aws", signingName: "s3", signingRegion: "us-east-1"},
+		{host: "myap-123456789012.s3-accesspoint-fips.dualstack.us-gov-west-1.amazonaws.com", partition: "aws-us-gov", signingName: "s3", signingRegion: "us-gov-west-1"},
+		{host: "myap-123456789012.s3-accesspoint.cn-north-1.amazonaws.com.cn", partition: "aws-cn", signingName: "s3", signingRegion: "cn-north-1"},
+		{host: "myol-123456789012.s3-object-lambda.eu-west-1.amazonaws.com", partition: "aws", signingName: "s3-object-lambda", signingRegion: "eu-west-1"},
+		{host: "myol-123456789012.s3-object-lambda-fips.us-east-1.amazonaws.com", partition: "aws", signingName: "s3-object-lambda", signingRegion: "us-east-1"},
+		{host: "graph.cluster-abc123xyz.us-east-1.neptune.amazonaws.com:8182", partition: "aws", signingName: "neptune-db", signingRegion: "us-east-1"},
+		{host: "graph.cluster-ro-abc123xyz.eu-west-1.neptune.amazonaws.com", partition: "aws", signingName: "neptune-db", signingRegion: "eu-west-1"},
+		{host: "graph-instance-1.abc123xyz.cn-north-1.neptune.amazonaws.com.cn:8182", partition: "aws-cn", signingName: "neptune-db", signingRegion: "cn-north-1"},
+		{host: "a1b2c3d4e5f6g7-ats.iot.us-east-1.amazonaws.com", partition: "aws", signingName: "iotdevicegateway", signingRegion: "us-east-1"},
+		{host: "data-ats.iot.us-east-1.amazonaws.com", partition: "aws", signingName: "iotdata", signingRegion: "us-east-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			service := determineAWSServiceFromHost(tt.host)
+			if assert.NotNil(t, service) {
+				assert.Equal(t, "https://"+tt.host, service.URL)
+				assert.Equal(t, tt.partition, service.PartitionID)
+				assert.Equal(t, tt.signingName, service.SigningName)
+				assert.Equal(t, tt.signingRegion, service.SigningRegion)
+			}
+		})
+	}
+
+	assert.Nil(t, determineAWSServiceFromHost("abc123.us-moon-1.aoss.amazonaws.com"))
+}
+
+func TestLimitPartitions(t *testing.T) {
+	resetPartitions := func() {
+		partitions, services, domains, servicesOnce = nil, nil, nil, sync.Once{}
+	}
+	resetPartitions()
+	defer resetPartitions()
+
+	assert.EqualError(t, LimitPartitions([]string{"aws", "aws-moon"}), `unknown partition "aws-moon", expected one of aws, aws-cn, aws-us-gov, aws-iso, aws-iso-b, aws-iso-e, aws-iso-f`)
+	assert.NoError(t, LimitPartitions([]string{"aws-us-gov"}))
+
+	assert.NotNil(t, determineAWSServiceFromHost("execute-api.us-gov-west-1.amazonaws.com"))
+	assert.NotNil(t, determineAWSServiceFromHost("sqs.us-gov-west-1.amazonaws.com"))
+	assert.NotNil(t, determineAWSServiceFromHost("newservice.us-gov-west-1.amazonaws.com"))
+	assert.Nil(t, determineAWSServiceFromHost("execute-api.us-east-1.amazonaws.com"))
+	assert.Nil(t, determineAWSServiceFromHost("sqs.us-east-1.amazonaws.com"))
+	assert.Nil(t, determineAWSServiceFromHost("execute-api.cn-north-1.amazonaws.com.cn"))
+	assert.Len(t, services, len(synthesizedHosts)*len(endpoints.AwsUsGovPartition().Regions()))
+	assert.Len(t, domains, len(synthesizedDomains)*len(endpoints.AwsUsGovPartition().Regions()))
+}
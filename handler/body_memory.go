@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// BodyMemory accounts for the bytes of the request bodies buffered in memory
+// across the requests in flight, and caps them, so that bursts of large
+// bodies are shed with a 503 instead of growing the memory of the proxy until
+// it is killed.
+type BodyMemory struct {
+	// Limit is the most bytes buffered at once, unlimited when zero.
+	Limit int64
+
+	used atomic.Int64
+	shed atomic.Int64
+}
+
+// errBodyMemoryExhausted is returned by the readers of the request bodies
+// when the BodyMemory has no room for their next bytes.
+var errBodyMemoryExhausted = errors.New("request body memory exhausted")
+
+// Used returns the bytes of the request bodies buffered now.
+func (m *BodyMemory) Used() int64 {
+	return m.used.Load()
+}
+
+// Shed returns the number of requests shed for lack of memory.
+func (m *BodyMemory) Shed() int64 {
+	return m.shed.Load()
+}
+
+// reserve accounts for n more bytes, false when they do not fit the limit.
+func (m *BodyMemory) reserve(n int64) bool {
+	for {
+		used := m.used.Load()
+		if m.Limit > 0 && used+n > m.Limit {
+			return false
+		}
+		if m.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// release returns n bytes reserved.
+func (m *BodyMemory) release(n int64) {
+	m.used.Add(-n)
+}
+
+// shedError returns the error rejecting a request shed for lack of memory.
+func (m *BodyMemory) shedError() error {
+	m.shed.Add(1)
+	return &StatusError{StatusCode: http.StatusServiceUnavailable, Err: fmt.Errorf("%w, %d bytes of request bodies are buffered", errBodyMemoryExhausted, m.Limit)}
+}
+
+// reservingReader reserves the bytes it reads from memory, failing with
+// errBodyMemoryExhausted once they do not fit. A nil memory is unlimited and
+// not accounted for.
+type reservingReader struct {
+	io.Reader
+	memory   *BodyMemory
+	reserved int64
+}
+
+func (r *reservingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 && r.memory != nil {
+		if !r.memory.reserve(int64(n)) {
+			return 0, errBodyMemoryExhausted
+		}
+		r.reserved += int64(n)
+	}
+	return n, err
+}
+
+// release returns the bytes reserved by r, once.
+func (r *reservingReader) release() {
+	if r == nil || r.memory == nil {
+		return
+	}
+	r.memory.release(r.reserved)
+	r.reserved = 0
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+func TestProxyClient_BodyMemory(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		chunked       bool
+		inUse         int64
+		maxMemory     int64
+		spill         bool
+		wantStatus    int
+		wantShed      int64
+		wantForwarded bool
+	}{
+		{
+			name:          "body fitting the memory",
+			body:          "0123456789",
+			wantForwarded: true,
+		},
+		{
+			name:       "body larger than the memory",
+			body:       strings.Repeat("x", 20),
+			wantStatus: http.StatusServiceUnavailable,
+			wantShed:   1,
+		},
+		{
+			name:       "chunked body larger than the memory",
+			body:       strings.Repeat("x", 20),
+			chunked:    true,
+			wantStatus: http.StatusServiceUnavailable,
+			wantShed:   1,
+		},
+		{
+			name:       "body larger than the memory left",
+			body:       "0123456789",
+			inUse:      5,
+			wantStatus: http.StatusServiceUnavailable,
+			wantShed:   1,
+		},
+		{
+			name:          "spilled body",
+			body:          strings.Repeat("x", 100),
+			maxMemory:     8,
+			spill:         true,
+			wantForwarded: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := &BodyMemory{Limit: 10}
+			memory.reserve(tt.inUse)
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:               v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+				Client:               client,
+				BodyMemory:           memory,
+				MaxRequestBodyMemory: tt.maxMemory,
+			}
+			if tt.spill {
+				proxyClient.RequestBodySpillDir = t.TempDir()
+			}
+			req := &http.Request{
+				Method:        http.MethodPut,
+				URL:           &url.URL{Path: "/bucket/key"},
+				Host:          "s3.us-east-1.amazonaws.com",
+				Header:        http.Header{},
+				ContentLength: int64(len(tt.body)),
+				Body:          io.NopCloser(strings.NewReader(tt.body)),
+			}
+			if tt.chunked {
+				req.ContentLength, req.TransferEncoding = -1, []string{"chunked"}
+			}
+
+			_, err := proxyClient.Do(req)
+			if tt.wantStatus != 0 {
+				assert.Equal(t, tt.wantStatus, errorStatusCode(err))
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantForwarded, client.Request != nil)
+			assert.Equal(t, tt.inUse, memory.Used(), "memory of the body released")
+			assert.Equal(t, tt.wantShed, memory.Shed())
+		})
+	}
+}
+
+func TestBodyMemory_Reserve(t *testing.T) {
+	memory := &BodyMemory{Limit: 10}
+	assert.True(t, memory.reserve(6))
+	assert.False(t, memory.reserve(5))
+	assert.True(t, memory.reserve(4))
+	memory.release(10)
+	assert.Equal(t, int64(0), memory.Used())
+
+	unlimited := &BodyMemory{}
+	assert.True(t, unlimited.reserve(1<<40))
+}
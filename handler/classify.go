@@ -0,0 +1,192 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClassField is the field the class of a request is set in, see Classifier.
+const ClassField = "class"
+
+// classifierSniffLength is the length of the body prefix classes are matched
+// against, enough for the first action of a bulk request.
+const classifierSniffLength = 4096
+
+// DefaultClassifiedContentTypes are the content types of the bodies a
+// Classifier sniffs by default.
+var DefaultClassifiedContentTypes = []string{"application/json", "application/x-ndjson"}
+
+// ClassRule classifies the requests whose body starts with Pattern.
+type ClassRule struct {
+	Class   string
+	Pattern *regexp.Regexp
+}
+
+// ParseClassRule parses a rule in the <class>=<regexp> format, e.g.
+// bulk=^\s*\{\s*"(index|create|update|delete)"\s*: for OpenSearch bulk
+// requests.
+func ParseClassRule(s string) (ClassRule, error) {
+	class, expression, ok := strings.Cut(s, "=")
+	if !ok || class == "" || expression == "" {
+		return ClassRule{}, fmt.Errorf("invalid class rule %q, expected <class>=<regexp>", s)
+	}
+	pattern, err := regexp.Compile(expression)
+	if err != nil {
+		return ClassRule{}, fmt.Errorf("invalid class rule %q: %w", s, err)
+	}
+	return ClassRule{Class: class, Pattern: pattern}, nil
+}
+
+// Classifier sorts requests into classes, such as OpenSearch bulk indexing
+// and queries sent to the same path, by matching the beginning of their body
+// against rules. The class is set in the ClassField field of the RequestInfo,
+// which breaks the statistics and logs down by class, and is used by the
+// ClassRateLimit policy.
+type Classifier struct {
+	// Rules are matched in order, the first matching rule classifies the
+	// request.
+	Rules []ClassRule
+	// ContentTypes are the content types of the bodies sniffed, the other
+	// requests are not classified.
+	ContentTypes []string
+}
+
+// classify sets the class of r in info, restoring the sniffed body of r.
+func (c *Classifier) classify(r *http.Request, info *RequestInfo) {
+	if r.Body == nil || r.Body == http.NoBody || !c.sniffed(r.Header.Get("Content-Type")) {
+		return
+	}
+
+	prefix := make([]byte, classifierSniffLength)
+	n, _ := io.ReadFull(r.Body, prefix)
+	prefix = prefix[:n]
+	// Read errors surface when the rest of the body is read.
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), r.Body), r.Body}
+
+	for _, rule := range c.Rules {
+		if rule.Pattern.Match(prefix) {
+			if info.Fields == nil {
+				info.Fields = map[string]string{}
+			}
+			info.Fields[ClassField] = rule.Class
+			return
+		}
+	}
+}
+
+func (c *Classifier) sniffed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.ContentTypes {
+		if strings.EqualFold(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClassRateLimit is a Policy limiting the rate of the requests of a class,
+// e.g. to throttle bulk indexing without throttling queries. Requests above
+// the rate are rejected with a 429.
+type ClassRateLimit struct {
+	Class string
+	// Rate is the sustained rate in requests per second, Burst the number of
+	// requests allowed at once, Rate when zero.
+	Rate  float64
+	Burst float64
+	// MaxWait is how long requests above the rate wait for a token before
+	// being rejected, rejected right away when zero.
+	MaxWait time.Duration
+
+	now    func() time.Time
+	mu     sync.Mutex
+	bucket tokenBucket
+}
+
+// ParseClassRateLimit parses a limit in the <class>=<requests per second>
+// format.
+func ParseClassRateLimit(s string) (*ClassRateLimit, error) {
+	class, value, ok := strings.Cut(s, "=")
+	rate, err := strconv.ParseFloat(value, 64)
+	if !ok || class == "" || err != nil || rate <= 0 || math.IsInf(rate, 0) {
+		return nil, fmt.Errorf("invalid class rate limit %q, expected <class>=<requests per second>", s)
+	}
+	return &ClassRateLimit{Class: class, Rate: rate}, nil
+}
+
+func (l *ClassRateLimit) Name() string {
+	return "class-rate-limit"
+}
+
+func (l *ClassRateLimit) Check(r *http.Request) *Rejection {
+	return l.check(r, true)
+}
+
+func (l *ClassRateLimit) Preview(r *http.Request) *Rejection {
+	return l.check(r, false)
+}
+
+// check rejects r when no token is left within MaxWait, and otherwise takes
+// one, waiting for it, when take is set.
+func (l *ClassRateLimit) check(r *http.Request, take bool) *Rejection {
+	info := RequestInfoFromContext(r.Context())
+	if info == nil || info.Fields[ClassField] != l.Class {
+		return nil
+	}
+
+	burst := rateLimitBurst(l.Rate, l.Burst)
+	now := l.currentTime()
+
+	l.mu.Lock()
+	wait, ok := l.bucket.reserve(l.Rate, burst, now, l.MaxWait, take)
+	tokens := l.bucket.available(l.Rate, burst, now)
+	l.mu.Unlock()
+
+	if ok && !take {
+		return nil
+	}
+	if ok {
+		return waitToken(r, wait)
+	}
+	return &Rejection{
+		StatusCode: http.StatusTooManyRequests,
+		Message:    fmt.Sprintf("rate limit of %g %s requests per second exceeded", l.Rate, l.Class),
+		Header:     http.Header{"Retry-After": []string{retryAfterTokens(tokens, l.Rate)}},
+	}
+}
+
+func (l *ClassRateLimit) currentTime() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const bulkRule = `bulk=^\s*\{\s*"(index|create|update|delete)"\s*:`
+
+func newTestClassifier(t *testing.T, rules ...string) *Classifier {
+	c := &Classifier{ContentTypes: DefaultClassifiedContentTypes}
+	for _, r := range rules {
+		rule, err := ParseClassRule(r)
+		assert.NoError(t, err)
+		c.Rules = append(c.Rules, rule)
+	}
+	return c
+}
+
+func TestClassifier(t *testing.T) {
+	classifier := newTestClassifier(t, bulkRule, `search=^\s*\{\s*"(query|aggs|size)"`)
+	large := `{"index":{"_index":"logs"}}` + "\n" + `{"message":"` + strings.Repeat("a", 2*classifierSniffLength) + `"}` + "\n"
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{name: "bulk", contentType: "application/x-ndjson", body: `{"index":{"_index":"logs"}}` + "\n" + `{"message":"a"}` + "\n", want: "bulk"},
+		{name: "bulk with charset", contentType: "application/json; charset=utf-8", body: ` { "delete" : {"_id":"1"}}` + "\n", want: "bulk"},
+		{name: "large bulk", contentType: "application/x-ndjson", body: large, want: "bulk"},
+		{name: "search", contentType: "application/json", body: `{"query":{"match_all":{}}}`, want: "search"},
+		{name: "unmatched", contentType: "application/json", body: `{"settings":{}}`},
+		{name: "other content type", contentType: "text/plain", body: `{"index":{}}`},
+		{name: "empty body", contentType: "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/_bulk", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			info := &RequestInfo{}
+			classifier.classify(r, info)
+
+			assert.Equal(t, tt.want, info.Fields[ClassField])
+			body, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.body, string(body), "the sniffed body is restored")
+		})
+	}
+}
+
+func TestParseClassRule(t *testing.T) {
+	rule, err := ParseClassRule(`bulk=^{"index"=`)
+	assert.NoError(t, err)
+	assert.Equal(t, "bulk", rule.Class)
+	assert.Equal(t, `^{"index"=`, rule.Pattern.String())
+
+	for _, s := range []string{"bulk", "=^a", "bulk=", "bulk=("} {
+		_, err := ParseClassRule(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestClassRateLimit(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limit, err := ParseClassRateLimit("bulk=2")
+	assert.NoError(t, err)
+	limit.now = func() time.Time { return now }
+
+	request := func(class string) *http.Request {
+		info := &RequestInfo{}
+		if class != "" {
+			info.Fields = map[string]string{ClassField: class}
+		}
+		return WithRequestInfo(httptest.NewRequest(http.MethodPost, "/", nil), info)
+	}
+
+	// The burst is the rate, previews take no token.
+	assert.Nil(t, limit.Check(request("bulk")))
+	assert.Nil(t, limit.Preview(request("bulk")))
+	assert.Nil(t, limit.Check(request("bulk")))
+	assert.NotNil(t, limit.Preview(request("bulk")))
+	rejection := limit.Check(request("bulk"))
+	if assert.NotNil(t, rejection) {
+		assert.Equal(t, http.StatusTooManyRequests, rejection.StatusCode)
+		assert.Equal(t, "1", rejection.Header.Get("Retry-After"))
+		assert.Equal(t, "rate limit of 2 bulk requests per second exceeded", rejection.Message)
+	}
+
+	// Other classes are not limited.
+	assert.Nil(t, limit.Check(request("search")))
+	assert.Nil(t, limit.Check(request("")))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.Nil(t, limit.Check(request("bulk")))
+	assert.NotNil(t, limit.Check(request("bulk")))
+
+	for _, s := range []string{"bulk", "bulk=0", "bulk=-1", "=1", "bulk=fast"} {
+		_, err := ParseClassRateLimit(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestHandler_ClassRateLimit(t *testing.T) {
+	limit, _ := ParseClassRateLimit("bulk=1")
+	h := &Handler{
+		ProxyClient: clientFunc(func(req *http.Request) (*http.Response, error) {
+			body, _ := io.ReadAll(req.Body)
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(string(body)))}, nil
+		}),
+		Classifier: newTestClassifier(t, bulkRule),
+		Policies:   []Policy{limit},
+		Stats:      NewStats(),
+	}
+
+	serve := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-ndjson")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	bulk := `{"create":{"_index":"logs"}}` + "\n" + `{"message":"a"}` + "\n"
+	w := serve(bulk)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, bulk, w.Body.String())
+	assert.Equal(t, http.StatusTooManyRequests, serve(bulk).Code)
+	assert.Equal(t, http.StatusOK, serve(`{"query":{"match_all":{}}}`).Code)
+
+	fields := h.Stats.Fields()
+	if assert.Len(t, fields, 1) {
+		assert.Equal(t, "unknown class=bulk", fields[0].Route)
+		assert.Equal(t, int64(2), fields[0].Requests)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The identities of a client certificate a ClientCertHeader forwards.
+const (
+	// ClientCertSubject is the distinguished name of the subject of the
+	// certificate, e.g. CN=payments,OU=Platform,O=Example.
+	ClientCertSubject = "subject"
+	// ClientCertSAN is the comma separated subject alternative names of the
+	// certificate: URIs, such as SPIFFE IDs, DNS names, email and IP
+	// addresses.
+	ClientCertSAN = "san"
+)
+
+// ClientCertHeader forwards the identity of the verified certificate of the
+// clients connected with mutual TLS in a header, set before the requests are
+// signed, so that the upstreams can authorize the original callers. The
+// header of the clients with the same name is always removed, so that it
+// cannot be forged by the clients connecting without a certificate.
+type ClientCertHeader struct {
+	Name     string
+	Identity string
+}
+
+// NewClientCertHeader returns the ClientCertHeader forwarding identity,
+// ClientCertSubject or ClientCertSAN, in the header name. The headers of the
+// signature cannot be set.
+func NewClientCertHeader(name, identity string) (*ClientCertHeader, error) {
+	if !validHeaderName(name) {
+		return nil, fmt.Errorf("invalid client certificate header name %q", name)
+	}
+	canonical := http.CanonicalHeaderKey(name)
+	if canonical == "Host" || canonical == "Authorization" || strings.HasPrefix(canonical, "X-Amz-") {
+		return nil, fmt.Errorf("client certificate header %s is set by the signature", canonical)
+	}
+	if identity != ClientCertSubject && identity != ClientCertSAN {
+		return nil, fmt.Errorf("unknown client certificate identity %q, expected subject or san", identity)
+	}
+	return &ClientCertHeader{Name: canonical, Identity: identity}, nil
+}
+
+// value returns the identity of the verified certificate of the client of
+// req, "" without one.
+func (h *ClientCertHeader) value(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+
+	value := cert.Subject.String()
+	if h.Identity == ClientCertSAN {
+		var names []string
+		for _, u := range cert.URIs {
+			names = append(names, u.String())
+		}
+		names = append(names, cert.DNSNames...)
+		names = append(names, cert.EmailAddresses...)
+		for _, ip := range cert.IPAddresses {
+			names = append(names, ip.String())
+		}
+		value = strings.Join(names, ",")
+	}
+	if strings.IndexFunc(value, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+		log.WithField("subject", cert.Subject.String()).Warn("client certificate identity has control characters, not forwarded")
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/awslabs/aws-sigv4-proxy/sigv4verifier"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewClientCertHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		identity string
+		want     *ClientCertHeader
+		wantErr  string
+	}{
+		{
+			name:     "subject",
+			header:   "x-client-subject",
+			identity: ClientCertSubject,
+			want:     &ClientCertHeader{Name: "X-Client-Subject", Identity: ClientCertSubject},
+		},
+		{
+			name:     "invalid name",
+			header:   "X Client",
+			identity: ClientCertSAN,
+			wantErr:  `invalid client certificate header name "X Client"`,
+		},
+		{
+			name:     "signature header",
+			header:   "authorization",
+			identity: ClientCertSAN,
+			wantErr:  "client certificate header Authorization is set by the signature",
+		},
+		{
+			name:     "unknown identity",
+			header:   "X-Client",
+			identity: "issuer",
+			wantErr:  `unknown client certificate identity "issuer", expected subject or san`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewClientCertHeader(tt.header, tt.identity)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// clientCert returns a client certificate with a subject and SANs.
+func clientCert(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	spiffeID, _ := url.Parse("spiffe://example.org/ns/payments/sa/api")
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: "payments", Organization: []string{"Example"}},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		URIs:           []*url.URL{spiffeID},
+		DNSNames:       []string{"payments.internal"},
+		EmailAddresses: []string{"payments@example.org"},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.1.23")},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert
+}
+
+func TestProxyClient_ClientCertHeader(t *testing.T) {
+	cert := clientCert(t)
+	tests := []struct {
+		name     string
+		identity string
+		tls      *tls.ConnectionState
+		want     string
+	}{
+		{
+			name:     "subject",
+			identity: ClientCertSubject,
+			tls:      &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			want:     "CN=payments,O=Example",
+		},
+		{
+			name:     "subject alternative names",
+			identity: ClientCertSAN,
+			tls:      &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			want:     "spiffe://example.org/ns/payments/sa/api,payments.internal,payments@example.org,10.0.1.23",
+		},
+		{
+			name:     "unverified certificate",
+			identity: ClientCertSubject,
+			tls:      &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+		},
+		{
+			name:     "plain HTTP",
+			identity: ClientCertSubject,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received http.Header
+			server := httptest.NewServer(&sigv4verifier.Verifier{
+				Credentials: map[string]string{"AKIDEXAMPLE": "secret"},
+				Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					received = r.Header.Clone()
+					result, _ := (&sigv4verifier.Verifier{Credentials: map[string]string{"AKIDEXAMPLE": "secret"}}).Verify(r)
+					json.NewEncoder(w).Encode(result)
+				}),
+			})
+			defer server.Close()
+			serverURL, _ := url.Parse(server.URL)
+
+			certHeader, err := NewClientCertHeader("X-Client-Identity", tt.identity)
+			assert.NoError(t, err)
+			proxyClient := &ProxyClient{
+				Signer:              v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")),
+				Client:              http.DefaultClient,
+				SigningNameOverride: "execute-api",
+				RegionOverride:      "us-east-1",
+				HostOverride:        serverURL.Host,
+				SchemeOverride:      serverURL.Scheme,
+				ClientCertHeader:    certHeader,
+			}
+
+			resp, err := proxyClient.Do(&http.Request{
+				Method: http.MethodGet,
+				URL:    &url.URL{Path: "/prod/items"},
+				Host:   "api.example.com",
+				Header: http.Header{"X-Client-Identity": []string{"CN=admin"}},
+				Body:   http.NoBody,
+				TLS:    tt.tls,
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+
+			var result sigv4verifier.Result
+			assert.NoError(t, json.Unmarshal(body, &result))
+			assert.Equal(t, tt.want, received.Get("X-Client-Identity"))
+			if tt.want != "" {
+				assert.Contains(t, result.SignedHeaders, "x-client-identity")
+			}
+		})
+	}
+}
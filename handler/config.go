@@ -0,0 +1,278 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the content of the --config file.
+type Config struct {
+	ConfigSets map[string]*ConfigSet `yaml:"config-sets"`
+	// RateLimits are the RateLimit policies enforced on all the requests.
+	RateLimits []*RateLimit `yaml:"rate-limits"`
+}
+
+// ConfigSet holds the signing settings of one upstream target. Requests are
+// routed to a ConfigSet by their Host header, or by the prefix of their path.
+// Unset fields fall back to the command line flags.
+type ConfigSet struct {
+	// Hosts are the incoming Host headers routed to this set.
+	Hosts []string `yaml:"hosts"`
+	// PathPrefixes are the path prefixes, such as /s3, of the requests routed
+	// to this set, which are removed from their path unless KeepPathPrefix.
+	PathPrefixes   []string `yaml:"path-prefixes"`
+	KeepPathPrefix bool     `yaml:"keep-path-prefix"`
+	// PathRewrites rewrite the paths of the requests of this set, once their
+	// path prefix is removed, after those of the flags.
+	PathRewrites []*PathRewrite `yaml:"path-rewrites"`
+	// Host is the upstream host to proxy to.
+	Host string `yaml:"host"`
+	// SignHost is the host to sign for.
+	SignHost string `yaml:"sign-host"`
+	// ForwardHostHeader is the Host header sent upstream, see
+	// ProxyClient.ForwardHostHeader. The sets setting it or SignHost do not
+	// inherit it from the flags.
+	ForwardHostHeader string `yaml:"forward-host-header"`
+	// Region and SigningName are detected from the incoming Host header when
+	// either is unset, or from Host for the sets routed by path only.
+	Region      string `yaml:"region"`
+	SigningName string `yaml:"signing-name"`
+	// RoleARN is the role assumed to sign the requests of this set.
+	RoleARN string `yaml:"role-arn"`
+	// MethodRoleARNs maps comma separated HTTP methods, or "*", to the role
+	// assumed to sign the requests with these methods, see MethodCredentials.
+	MethodRoleARNs map[string]string `yaml:"method-role-arns"`
+	// ExternalID and SessionDuration, when set, are the external ID and the
+	// duration of the sessions of the roles of the set, cached independently
+	// of the other sets.
+	ExternalID      string        `yaml:"external-id"`
+	SessionDuration time.Duration `yaml:"session-duration"`
+	// Strip lists the headers to strip from incoming requests.
+	Strip []string `yaml:"strip"`
+	// CustomHeaders are added to the upstream requests along with the
+	// --custom-headers, replacing those with the same names, see
+	// ProxyClient.CustomHeaders.
+	CustomHeaders map[string]string `yaml:"custom-headers"`
+	Scheme        string            `yaml:"upstream-url-scheme"`
+	// SigningAlgorithm is SigningAlgorithmV4 or SigningAlgorithmV4A.
+	SigningAlgorithm string `yaml:"signing-algorithm"`
+	// MaxInFlight limits the requests in flight to Host, see HostLimiter.
+	MaxInFlight int `yaml:"max-in-flight"`
+	// ForceHTTP1 sends the requests to Host, or to Hosts without it, over
+	// HTTP/1.1 only.
+	ForceHTTP1 bool `yaml:"upstream-force-http1"`
+}
+
+// LoadConfig reads and validates the YAML config file at path.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config Config
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("unable to parse config %s: %w", path, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+func (c *Config) validate() error {
+	routed := map[string]string{}
+	prefixes := map[string]string{}
+	for _, name := range c.Names() {
+		set := c.ConfigSets[name]
+		if set == nil || (len(set.Hosts) == 0 && len(set.PathPrefixes) == 0) {
+			return fmt.Errorf("config set %s has no hosts nor path-prefixes", name)
+		}
+		if len(set.Hosts) == 0 && set.Region == "" {
+			if set.Host == "" {
+				return fmt.Errorf("config set %s routed by path must set host", name)
+			}
+			if determineAWSServiceFromHost(set.Host) == nil {
+				return fmt.Errorf("config set %s must set region and signing-name, they cannot be detected from host %s", name, set.Host)
+			}
+		}
+		if set.RoleARN != "" && len(set.MethodRoleARNs) > 0 {
+			return fmt.Errorf("config set %s must set either role-arn or method-role-arns", name)
+		}
+		if (set.ExternalID != "" || set.SessionDuration != 0) && set.RoleARN == "" && len(set.MethodRoleARNs) == 0 {
+			return fmt.Errorf("config set %s must set role-arn or method-role-arns to set external-id or session-duration", name)
+		}
+		if set.SessionDuration != 0 && (set.SessionDuration < 15*time.Minute || set.SessionDuration > 12*time.Hour) {
+			return fmt.Errorf("config set %s has a session-duration of %s, outside of the 15m to 12h of STS", name, set.SessionDuration)
+		}
+		if err := ValidateForwardHostHeader(set.ForwardHostHeader, set.SignHost); err != nil {
+			return fmt.Errorf("config set %s: %w", name, err)
+		}
+		if (set.Region == "") != (set.SigningName == "") {
+			return fmt.Errorf("config set %s must set both region and signing-name, or neither", name)
+		}
+		for header := range set.CustomHeaders {
+			if !validHeaderName(header) {
+				return fmt.Errorf("config set %s has an invalid custom header name %q", name, header)
+			}
+		}
+		if set.MaxInFlight != 0 && (set.MaxInFlight < 0 || set.Host == "") {
+			return fmt.Errorf("config set %s must set host and a positive max-in-flight", name)
+		}
+		switch set.SigningAlgorithm {
+		case "", SigningAlgorithmV4, SigningAlgorithmV4A:
+		default:
+			return fmt.Errorf("config set %s has an unknown signing-algorithm %s", name, set.SigningAlgorithm)
+		}
+		for _, host := range set.Hosts {
+			host = routeHost(host)
+			if other, ok := routed[host]; ok {
+				return fmt.Errorf("host %s is routed to both config sets %s and %s", host, other, name)
+			}
+			routed[host] = name
+		}
+		for i, rewrite := range set.PathRewrites {
+			if rewrite == nil {
+				return fmt.Errorf("config set %s has an empty path rewrite %d", name, i+1)
+			}
+			if err := rewrite.compile(); err != nil {
+				return fmt.Errorf("config set %s: %w", name, err)
+			}
+		}
+		for _, prefix := range set.PathPrefixes {
+			if !pathPrefix.MatchString(prefix) {
+				return fmt.Errorf("config set %s has an invalid path prefix %q, expected /segment[/segment...]", name, prefix)
+			}
+			prefix = routePathPrefix(prefix)
+			if other, ok := prefixes[prefix]; ok {
+				return fmt.Errorf("path prefix %s is routed to both config sets %s and %s", prefix, other, name)
+			}
+			prefixes[prefix] = name
+		}
+	}
+	for i, limit := range c.RateLimits {
+		if limit == nil {
+			return fmt.Errorf("rate limit %d is empty", i+1)
+		}
+		if err := limit.Validate(); err != nil {
+			return fmt.Errorf("rate limit %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// pathPrefix matches the path prefixes made of unreserved characters, which
+// are the same escaped or not.
+var pathPrefix = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)+/?$`)
+
+// AddPathRoute adds a config set routing the requests under prefix to host,
+// signing for the service and region detected from host.
+func (c *Config) AddPathRoute(prefix, host string) error {
+	if c.ConfigSets == nil {
+		c.ConfigSets = map[string]*ConfigSet{}
+	}
+	name := "path-route " + prefix
+	c.ConfigSets[name] = &ConfigSet{PathPrefixes: []string{prefix}, Host: host}
+	if err := c.validate(); err != nil {
+		delete(c.ConfigSets, name)
+		return err
+	}
+	return nil
+}
+
+// Names returns the names of the config sets, sorted.
+func (c *Config) Names() []string {
+	names := make([]string, 0, len(c.ConfigSets))
+	for name := range c.ConfigSets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ProxyClient returns a copy of base applying the settings of the set,
+// signing with signer.
+func (c *ConfigSet) ProxyClient(base *ProxyClient, signer *v4.Signer) *ProxyClient {
+	client := *base
+	client.Signer = signer
+	if c.Host != "" {
+		client.HostOverride = c.Host
+	}
+	if c.SignHost != "" {
+		client.SigningHostOverride = c.SignHost
+	}
+	if c.SignHost != "" || c.ForwardHostHeader != "" {
+		client.ForwardHostHeader = c.ForwardHostHeader
+	}
+	if c.Region != "" {
+		client.RegionOverride = c.Region
+		client.SigningNameOverride = c.SigningName
+	} else if len(c.Hosts) == 0 {
+		// The requests routed by path carry the Host header of the proxy.
+		if service := determineAWSServiceFromHost(c.Host); service != nil {
+			client.RegionOverride = service.SigningRegion
+			client.SigningNameOverride = service.SigningName
+		}
+	}
+	if c.Strip != nil {
+		client.StripRequestHeaders = c.Strip
+	}
+	if len(c.PathRewrites) > 0 {
+		client.PathRewrites = append(append([]*PathRewrite(nil), base.PathRewrites...), c.PathRewrites...)
+	}
+	if len(c.CustomHeaders) > 0 {
+		client.CustomHeaders = base.CustomHeaders.Clone()
+		if client.CustomHeaders == nil {
+			client.CustomHeaders = http.Header{}
+		}
+		for name, value := range c.CustomHeaders {
+			client.CustomHeaders.Set(name, value)
+		}
+	}
+	if c.Scheme != "" {
+		client.SchemeOverride = c.Scheme
+	}
+	if c.SigningAlgorithm != "" {
+		client.SigningAlgorithm = c.SigningAlgorithm
+	}
+	if c.RoleARN != "" || len(c.MethodRoleARNs) > 0 {
+		// Session tags and method roles are bound to the role of the flags.
+		client.CredentialsProvider = nil
+	}
+	return &client
+}
+
+// routeHost normalizes the Host header of a request for routing.
+func routeHost(host string) string {
+	host = strings.ToLower(host)
+	if i := strings.LastIndexByte(host, ':'); i > strings.LastIndexByte(host, ']') {
+		host = host[:i]
+	}
+	return host
+}
@@ -0,0 +1,354 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    *Config
+		wantErr bool
+	}{
+		{
+			name: "loads config sets",
+			content: `
+config-sets:
+  search:
+    hosts: [search.internal]
+    host: vpc-search.eu-west-1.es.amazonaws.com
+    region: eu-west-1
+    signing-name: es
+    role-arn: arn:aws:iam::123456789012:role/search
+    external-id: search-proxy
+    session-duration: 2h
+    strip: [Authorization]
+    custom-headers:
+      X-Tenant: search
+    max-in-flight: 50
+    upstream-force-http1: true
+  queue:
+    hosts: [sqs.us-east-1.amazonaws.com]
+    method-role-arns:
+      GET,HEAD: arn:aws:iam::123456789012:role/read
+      "*": arn:aws:iam::123456789012:role/write
+  mrap:
+    hosts: [mrap.internal]
+    host: mfzwi23gnjvgw.mrap.accesspoint.s3-global.amazonaws.com
+    region: "*"
+    signing-name: s3
+    signing-algorithm: v4a
+`,
+			want: &Config{ConfigSets: map[string]*ConfigSet{
+				"search": {
+					Hosts:           []string{"search.internal"},
+					Host:            "vpc-search.eu-west-1.es.amazonaws.com",
+					Region:          "eu-west-1",
+					SigningName:     "es",
+					RoleARN:         "arn:aws:iam::123456789012:role/search",
+					ExternalID:      "search-proxy",
+					SessionDuration: 2 * time.Hour,
+					Strip:           []string{"Authorization"},
+					CustomHeaders:   map[string]string{"X-Tenant": "search"},
+					MaxInFlight:     50,
+					ForceHTTP1:      true,
+				},
+				"queue": {
+					Hosts: []string{"sqs.us-east-1.amazonaws.com"},
+					MethodRoleARNs: map[string]string{
+						"GET,HEAD": "arn:aws:iam::123456789012:role/read",
+						"*":        "arn:aws:iam::123456789012:role/write",
+					},
+				},
+				"mrap": {
+					Hosts:            []string{"mrap.internal"},
+					Host:             "mfzwi23gnjvgw.mrap.accesspoint.s3-global.amazonaws.com",
+					Region:           "*",
+					SigningName:      "s3",
+					SigningAlgorithm: SigningAlgorithmV4A,
+				},
+			}},
+		},
+		{
+			name: "loads path routed config sets",
+			content: `
+config-sets:
+  s3:
+    path-prefixes: [/s3]
+    host: s3.eu-west-1.amazonaws.com
+  prometheus:
+    path-prefixes: [/aps/workspaces, /prometheus/]
+    keep-path-prefix: true
+    host: aps-workspaces.eu-west-1.amazonaws.com
+    role-arn: arn:aws:iam::123456789012:role/prometheus
+`,
+			want: &Config{ConfigSets: map[string]*ConfigSet{
+				"s3": {
+					PathPrefixes: []string{"/s3"},
+					Host:         "s3.eu-west-1.amazonaws.com",
+				},
+				"prometheus": {
+					PathPrefixes:   []string{"/aps/workspaces", "/prometheus/"},
+					KeepPathPrefix: true,
+					Host:           "aps-workspaces.eu-west-1.amazonaws.com",
+					RoleARN:        "arn:aws:iam::123456789012:role/prometheus",
+				},
+			}},
+		},
+		{
+			name: "loads rate limits",
+			content: `
+rate-limits:
+  - key: client-ip
+    rate: 10
+    burst: 20
+  - key: header
+    header: X-Api-Key
+    rate: 5
+  - key: service
+    rate: 100
+`,
+			want: &Config{RateLimits: []*RateLimit{
+				{Key: RateLimitClientIP, Rate: 10, Burst: 20},
+				{Key: RateLimitHeader, Header: "X-Api-Key", Rate: 5},
+				{Key: RateLimitService, Rate: 100},
+			}},
+		},
+		{
+			name:    "rejects rate limits by header without header",
+			content: "rate-limits:\n  - key: header\n    rate: 5\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects rate limits without rate",
+			content: "rate-limits:\n  - key: client-ip\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects unknown rate limit keys",
+			content: "rate-limits:\n  - key: user\n    rate: 5\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects max-in-flight without host",
+			content: "config-sets:\n  search:\n    hosts: [a]\n    max-in-flight: 10\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects external-id without role",
+			content: "config-sets:\n  search:\n    hosts: [a]\n    external-id: search-proxy\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects session-duration beyond STS limits",
+			content: "config-sets:\n  search:\n    hosts: [a]\n    role-arn: arn:aws:iam::123456789012:role/search\n    session-duration: 13h\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects path routed config sets without host",
+			content: "config-sets:\n  s3:\n    path-prefixes: [/s3]\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects path routed config sets to undetectable hosts",
+			content: "config-sets:\n  search:\n    path-prefixes: [/search]\n    host: search.internal\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects invalid path prefixes",
+			content: "config-sets:\n  s3:\n    path-prefixes: [/]\n    host: s3.eu-west-1.amazonaws.com\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects path prefixes routed to several config sets",
+			content: "config-sets:\n  a:\n    path-prefixes: [/s3]\n    host: s3.eu-west-1.amazonaws.com\n  b:\n    path-prefixes: [/s3/]\n    host: s3.us-west-2.amazonaws.com\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects invalid path rewrites",
+			content: "config-sets:\n  aps:\n    hosts: [aps.internal]\n    path-rewrites:\n      - match: ^/api/(\n        replace: /\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects unknown fields",
+			content: "config-sets:\n  search:\n    hosts: [a]\n    regoin: eu-west-1\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects config sets without hosts",
+			content: "config-sets:\n  search:\n    region: eu-west-1\n    signing-name: es\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects a region without signing name",
+			content: "config-sets:\n  search:\n    hosts: [a]\n    region: eu-west-1\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects a role along with method roles",
+			content: "config-sets:\n  search:\n    hosts: [a]\n    role-arn: arn:a\n    method-role-arns:\n      GET: arn:b\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects invalid custom header names",
+			content: "config-sets:\n  search:\n    hosts: [a]\n    custom-headers:\n      \"X Tenant\": search\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects unknown signing algorithms",
+			content: "config-sets:\n  search:\n    hosts: [a]\n    signing-algorithm: v5\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects a forwarded Host header other than the signed one",
+			content: "config-sets:\n  a:\n    hosts: [a.internal]\n    sign-host: api.example.com\n    forward-host-header: original\n",
+			wantErr: true,
+		},
+		{
+			name:    "rejects hosts routed to several config sets",
+			content: "config-sets:\n  a:\n    hosts: [a.internal]\n  b:\n    hosts: [A.internal:8080]\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := LoadConfig(writeConfig(t, tt.content))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, config)
+		})
+	}
+}
+
+func TestConfigSet_ProxyClient(t *testing.T) {
+	signer := v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", ""))
+	base := &ProxyClient{
+		Client:              &mockHTTPClient{},
+		StripRequestHeaders: []string{"X-Base"},
+		RegionOverride:      "us-east-1",
+		SigningNameOverride: "execute-api",
+		LogFailedRequest:    true,
+	}
+
+	set := &ConfigSet{Host: "upstream.internal", Region: "eu-west-1", SigningName: "es", Strip: []string{"Authorization"}, SigningAlgorithm: SigningAlgorithmV4A}
+	client := set.ProxyClient(base, signer)
+
+	assert.Equal(t, &ProxyClient{
+		Signer:              signer,
+		Client:              base.Client,
+		StripRequestHeaders: []string{"Authorization"},
+		HostOverride:        "upstream.internal",
+		RegionOverride:      "eu-west-1",
+		SigningNameOverride: "es",
+		LogFailedRequest:    true,
+		SigningAlgorithm:    SigningAlgorithmV4A,
+	}, client)
+	assert.Equal(t, "us-east-1", base.RegionOverride)
+}
+
+func TestConfigSet_ProxyClientPathRouted(t *testing.T) {
+	base := &ProxyClient{Client: &mockHTTPClient{}}
+
+	client := (&ConfigSet{PathPrefixes: []string{"/s3"}, Host: "s3.eu-west-1.amazonaws.com"}).ProxyClient(base, nil)
+	assert.Equal(t, "s3.eu-west-1.amazonaws.com", client.HostOverride)
+	assert.Equal(t, "eu-west-1", client.RegionOverride)
+	assert.Equal(t, "s3", client.SigningNameOverride)
+
+	// Host routed sets detect the service from the incoming Host header.
+	client = (&ConfigSet{Hosts: []string{"s3.internal"}, Host: "s3.eu-west-1.amazonaws.com"}).ProxyClient(base, nil)
+	assert.Equal(t, "", client.RegionOverride)
+}
+
+func TestConfig_AddPathRoute(t *testing.T) {
+	config := &Config{}
+	assert.NoError(t, config.AddPathRoute("/s3", "s3.eu-west-1.amazonaws.com"))
+	assert.Equal(t, &ConfigSet{PathPrefixes: []string{"/s3"}, Host: "s3.eu-west-1.amazonaws.com"}, config.ConfigSets["path-route /s3"])
+
+	assert.Error(t, config.AddPathRoute("/s3/", "s3.us-west-2.amazonaws.com"))
+	assert.Error(t, config.AddPathRoute("/search", "search.internal"))
+	assert.Equal(t, []string{"path-route /s3"}, config.Names())
+}
+
+func TestConfigSet_ProxyClientCustomHeaders(t *testing.T) {
+	base := &ProxyClient{Client: &mockHTTPClient{}, CustomHeaders: http.Header{"X-Env": []string{"prod"}, "X-Tenant": []string{"base"}}}
+
+	client := (&ConfigSet{Hosts: []string{"search.internal"}, CustomHeaders: map[string]string{"x-tenant": "search"}}).ProxyClient(base, nil)
+	assert.Equal(t, http.Header{"X-Env": []string{"prod"}, "X-Tenant": []string{"search"}}, client.CustomHeaders)
+	assert.Equal(t, []string{"base"}, base.CustomHeaders["X-Tenant"])
+
+	client = (&ConfigSet{Hosts: []string{"search.internal"}}).ProxyClient(base, nil)
+	assert.Equal(t, base.CustomHeaders, client.CustomHeaders)
+}
+
+func TestConfigSet_ProxyClientForwardHostHeader(t *testing.T) {
+	base := &ProxyClient{Client: &mockHTTPClient{}, ForwardHostHeader: ForwardHostOriginal}
+
+	client := (&ConfigSet{Hosts: []string{"api.internal"}}).ProxyClient(base, nil)
+	assert.Equal(t, ForwardHostOriginal, client.ForwardHostHeader)
+
+	client = (&ConfigSet{Hosts: []string{"api.internal"}, SignHost: "api.example.com"}).ProxyClient(base, nil)
+	assert.Equal(t, "", client.ForwardHostHeader)
+	assert.Equal(t, ForwardHostSigning, client.forwardHostHeader())
+
+	client = (&ConfigSet{Hosts: []string{"api.internal"}, ForwardHostHeader: ForwardHostOverride}).ProxyClient(base, nil)
+	assert.Equal(t, ForwardHostOverride, client.ForwardHostHeader)
+}
+
+func TestConfigSet_ProxyClientPathRewrites(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `
+config-sets:
+  aps:
+    hosts: [aps.internal]
+    path-rewrites:
+      - match: ^/api/v1/(.*)$
+        replace: /workspaces/ws-123/api/v1/$1
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	strip, _ := NewStripPathPrefix("/prometheus")
+	base := &ProxyClient{Client: &mockHTTPClient{}, PathRewrites: []*PathRewrite{strip}}
+
+	client := config.ConfigSets["aps"].ProxyClient(base, nil)
+	assert.Equal(t, []*PathRewrite{strip, config.ConfigSets["aps"].PathRewrites[0]}, client.PathRewrites)
+	assert.Len(t, base.PathRewrites, 1)
+
+	u, _ := url.Parse("https://aps-workspaces.us-east-1.amazonaws.com/prometheus/api/v1/remote_write")
+	assert.NoError(t, rewritePath(u, client.PathRewrites))
+	assert.Equal(t, "/workspaces/ws-123/api/v1/remote_write", u.Path)
+}
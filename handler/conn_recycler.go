@@ -0,0 +1,225 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ConnRecycler is a RoundTripper tracking the age of the upstream
+// connections, and closing those older than MaxAge once the request they
+// are reused for completes, so long-lived proxies pick up the DNS changes of
+// their upstreams, such as weighted records, and get rebalanced by their load
+// balancers. The connections must be dialed with Dial.
+type ConnRecycler struct {
+	Transport http.RoundTripper
+	// MaxAge is the age of the connections after which they are not reused,
+	// the connections are never recycled when zero.
+	MaxAge time.Duration
+
+	now   func() time.Time
+	mu    sync.Mutex
+	addrs map[string]*connAddr
+}
+
+// ConnStats are the connections to an upstream address.
+type ConnStats struct {
+	Address string
+	Open    int
+	// OldestAge is the age of the oldest connection open.
+	OldestAge time.Duration
+	Opened    int64
+	Recycled  int64
+}
+
+// connAddr holds the connections to an address.
+type connAddr struct {
+	open     map[*recycledConn]struct{}
+	opened   int64
+	recycled int64
+}
+
+// recycledConn is a connection dialed by a ConnRecycler.
+type recycledConn struct {
+	net.Conn
+	recycler *ConnRecycler
+	addr     string
+	opened   time.Time
+	// recycling is set once the connection is not to be reused.
+	recycling atomic.Bool
+	http2     atomic.Bool
+	closed    sync.Once
+}
+
+func (c *recycledConn) Close() error {
+	c.closed.Do(func() { c.recycler.remove(c) })
+	return c.Conn.Close()
+}
+
+// Dial returns dial, such as the DialContext of an http.Transport, tracking
+// the connections it dials.
+func (r *ConnRecycler) Dial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c := &recycledConn{Conn: conn, recycler: r, addr: addr, opened: r.currentTime()}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		a := r.addr(addr)
+		a.open[c] = struct{}{}
+		a.opened++
+		return c, nil
+	}
+}
+
+func (r *ConnRecycler) RoundTrip(req *http.Request) (*http.Response, error) {
+	if r.MaxAge <= 0 {
+		return r.Transport.RoundTrip(req)
+	}
+	var traced *http.Request
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn := info.Conn
+			tlsConn, isTLS := conn.(*tls.Conn)
+			if isTLS {
+				conn = tlsConn.NetConn()
+			}
+			c, ok := conn.(*recycledConn)
+			if !ok {
+				return
+			}
+			if isTLS && tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+				c.http2.Store(true)
+			}
+			if !info.Reused || r.currentTime().Sub(c.opened) < r.MaxAge {
+				return
+			}
+			if !c.http2.Load() {
+				// Read by HTTP/1.1 once the connection is picked.
+				traced.Close = true
+			} else if !traced.Close {
+				return
+			}
+			r.recycle(c)
+		},
+	}
+	traced = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	// HTTP/2 reads Close before the connection is picked, the requests to
+	// an address with an old HTTP/2 connection close the connection they
+	// get, most often the only one.
+	traced.Close = req.Close || r.hasOldHTTP2Conn(requestAddr(req))
+	return r.Transport.RoundTrip(traced)
+}
+
+// recycle counts c as recycled, once. The connection is closed once the
+// request completes, or once its other HTTP/2 streams do.
+func (r *ConnRecycler) recycle(c *recycledConn) {
+	if !c.recycling.CompareAndSwap(false, true) {
+		return
+	}
+	r.mu.Lock()
+	r.addr(c.addr).recycled++
+	r.mu.Unlock()
+	log.WithFields(log.Fields{"address": c.addr, "age": r.currentTime().Sub(c.opened).Round(time.Second)}).Debug("recycling upstream connection")
+}
+
+// hasOldHTTP2Conn reports whether an HTTP/2 connection to addr older than
+// MaxAge is not recycled yet.
+func (r *ConnRecycler) hasOldHTTP2Conn(addr string) bool {
+	now := r.currentTime()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.addrs[addr]
+	if !ok {
+		return false
+	}
+	for c := range a.open {
+		if c.http2.Load() && !c.recycling.Load() && now.Sub(c.opened) >= r.MaxAge {
+			return true
+		}
+	}
+	return false
+}
+
+// requestAddr returns the address the connections of req are dialed to.
+func requestAddr(req *http.Request) string {
+	port := req.URL.Port()
+	if port == "" {
+		port = "443"
+		if req.URL.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(req.URL.Hostname(), port)
+}
+
+// Stats returns the connections by address, sorted by address.
+func (r *ConnRecycler) Stats() []ConnStats {
+	now := r.currentTime()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := make([]ConnStats, 0, len(r.addrs))
+	for addr, a := range r.addrs {
+		s := ConnStats{Address: addr, Open: len(a.open), Opened: a.opened, Recycled: a.recycled}
+		for c := range a.open {
+			if age := now.Sub(c.opened); age > s.OldestAge {
+				s.OldestAge = age
+			}
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Address < stats[j].Address })
+	return stats
+}
+
+// addr returns the connections to addr. It must be called with the lock held.
+func (r *ConnRecycler) addr(addr string) *connAddr {
+	if r.addrs == nil {
+		r.addrs = map[string]*connAddr{}
+	}
+	a, ok := r.addrs[addr]
+	if !ok {
+		a = &connAddr{open: map[*recycledConn]struct{}{}}
+		r.addrs[addr] = a
+	}
+	return a
+}
+
+func (r *ConnRecycler) remove(c *recycledConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.addr(c.addr).open, c)
+}
+
+func (r *ConnRecycler) currentTime() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnRecycler(t *testing.T) {
+	tests := []struct {
+		name  string
+		http2 bool
+	}{
+		{name: "HTTP/1.1"},
+		{name: "HTTP/2", http2: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, r.RemoteAddr)
+			}))
+			server.EnableHTTP2 = tt.http2
+			server.StartTLS()
+			defer server.Close()
+
+			now := time.Now()
+			transport := server.Client().Transport.(*http.Transport).Clone()
+			recycler := &ConnRecycler{Transport: transport, MaxAge: time.Minute, now: func() time.Time { return now }}
+			transport.DialContext = recycler.Dial((&net.Dialer{}).DialContext)
+			client := &http.Client{Transport: recycler}
+
+			get := func() string {
+				resp, err := client.Get(server.URL)
+				if !assert.NoError(t, err) {
+					return ""
+				}
+				defer resp.Body.Close()
+				assert.Equal(t, tt.http2, resp.ProtoMajor == 2)
+				body, _ := io.ReadAll(resp.Body)
+				return string(body)
+			}
+
+			first := get()
+			assert.Equal(t, first, get(), "young connections are reused")
+			now = now.Add(2 * time.Minute)
+			assert.Equal(t, first, get(), "the request completes on the old connection")
+			assert.NotEqual(t, first, get(), "old connections are not reused")
+
+			addr := server.Listener.Addr().String()
+			assert.Eventually(t, func() bool {
+				stats := recycler.Stats()
+				return len(stats) == 1 && stats[0].Open == 1
+			}, time.Second, 10*time.Millisecond)
+			assert.Equal(t, []ConnStats{{Address: addr, Open: 1, Opened: 2, Recycled: 1}}, recycler.Stats())
+		})
+	}
+}
+
+func TestConnRecycler_Disabled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	recycler := &ConnRecycler{Transport: transport, now: func() time.Time { return now }}
+	transport.DialContext = recycler.Dial((&net.Dialer{}).DialContext)
+	client := &http.Client{Transport: recycler}
+
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		addrs = append(addrs, string(body))
+		now = now.Add(time.Hour)
+	}
+	assert.Equal(t, addrs[0], addrs[1])
+	assert.Equal(t, []ConnStats{{Address: server.Listener.Addr().String(), Open: 1, OldestAge: 2 * time.Hour, Opened: 1}}, recycler.Stats())
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// CredentialsProvider returns the credentials a request should be signed
+// with, allowing a single ProxyClient to sign with several identities.
+type CredentialsProvider interface {
+	Credentials(req *http.Request) (*credentials.Credentials, error)
+}
+
+// CredentialsExpirer is implemented by the holders of cached credentials that
+// can force them to expire, so they are retrieved again on their next use.
+type CredentialsExpirer interface {
+	// ExpireCredentials expires the cached credentials and returns how many
+	// were expired.
+	ExpireCredentials() int
+}
+
+// CredentialsSet is a CredentialsExpirer of static credentials.
+type CredentialsSet []*credentials.Credentials
+
+func (s CredentialsSet) ExpireCredentials() int {
+	for _, creds := range s {
+		creds.Expire()
+	}
+	return len(s)
+}
+
+// maxCachedCredentials bounds the number of distinct identities cached by a
+// CredentialsProvider, as they may be derived from client input.
+const maxCachedCredentials = 1024
+
+// sessionTagValue matches the characters STS accepts in session tag values.
+var sessionTagValue = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]{0,256}$`)
+
+// SessionTagCredentials assumes RoleARN with session tags, some of which are
+// sourced from the incoming request headers. Credentials are cached per
+// distinct set of tag values.
+type SessionTagCredentials struct {
+	Client  client.ConfigProvider
+	RoleARN string
+	// Tags are static session tags applied to every session.
+	Tags map[string]string
+	// HeaderTags maps session tag keys to the request header holding their
+	// value. Tags whose header is missing are omitted.
+	HeaderTags map[string]string
+	// TransitiveTagKeys are the tag keys that persist through role chaining.
+	TransitiveTagKeys []string
+	// Options are applied to every AssumeRoleProvider.
+	Options []func(*stscreds.AssumeRoleProvider)
+
+	mu    sync.Mutex
+	cache map[string]*credentials.Credentials
+}
+
+func (s *SessionTagCredentials) Credentials(req *http.Request) (*credentials.Credentials, error) {
+	tags := make(map[string]string, len(s.Tags)+len(s.HeaderTags))
+	for k, v := range s.Tags {
+		tags[k] = v
+	}
+	for k, header := range s.HeaderTags {
+		v := req.Header.Get(header)
+		if v == "" {
+			continue
+		}
+		if !sessionTagValue.MatchString(v) {
+			return nil, badRequest(fmt.Errorf("invalid value in header %s for session tag %s", header, k))
+		}
+		tags[k] = v
+	}
+
+	key := sessionTagsKey(tags)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if creds, ok := s.cache[key]; ok {
+		return creds, nil
+	}
+	if s.cache == nil || len(s.cache) >= maxCachedCredentials {
+		s.cache = map[string]*credentials.Credentials{}
+	}
+
+	options := append([]func(*stscreds.AssumeRoleProvider){func(p *stscreds.AssumeRoleProvider) {
+		p.Tags = SessionTags(tags)
+		p.TransitiveTagKeys = aws.StringSlice(s.TransitiveTagKeys)
+	}}, s.Options...)
+	creds := stscreds.NewCredentials(s.Client, s.RoleARN, options...)
+	s.cache[key] = creds
+	return creds, nil
+}
+
+// MethodCredentials signs requests with the credentials of the role mapped
+// to their HTTP method, e.g. a read-only role for GET and HEAD and a write
+// role for the others. Methods without a role are signed with the role of
+// "*", or forbidden.
+type MethodCredentials struct {
+	Methods map[string]*credentials.Credentials
+}
+
+// NewMethodCredentials returns the MethodCredentials of roles, which maps
+// comma separated HTTP methods, or "*", to role ARNs. newCredentials returns
+// the credentials of a role, and is called once per distinct role.
+func NewMethodCredentials(roles map[string]string, newCredentials func(roleARN string) *credentials.Credentials) (*MethodCredentials, error) {
+	m := &MethodCredentials{Methods: map[string]*credentials.Credentials{}}
+	byRole := map[string]*credentials.Credentials{}
+	for methods, roleARN := range roles {
+		creds, ok := byRole[roleARN]
+		if !ok {
+			creds = newCredentials(roleARN)
+			byRole[roleARN] = creds
+		}
+		for _, method := range strings.Split(methods, ",") {
+			method = strings.ToUpper(strings.TrimSpace(method))
+			if method != "*" && !httpMethod.MatchString(method) {
+				return nil, fmt.Errorf("invalid HTTP method %q for role %s", method, roleARN)
+			}
+			if _, ok := m.Methods[method]; ok {
+				return nil, fmt.Errorf("HTTP method %s is mapped to several roles", method)
+			}
+			m.Methods[method] = creds
+		}
+	}
+	return m, nil
+}
+
+var httpMethod = regexp.MustCompile(`^[A-Z]+$`)
+
+func (m *MethodCredentials) Credentials(req *http.Request) (*credentials.Credentials, error) {
+	if creds, ok := m.Methods[req.Method]; ok {
+		return creds, nil
+	}
+	if creds, ok := m.Methods["*"]; ok {
+		return creds, nil
+	}
+	return nil, &StatusError{StatusCode: http.StatusForbidden, Err: fmt.Errorf("no role is mapped to the %s method", req.Method)}
+}
+
+func (m *MethodCredentials) ExpireCredentials() int {
+	expired := map[*credentials.Credentials]bool{}
+	for _, creds := range m.Methods {
+		if !expired[creds] {
+			creds.Expire()
+			expired[creds] = true
+		}
+	}
+	return len(expired)
+}
+
+// HeaderRoleCredentials signs requests with the credentials of the role
+// named by one of their headers, so that one proxy serves several tenants
+// each signing with its own role. Only the roles of AllowedRoles can be
+// assumed, requests without the header are forbidden. Credentials are cached
+// per role.
+type HeaderRoleCredentials struct {
+	// Header holds the ARN of the role to assume. The header is never sent
+	// upstream.
+	Header string
+	// AllowedRoles are the ARNs of the roles that can be assumed, where *
+	// matches any characters, e.g. arn:aws:iam::123456789012:role/tenant-*.
+	AllowedRoles []string
+	// NewCredentials returns the credentials of a role.
+	NewCredentials func(roleARN string) *credentials.Credentials
+
+	mu    sync.Mutex
+	cache map[string]*credentials.Credentials
+}
+
+var roleARN = regexp.MustCompile(`^arn:aws[a-z-]*:iam::[0-9]{12}:role/[\w+=,.@/-]{1,512}$`)
+
+func (h *HeaderRoleCredentials) Credentials(req *http.Request) (*credentials.Credentials, error) {
+	arn := req.Header.Get(h.Header)
+	req.Header.Del(h.Header)
+	if arn == "" {
+		return nil, &StatusError{StatusCode: http.StatusForbidden, Err: fmt.Errorf("missing role in header %s", h.Header)}
+	}
+	if !roleARN.MatchString(arn) || !h.allowed(arn) {
+		return nil, &StatusError{StatusCode: http.StatusForbidden, Err: fmt.Errorf("role %q of header %s is not allowed", arn, h.Header)}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if creds, ok := h.cache[arn]; ok {
+		return creds, nil
+	}
+	if h.cache == nil || len(h.cache) >= maxCachedCredentials {
+		h.cache = map[string]*credentials.Credentials{}
+	}
+	creds := h.NewCredentials(arn)
+	h.cache[arn] = creds
+	return creds, nil
+}
+
+func (h *HeaderRoleCredentials) allowed(arn string) bool {
+	for _, pattern := range h.AllowedRoles {
+		if matchWildcard(pattern, arn) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HeaderRoleCredentials) ExpireCredentials() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, creds := range h.cache {
+		creds.Expire()
+	}
+	return len(h.cache)
+}
+
+func (s *SessionTagCredentials) ExpireCredentials() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, creds := range s.cache {
+		creds.Expire()
+	}
+	return len(s.cache)
+}
+
+// SessionTags converts a map of tags into STS session tags, sorted by key.
+func SessionTags(tags map[string]string) []*sts.Tag {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	stsTags := make([]*sts.Tag, 0, len(keys))
+	for _, k := range keys {
+		stsTags = append(stsTags, &sts.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return stsTags
+}
+
+func sessionTagsKey(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\x00")
+}
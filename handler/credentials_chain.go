@@ -0,0 +1,224 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxCredentialsRefreshes bounds the refresh history of a CredentialsChain.
+const maxCredentialsRefreshes = 20
+
+// credentialsEnv are the environment variables steering the credential
+// chain of the SDK, in the order it considers them. Their values are shown,
+// except for the secret ones and the access key ID, masked.
+var credentialsEnv = []struct {
+	name   string
+	secret bool
+}{
+	{name: "AWS_PROFILE"},
+	{name: "AWS_ACCESS_KEY_ID"},
+	{name: "AWS_SECRET_ACCESS_KEY", secret: true},
+	{name: "AWS_SESSION_TOKEN", secret: true},
+	{name: "AWS_WEB_IDENTITY_TOKEN_FILE"},
+	{name: "AWS_ROLE_ARN"},
+	{name: "AWS_SDK_LOAD_CONFIG"},
+	{name: "AWS_SHARED_CREDENTIALS_FILE"},
+	{name: "AWS_CONFIG_FILE"},
+	{name: "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"},
+	{name: "AWS_CONTAINER_CREDENTIALS_FULL_URI"},
+	{name: "AWS_CONTAINER_AUTHORIZATION_TOKEN", secret: true},
+	{name: "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"},
+	{name: "AWS_EC2_METADATA_DISABLED"},
+}
+
+// CredentialsChain records which provider of the credential chain of the SDK
+// the credentials of the proxy come from, and when they were refreshed:
+// credentials that work on a workstation but not in a cluster are most often
+// picked from another provider than expected.
+type CredentialsChain struct {
+	// Environment holds the environment variables steering the chain, secret
+	// values redacted.
+	Environment map[string]string
+
+	mu        sync.Mutex
+	refreshes []CredentialsRefresh
+	tracked   []*trackedProvider
+}
+
+// CredentialsRefresh is a retrieval of the credentials from the chain.
+type CredentialsRefresh struct {
+	Time time.Time `json:"time"`
+	// Provider is the provider of the chain the credentials came from, e.g.
+	// EnvConfigCredentials, WebIdentityCredentials or EC2RoleProvider.
+	Provider    string     `json:"provider,omitempty"`
+	AccessKeyID string     `json:"access_key_id,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// NewCredentialsChain returns a CredentialsChain of the environment of the
+// process.
+func NewCredentialsChain() *CredentialsChain {
+	env := map[string]string{}
+	for _, v := range credentialsEnv {
+		value, ok := os.LookupEnv(v.name)
+		if !ok {
+			continue
+		}
+		if v.secret {
+			value = "(set)"
+		} else if v.name == "AWS_ACCESS_KEY_ID" {
+			value = maskAccessKeyID(value)
+		}
+		env[v.name] = value
+	}
+	return &CredentialsChain{Environment: env}
+}
+
+// Track returns credentials retrieving creds, recording each retrieval.
+// Forcing them to expire also expires creds.
+func (c *CredentialsChain) Track(creds *credentials.Credentials) *credentials.Credentials {
+	p := &trackedProvider{creds: creds, chain: c}
+	p.tracking = credentials.NewCredentials(p)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tracked = append(c.tracked, p)
+	return p.tracking
+}
+
+// Reset makes the tracked credentials retrieve creds instead, and expires
+// them, e.g. with the credentials of a new session reading the shared
+// credentials file again: the SDK reads it once, when creating the session.
+// It returns the number of tracked credentials.
+func (c *CredentialsChain) Reset(creds *credentials.Credentials) int {
+	c.mu.Lock()
+	tracked := append([]*trackedProvider(nil), c.tracked...)
+	c.mu.Unlock()
+
+	for _, p := range tracked {
+		p.mu.Lock()
+		p.creds = creds
+		p.mu.Unlock()
+		p.tracking.Expire()
+	}
+	return len(tracked)
+}
+
+// Refreshes returns the latest retrievals of the credentials, oldest first.
+func (c *CredentialsChain) Refreshes() []CredentialsRefresh {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]CredentialsRefresh(nil), c.refreshes...)
+}
+
+// Provider returns the provider of the last credentials retrieved, "" until
+// they are.
+func (c *CredentialsChain) Provider() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(c.refreshes) - 1; i >= 0; i-- {
+		if c.refreshes[i].Error == "" {
+			return c.refreshes[i].Provider
+		}
+	}
+	return ""
+}
+
+func (c *CredentialsChain) record(refresh CredentialsRefresh) {
+	previous := c.Provider()
+
+	fields := log.Fields{"provider": refresh.Provider, "access_key_id": refresh.AccessKeyID}
+	if refresh.ExpiresAt != nil {
+		fields["expires_at"] = refresh.ExpiresAt.Format(time.RFC3339)
+	}
+	switch {
+	case refresh.Error != "":
+		log.WithFields(log.Fields{"environment": c.Environment}).Warnf("unable to retrieve credentials from the credential chain: %s", refresh.Error)
+	case previous == "":
+		log.WithFields(fields).WithField("environment", c.Environment).Info("credentials retrieved from the credential chain")
+	case previous != refresh.Provider:
+		log.WithFields(fields).WithField("previous_provider", previous).Warn("credentials retrieved from another provider of the credential chain")
+	default:
+		log.WithFields(fields).Debug("credentials refreshed")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.refreshes) == maxCredentialsRefreshes {
+		c.refreshes = c.refreshes[1:]
+	}
+	c.refreshes = append(c.refreshes, refresh)
+}
+
+// maskAccessKeyID keeps the prefix of id telling long-term (AKIA) from
+// temporary (ASIA) credentials, and its last characters.
+func maskAccessKeyID(id string) string {
+	if len(id) < 12 {
+		return id
+	}
+	return id[:4] + "..." + id[len(id)-4:]
+}
+
+// trackedProvider is a credentials.Provider retrieving creds, for tracking.
+type trackedProvider struct {
+	chain    *CredentialsChain
+	tracking *credentials.Credentials
+
+	mu    sync.Mutex
+	creds *credentials.Credentials
+}
+
+func (p *trackedProvider) current() *credentials.Credentials {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.creds
+}
+
+func (p *trackedProvider) Retrieve() (credentials.Value, error) {
+	return p.RetrieveWithContext(aws.BackgroundContext())
+}
+
+func (p *trackedProvider) RetrieveWithContext(ctx credentials.Context) (credentials.Value, error) {
+	// Only called once the credentials expired, or were forced to.
+	creds := p.current()
+	creds.Expire()
+	value, err := creds.GetWithContext(ctx)
+
+	refresh := CredentialsRefresh{Time: time.Now(), Provider: value.ProviderName, AccessKeyID: maskAccessKeyID(value.AccessKeyID)}
+	if err != nil {
+		refresh.Error = err.Error()
+	} else if expiresAt, err := creds.ExpiresAt(); err == nil {
+		refresh.ExpiresAt = &expiresAt
+	}
+	p.chain.record(refresh)
+	return value, err
+}
+
+func (p *trackedProvider) IsExpired() bool {
+	return p.current().IsExpired()
+}
+
+func (p *trackedProvider) ExpiresAt() (time.Time, error) {
+	return p.current().ExpiresAt()
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionTagCredentials_Credentials(t *testing.T) {
+	provider := &SessionTagCredentials{
+		Client:     session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")})),
+		RoleARN:    "arn:aws:iam::123456789012:role/example",
+		Tags:       map[string]string{"team": "observability"},
+		HeaderTags: map[string]string{"tenant": "X-Tenant-Id"},
+	}
+
+	tenantA := &http.Request{Header: http.Header{"X-Tenant-Id": []string{"a"}}}
+	tenantB := &http.Request{Header: http.Header{"X-Tenant-Id": []string{"b"}}}
+
+	credsA, err := provider.Credentials(tenantA)
+	assert.NoError(t, err)
+	credsB, err := provider.Credentials(tenantB)
+	assert.NoError(t, err)
+	credsA2, err := provider.Credentials(tenantA)
+	assert.NoError(t, err)
+
+	assert.Same(t, credsA, credsA2)
+	assert.NotSame(t, credsA, credsB)
+
+	_, err = provider.Credentials(&http.Request{Header: http.Header{"X-Tenant-Id": []string{"<script>"}}})
+	var statusErr *StatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusBadRequest, statusErr.StatusCode)
+}
+
+func TestSessionTags(t *testing.T) {
+	assert.Equal(t, []*sts.Tag{
+		{Key: aws.String("a"), Value: aws.String("1")},
+		{Key: aws.String("b"), Value: aws.String("2")},
+	}, SessionTags(map[string]string{"b": "2", "a": "1"}))
+}
+
+func TestMethodCredentials_Credentials(t *testing.T) {
+	assumed := map[string]*credentials.Credentials{}
+	newCredentials := func(roleARN string) *credentials.Credentials {
+		creds := credentials.NewStaticCredentials(roleARN, "SECRET", "")
+		assumed[roleARN] = creds
+		return creds
+	}
+
+	provider, err := NewMethodCredentials(map[string]string{
+		"GET, head": "arn:aws:iam::123456789012:role/read",
+		"PUT,POST":  "arn:aws:iam::123456789012:role/write",
+	}, newCredentials)
+	assert.NoError(t, err)
+	assert.Len(t, assumed, 2)
+
+	for method, role := range map[string]string{
+		http.MethodGet:  "read",
+		http.MethodHead: "read",
+		http.MethodPut:  "write",
+		http.MethodPost: "write",
+	} {
+		creds, err := provider.Credentials(&http.Request{Method: method})
+		assert.NoError(t, err)
+		assert.Same(t, assumed["arn:aws:iam::123456789012:role/"+role], creds, method)
+	}
+
+	_, err = provider.Credentials(&http.Request{Method: http.MethodDelete})
+	assert.Equal(t, http.StatusForbidden, errorStatusCode(err))
+
+	provider, err = NewMethodCredentials(map[string]string{
+		"GET": "arn:aws:iam::123456789012:role/read",
+		"*":   "arn:aws:iam::123456789012:role/write",
+	}, newCredentials)
+	assert.NoError(t, err)
+	creds, err := provider.Credentials(&http.Request{Method: http.MethodDelete})
+	assert.NoError(t, err)
+	assert.Same(t, assumed["arn:aws:iam::123456789012:role/write"], creds)
+
+	_, err = NewMethodCredentials(map[string]string{"GET": "a", "GET,HEAD": "b"}, newCredentials)
+	assert.Error(t, err)
+	_, err = NewMethodCredentials(map[string]string{"G/T": "a"}, newCredentials)
+	assert.Error(t, err)
+}
+
+func TestHeaderRoleCredentials_Credentials(t *testing.T) {
+	assumed := map[string]int{}
+	provider := &HeaderRoleCredentials{
+		Header:       "X-Assume-Role-Arn",
+		AllowedRoles: []string{"arn:aws:iam::123456789012:role/tenant-*", "arn:aws:iam::210987654321:role/partner"},
+		NewCredentials: func(roleARN string) *credentials.Credentials {
+			assumed[roleARN]++
+			return credentials.NewStaticCredentials(roleARN, "SECRET", "")
+		},
+	}
+	request := func(role string) *http.Request {
+		header := http.Header{}
+		if role != "" {
+			header.Set("X-Assume-Role-Arn", role)
+		}
+		return &http.Request{Header: header}
+	}
+
+	req := request("arn:aws:iam::123456789012:role/tenant-a")
+	tenantA, err := provider.Credentials(req)
+	assert.NoError(t, err)
+	assert.Empty(t, req.Header.Get("X-Assume-Role-Arn"))
+	tenantB, err := provider.Credentials(request("arn:aws:iam::123456789012:role/tenant-b"))
+	assert.NoError(t, err)
+	tenantA2, err := provider.Credentials(request("arn:aws:iam::123456789012:role/tenant-a"))
+	assert.NoError(t, err)
+	assert.Same(t, tenantA, tenantA2)
+	assert.NotSame(t, tenantA, tenantB)
+	assert.Equal(t, 1, assumed["arn:aws:iam::123456789012:role/tenant-a"])
+
+	partner, err := provider.Credentials(request("arn:aws:iam::210987654321:role/partner"))
+	assert.NoError(t, err)
+	assert.NotNil(t, partner)
+
+	for _, role := range []string{
+		"arn:aws:iam::123456789012:role/admin",
+		"arn:aws:iam::210987654321:role/partner-admin",
+		"arn:aws:iam::123456789012:role/tenant-a\nX: y",
+		"tenant-a",
+		"",
+	} {
+		_, err := provider.Credentials(request(role))
+		assert.Equal(t, http.StatusForbidden, errorStatusCode(err), role)
+	}
+	assert.Len(t, assumed, 3)
+	assert.Equal(t, 3, provider.ExpireCredentials())
+}
@@ -0,0 +1,31 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+// Package handler is the proxy of aws-sigv4-proxy as a library: a Handler
+// serves the requests of the clients, and its ProxyClient signs them with
+// SigV4 or SigV4A and sends them upstream.
+//
+//	import "github.com/awslabs/aws-sigv4-proxy/handler"
+//
+// The module is released with semantic versioning, tagged vMAJOR.MINOR.PATCH.
+// Within a major version, the exported API of the package, Handler,
+// ProxyClient and the Client, Policy and CredentialsProvider interfaces
+// first, stays compatible: exported identifiers are not removed or renamed,
+// the signatures of the functions and methods do not change, and the
+// interfaces gain no methods, optional ones being separate interfaces such as
+// PolicyPreviewer. New fields, methods, functions and types may be added in
+// minor versions, so the structs are to be built with keyed fields. The
+// internal packages and the log messages are not covered.
+package handler
@@ -0,0 +1,250 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// dynamoDBContentType is the content type of the requests of the AWS SDKs to
+// DynamoDB, with attribute values.
+const dynamoDBContentType = "application/x-amz-json-1.0"
+
+// dynamoDBItemMembers are the members of DynamoDB requests and responses
+// holding a map of attribute values.
+var dynamoDBItemMembers = []string{"Item", "Key", "ExclusiveStartKey", "ExpressionAttributeValues", "Attributes", "LastEvaluatedKey"}
+
+// isSimpleDynamoDBJSON reports whether req is a DynamoDB request in plain
+// JSON, rather than the attribute values sent by the AWS SDKs.
+func isSimpleDynamoDBJSON(req *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// dynamoDBRequestFromJSON converts the plain JSON items of a DynamoDB request
+// body to attribute values.
+func dynamoDBRequestFromJSON(body []byte) ([]byte, error) {
+	return convertDynamoDBBody(body, toAttributeValue)
+}
+
+// dynamoDBResponseToJSON converts the attribute values of a DynamoDB response
+// body to plain JSON items.
+func dynamoDBResponseToJSON(body []byte) ([]byte, error) {
+	return convertDynamoDBBody(body, fromAttributeValue)
+}
+
+// toSimpleDynamoDBResponse converts the body of a successful DynamoDB response
+// to plain JSON.
+func toSimpleDynamoDBResponse(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	converted, err := dynamoDBResponseToJSON(body)
+	if err != nil {
+		return fmt.Errorf("unable to convert DynamoDB response: %w", err)
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(converted))
+	resp.ContentLength = int64(len(converted))
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(converted)))
+	// The checksum is of the attribute values.
+	resp.Header.Del("X-Amz-Crc32")
+	return nil
+}
+
+func convertDynamoDBBody(body []byte, convert func(interface{}) (interface{}, error)) ([]byte, error) {
+	var message map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// Numbers keep their precision, DynamoDB supports 38 digits.
+	decoder.UseNumber()
+	if err := decoder.Decode(&message); err != nil {
+		return nil, err
+	}
+
+	for _, member := range dynamoDBItemMembers {
+		if err := convertItemMember(message, member, convert); err != nil {
+			return nil, err
+		}
+	}
+	if err := convertItemsMember(message, "Items", convert); err != nil {
+		return nil, err
+	}
+	// The requests and responses of batch operations, by table.
+	for _, member := range []string{"RequestItems", "UnprocessedKeys", "UnprocessedItems", "Responses"} {
+		tables, _ := message[member].(map[string]interface{})
+		for table, requests := range tables {
+			var err error
+			switch requests := requests.(type) {
+			case map[string]interface{}:
+				err = convertItemsMember(requests, "Keys", convert)
+			case []interface{}:
+				// BatchWriteItem requests and BatchGetItem responses.
+				for i, request := range requests {
+					if write, ok := request.(map[string]interface{}); ok && member != "Responses" {
+						if err = convertItemMember(write["PutRequest"], "Item", convert); err == nil {
+							err = convertItemMember(write["DeleteRequest"], "Key", convert)
+						}
+					} else {
+						requests[i], err = convertItem(request, convert)
+					}
+					if err != nil {
+						break
+					}
+				}
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", member, table, err)
+			}
+		}
+	}
+	return json.Marshal(message)
+}
+
+// convertItemMember converts the item of the member of message, if any.
+func convertItemMember(message interface{}, member string, convert func(interface{}) (interface{}, error)) error {
+	m, ok := message.(map[string]interface{})
+	if !ok || m[member] == nil {
+		return nil
+	}
+	item, err := convertItem(m[member], convert)
+	if err != nil {
+		return fmt.Errorf("%s: %w", member, err)
+	}
+	m[member] = item
+	return nil
+}
+
+// convertItemsMember converts the list of items of the member of message, if
+// any.
+func convertItemsMember(message map[string]interface{}, member string, convert func(interface{}) (interface{}, error)) error {
+	items, _ := message[member].([]interface{})
+	for i := range items {
+		item, err := convertItem(items[i], convert)
+		if err != nil {
+			return fmt.Errorf("%s[%d]: %w", member, i, err)
+		}
+		items[i] = item
+	}
+	return nil
+}
+
+func convertItem(item interface{}, convert func(interface{}) (interface{}, error)) (interface{}, error) {
+	attributes, ok := item.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("item must be an object")
+	}
+	converted := make(map[string]interface{}, len(attributes))
+	for name, value := range attributes {
+		v, err := convert(value)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %w", name, err)
+		}
+		converted[name] = v
+	}
+	return converted, nil
+}
+
+// toAttributeValue converts a plain JSON value to a DynamoDB attribute value.
+func toAttributeValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil:
+		return map[string]interface{}{"NULL": true}, nil
+	case bool:
+		return map[string]interface{}{"BOOL": v}, nil
+	case json.Number:
+		return map[string]interface{}{"N": v.String()}, nil
+	case string:
+		return map[string]interface{}{"S": v}, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i := range v {
+			av, err := toAttributeValue(v[i])
+			if err != nil {
+				return nil, err
+			}
+			list[i] = av
+		}
+		return map[string]interface{}{"L": list}, nil
+	case map[string]interface{}:
+		m, err := convertItem(v, toAttributeValue)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"M": m}, nil
+	}
+	return nil, fmt.Errorf("unsupported value %v", v)
+}
+
+// fromAttributeValue converts a DynamoDB attribute value to plain JSON. Sets
+// become lists, and binary values stay base64 encoded.
+func fromAttributeValue(av interface{}) (interface{}, error) {
+	typed, ok := av.(map[string]interface{})
+	if !ok || len(typed) != 1 {
+		return nil, fmt.Errorf("invalid attribute value %v", av)
+	}
+	for typ, v := range typed {
+		switch typ {
+		case "S", "B", "BOOL", "SS", "BS":
+			return v, nil
+		case "N":
+			if s, ok := v.(string); ok {
+				return json.Number(s), nil
+			}
+		case "NS":
+			if ns, ok := v.([]interface{}); ok {
+				numbers := make([]interface{}, len(ns))
+				for i := range ns {
+					s, ok := ns[i].(string)
+					if !ok {
+						return nil, fmt.Errorf("invalid NS attribute value %v", v)
+					}
+					numbers[i] = json.Number(s)
+				}
+				return numbers, nil
+			}
+		case "NULL":
+			return nil, nil
+		case "L":
+			if l, ok := v.([]interface{}); ok {
+				list := make([]interface{}, len(l))
+				for i := range l {
+					value, err := fromAttributeValue(l[i])
+					if err != nil {
+						return nil, err
+					}
+					list[i] = value
+				}
+				return list, nil
+			}
+		case "M":
+			return convertItem(v, fromAttributeValue)
+		}
+		return nil, fmt.Errorf("invalid %s attribute value %v", typ, v)
+	}
+	return nil, nil
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDynamoDBRequestFromJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "PutItem",
+			body: `{"TableName":"orders","Item":{"id":"o-1","total":12345678901234567890.5,"paid":true,"note":null,"lines":[{"sku":"a","qty":2}]}}`,
+			want: `{"Item":{"id":{"S":"o-1"},"lines":{"L":[{"M":{"qty":{"N":"2"},"sku":{"S":"a"}}}]},"note":{"NULL":true},"paid":{"BOOL":true},"total":{"N":"12345678901234567890.5"}},"TableName":"orders"}`,
+		},
+		{
+			name: "Query",
+			body: `{"TableName":"orders","KeyConditionExpression":"id = :id","ExpressionAttributeValues":{":id":"o-1"},"ExclusiveStartKey":{"id":"o-0"}}`,
+			want: `{"ExclusiveStartKey":{"id":{"S":"o-0"}},"ExpressionAttributeValues":{":id":{"S":"o-1"}},"KeyConditionExpression":"id = :id","TableName":"orders"}`,
+		},
+		{
+			name: "BatchGetItem",
+			body: `{"RequestItems":{"orders":{"Keys":[{"id":"o-1"}],"ProjectionExpression":"id"}}}`,
+			want: `{"RequestItems":{"orders":{"Keys":[{"id":{"S":"o-1"}}],"ProjectionExpression":"id"}}}`,
+		},
+		{
+			name: "BatchWriteItem",
+			body: `{"RequestItems":{"orders":[{"PutRequest":{"Item":{"id":"o-1"}}},{"DeleteRequest":{"Key":{"id":"o-2"}}}]}}`,
+			want: `{"RequestItems":{"orders":[{"PutRequest":{"Item":{"id":{"S":"o-1"}}}},{"DeleteRequest":{"Key":{"id":{"S":"o-2"}}}}]}}`,
+		},
+		{
+			name: "without items",
+			body: `{"TableName":"orders"}`,
+			want: `{"TableName":"orders"}`,
+		},
+		{
+			name:    "item that is not an object",
+			body:    `{"TableName":"orders","Item":["o-1"]}`,
+			wantErr: "Item: item must be an object",
+		},
+		{
+			name:    "invalid JSON",
+			body:    `{"TableName":`,
+			wantErr: "unexpected EOF",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dynamoDBRequestFromJSON([]byte(tt.body))
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+}
+
+func TestDynamoDBResponseToJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "GetItem",
+			body: `{"Item":{"id":{"S":"o-1"},"total":{"N":"12345678901234567890.5"},"tags":{"SS":["a","b"]},"sizes":{"NS":["1","2.5"]},"blob":{"B":"aGk="},"paid":{"BOOL":false},"note":{"NULL":true},"address":{"M":{"lines":{"L":[{"S":"1 Main St"}]}}}}}`,
+			want: `{"Item":{"address":{"lines":["1 Main St"]},"blob":"aGk=","id":"o-1","note":null,"paid":false,"sizes":[1,2.5],"tags":["a","b"],"total":12345678901234567890.5}}`,
+		},
+		{
+			name: "Query",
+			body: `{"Count":1,"Items":[{"id":{"S":"o-1"}}],"LastEvaluatedKey":{"id":{"S":"o-1"}},"ScannedCount":1}`,
+			want: `{"Count":1,"Items":[{"id":"o-1"}],"LastEvaluatedKey":{"id":"o-1"},"ScannedCount":1}`,
+		},
+		{
+			name: "BatchGetItem",
+			body: `{"Responses":{"orders":[{"id":{"S":"o-1"}}]},"UnprocessedKeys":{"orders":{"Keys":[{"id":{"S":"o-2"}}]}}}`,
+			want: `{"Responses":{"orders":[{"id":"o-1"}]},"UnprocessedKeys":{"orders":{"Keys":[{"id":"o-2"}]}}}`,
+		},
+		{
+			name: "BatchWriteItem",
+			body: `{"UnprocessedItems":{"orders":[{"PutRequest":{"Item":{"id":{"S":"o-1"}}}}]}}`,
+			want: `{"UnprocessedItems":{"orders":[{"PutRequest":{"Item":{"id":"o-1"}}}]}}`,
+		},
+		{
+			name:    "invalid attribute value",
+			body:    `{"Item":{"id":{"N":1}}}`,
+			wantErr: "Item: attribute id: invalid N attribute value 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dynamoDBResponseToJSON([]byte(tt.body))
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+}
+
+func TestProxyClient_DynamoDBSimpleJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+		wantBody    string
+		wantResp    string
+		// wantRespType is the content type of the response.
+		wantRespType string
+	}{
+		{
+			name:         "plain JSON",
+			contentType:  "application/json",
+			status:       http.StatusOK,
+			wantBody:     `{"Key":{"id":{"S":"o-1"}},"TableName":"orders"}`,
+			wantResp:     `{"Item":{"id":"o-1"}}`,
+			wantRespType: "application/json",
+		},
+		{
+			name:         "attribute values",
+			contentType:  dynamoDBContentType,
+			status:       http.StatusOK,
+			wantBody:     `{"TableName":"orders","Key":{"id":"o-1"}}`,
+			wantResp:     `{"Item":{"id":{"S":"o-1"}}}`,
+			wantRespType: dynamoDBContentType,
+		},
+		{
+			name:         "error",
+			contentType:  "application/json",
+			status:       http.StatusBadRequest,
+			wantBody:     `{"Key":{"id":{"S":"o-1"}},"TableName":"orders"}`,
+			wantResp:     `{"__type":"com.amazonaws.dynamodb.v20120810#ResourceNotFoundException"}`,
+			wantRespType: dynamoDBContentType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent *http.Request
+			var sentBody []byte
+			proxyClient := &ProxyClient{
+				Signer: v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+				Client: clientFunc(func(req *http.Request) (*http.Response, error) {
+					sent = req
+					sentBody, _ = io.ReadAll(req.Body)
+					body := `{"Item":{"id":{"S":"o-1"}}}`
+					if tt.status != http.StatusOK {
+						body = tt.wantResp
+					}
+					return &http.Response{
+						StatusCode: tt.status,
+						Header:     http.Header{"Content-Type": {dynamoDBContentType}, "X-Amz-Crc32": {"1234"}},
+						Body:       io.NopCloser(strings.NewReader(body)),
+					}, nil
+				}),
+				DynamoDBSimpleJSON: true,
+			}
+
+			body := `{"TableName":"orders","Key":{"id":"o-1"}}`
+			resp, err := proxyClient.Do(&http.Request{
+				Method:        http.MethodPost,
+				URL:           &url.URL{Path: "/"},
+				Host:          "dynamodb.eu-west-1.amazonaws.com",
+				Header:        http.Header{"Content-Type": {tt.contentType}, "X-Amz-Target": {"DynamoDB_20120810.GetItem"}, "Accept-Encoding": {"gzip"}},
+				ContentLength: int64(len(body)),
+				Body:          io.NopCloser(strings.NewReader(body)),
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.Equal(t, tt.wantBody, string(sentBody))
+			assert.Equal(t, int64(len(tt.wantBody)), sent.ContentLength)
+			assert.Equal(t, dynamoDBContentType, sent.Header.Get("Content-Type"))
+			respBody, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, tt.wantResp, string(respBody))
+			assert.Equal(t, tt.wantRespType, resp.Header.Get("Content-Type"))
+		})
+	}
+}
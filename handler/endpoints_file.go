@@ -0,0 +1,65 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/awslabs/aws-sigv4-proxy/handler/internal/endpointsmodel"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+var (
+	// fileEndpoints are the endpoints of the file loaded by
+	// LoadEndpointsFile, looked up before the built-in ones.
+	fileEndpoints map[string]endpoints.ResolvedEndpoint
+	// builtinEndpointsReplaced is set when the endpoints of the file replace
+	// the built-in ones.
+	builtinEndpointsReplaced bool
+)
+
+// LoadEndpointsFile loads the endpoints of the file at path, an endpoints.json
+// document in the format of the endpoints model of the AWS SDKs, into the
+// endpoints the signing name and region of the hosts are looked up in. They
+// take precedence over the built-in endpoints, or replace them all with
+// replace, e.g. for the partitions of air-gapped regions the SDK does not
+// know about. It returns the number of hosts of the file, and must be called
+// before any request is proxied.
+func LoadEndpointsFile(path string, replace bool) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	resolver, err := endpoints.DecodeModel(f)
+	if err != nil {
+		return 0, fmt.Errorf("invalid endpoints file %s: %w", path, err)
+	}
+	partitions, ok := resolver.(endpoints.EnumPartitions)
+	if !ok {
+		return 0, fmt.Errorf("invalid endpoints file %s: no partitions", path)
+	}
+	resolved := endpointsmodel.Resolve(partitions.Partitions())
+	if len(resolved) == 0 {
+		return 0, fmt.Errorf("invalid endpoints file %s: no HTTPS endpoints", path)
+	}
+
+	fileEndpoints, builtinEndpointsReplaced = resolved, replace
+	return len(resolved), nil
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/stretchr/testify/assert"
+)
+
+const airGappedEndpoints = `{
+  "version": 3,
+  "partitions": [{
+    "partition": "aws-airgap",
+    "partitionName": "Air-gapped",
+    "dnsSuffix": "airgap.internal",
+    "regionRegex": "^airgap\\-\\w+\\-\\d+$",
+    "defaults": {"hostname": "{service}.{region}.{dnsSuffix}", "protocols": ["https"], "signatureVersions": ["v4"]},
+    "regions": {"airgap-east-1": {"description": "Air-gapped East"}},
+    "services": {
+      "sqs": {"endpoints": {"airgap-east-1": {}}},
+      "es": {"endpoints": {"airgap-east-1": {"hostname": "search.airgap-east-1.airgap.internal"}}},
+      "execute-api": {"endpoints": {"airgap-east-1": {"hostname": "api.airgap.internal", "credentialScope": {"region": "airgap-east-1", "service": "execute-api"}}}}
+    }
+  }]
+}`
+
+func TestLoadEndpointsFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		replace bool
+		want    map[string]*endpoints.ResolvedEndpoint
+		wantErr string
+	}{
+		{
+			name:    "adds to the built-in endpoints",
+			content: airGappedEndpoints,
+			want: map[string]*endpoints.ResolvedEndpoint{
+				"sqs.airgap-east-1.airgap.internal":    {URL: "https://sqs.airgap-east-1.airgap.internal", PartitionID: "aws-airgap", SigningRegion: "airgap-east-1", SigningName: "sqs", SigningNameDerived: true, SigningMethod: "v4"},
+				"search.airgap-east-1.airgap.internal": {URL: "https://search.airgap-east-1.airgap.internal", PartitionID: "aws-airgap", SigningRegion: "airgap-east-1", SigningName: "es", SigningNameDerived: true, SigningMethod: "v4"},
+				"api.airgap.internal":                  {URL: "https://api.airgap.internal", PartitionID: "aws-airgap", SigningRegion: "airgap-east-1", SigningName: "execute-api", SigningMethod: "v4"},
+				"sqs.us-east-1.amazonaws.com":          {URL: "https://sqs.us-east-1.amazonaws.com", PartitionID: "aws", SigningRegion: "us-east-1", SigningName: "sqs", SigningNameDerived: true, SigningMethod: "v4"},
+			},
+		},
+		{
+			name:    "replaces the built-in endpoints",
+			content: airGappedEndpoints,
+			replace: true,
+			want: map[string]*endpoints.ResolvedEndpoint{
+				"sqs.airgap-east-1.airgap.internal":   {URL: "https://sqs.airgap-east-1.airgap.internal", PartitionID: "aws-airgap", SigningRegion: "airgap-east-1", SigningName: "sqs", SigningNameDerived: true, SigningMethod: "v4"},
+				"sqs.us-east-1.amazonaws.com":         nil,
+				"execute-api.us-east-1.amazonaws.com": nil,
+			},
+		},
+		{
+			name:    "rejects other versions",
+			content: `{"version": 2, "partitions": []}`,
+			wantErr: "endpoints version 2, not supported",
+		},
+		{
+			name:    "rejects files without endpoints",
+			content: `{"version": 3, "partitions": []}`,
+			wantErr: "no HTTPS endpoints",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() { fileEndpoints, builtinEndpointsReplaced = nil, false })
+
+			hosts, err := LoadEndpointsFile(writeConfig(t, tt.content), tt.replace)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, 3, hosts)
+			for host, want := range tt.want {
+				assert.Equal(t, want, determineAWSServiceFromHost(host), host)
+			}
+		})
+	}
+}
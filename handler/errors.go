@@ -0,0 +1,71 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// StatusClientClosedRequest is the non-standard status, borrowed from nginx,
+// of requests the downstream client aborted before they could be proxied.
+const StatusClientClosedRequest = 499
+
+// StatusError is returned when a request is rejected before it reaches the
+// upstream. StatusCode is the status the downstream client should receive
+// instead of the default 502.
+type StatusError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// signingError is returned when a request cannot be signed, e.g. when its
+// credentials cannot be retrieved.
+type signingError struct {
+	err error
+}
+
+func (e *signingError) Error() string {
+	return e.err.Error()
+}
+
+func (e *signingError) Unwrap() error {
+	return e.err
+}
+
+func badRequest(err error) error {
+	return &StatusError{StatusCode: http.StatusBadRequest, Err: err}
+}
+
+// downstreamBodyError classifies a failure to read the body of a downstream
+// request. It is the client's doing: the request was too large, or the client
+// went away, and must not be reported as an upstream failure.
+func downstreamBodyError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return &StatusError{StatusCode: http.StatusRequestEntityTooLarge, Err: err}
+	}
+	return &StatusError{StatusCode: StatusClientClosedRequest, Err: fmt.Errorf("unable to read request body: %w", err)}
+}
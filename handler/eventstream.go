@@ -0,0 +1,126 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// EventStreamContentType is the content type of AWS event stream responses,
+// such as Bedrock response streams.
+const EventStreamContentType = "application/vnd.amazon.eventstream"
+
+const (
+	eventStreamPreludeLength = 12
+	eventStreamCRCLength     = 4
+	// eventStreamMaxMessageLength is the 16MB limit of the AWS SDKs.
+	eventStreamMaxMessageLength = 16 << 20
+)
+
+// eventStreamMessage is a message of an AWS event stream. Only string header
+// values are kept, which covers :message-type, :event-type and
+// :exception-type.
+type eventStreamMessage struct {
+	Headers map[string]string
+	Payload []byte
+}
+
+// readEventStreamMessage reads the next message of an AWS event stream,
+// returning io.EOF at the end of the stream.
+func readEventStreamMessage(r io.Reader) (*eventStreamMessage, error) {
+	prelude := make([]byte, eventStreamPreludeLength)
+	if _, err := io.ReadFull(r, prelude); err != nil {
+		return nil, err
+	}
+	totalLength := binary.BigEndian.Uint32(prelude[0:4])
+	headersLength := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[0:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return nil, fmt.Errorf("event stream message prelude checksum mismatch")
+	}
+	if totalLength > eventStreamMaxMessageLength || uint64(totalLength) < uint64(headersLength)+eventStreamPreludeLength+eventStreamCRCLength {
+		return nil, fmt.Errorf("invalid event stream message length %d", totalLength)
+	}
+
+	message := make([]byte, totalLength)
+	copy(message, prelude)
+	if _, err := io.ReadFull(r, message[eventStreamPreludeLength:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	crcOffset := totalLength - eventStreamCRCLength
+	if crc32.ChecksumIEEE(message[:crcOffset]) != binary.BigEndian.Uint32(message[crcOffset:]) {
+		return nil, fmt.Errorf("event stream message checksum mismatch")
+	}
+
+	headersEnd := eventStreamPreludeLength + headersLength
+	headers, err := parseEventStreamHeaders(message[eventStreamPreludeLength:headersEnd])
+	if err != nil {
+		return nil, err
+	}
+	return &eventStreamMessage{Headers: headers, Payload: message[headersEnd:crcOffset]}, nil
+}
+
+// eventStreamHeaderLengths are the fixed lengths of the header value types,
+// -1 for the variable length types prefixed with their uint16 length.
+var eventStreamHeaderLengths = map[byte]int{
+	0: 0,  // true
+	1: 0,  // false
+	2: 1,  // byte
+	3: 2,  // short
+	4: 4,  // integer
+	5: 8,  // long
+	6: -1, // byte array
+	7: -1, // string
+	8: 8,  // timestamp
+	9: 16, // uuid
+}
+
+const eventStreamStringHeader = 7
+
+func parseEventStreamHeaders(b []byte) (map[string]string, error) {
+	headers := map[string]string{}
+	for len(b) > 0 {
+		nameLength := int(b[0])
+		if len(b) < 1+nameLength+1 {
+			return nil, fmt.Errorf("truncated event stream header")
+		}
+		name := string(b[1 : 1+nameLength])
+		valueType := b[1+nameLength]
+		b = b[1+nameLength+1:]
+
+		valueLength, ok := eventStreamHeaderLengths[valueType]
+		if !ok {
+			return nil, fmt.Errorf("unknown event stream header type %d", valueType)
+		}
+		if valueLength < 0 {
+			if len(b) < 2 {
+				return nil, fmt.Errorf("truncated event stream header")
+			}
+			valueLength = int(binary.BigEndian.Uint16(b))
+			b = b[2:]
+		}
+		if len(b) < valueLength {
+			return nil, fmt.Errorf("truncated event stream header")
+		}
+		if valueType == eventStreamStringHeader {
+			headers[name] = string(b[:valueLength])
+		}
+		b = b[valueLength:]
+	}
+	return headers, nil
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// encodeEventStreamMessage encodes a message with string headers, as AWS
+// services do.
+func encodeEventStreamMessage(headers map[string]string, payload []byte) []byte {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var h bytes.Buffer
+	for _, name := range names {
+		h.WriteByte(byte(len(name)))
+		h.WriteString(name)
+		h.WriteByte(eventStreamStringHeader)
+		binary.Write(&h, binary.BigEndian, uint16(len(headers[name])))
+		h.WriteString(headers[name])
+	}
+	return encodeRawEventStreamMessage(h.Bytes(), payload)
+}
+
+func encodeRawEventStreamMessage(headers, payload []byte) []byte {
+	var m bytes.Buffer
+	binary.Write(&m, binary.BigEndian, uint32(eventStreamPreludeLength+len(headers)+len(payload)+eventStreamCRCLength))
+	binary.Write(&m, binary.BigEndian, uint32(len(headers)))
+	binary.Write(&m, binary.BigEndian, crc32.ChecksumIEEE(m.Bytes()))
+	m.Write(headers)
+	m.Write(payload)
+	binary.Write(&m, binary.BigEndian, crc32.ChecksumIEEE(m.Bytes()))
+	return m.Bytes()
+}
+
+func TestReadEventStreamMessage(t *testing.T) {
+	headers := map[string]string{":message-type": "event", ":event-type": "chunk"}
+	message := encodeEventStreamMessage(headers, []byte(`{"bytes":"e30="}`))
+
+	// A non-string header is skipped.
+	timestamp := []byte{4, 't', 'i', 'm', 'e', 8, 0, 0, 0, 0, 0, 0, 0, 1}
+	withTimestamp, err := readEventStreamMessage(bytes.NewReader(encodeRawEventStreamMessage(timestamp, []byte("{}"))))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{}, withTimestamp.Headers)
+	assert.Equal(t, []byte("{}"), withTimestamp.Payload)
+
+	r := bytes.NewReader(append(append([]byte{}, message...), message...))
+	for i := 0; i < 2; i++ {
+		got, err := readEventStreamMessage(r)
+		assert.NoError(t, err)
+		assert.Equal(t, headers, got.Headers)
+		assert.Equal(t, []byte(`{"bytes":"e30="}`), got.Payload)
+	}
+	_, err = readEventStreamMessage(r)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = readEventStreamMessage(bytes.NewReader(message[:len(message)-2]))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	corrupted := append([]byte{}, message...)
+	corrupted[len(corrupted)-6] ^= 0xff
+	_, err = readEventStreamMessage(bytes.NewReader(corrupted))
+	assert.EqualError(t, err, "event stream message checksum mismatch")
+
+	corrupted = append([]byte{}, message...)
+	corrupted[2] ^= 0xff
+	_, err = readEventStreamMessage(bytes.NewReader(corrupted))
+	assert.EqualError(t, err, "event stream message prelude checksum mismatch")
+}
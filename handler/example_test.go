@@ -0,0 +1,41 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler_test
+
+import (
+	"net/http"
+
+	"github.com/awslabs/aws-sigv4-proxy/handler"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// Proxies the requests to an Amazon OpenSearch Service domain, signed with
+// the credentials of the environment.
+func ExampleHandler() {
+	signer := v4.NewSigner(credentials.NewEnvCredentials())
+	proxy := &handler.Handler{
+		ProxyClient: &handler.ProxyClient{
+			Signer:              signer,
+			Client:              http.DefaultClient,
+			HostOverride:        "search-my-domain.eu-west-1.es.amazonaws.com",
+			RegionOverride:      "eu-west-1",
+			SigningNameOverride: "es",
+		},
+	}
+	http.ListenAndServe(":8080", proxy)
+}
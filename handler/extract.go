@@ -0,0 +1,225 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Sources of the fields extracted by an Extraction.
+const (
+	ExtractFromRequest  = "request"
+	ExtractFromResponse = "response"
+	ExtractFromPath     = "path"
+)
+
+// maxExtractedValueLength truncates extracted values, which end up in
+// statistics and logs.
+const maxExtractedValueLength = 128
+
+// Extraction extracts a field of the requests proxied to a service, such as
+// the model of Bedrock requests or the index of OpenSearch ones, to break
+// statistics and logs down by it.
+type Extraction struct {
+	// Service is the signing name of the requests the field is extracted
+	// from, "*" for all of them.
+	Service string
+	// Source is ExtractFromRequest or ExtractFromResponse to extract the
+	// field from the JSON body with Path, or ExtractFromPath to extract it
+	// from the URL path with Pattern.
+	Source string
+	Name   string
+	// Path is a JSONPath made of $, .name, ['name'] and [index] steps.
+	Path []jsonPathStep
+	// Pattern is a regular expression whose first group is the field.
+	Pattern *regexp.Regexp
+}
+
+// ParseExtraction parses an extraction in the
+// <service>:<request|response|path>:<name>=<expression> format, e.g.
+// bedrock:path:model=^/model/([^/]+)/ or es:response:took=$.took.
+func ParseExtraction(s string) (*Extraction, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid extraction %q, expected <service>:<request|response|path>:<name>=<expression>", s)
+	}
+	name, expression, ok := strings.Cut(parts[2], "=")
+	if !ok || name == "" || parts[0] == "" {
+		return nil, fmt.Errorf("invalid extraction %q, expected <service>:<request|response|path>:<name>=<expression>", s)
+	}
+
+	e := &Extraction{Service: parts[0], Source: parts[1], Name: name}
+	var err error
+	switch e.Source {
+	case ExtractFromRequest, ExtractFromResponse:
+		e.Path, err = parseJSONPath(expression)
+	case ExtractFromPath:
+		e.Pattern, err = regexp.Compile(expression)
+		if err == nil && e.Pattern.NumSubexp() == 0 {
+			err = fmt.Errorf("pattern %q has no group", expression)
+		}
+	default:
+		err = fmt.Errorf("unknown source %q", e.Source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid extraction %q: %w", s, err)
+	}
+	return e, nil
+}
+
+// Extractor extracts fields of the proxied requests into their RequestInfo.
+type Extractor struct {
+	Extractions []*Extraction
+}
+
+// needsRequestBody reports whether a field is extracted from request bodies.
+func (x *Extractor) needsRequestBody() bool {
+	for _, e := range x.Extractions {
+		if e.Source == ExtractFromRequest {
+			return true
+		}
+	}
+	return false
+}
+
+// extract sets the fields extracted from source in info. body is the request
+// or response body, or the URL path.
+func (x *Extractor) extract(info *RequestInfo, source string, body []byte) {
+	var document interface{}
+	parsed := false
+	for _, e := range x.Extractions {
+		if e.Source != source || (e.Service != "*" && e.Service != info.Service) {
+			continue
+		}
+
+		var value string
+		var ok bool
+		if source == ExtractFromPath {
+			if match := e.Pattern.FindSubmatch(body); match != nil {
+				value, ok = string(match[1]), true
+			}
+		} else {
+			if !parsed {
+				parsed = true
+				decoder := json.NewDecoder(bytes.NewReader(body))
+				decoder.UseNumber()
+				if decoder.Decode(&document) != nil {
+					document = nil
+				}
+			}
+			value, ok = evalJSONPath(document, e.Path)
+		}
+		if !ok {
+			continue
+		}
+
+		if len(value) > maxExtractedValueLength {
+			value = value[:maxExtractedValueLength]
+		}
+		if info.Fields == nil {
+			info.Fields = map[string]string{}
+		}
+		info.Fields[e.Name] = value
+	}
+}
+
+// jsonPathStep is a step of a JSONPath, a member name or an array index.
+type jsonPathStep struct {
+	name  string
+	index int
+	isKey bool
+}
+
+var jsonPathStepPattern = regexp.MustCompile(`^(?:\.([A-Za-z_][A-Za-z0-9_-]*)|\['([^']*)'\]|\[([0-9]+)\])`)
+
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("JSONPath %q must start with $", path)
+	}
+
+	var steps []jsonPathStep
+	rest := path[1:]
+	for rest != "" {
+		match := jsonPathStepPattern.FindStringSubmatch(rest)
+		if match == nil {
+			return nil, fmt.Errorf("unsupported JSONPath %q at %q", path, rest)
+		}
+		switch {
+		case match[1] != "":
+			steps = append(steps, jsonPathStep{name: match[1], isKey: true})
+		case match[3] != "":
+			index, _ := strconv.Atoi(match[3])
+			steps = append(steps, jsonPathStep{index: index})
+		default:
+			steps = append(steps, jsonPathStep{name: match[2], isKey: true})
+		}
+		rest = rest[len(match[0]):]
+	}
+	return steps, nil
+}
+
+// evalJSONPath returns the scalar at path in document.
+func evalJSONPath(document interface{}, path []jsonPathStep) (string, bool) {
+	for _, step := range path {
+		if step.isKey {
+			object, ok := document.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			document, ok = object[step.name]
+			if !ok {
+				return "", false
+			}
+			continue
+		}
+
+		array, ok := document.([]interface{})
+		if !ok || step.index >= len(array) {
+			return "", false
+		}
+		document = array[step.index]
+	}
+
+	switch v := document.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+// capturedBody records the bytes of a request body as they are read, to
+// extract fields from it once the request has been proxied.
+type capturedBody struct {
+	io.ReadCloser
+	buf bytes.Buffer
+}
+
+func (b *capturedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExtraction(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{in: "bedrock:path:model=^/model/([^/]+)/"},
+		{in: "es:response:took=$.took"},
+		{in: "*:request:first=$.messages[0]['role']"},
+		{in: "es:response:took", wantErr: true},
+		{in: "es:header:took=$.took", wantErr: true},
+		{in: "es:response:took=took", wantErr: true},
+		{in: "es:response:all=$.hits[*]", wantErr: true},
+		{in: "bedrock:path:model=^/model/", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			_, err := ParseExtraction(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestExtractor_extract(t *testing.T) {
+	extractor := &Extractor{}
+	for _, s := range []string{
+		"bedrock:path:model=^/model/([^/]+)/",
+		"bedrock:request:max_tokens=$.max_tokens",
+		"bedrock:request:role=$.messages[0]['role']",
+		"*:response:stop=$.stop_reason",
+		"es:request:index=$.index",
+		"bedrock:request:missing=$.missing.field",
+		"bedrock:request:object=$.messages",
+	} {
+		e, err := ParseExtraction(s)
+		assert.NoError(t, err)
+		extractor.Extractions = append(extractor.Extractions, e)
+	}
+
+	info := &RequestInfo{Service: "bedrock"}
+	extractor.extract(info, ExtractFromPath, []byte("/model/anthropic.claude-v2/invoke"))
+	extractor.extract(info, ExtractFromRequest, []byte(`{"max_tokens":512,"index":"logs","messages":[{"role":"user"}]}`))
+	extractor.extract(info, ExtractFromResponse, []byte(`{"stop_reason":"end_turn"}`))
+	assert.Equal(t, map[string]string{
+		"model":      "anthropic.claude-v2",
+		"max_tokens": "512",
+		"role":       "user",
+		"stop":       "end_turn",
+	}, info.Fields)
+
+	info = &RequestInfo{Service: "bedrock"}
+	extractor.extract(info, ExtractFromRequest, []byte("not json"))
+	assert.Nil(t, info.Fields)
+}
+
+func TestHandler_ServeHTTPExtractsFields(t *testing.T) {
+	extractor := &Extractor{}
+	for _, s := range []string{"bedrock:path:model=^/model/([^/]+)/", "bedrock:request:max_tokens=$.max_tokens"} {
+		e, _ := ParseExtraction(s)
+		extractor.Extractions = append(extractor.Extractions, e)
+	}
+	stats := NewStats()
+	client := clientFunc(func(req *http.Request) (*http.Response, error) {
+		io.ReadAll(req.Body)
+		RequestInfoFromContext(req.Context()).Service = "bedrock"
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+	})
+	h := &Handler{ProxyClient: client, Stats: stats, Extractor: extractor}
+
+	r := httptest.NewRecorder()
+	h.ServeHTTP(r, httptest.NewRequest(http.MethodPost, "/model/amazon.titan/invoke", strings.NewReader(`{"max_tokens":64}`)))
+
+	assert.Equal(t, http.StatusOK, r.Code)
+	fields := stats.Fields()
+	assert.Len(t, fields, 2)
+	assert.Equal(t, "bedrock max_tokens=64", fields[0].Route)
+	assert.Equal(t, "bedrock model=amazon.titan", fields[1].Route)
+	assert.Equal(t, int64(1), fields[1].StatusClass[2])
+}
+
+type clientFunc func(req *http.Request) (*http.Response, error)
+
+func (f clientFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultLogFailedRequestMaxBytes is the default of
+// ProxyClient.LogFailedRequestMaxBytes.
+const DefaultLogFailedRequestMaxBytes = 4096
+
+// failedResponseBody is the body of a failed response, logged once closed.
+// Its first bytes are captured as the client reads it, so large error
+// payloads are streamed instead of buffered.
+type failedResponseBody struct {
+	io.Reader
+	body     io.ReadCloser
+	entry    *log.Entry
+	encoding string
+	capture  *cappedBuffer
+	once     sync.Once
+}
+
+func newFailedResponseBody(body io.ReadCloser, entry *log.Entry, encoding string, maxBytes int) *failedResponseBody {
+	capture := &cappedBuffer{max: maxBytes}
+	return &failedResponseBody{
+		Reader:   io.TeeReader(body, capture),
+		body:     body,
+		entry:    entry,
+		encoding: encoding,
+		capture:  capture,
+	}
+}
+
+func (b *failedResponseBody) Close() error {
+	err := b.body.Close()
+	b.once.Do(func() {
+		message := loggedBody(b.encoding, b.capture.buf.Bytes())
+		if b.capture.truncated {
+			message += "... (truncated)"
+		}
+		b.entry.WithField("message", message).
+			WithField("body_bytes", b.capture.n).
+			Error("error proxying request")
+	})
+	return err
+}
+
+// cappedBuffer keeps the first max bytes written to it, and counts them all.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	n         int64
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	kept := p
+	if room := c.max - c.buf.Len(); room < len(p) {
+		c.truncated = true
+		kept = p[:max(room, 0)]
+	}
+	c.buf.Write(kept)
+	return len(p), nil
+}
+
+// maxLoggedBodyBytes bounds the decoded bodies of the failed responses
+// logged, as a small compressed body can decode to a large one.
+const maxLoggedBodyBytes = 64 << 10
+
+// loggedBody returns body, encoded with the Content-Encoding encoding, as
+// text for the logs. Bodies encoded with gzip or deflate are decoded; the
+// client still receives the encoded bytes.
+func loggedBody(encoding string, body []byte) string {
+	var encodings []string
+	for _, e := range strings.Split(encoding, ",") {
+		if e = strings.ToLower(strings.TrimSpace(e)); e != "" && e != "identity" {
+			encodings = append(encodings, e)
+		}
+	}
+
+	decoded := body
+	// The encodings are listed in the order they were applied.
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var err error
+		decoded, err = decodeBody(encodings[i], decoded)
+		if err != nil {
+			return fmt.Sprintf("(%d bytes of %s encoded body: %v)", len(body), encoding, err)
+		}
+	}
+	return string(decoded)
+}
+
+// decodeBody decodes body encoded with encoding, up to maxLoggedBodyBytes.
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	var r io.Reader
+	switch encoding {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	case "deflate":
+		// Deflate is meant to be zlib wrapped, but some servers send it raw.
+		if z, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			r = z
+		} else {
+			r = flate.NewReader(bytes.NewReader(body))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encoding %s", encoding)
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(r, maxLoggedBodyBytes+1))
+	// The logged bodies may be cut short by LogFailedRequestMaxBytes.
+	if errors.Is(err, io.ErrUnexpectedEOF) && len(decoded) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > maxLoggedBodyBytes {
+		decoded = append(decoded[:maxLoggedBodyBytes], "... (truncated)"...)
+	}
+	return decoded, nil
+}
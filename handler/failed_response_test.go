@@ -0,0 +1,173 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggedBody(t *testing.T) {
+	const message = `{"message":"The security token included in the request is invalid"}`
+	encode := func(newWriter func(w io.Writer) io.WriteCloser, body string) []byte {
+		var buf bytes.Buffer
+		w := newWriter(&buf)
+		io.WriteString(w, body)
+		w.Close()
+		return buf.Bytes()
+	}
+	gzipped := func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+	zlibbed := func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }
+	raw := func(w io.Writer) io.WriteCloser { f, _ := flate.NewWriter(w, flate.DefaultCompression); return f }
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     string
+	}{
+		{
+			name: "not encoded",
+			body: []byte(message),
+			want: message,
+		},
+		{
+			name:     "identity",
+			encoding: "identity",
+			body:     []byte(message),
+			want:     message,
+		},
+		{
+			name:     "gzip",
+			encoding: "gzip",
+			body:     encode(gzipped, message),
+			want:     message,
+		},
+		{
+			name:     "zlib deflate",
+			encoding: "Deflate",
+			body:     encode(zlibbed, message),
+			want:     message,
+		},
+		{
+			name:     "raw deflate",
+			encoding: "deflate",
+			body:     encode(raw, message),
+			want:     message,
+		},
+		{
+			name:     "several encodings",
+			encoding: "deflate, gzip",
+			body:     encode(gzipped, string(encode(zlibbed, message))),
+			want:     message,
+		},
+		{
+			name:     "large body",
+			encoding: "gzip",
+			body:     encode(gzipped, strings.Repeat("a", maxLoggedBodyBytes+1)),
+			want:     strings.Repeat("a", maxLoggedBodyBytes) + "... (truncated)",
+		},
+		{
+			name:     "unsupported encoding",
+			encoding: "br",
+			body:     []byte{0x1b, 0x03},
+			want:     "(2 bytes of br encoded body: unsupported encoding br)",
+		},
+		{
+			name:     "corrupted body",
+			encoding: "gzip",
+			body:     []byte("not a gzip body"),
+			want:     "(15 bytes of gzip encoded body: gzip: invalid header)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, loggedBody(tt.encoding, tt.body))
+		})
+	}
+}
+
+func TestFailedResponseBody(t *testing.T) {
+	gzipped := func(body string) string {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		io.WriteString(w, body)
+		w.Close()
+		return buf.String()
+	}
+	large := strings.Repeat("error ", 1000)
+
+	tests := []struct {
+		name        string
+		encoding    string
+		body        string
+		maxBytes    int
+		wantMessage string
+	}{
+		{
+			name:        "small body",
+			body:        "AccessDenied",
+			maxBytes:    16,
+			wantMessage: "AccessDenied",
+		},
+		{
+			name:        "large body",
+			body:        large,
+			maxBytes:    16,
+			wantMessage: "error error erro... (truncated)",
+		},
+		{
+			name:        "large gzip body",
+			encoding:    "gzip",
+			body:        gzipped(large),
+			maxBytes:    32,
+			wantMessage: "erro... (truncated)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := log.New()
+			logger.SetOutput(&logs)
+			logger.SetFormatter(&log.JSONFormatter{})
+
+			body := newFailedResponseBody(io.NopCloser(strings.NewReader(tt.body)), log.NewEntry(logger), tt.encoding, tt.maxBytes)
+			got, err := io.ReadAll(body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.body, string(got))
+			assert.Empty(t, logs.String(), "logged before the body is closed")
+
+			assert.NoError(t, body.Close())
+			assert.NoError(t, body.Close())
+			var entry map[string]interface{}
+			assert.NoError(t, json.Unmarshal(logs.Bytes(), &entry), "logged once")
+			assert.Equal(t, "error proxying request", entry["msg"])
+			assert.Equal(t, tt.wantMessage, entry["message"])
+			assert.Equal(t, float64(len(tt.body)), entry["body_bytes"])
+		})
+	}
+}
@@ -0,0 +1,339 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultForwardProxyHosts are the hosts a ForwardProxy intercepts by
+// default, those of the AWS services.
+var DefaultForwardProxyHosts = []string{"*.amazonaws.com", "*.amazonaws.com.cn", "*.api.aws", "*.on.aws"}
+
+const (
+	// forwardProxyCertValidity is how long the certificates issued for the
+	// intercepted hosts are valid, at most as long as the CA.
+	forwardProxyCertValidity = 7 * 24 * time.Hour
+	// maxForwardProxyCerts bounds the certificates a ForwardProxy caches.
+	maxForwardProxyCerts = 10000
+	// forwardProxyHandshakeTimeout bounds the TLS handshakes of the clients
+	// of the tunnels.
+	forwardProxyHandshakeTimeout = 10 * time.Second
+)
+
+// ForwardProxy makes the proxy usable as a standard HTTP forward proxy, set
+// in HTTP_PROXY and HTTPS_PROXY, for the tools without endpoint overrides.
+// The requests in absolute form, http://host/path, are handled by Handler as
+// the other requests. The tunnels of CONNECT requests are intercepted: the
+// TLS connections of the clients are terminated with certificates issued by
+// CA for the host of the tunnel, which the clients must trust, and their
+// requests handled by Handler, signed and sent upstream. Only the hosts
+// matching Hosts can be proxied, the others are forbidden.
+type ForwardProxy struct {
+	Handler http.Handler
+	// Hosts are the hosts the clients may reach through the proxy, * matching
+	// any characters, e.g. *.amazonaws.com.
+	Hosts []string
+
+	ca     *x509.Certificate
+	caKey  any
+	key    *ecdsa.PrivateKey
+	now    func() time.Time
+	mu     sync.Mutex
+	certs  map[string]*tls.Certificate
+	once   sync.Once
+	tunnel *tunnelListener
+	server *http.Server
+}
+
+// NewForwardProxy returns the ForwardProxy of handler issuing the
+// certificates of the intercepted hosts with the certificate and key of ca.
+func NewForwardProxy(handler http.Handler, ca tls.Certificate, hosts []string) (*ForwardProxy, error) {
+	if len(ca.Certificate) == 0 {
+		return nil, errors.New("no forward proxy CA certificate")
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid forward proxy CA certificate: %w", err)
+	}
+	if !caCert.IsCA {
+		return nil, fmt.Errorf("forward proxy certificate %s is not a CA", caCert.Subject)
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("no forward proxy hosts")
+	}
+	// The certificates of all the hosts share a key, issuing them only
+	// takes a signature.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &ForwardProxy{Handler: handler, Hosts: hosts, ca: caCert, caKey: ca.PrivateKey, key: key}, nil
+}
+
+func (f *ForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		f.connect(w, r)
+		return
+	}
+	if r.URL.IsAbs() && !f.allowed(r.Host) {
+		log.WithField("host", r.Host).Debug("forward proxy host not allowed")
+		http.Error(w, fmt.Sprintf("host %s is not allowed through the proxy", r.Host), http.StatusForbidden)
+		return
+	}
+	f.Handler.ServeHTTP(w, r)
+}
+
+// Shutdown stops serving the intercepted tunnels once their requests
+// complete, and closes them when ctx is done first.
+func (f *ForwardProxy) Shutdown(ctx context.Context) error {
+	f.once.Do(f.start)
+	// The listener may not be served yet.
+	f.tunnel.Close()
+	if err := f.server.Shutdown(ctx); err != nil {
+		f.server.Close()
+		return err
+	}
+	return nil
+}
+
+// connect intercepts the tunnel r asks for: the client is told the tunnel is
+// established, then its TLS connection is terminated and served.
+func (f *ForwardProxy) connect(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		http.Error(w, fmt.Sprintf("invalid CONNECT target %q, expected host:port", host), http.StatusBadRequest)
+		return
+	}
+	if !f.allowed(host) {
+		log.WithField("host", host).Debug("forward proxy host not allowed")
+		http.Error(w, fmt.Sprintf("host %s is not allowed through the proxy", host), http.StatusForbidden)
+		return
+	}
+
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		// Tunnels over HTTP/2 cannot be hijacked.
+		log.WithError(err).Error("unable to intercept CONNECT tunnel")
+		http.Error(w, "CONNECT is only supported over HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	buffered.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n")
+	if err := buffered.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	hostname, _, _ := net.SplitHostPort(host)
+	tlsConn := tls.Server(&bufferedConn{Conn: conn, r: buffered.Reader}, &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return f.certificate(hostname)
+		},
+		NextProtos: []string{"http/1.1"},
+		MinVersion: tls.VersionTLS12,
+	})
+	ctx, cancel := context.WithTimeout(r.Context(), forwardProxyHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		// Clients not trusting the CA abort the handshake.
+		log.WithError(err).WithField("host", host).Warn("TLS handshake of CONNECT tunnel failed")
+		conn.Close()
+		return
+	}
+	log.WithField("host", host).Debug("intercepting CONNECT tunnel")
+
+	f.once.Do(f.start)
+	f.tunnel.push(&tunnelConn{Conn: tlsConn, host: host})
+}
+
+// start starts the server of the intercepted tunnels.
+func (f *ForwardProxy) start() {
+	f.tunnel = &tunnelListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+	f.server = &http.Server{
+		Handler: http.HandlerFunc(f.serveTunneled),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, tunnelConnKey{}, c)
+		},
+	}
+	go f.server.Serve(f.tunnel)
+}
+
+type tunnelConnKey struct{}
+
+// serveTunneled handles r, read from an intercepted tunnel, as if it was sent
+// to the host of the tunnel.
+func (f *ForwardProxy) serveTunneled(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value(tunnelConnKey{}).(*tunnelConn)
+	hostname, port, _ := net.SplitHostPort(conn.host)
+	if !strings.EqualFold(requestHostname(r.Host), hostname) {
+		http.Error(w, fmt.Sprintf("host %s does not match the CONNECT target %s", r.Host, conn.host), http.StatusBadRequest)
+		return
+	}
+	r.Host = normalizeHost(net.JoinHostPort(hostname, port), "https")
+	state := conn.Conn.(*tls.Conn).ConnectionState()
+	r.TLS = &state
+	f.Handler.ServeHTTP(w, r)
+}
+
+// allowed returns whether the host, with or without port, matches Hosts.
+func (f *ForwardProxy) allowed(host string) bool {
+	hostname := strings.ToLower(requestHostname(host))
+	for _, pattern := range f.Hosts {
+		if matchWildcard(strings.ToLower(pattern), hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// certificate returns the certificate of hostname issued by the CA, cached
+// until half of its validity has elapsed.
+func (f *ForwardProxy) certificate(hostname string) (*tls.Certificate, error) {
+	hostname = strings.ToLower(hostname)
+	now := f.currentTime()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cert, ok := f.certs[hostname]; ok {
+		leaf := cert.Leaf
+		if now.Before(leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) / 2)) {
+			return cert, nil
+		}
+	}
+	if f.certs == nil || len(f.certs) >= maxForwardProxyCerts {
+		f.certs = map[string]*tls.Certificate{}
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hostname},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(forwardProxyCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(hostname); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{hostname}
+	}
+	if template.NotAfter.After(f.ca.NotAfter) {
+		template.NotAfter = f.ca.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, f.ca, &f.key.PublicKey, f.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to issue the certificate of %s: %w", hostname, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der, f.ca.Raw}, PrivateKey: f.key, Leaf: leaf}
+	f.certs[hostname] = cert
+	return cert, nil
+}
+
+func (f *ForwardProxy) currentTime() time.Time {
+	if f.now != nil {
+		return f.now()
+	}
+	return time.Now()
+}
+
+// requestHostname returns the host of a Host header, without its port.
+func requestHostname(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return hostname
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// tunnelConn is the TLS connection of an intercepted tunnel to host.
+type tunnelConn struct {
+	net.Conn
+	host string
+}
+
+// bufferedConn reads what the client sent along with the CONNECT request
+// before the rest of its connection.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// tunnelListener accepts the connections of the intercepted tunnels, pushed
+// once their TLS handshake completes.
+type tunnelListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *tunnelListener) push(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.closed:
+		c.Close()
+	}
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tunnelListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *tunnelListener) Addr() net.Addr {
+	return tunnelAddr{}
+}
+
+type tunnelAddr struct{}
+
+func (tunnelAddr) Network() string { return "tunnel" }
+func (tunnelAddr) String() string  { return "forward-proxy" }
@@ -0,0 +1,224 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// forwardProxyCA returns a CA certificate and its key.
+func forwardProxyCA(t *testing.T, isCA bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "aws-sigv4-proxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestNewForwardProxy(t *testing.T) {
+	_, err := NewForwardProxy(http.NotFoundHandler(), forwardProxyCA(t, false), DefaultForwardProxyHosts)
+	assert.Error(t, err, "not a CA")
+	_, err = NewForwardProxy(http.NotFoundHandler(), forwardProxyCA(t, true), nil)
+	assert.Error(t, err, "no hosts")
+	_, err = NewForwardProxy(http.NotFoundHandler(), forwardProxyCA(t, true), DefaultForwardProxyHosts)
+	assert.NoError(t, err)
+}
+
+func TestForwardProxy(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		wantErr    bool
+		wantStatus int
+		wantHost   string
+		wantTLS    bool
+	}{
+		{
+			name:       "CONNECT",
+			url:        "https://sts.us-east-1.amazonaws.com/?Action=GetCallerIdentity",
+			wantStatus: http.StatusOK,
+			wantHost:   "sts.us-east-1.amazonaws.com",
+			wantTLS:    true,
+		},
+		{
+			name:       "CONNECT with a port",
+			url:        "https://search-logs.eu-west-1.es.amazonaws.com:8443/_search",
+			wantStatus: http.StatusOK,
+			wantHost:   "search-logs.eu-west-1.es.amazonaws.com:8443",
+			wantTLS:    true,
+		},
+		{
+			name:    "CONNECT to a host not allowed",
+			url:     "https://example.com/",
+			wantErr: true,
+		},
+		{
+			name:       "absolute form",
+			url:        "http://sqs.us-east-1.amazonaws.com/123456789012/queue",
+			wantStatus: http.StatusOK,
+			wantHost:   "sqs.us-east-1.amazonaws.com",
+		},
+		{
+			name:       "absolute form to a host not allowed",
+			url:        "http://example.com/",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	ca := forwardProxyCA(t, true)
+	caCert, _ := x509.ParseCertificate(ca.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	var gotHost string
+	var gotTLS bool
+	forward, err := NewForwardProxy(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost, gotTLS = r.Host, r.TLS != nil
+		w.Write([]byte("signed"))
+	}), ca, DefaultForwardProxyHosts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	server := httptest.NewServer(forward)
+	defer server.Close()
+	defer forward.Shutdown(context.Background())
+
+	proxyURL, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotHost, gotTLS = "", false
+			resp, err := client.Get(tt.url)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			assert.Equal(t, tt.wantHost, gotHost)
+			assert.Equal(t, tt.wantTLS, gotTLS)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, "signed", string(body))
+			}
+		})
+	}
+}
+
+func TestForwardProxy_Shutdown(t *testing.T) {
+	ca := forwardProxyCA(t, true)
+	caCert, _ := x509.ParseCertificate(ca.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	forward, err := NewForwardProxy(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}), ca, DefaultForwardProxyHosts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	server := httptest.NewServer(forward)
+	defer server.Close()
+
+	proxyURL, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	failed := make(chan error)
+	go func() {
+		_, err := client.Get("https://sts.us-east-1.amazonaws.com/")
+		failed <- err
+	}()
+	<-started
+
+	// The tunnels still serving a request are closed once ctx is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, forward.Shutdown(ctx), context.DeadlineExceeded)
+	select {
+	case err := <-failed:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the tunnel was not closed")
+	}
+}
+
+func TestForwardProxy_Certificate(t *testing.T) {
+	forward, err := NewForwardProxy(http.NotFoundHandler(), forwardProxyCA(t, true), DefaultForwardProxyHosts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Now()
+	forward.now = func() time.Time { return now }
+
+	cert, err := forward.certificate("S3.us-east-1.amazonaws.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"s3.us-east-1.amazonaws.com"}, cert.Leaf.DNSNames)
+	assert.NoError(t, cert.Leaf.CheckSignatureFrom(forward.ca))
+	assert.False(t, cert.Leaf.NotAfter.After(forward.ca.NotAfter), "outlives the CA")
+
+	cached, _ := forward.certificate("s3.us-east-1.amazonaws.com")
+	assert.Same(t, cert, cached)
+
+	// Issued again once half its validity has elapsed, capped by the CA.
+	now = cert.Leaf.NotAfter
+	renewed, _ := forward.certificate("s3.us-east-1.amazonaws.com")
+	assert.NotSame(t, cert, renewed)
+
+	ip, err := forward.certificate("10.0.0.1")
+	if assert.NoError(t, err) {
+		assert.Empty(t, ip.Leaf.DNSNames)
+		assert.Equal(t, "10.0.0.1", ip.Leaf.IPAddresses[0].String())
+	}
+}
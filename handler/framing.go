@@ -0,0 +1,355 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Framing is a Policy rejecting requests whose body framing is ambiguous:
+// several Content-Length headers with different values, or both
+// Content-Length and Transfer-Encoding. A load balancer in front of the proxy
+// that frames such a request differently than the proxy does can be made to
+// smuggle a request past its own checks (RFC 9112 section 11.2).
+//
+// net/http rejects conflicting Content-Length headers itself, and silently
+// drops Content-Length when Transfer-Encoding is set. The latter is only
+// detected on the connections accepted by a FramingListener.
+type Framing struct {
+	// LogOnly logs the ambiguous requests instead of rejecting them, to find
+	// the clients that would be rejected before enforcing the policy.
+	LogOnly bool
+}
+
+func (f *Framing) Name() string {
+	return "framing"
+}
+
+func (f *Framing) Check(r *http.Request) *Rejection {
+	transferEncodings := append(append([]string(nil), r.Header["Transfer-Encoding"]...), r.TransferEncoding...)
+	err := framingError(r.Header["Content-Length"], transferEncodings)
+	if conn, ok := r.Context().Value(framingConnKey{}).(*framingConn); ok {
+		// The verdict must be consumed even when the headers are already
+		// ambiguous, to stay in step with the connection.
+		if connErr := conn.verdict(r.Method, r.RequestURI); err == nil {
+			err = connErr
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	if f.LogOnly {
+		log.WithFields(log.Fields{"policy": f.Name(), "remote_addr": r.RemoteAddr}).Warn(err.Error())
+		return nil
+	}
+	// The rest of the connection cannot be trusted to start at a request
+	// boundary.
+	return &Rejection{
+		StatusCode: http.StatusBadRequest,
+		Message:    err.Error(),
+		Header:     http.Header{"Connection": {"close"}},
+	}
+}
+
+// framingError returns why a request with the given Content-Length and
+// Transfer-Encoding header values is ambiguous. Repeated identical
+// Content-Length values are allowed (RFC 9110 section 8.6).
+func framingError(contentLengths, transferEncodings []string) error {
+	if len(contentLengths) == 0 {
+		return nil
+	}
+	if len(transferEncodings) > 0 {
+		return fmt.Errorf("both Content-Length and Transfer-Encoding headers are set")
+	}
+
+	first := ""
+	for _, header := range contentLengths {
+		for _, v := range strings.Split(header, ",") {
+			v = strings.TrimSpace(v)
+			if first == "" {
+				first = v
+			} else if v != first {
+				return fmt.Errorf("conflicting Content-Length headers %q", strings.Join(contentLengths, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+type framingConnKey struct{}
+
+// FramingListener records the framing headers of the HTTP/1 requests read from
+// the connections it accepts, before net/http normalizes them, for the Framing
+// policy to check. The server must use FramingConnContext as its ConnContext.
+func FramingListener(l net.Listener) net.Listener {
+	return &framingListener{Listener: l}
+}
+
+// FramingConnContext makes the connections accepted by a FramingListener
+// available to the Framing policy.
+func FramingConnContext(ctx context.Context, c net.Conn) context.Context {
+	if conn, ok := c.(*framingConn); ok {
+		return context.WithValue(ctx, framingConnKey{}, conn)
+	}
+	return ctx
+}
+
+type framingListener struct {
+	net.Listener
+}
+
+func (l *framingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &framingConn{Conn: c}, nil
+}
+
+// maxFramedRequests bounds the verdicts kept for a connection whose requests
+// are not all checked by the policy.
+const maxFramedRequests = 16
+
+type framingConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	parser framingParser
+}
+
+func (c *framingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		c.parser.feed(b[:n])
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// verdict returns the framing error of the oldest request read from the
+// connection with the given request line, discarding the requests before it.
+// It returns nil when the request was not tracked.
+func (c *framingConn) verdict(method, target string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.parser.requests) > 0 {
+		req := c.parser.requests[0]
+		c.parser.requests = c.parser.requests[1:]
+		if req.method == method && req.target == target {
+			return req.err
+		}
+	}
+	return nil
+}
+
+type framingState int
+
+const (
+	framingHead framingState = iota
+	framingBody
+	framingChunkSize
+	framingChunkData
+	framingChunkEnd
+	framingTrailer
+	// framingLost stops the tracking of a connection whose requests can no
+	// longer be delimited: it switched protocols, or sent something net/http
+	// will reject and close the connection for anyway.
+	framingLost
+)
+
+// maxFramingHeadBytes matches the default http.Server MaxHeaderBytes, plus the
+// slack net/http allows.
+const maxFramingHeadBytes = http.DefaultMaxHeaderBytes + 4096
+
+type framedRequest struct {
+	method string
+	target string
+	err    error
+}
+
+// framingParser delimits the HTTP/1 requests of a connection, the same way
+// net/http does, to record the framing headers of each one.
+type framingParser struct {
+	state     framingState
+	line      []byte
+	headBytes int
+	remaining int64
+
+	method           string
+	target           string
+	contentLengths   []string
+	transferEncoding []string
+	upgrade          bool
+
+	requests []framedRequest
+}
+
+func (p *framingParser) feed(b []byte) {
+	for len(b) > 0 && p.state != framingLost {
+		if p.state == framingBody || p.state == framingChunkData {
+			n := int64(len(b))
+			if n > p.remaining {
+				n = p.remaining
+			}
+			b = b[n:]
+			if p.remaining -= n; p.remaining > 0 {
+				continue
+			}
+			if p.state == framingBody {
+				p.state = framingHead
+			} else {
+				p.state = framingChunkEnd
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			p.line = append(p.line, b...)
+			p.headBytes += len(b)
+			if p.headBytes > maxFramingHeadBytes {
+				p.state = framingLost
+			}
+			return
+		}
+		p.line = append(p.line, b[:i]...)
+		p.headBytes += i + 1
+		b = b[i+1:]
+		line := string(bytes.TrimSuffix(p.line, []byte("\r")))
+		p.line = p.line[:0]
+		if p.headBytes > maxFramingHeadBytes {
+			p.state = framingLost
+			return
+		}
+		p.readLine(line)
+	}
+}
+
+func (p *framingParser) readLine(line string) {
+	switch p.state {
+	case framingHead:
+		p.readHeadLine(line)
+	case framingChunkSize:
+		size, _, _ := strings.Cut(line, ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		switch {
+		case err != nil || n < 0:
+			p.state = framingLost
+		case n == 0:
+			p.state = framingTrailer
+		default:
+			p.remaining = n
+			p.state = framingChunkData
+		}
+	case framingChunkEnd:
+		if line != "" {
+			p.state = framingLost
+			return
+		}
+		p.headBytes = 0
+		p.state = framingChunkSize
+	case framingTrailer:
+		if line == "" {
+			p.headBytes = 0
+			p.state = framingHead
+		}
+	}
+}
+
+func (p *framingParser) readHeadLine(line string) {
+	if p.method == "" {
+		method, rest, ok1 := strings.Cut(line, " ")
+		target, proto, ok2 := strings.Cut(rest, " ")
+		// HTTP/2 connections start with PRI * HTTP/2.0.
+		if !ok1 || !ok2 || method == "" || !strings.HasPrefix(proto, "HTTP/1.") {
+			p.state = framingLost
+			return
+		}
+		p.method, p.target = method, target
+		return
+	}
+	if line == "" {
+		p.endHead()
+		return
+	}
+	// Obsolete line folding is rejected by net/http.
+	if line[0] == ' ' || line[0] == '\t' {
+		p.state = framingLost
+		return
+	}
+	name, value, ok := strings.Cut(line, ":")
+	if !ok {
+		p.state = framingLost
+		return
+	}
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(name) {
+	case "content-length":
+		p.contentLengths = append(p.contentLengths, value)
+	case "transfer-encoding":
+		p.transferEncoding = append(p.transferEncoding, value)
+	case "upgrade":
+		p.upgrade = true
+	}
+}
+
+func (p *framingParser) endHead() {
+	p.requests = append(p.requests, framedRequest{
+		method: p.method,
+		target: p.target,
+		err:    framingError(p.contentLengths, p.transferEncoding),
+	})
+	if len(p.requests) > maxFramedRequests {
+		p.requests = p.requests[1:]
+	}
+
+	p.headBytes = 0
+	switch {
+	case p.upgrade || p.method == "CONNECT":
+		p.state = framingLost
+	case len(p.transferEncoding) > 0:
+		// net/http only accepts chunked requests.
+		if !strings.EqualFold(p.transferEncoding[len(p.transferEncoding)-1], "chunked") {
+			p.state = framingLost
+		} else {
+			p.state = framingChunkSize
+		}
+	case len(p.contentLengths) > 0:
+		v, _, _ := strings.Cut(p.contentLengths[0], ",")
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		switch {
+		case err != nil || n < 0:
+			p.state = framingLost
+		case n > 0:
+			p.remaining = n
+			p.state = framingBody
+		}
+	}
+
+	p.method, p.target = "", ""
+	p.contentLengths, p.transferEncoding, p.upgrade = nil, nil, false
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFraming_Check(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		chunked bool
+		logOnly bool
+		want    string
+	}{
+		{
+			name:   "single Content-Length",
+			header: http.Header{"Content-Length": {"5"}},
+		},
+		{
+			name:   "identical Content-Length headers",
+			header: http.Header{"Content-Length": {"5", "5"}},
+		},
+		{
+			name:   "identical Content-Length list",
+			header: http.Header{"Content-Length": {"5, 5"}},
+		},
+		{
+			name:   "conflicting Content-Length headers",
+			header: http.Header{"Content-Length": {"5", "50"}},
+			want:   `conflicting Content-Length headers "5, 50"`,
+		},
+		{
+			name:   "conflicting Content-Length list",
+			header: http.Header{"Content-Length": {"5,50"}},
+			want:   `conflicting Content-Length headers "5,50"`,
+		},
+		{
+			name:   "Content-Length and Transfer-Encoding headers",
+			header: http.Header{"Content-Length": {"5"}, "Transfer-Encoding": {"chunked"}},
+			want:   "both Content-Length and Transfer-Encoding headers are set",
+		},
+		{
+			name:    "Content-Length and chunked request",
+			header:  http.Header{"Content-Length": {"5"}},
+			chunked: true,
+			want:    "both Content-Length and Transfer-Encoding headers are set",
+		},
+		{
+			name:    "chunked request",
+			chunked: true,
+		},
+		{
+			name:    "log only",
+			header:  http.Header{"Content-Length": {"5", "50"}},
+			logOnly: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+			r.Header = tt.header
+			if tt.chunked {
+				r.TransferEncoding = []string{"chunked"}
+			}
+
+			rejection := (&Framing{LogOnly: tt.logOnly}).Check(r)
+			if tt.want == "" {
+				assert.Nil(t, rejection)
+				return
+			}
+			if assert.NotNil(t, rejection) {
+				assert.Equal(t, http.StatusBadRequest, rejection.StatusCode)
+				assert.Equal(t, tt.want, rejection.Message)
+				assert.Equal(t, "close", rejection.Header.Get("Connection"))
+			}
+		})
+	}
+}
+
+func TestFramingParser(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []framedRequest
+		lost bool
+	}{
+		{
+			name: "requests without body",
+			data: "GET /a HTTP/1.1\r\nHost: example.com\r\n\r\nGET /b HTTP/1.1\nHost: example.com\n\n",
+			want: []framedRequest{{method: "GET", target: "/a"}, {method: "GET", target: "/b"}},
+		},
+		{
+			name: "Content-Length body looking like a request",
+			data: "POST /a HTTP/1.1\r\nContent-Length: 57\r\n\r\n" +
+				"GET /b HTTP/1.1\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n" +
+				"GET /c HTTP/1.1\r\n\r\n",
+			want: []framedRequest{{method: "POST", target: "/a"}, {method: "GET", target: "/c"}},
+		},
+		{
+			name: "chunked body with extensions and trailers",
+			data: "POST /a HTTP/1.1\r\ntransfer-encoding: chunked\r\n\r\n" +
+				"5;name=value\r\nhello\r\n6\r\n world\r\n0\r\nChecksum: abc\r\n\r\n" +
+				"GET /b HTTP/1.1\r\n\r\n",
+			want: []framedRequest{{method: "POST", target: "/a"}, {method: "GET", target: "/b"}},
+		},
+		{
+			name: "Content-Length and Transfer-Encoding",
+			data: "POST /a HTTP/1.1\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"0\r\n\r\n" +
+				"GET /admin HTTP/1.1\r\n\r\n",
+			want: []framedRequest{
+				{method: "POST", target: "/a", err: framingError([]string{"4"}, []string{"chunked"})},
+				{method: "GET", target: "/admin"},
+			},
+		},
+		{
+			name: "conflicting Content-Length headers",
+			data: "POST /a HTTP/1.1\r\nContent-Length: 4\r\ncontent-length: 40\r\n\r\nbody",
+			want: []framedRequest{{method: "POST", target: "/a", err: framingError([]string{"4", "40"}, nil)}},
+		},
+		{
+			name: "protocol switch",
+			data: "GET /ws HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\nGET /b HTTP/1.1\r\n\r\n",
+			want: []framedRequest{{method: "GET", target: "/ws"}},
+			lost: true,
+		},
+		{
+			name: "HTTP/2",
+			data: "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n",
+			lost: true,
+		},
+		{
+			name: "invalid chunk size",
+			data: "POST /a HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n",
+			want: []framedRequest{{method: "POST", target: "/a"}},
+			lost: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, size := range []int{1, 7, len(tt.data)} {
+				p := framingParser{}
+				for data := tt.data; len(data) > 0; {
+					n := size
+					if n > len(data) {
+						n = len(data)
+					}
+					p.feed([]byte(data[:n]))
+					data = data[n:]
+				}
+				assert.Equal(t, tt.want, p.requests, "read %d bytes at a time", size)
+				assert.Equal(t, tt.lost, p.state == framingLost, "read %d bytes at a time", size)
+			}
+		})
+	}
+}
+
+func TestFramingListener(t *testing.T) {
+	upstream := clientFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Body != nil {
+			io.Copy(io.Discard, req.Body)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("ok"))}, nil
+	})
+	server := httptest.NewUnstartedServer(&Handler{ProxyClient: upstream, Policies: []Policy{&Framing{}}})
+	server.Listener = FramingListener(server.Listener)
+	server.Config.ConnContext = FramingConnContext
+	server.Start()
+	defer server.Close()
+
+	roundTrip := func(t *testing.T, requests string, count int) []*http.Response {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte(requests))
+		assert.NoError(t, err)
+
+		reader := bufio.NewReader(conn)
+		var responses []*http.Response
+		for i := 0; i < count; i++ {
+			resp, err := http.ReadResponse(reader, nil)
+			if !assert.NoError(t, err) {
+				return responses
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body = io.NopCloser(strings.NewReader(string(body)))
+			responses = append(responses, resp)
+		}
+		return responses
+	}
+
+	t.Run("pipelined requests", func(t *testing.T) {
+		responses := roundTrip(t, "POST /a HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n"+
+			"5\r\nhello\r\n0\r\n\r\n"+
+			"POST /b HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello"+
+			"GET /c HTTP/1.1\r\nHost: example.com\r\n\r\n", 3)
+		for _, resp := range responses {
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	})
+
+	t.Run("Content-Length and Transfer-Encoding", func(t *testing.T) {
+		responses := roundTrip(t, "POST /a HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n"+
+			"0\r\n\r\n", 1)
+		if assert.Len(t, responses, 1) {
+			body, _ := io.ReadAll(responses[0].Body)
+			assert.Equal(t, http.StatusBadRequest, responses[0].StatusCode)
+			assert.Contains(t, string(body), `"message":"request rejected by framing - both Content-Length and Transfer-Encoding headers are set"`)
+			assert.True(t, responses[0].Close)
+		}
+	})
+}
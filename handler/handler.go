@@ -17,15 +17,49 @@ package handler
 
 import (
 	"bytes"
-    "fmt"
-    "io"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"time"
 
+	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 )
 
+// Handler is the http.Handler of the proxy, proxying the requests of the
+// clients with ProxyClient, usually a ProxyClient.
 type Handler struct {
 	ProxyClient Client
+	// Policies are checked in order before proxying each request, the first
+	// rejection is decisive and returned to the client, along with the
+	// rejections of the remaining policies implementing PolicyPreviewer.
+	Policies []Policy
+	// Stats, when set, collects statistics of the proxied requests.
+	Stats *Stats
+	// Throttling, when set, translates throttling responses of the upstream.
+	Throttling *Throttling
+	// Tee, when set, copies a sample of the responses for inspection.
+	Tee *Tee
+	// WebSocket, when set, bridges WebSocket connections to upstream response
+	// streams.
+	WebSocket *WebSocketBridge
+	// Extractor, when set, extracts fields of the requests to break the
+	// statistics and logs down by.
+	Extractor *Extractor
+	// Classifier, when set, classifies the requests before the policies are
+	// checked.
+	Classifier *Classifier
+	// ResponseHeaders, when set, only passes the allowed headers of the
+	// upstream responses downstream.
+	ResponseHeaders *ResponseHeaderAllowlist
+	// AccessLog, when set, logs a line per request, apart from the other
+	// logs.
+	AccessLog *log.Logger
+	// LogLegacyClients logs the requests of the clients connected with
+	// HTTP/1.0 or a deprecated TLS version, to track them down.
+	LogLegacyClients bool
 }
 
 func (h *Handler) write(w http.ResponseWriter, status int, body []byte) {
@@ -33,31 +67,256 @@ func (h *Handler) write(w http.ResponseWriter, status int, body []byte) {
 	w.Write(body)
 }
 
+// reject responds with the rejection of the decisive policy, the first one
+// rejecting r. The remaining policies are previewed to also list the other
+// rules the request breaks; the others are not evaluated, as a policy may
+// account for the requests it checks.
+func (h *Handler) reject(w http.ResponseWriter, r *http.Request, start time.Time, decisive Policy, rejection *Rejection, remaining []Policy) {
+	log.WithFields(log.Fields{"policy": decisive.Name(), "result": "rejected", "status_code": rejection.StatusCode}).Debug(rejection.Message)
+	body := policyError{
+		Message:    fmt.Sprintf("request rejected by %v - %v", decisive.Name(), rejection.Message),
+		Policy:     decisive.Name(),
+		Rejections: []policyRejection{{Policy: decisive.Name(), StatusCode: rejection.StatusCode, Message: rejection.Message}},
+	}
+	for _, policy := range remaining {
+		previewer, ok := policy.(PolicyPreviewer)
+		if !ok {
+			log.WithFields(log.Fields{"policy": policy.Name(), "result": "skipped"}).Debug("policy not evaluated")
+			continue
+		}
+		other := previewer.Preview(r)
+		if other == nil {
+			log.WithFields(log.Fields{"policy": policy.Name(), "result": "allowed"}).Debug("policy previewed")
+			continue
+		}
+		log.WithFields(log.Fields{"policy": policy.Name(), "result": "rejected", "status_code": other.StatusCode}).Debug(other.Message)
+		body.Rejections = append(body.Rejections, policyRejection{Policy: policy.Name(), StatusCode: other.StatusCode, Message: other.Message})
+	}
+	log.WithFields(log.Fields{"policy": decisive.Name(), "status_code": rejection.StatusCode, "rejections": len(body.Rejections)}).Info(rejection.Message)
+
+	for k, vals := range rejection.Header {
+		for _, v := range vals {
+			w.Header().Add(k, v)
+		}
+	}
+	b, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	h.write(w, rejection.StatusCode, b)
+	h.record(r, rejection.StatusCode, start, rejection.Message)
+}
+
+// record accounts for a completed request in the handler statistics.
+func (h *Handler) record(r *http.Request, statusCode int, start time.Time, message string) {
+	if h.Stats == nil {
+		return
+	}
+
+	path := ""
+	if r.URL != nil {
+		path = r.URL.Path
+	}
+	h.Stats.Record(r.Method, path, RequestInfoFromContext(r.Context()), statusCode, time.Since(start), message)
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	info := &RequestInfo{Client: clientProtocol(r)}
+	r = WithRequestInfo(r, info)
+	// The policies may buffer the body, e.g. to verify its hash, which is
+	// released once the request is served.
+	defer func() {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+	}()
+
+	if h.AccessLog != nil {
+		aw := &accessLogWriter{ResponseWriter: w}
+		body := &countingBody{ReadCloser: http.NoBody}
+		if r.Body != nil {
+			body.ReadCloser = r.Body
+			r.Body = body
+		}
+		w = aw
+		defer h.logAccess(aw, r, body, start)
+	}
+
+	if h.LogLegacyClients && info.Client.Legacy() {
+		log.WithFields(info.Client.logFields()).WithFields(log.Fields{"remote_addr": r.RemoteAddr, "user_agent": r.UserAgent()}).Warn("request from a legacy client")
+	}
+
+	if h.Classifier != nil {
+		h.Classifier.classify(r, info)
+	}
+
+	for i, policy := range h.Policies {
+		rejection := policy.Check(r)
+		if rejection == nil {
+			log.WithFields(log.Fields{"policy": policy.Name(), "result": "allowed"}).Debug("policy evaluated")
+			continue
+		}
+		h.reject(w, r, start, policy, rejection, h.Policies[i+1:])
+		return
+	}
+
+	if h.WebSocket != nil && websocket.IsWebSocketUpgrade(r) {
+		statusCode, message := h.WebSocket.serve(w, r, h.ProxyClient)
+		h.record(r, statusCode, start, message)
+		return
+	}
+
+	var counted *countingBody
+	if h.Stats != nil && r.Body != nil {
+		counted = &countingBody{ReadCloser: r.Body}
+		r.Body = counted
+	}
+	var captured *capturedBody
+	if h.Extractor != nil && h.Extractor.needsRequestBody() && r.Body != nil {
+		captured = &capturedBody{ReadCloser: r.Body}
+		r.Body = captured
+	}
+
 	resp, err := h.ProxyClient.Do(r)
+	if h.Extractor != nil {
+		if r.URL != nil {
+			h.Extractor.extract(info, ExtractFromPath, []byte(r.URL.Path))
+		}
+		if captured != nil {
+			h.Extractor.extract(info, ExtractFromRequest, captured.buf.Bytes())
+		}
+	}
+	if err != nil && errorStatusCode(err) == StatusClientClosedRequest {
+		log.WithError(err).Info("client closed the request before it was proxied")
+		h.write(w, StatusClientClosedRequest, []byte(err.Error()))
+		h.record(r, StatusClientClosedRequest, start, err.Error())
+		return
+	}
 	if err != nil {
-	    errorMsg := "unable to proxy request"
-		log.WithError(err).Error(errorMsg)
-		h.write(w, http.StatusBadGateway, []byte(fmt.Sprintf("%v - %v", errorMsg, err.Error())))
+		errorMsg := "unable to proxy request"
+		log.WithError(err).WithFields(info.logFields()).Error(errorMsg)
+		h.write(w, errorStatusCode(err), []byte(fmt.Sprintf("%v - %v", errorMsg, err.Error())))
+		h.record(r, errorStatusCode(err), start, err.Error())
+		return
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		h.tunnel(w, r, resp, start)
 		return
 	}
 	defer resp.Body.Close()
 
-	// read response body
+	if h.Throttling != nil && h.Throttling.Translate(resp) {
+		log.WithField("status_code", resp.StatusCode).Debug("upstream throttled the request")
+	}
+
+	// read response body, the tee copies it as it is read
+	body := io.Reader(resp.Body)
+	var tee *teeWriter
+	if h.Tee != nil {
+		if tee = h.Tee.start(r, resp.StatusCode, resp.Header.Clone()); tee != nil {
+			body = io.TeeReader(resp.Body, tee)
+		}
+	}
 	buf := bytes.Buffer{}
-	if _, err := io.Copy(&buf, resp.Body); err != nil {
-	    errorMsg := "error while reading response from upstream"
+	if _, err := io.Copy(&buf, body); err != nil && r.Context().Err() != nil {
+		log.WithError(err).Info("client closed the request while the response was read")
+		h.record(r, StatusClientClosedRequest, start, err.Error())
+		return
+	} else if err != nil {
+		errorMsg := "error while reading response from upstream"
 		log.WithError(err).Error(errorMsg)
-		h.write(w, http.StatusInternalServerError, []byte(fmt.Sprintf("%v - %v", errorMsg, err.Error())))
+		statusCode := http.StatusInternalServerError
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			statusCode = statusErr.StatusCode
+		}
+		h.write(w, statusCode, []byte(fmt.Sprintf("%v - %v", errorMsg, err.Error())))
+		h.record(r, statusCode, start, err.Error())
 		return
 	}
 
-	// copy headers
-	for k, vals := range resp.Header {
+	if h.Extractor != nil {
+		h.Extractor.extract(info, ExtractFromResponse, buf.Bytes())
+		if len(info.Fields) > 0 {
+			log.WithFields(info.logFields()).WithField("status_code", resp.StatusCode).Debug("proxied request")
+		}
+	}
+
+	// copy headers, the tee gets them all
+	header := resp.Header
+	if h.ResponseHeaders != nil {
+		header = resp.Header.Clone()
+		if removed := h.ResponseHeaders.Filter(header); len(removed) > 0 {
+			log.WithField("headers", removed).Debug("removed response headers that are not allowed")
+		}
+	}
+	for k, vals := range header {
 		for _, v := range vals {
 			w.Header().Add(k, v)
 		}
 	}
 
+	// copy trailers, read with the body, such as the grpc-status of gRPC
+	// responses; they are announced and the body chunked to carry them
+	trailer := resp.Trailer
+	if h.ResponseHeaders != nil && len(trailer) > 0 {
+		trailer = resp.Trailer.Clone()
+		if removed := h.ResponseHeaders.Filter(trailer); len(removed) > 0 {
+			log.WithField("trailers", removed).Debug("removed response trailers that are not allowed")
+		}
+	}
+	if len(trailer) > 0 {
+		w.Header().Del("Content-Length")
+		for k := range trailer {
+			w.Header().Add("Trailer", k)
+		}
+	}
+
 	h.write(w, resp.StatusCode, buf.Bytes())
+	for k, vals := range trailer {
+		for _, v := range vals {
+			w.Header().Add(k, v)
+		}
+	}
+	h.record(r, resp.StatusCode, start, http.StatusText(resp.StatusCode))
+	if h.Stats != nil {
+		var requestBytes int64
+		if counted != nil {
+			requestBytes = counted.n
+		}
+		h.Stats.RecordSizes(info, requestBytes, int64(buf.Len()))
+	}
+
+	if tee != nil {
+		tee.done()
+	}
+
+	var bytesIn int64
+	if r.ContentLength > 0 {
+		bytesIn = r.ContentLength
+	}
+	for _, policy := range h.Policies {
+		if observer, ok := policy.(PolicyObserver); ok {
+			observer.Observe(r, bytesIn, int64(buf.Len()))
+		}
+	}
+}
+
+func errorStatusCode(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	return http.StatusBadGateway
+}
+
+// countingBody counts the bytes of a request body read by the ProxyClient.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
 }
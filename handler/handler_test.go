@@ -16,18 +16,27 @@
 package handler
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/stretchr/testify/assert"
 )
 
 type mockProxyClient struct {
 	Fail     bool
+	Err      error
 	Response *http.Response
 }
 
@@ -35,9 +44,73 @@ func (m *mockProxyClient) Do(req *http.Request) (*http.Response, error) {
 	if m.Fail {
 		return nil, fmt.Errorf("mockProxyClient.Do failed")
 	}
+	if m.Err != nil {
+		return nil, m.Err
+	}
 
 	return m.Response, nil
 }
+
+type mockPolicy struct {
+	Rejection *Rejection
+}
+
+func (m *mockPolicy) Name() string {
+	return "mock"
+}
+
+func (m *mockPolicy) Check(r *http.Request) *Rejection {
+	return m.Rejection
+}
+
+type mockPreviewPolicy struct {
+	mockPolicy
+	PolicyName string
+	checks     int
+}
+
+func (m *mockPreviewPolicy) Name() string {
+	return m.PolicyName
+}
+
+func (m *mockPreviewPolicy) Check(r *http.Request) *Rejection {
+	m.checks++
+	return m.Rejection
+}
+
+func (m *mockPreviewPolicy) Preview(r *http.Request) *Rejection {
+	return m.Rejection
+}
+
+func TestHandler_Rejections(t *testing.T) {
+	auth := &mockPreviewPolicy{PolicyName: "auth", mockPolicy: mockPolicy{Rejection: &Rejection{StatusCode: http.StatusUnauthorized, Message: "missing API key"}}}
+	unpreviewable := &mockPolicy{Rejection: &Rejection{StatusCode: http.StatusBadRequest, Message: "bad request"}}
+	quota := &mockPreviewPolicy{PolicyName: "quota", mockPolicy: mockPolicy{Rejection: &Rejection{StatusCode: http.StatusTooManyRequests, Message: "quota exceeded"}}}
+	allowed := &mockPreviewPolicy{PolicyName: "allowed"}
+	h := &Handler{
+		ProxyClient: &mockProxyClient{Fail: true},
+		Policies:    []Policy{allowed, auth, unpreviewable, quota},
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	// The first rejection is decisive, policies that cannot be previewed are
+	// not evaluated.
+	assert.JSONEq(t, `{
+		"message": "request rejected by auth - missing API key",
+		"policy": "auth",
+		"rejections": [
+			{"policy": "auth", "status_code": 401, "message": "missing API key"},
+			{"policy": "quota", "status_code": 429, "message": "quota exceeded"}
+		]
+	}`, w.Body.String())
+	assert.Equal(t, 1, allowed.checks)
+	assert.Equal(t, 0, quota.checks)
+}
+
 func TestHandler_ServeHTTP(t *testing.T) {
 	type want struct {
 		statusCode int
@@ -63,6 +136,50 @@ func TestHandler_ServeHTTP(t *testing.T) {
 				header:     http.Header{},
 			},
 		},
+		{
+			name: "responds with the rejection of a policy",
+			handler: &Handler{
+				ProxyClient: &mockProxyClient{Fail: true},
+				Policies: []Policy{
+					&mockPolicy{},
+					&mockPolicy{Rejection: &Rejection{
+						StatusCode: http.StatusTooManyRequests,
+						Message:    "slow down",
+						Header:     http.Header{"Retry-After": []string{"1"}},
+					}},
+				},
+			},
+			request: &http.Request{},
+			want: &want{
+				statusCode: http.StatusTooManyRequests,
+				body:       []byte(`{"message":"request rejected by mock - slow down","policy":"mock","rejections":[{"policy":"mock","status_code":429,"message":"slow down"}]}`),
+				header:     http.Header{"Retry-After": []string{"1"}, "Content-Type": []string{"application/json"}},
+			},
+		},
+		{
+			name: "responds with the status of a StatusError",
+			handler: &Handler{
+				ProxyClient: &mockProxyClient{Err: badRequest(fmt.Errorf("invalid header"))},
+			},
+			request: &http.Request{},
+			want: &want{
+				statusCode: http.StatusBadRequest,
+				body:       []byte(`unable to proxy request - invalid header`),
+				header:     http.Header{},
+			},
+		},
+		{
+			name: "responds with 499 if the client aborted the request",
+			handler: &Handler{
+				ProxyClient: &mockProxyClient{Err: &StatusError{StatusCode: StatusClientClosedRequest, Err: fmt.Errorf("unable to read request body: unexpected EOF")}},
+			},
+			request: &http.Request{},
+			want: &want{
+				statusCode: StatusClientClosedRequest,
+				body:       []byte(`unable to read request body: unexpected EOF`),
+				header:     http.Header{},
+			},
+		},
 		{
 			name: "responds with proxied response if everything is 👍",
 			handler: &Handler{
@@ -85,6 +202,28 @@ func TestHandler_ServeHTTP(t *testing.T) {
 				body: []byte(`proxy call successful`),
 			},
 		},
+		{
+			name: "responds with the translated throttling response",
+			handler: &Handler{
+				ProxyClient: &mockProxyClient{
+					Response: &http.Response{
+						StatusCode: http.StatusTooManyRequests,
+						Header:     http.Header{},
+						Body:       ioutil.NopCloser(bytes.NewBuffer([]byte(`slow down`))),
+					},
+				},
+				Throttling: &Throttling{RetryAfter: 5 * time.Second, StatusCode: http.StatusServiceUnavailable},
+			},
+			request: &http.Request{},
+			want: &want{
+				statusCode: http.StatusServiceUnavailable,
+				header: http.Header{
+					"Retry-After":            []string{"5"},
+					"X-Original-Status-Code": []string{"429"},
+				},
+				body: []byte(`slow down`),
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -104,3 +243,212 @@ func TestHandler_ServeHTTP(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_UpstreamCancelled(t *testing.T) {
+	tests := []struct {
+		name string
+		// stream writes part of the response before blocking.
+		stream bool
+	}{
+		{name: "waiting for the response"},
+		{name: "streaming the response", stream: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cancelled := make(chan struct{})
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.stream {
+					w.Write([]byte("partial"))
+					w.(http.Flusher).Flush()
+				}
+				select {
+				case <-r.Context().Done():
+					close(cancelled)
+				case <-time.After(5 * time.Second):
+				}
+			}))
+			defer upstream.Close()
+
+			stats := NewStats()
+			proxy := httptest.NewServer(&Handler{Stats: stats, ProxyClient: &ProxyClient{
+				Signer:              v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+				Client:              http.DefaultClient,
+				HostOverride:        strings.TrimPrefix(upstream.URL, "http://"),
+				SchemeOverride:      "http",
+				SigningNameOverride: "execute-api",
+				RegionOverride:      "us-east-1",
+			}})
+			defer proxy.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, proxy.URL+"/stream", nil)
+			_, err := http.DefaultClient.Do(req)
+			assert.Error(t, err)
+
+			select {
+			case <-cancelled:
+			case <-time.After(2 * time.Second):
+				t.Fatal("the upstream request was not cancelled when the client went away")
+			}
+			assert.Eventually(t, func() bool { return stats.ClientAborts() == 1 }, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestHandler_ClientProtocol(t *testing.T) {
+	tests := []struct {
+		name       string
+		tlsVersion uint16
+		http10     bool
+		want       ClientProtocol
+		wantLegacy bool
+	}{
+		{
+			name:       "TLS 1.3",
+			tlsVersion: tls.VersionTLS13,
+			want:       ClientProtocol{Proto: "HTTP/1.1", TLSVersion: "TLS 1.3", ALPN: "http/1.1"},
+		},
+		{
+			name:       "TLS 1.1",
+			tlsVersion: tls.VersionTLS11,
+			want:       ClientProtocol{Proto: "HTTP/1.1", TLSVersion: "TLS 1.1", ALPN: "http/1.1"},
+			wantLegacy: true,
+		},
+		{
+			name:       "HTTP/1.0",
+			http10:     true,
+			want:       ClientProtocol{Proto: "HTTP/1.0"},
+			wantLegacy: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := NewStats()
+			server := httptest.NewUnstartedServer(&Handler{
+				Stats:            stats,
+				ProxyClient:      &mockProxyClient{Response: &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok"))}},
+				LogLegacyClients: true,
+			})
+			if tt.tlsVersion != 0 {
+				server.TLS = &tls.Config{MinVersion: tt.tlsVersion, MaxVersion: tt.tlsVersion, NextProtos: []string{"http/1.1"}}
+				server.StartTLS()
+			} else {
+				server.Start()
+			}
+			defer server.Close()
+
+			client := server.Client()
+			if transport, ok := client.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+				transport.TLSClientConfig.MinVersion = tls.VersionTLS10
+				transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+			}
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			if tt.http10 {
+				conn, err := net.Dial("tcp", server.Listener.Addr().String())
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer conn.Close()
+				conn.Write([]byte("GET / HTTP/1.0\r\nHost: example.com\r\n\r\n"))
+				resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+				if assert.NoError(t, err) {
+					assert.Equal(t, http.StatusOK, resp.StatusCode)
+				}
+			} else {
+				resp, err := client.Do(req)
+				if assert.NoError(t, err) {
+					resp.Body.Close()
+					assert.Equal(t, http.StatusOK, resp.StatusCode)
+				}
+			}
+
+			assert.Equal(t, []ClientProtocolStats{{ClientProtocol: tt.want, Requests: 1}}, stats.ClientProtocols())
+			assert.Equal(t, tt.wantLegacy, tt.want.Legacy())
+		})
+	}
+}
+
+func TestHandler_BodySizes(t *testing.T) {
+	stats := NewStats()
+	proxy := &Handler{Stats: stats, ProxyClient: &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+		Client: clientFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(strings.Repeat("b", 5000)))}, nil
+		}),
+	}}
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("a", 2000)))
+	r.Host = "es.eu-west-1.amazonaws.com"
+	r.ContentLength = -1
+	proxy.ServeHTTP(httptest.NewRecorder(), r)
+
+	sizes := stats.Sizes()
+	if assert.Len(t, sizes, 1) {
+		assert.Equal(t, "es", sizes[0].Route)
+		assert.Equal(t, []int64{0, 1, 0, 0, 0, 0, 0, 0, 0, 0}, sizes[0].Request.Counts)
+		assert.Equal(t, int64(2000), sizes[0].Request.Sum)
+		assert.Equal(t, []int64{0, 0, 1, 0, 0, 0, 0, 0, 0, 0}, sizes[0].Response.Counts)
+		assert.Equal(t, int64(5000), sizes[0].Response.Sum)
+	}
+}
+
+func TestHandler_Trailers(t *testing.T) {
+	tests := []struct {
+		name            string
+		http2           bool
+		responseHeaders *ResponseHeaderAllowlist
+		want            http.Header
+	}{
+		{
+			name: "HTTP/1.1",
+			want: http.Header{"Grpc-Status": {"0"}, "X-Checksum": {"abc"}},
+		},
+		{
+			name:  "HTTP/2",
+			http2: true,
+			want:  http.Header{"Grpc-Status": {"0"}, "X-Checksum": {"abc"}},
+		},
+		{
+			name:            "allowlist",
+			responseHeaders: &ResponseHeaderAllowlist{Allowed: []string{"Grpc-*"}},
+			want:            http.Header{"Grpc-Status": {"0"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewUnstartedServer(&Handler{
+				ProxyClient: &mockProxyClient{Response: &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Length": {"2"}},
+					Body:       ioutil.NopCloser(strings.NewReader("ok")),
+					Trailer:    http.Header{"Grpc-Status": {"0"}, "X-Checksum": {"abc"}},
+				}},
+				ResponseHeaders: tt.responseHeaders,
+			})
+			if tt.http2 {
+				server.EnableHTTP2 = true
+				server.StartTLS()
+			} else {
+				server.Start()
+			}
+			defer server.Close()
+
+			resp, err := server.Client().Get(server.URL)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+
+			assert.Equal(t, "ok", string(body))
+			if tt.http2 {
+				assert.Equal(t, 2, resp.ProtoMajor)
+			}
+			assert.Equal(t, tt.want, resp.Trailer)
+		})
+	}
+}
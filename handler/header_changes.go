@@ -0,0 +1,96 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"math/rand"
+	"net/http"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The header rules of a ProxyClient, as named in HeaderChange.
+const (
+	// HeaderRuleStrip removed a header of the client, StripRequestHeaders.
+	HeaderRuleStrip = "strip"
+	// HeaderRuleDuplicate copied a header of the client to an X-Original-
+	// header, DuplicateRequestHeaders.
+	HeaderRuleDuplicate = "duplicate"
+	// HeaderRuleCustom added a header, CustomHeaders.
+	HeaderRuleCustom = "custom"
+	// HeaderRuleIdentity set a signed header, IdentityHeaders.
+	HeaderRuleIdentity = "identity"
+	// HeaderRuleDropped dropped a header of the client as the proxy set a
+	// header with the same name, such as Authorization or an identity header.
+	HeaderRuleDropped = "dropped"
+	// HeaderRuleUnsigned forwarded a header of the client without signing it,
+	// as the headers of the clients are added once the request is signed.
+	HeaderRuleUnsigned = "unsigned"
+)
+
+// HeaderChange is a change of a header rule to the headers of a request.
+type HeaderChange struct {
+	Rule string
+	// Pattern is the header, or pattern, of the rule, e.g. X-Amz-* for a
+	// strip rule, empty for the unsigned headers as their names are up to the
+	// clients.
+	Pattern string
+	// Header is the header changed.
+	Header string
+}
+
+// HeaderRuleCount is the number of headers changed by a rule.
+type HeaderRuleCount struct {
+	Rule    string
+	Pattern string
+	Headers int64
+}
+
+// reportHeaderChanges attaches the header changes of the upstream request of
+// req to its RequestInfo, and logs them at debug level, or at info level for
+// the requests sampled by HeaderLogSampleRate.
+func (p *ProxyClient) reportHeaderChanges(req *http.Request, changes []HeaderChange) {
+	if info := RequestInfoFromContext(req.Context()); info != nil {
+		info.HeaderChanges = changes
+	}
+
+	sampled := p.HeaderLogSampleRate > 0 && rand.Float64() < p.HeaderLogSampleRate
+	if !sampled && log.GetLevel() < log.DebugLevel {
+		return
+	}
+	entry := log.WithField("request", req.Method+" "+req.URL.Path).WithFields(headerChangesLogFields(changes))
+	if sampled {
+		entry.Info("header rules applied")
+	} else {
+		entry.Debug("header rules applied")
+	}
+}
+
+// headerChangesLogFields returns the headers changed by each rule, sorted, as
+// log fields named after the rules.
+func headerChangesLogFields(changes []HeaderChange) log.Fields {
+	byRule := map[string][]string{}
+	for _, c := range changes {
+		byRule[c.Rule] = append(byRule[c.Rule], c.Header)
+	}
+	fields := log.Fields{}
+	for rule, headers := range byRule {
+		sort.Strings(headers)
+		fields["headers_"+rule] = headers
+	}
+	return fields
+}
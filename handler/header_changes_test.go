@@ -0,0 +1,121 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyClient_HeaderChanges(t *testing.T) {
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer:                  v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")),
+		Client:                  client,
+		StripRequestHeaders:     []string{"X-Internal-*", "Cookie", "X-Absent"},
+		DuplicateRequestHeaders: []string{"X-Tenant"},
+		CustomHeaders:           http.Header{"X-Proxy": []string{"sigv4"}, "X-Tenant": []string{"default"}},
+		IdentityHeaders:         http.Header{"X-Environment": []string{"production"}},
+		SigningNameOverride:     "execute-api",
+		RegionOverride:          "us-east-1",
+		HostOverride:            "api.example.com",
+		HeaderLogSampleRate:     1,
+	}
+	info := &RequestInfo{}
+	req := WithRequestInfo(&http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: "/prod/items"},
+		Host:   "api.example.com",
+		Header: http.Header{
+			"Authorization":    []string{"Bearer token"},
+			"X-Internal-Token": []string{"secret"},
+			"Cookie":           []string{"session=1"},
+			"X-Tenant":         []string{"acme"},
+			"X-Environment":    []string{"development"},
+		},
+		Body: http.NoBody,
+	}, info)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	log.SetFormatter(&log.JSONFormatter{})
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFormatter(&log.TextFormatter{})
+	}()
+	_, err := proxyClient.Do(req)
+	assert.NoError(t, err)
+
+	assert.ElementsMatch(t, []HeaderChange{
+		{Rule: HeaderRuleIdentity, Pattern: "X-Environment", Header: "X-Environment"},
+		{Rule: HeaderRuleStrip, Pattern: "X-Internal-*", Header: "X-Internal-Token"},
+		{Rule: HeaderRuleStrip, Pattern: "Cookie", Header: "Cookie"},
+		{Rule: HeaderRuleDuplicate, Pattern: "X-Tenant", Header: "X-Original-X-Tenant"},
+		{Rule: HeaderRuleDropped, Pattern: "Authorization", Header: "Authorization"},
+		{Rule: HeaderRuleDropped, Pattern: "X-Environment", Header: "X-Environment"},
+		{Rule: HeaderRuleUnsigned, Header: "X-Tenant"},
+		{Rule: HeaderRuleCustom, Pattern: "X-Proxy", Header: "X-Proxy"},
+	}, info.HeaderChanges)
+	assert.Equal(t, "sigv4", client.Request.Header.Get("X-Proxy"))
+	assert.Equal(t, "acme", client.Request.Header.Get("X-Tenant"))
+
+	var entry map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var e map[string]interface{}
+		if json.Unmarshal([]byte(line), &e) == nil && e["msg"] == "header rules applied" {
+			entry = e
+		}
+	}
+	if assert.NotNil(t, entry, "header changes logged") {
+		assert.Equal(t, "info", entry["level"])
+		assert.Equal(t, []interface{}{"Cookie", "X-Internal-Token"}, entry["headers_strip"])
+		assert.Equal(t, []interface{}{"Authorization", "X-Environment"}, entry["headers_dropped"])
+	}
+}
+
+func TestStats_HeaderRules(t *testing.T) {
+	stats := NewStats()
+	info := &RequestInfo{Service: "es", HeaderChanges: []HeaderChange{
+		{Rule: HeaderRuleStrip, Pattern: "X-Internal-*", Header: "X-Internal-Token"},
+		{Rule: HeaderRuleStrip, Pattern: "X-Internal-*", Header: "X-Internal-User"},
+		{Rule: HeaderRuleUnsigned, Header: "Accept"},
+	}}
+	stats.Record(http.MethodGet, "/", info, http.StatusOK, time.Millisecond, "")
+	stats.Record(http.MethodGet, "/", info, http.StatusOK, time.Millisecond, "")
+
+	assert.Equal(t, []HeaderRuleCount{
+		{Rule: HeaderRuleStrip, Pattern: "X-Internal-*", Headers: 4},
+		{Rule: HeaderRuleUnsigned, Headers: 2},
+	}, stats.HeaderRules())
+
+	r := httptest.NewRecorder()
+	(&Admin{Stats: stats}).ServeHTTP(r, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, r.Body.String(), "# TYPE sigv4_proxy_header_changes_total counter\n")
+	assert.Contains(t, r.Body.String(), `sigv4_proxy_header_changes_total{rule="strip",pattern="X-Internal-*"} 4`+"\n")
+	assert.Contains(t, r.Body.String(), `sigv4_proxy_header_changes_total{rule="unsigned",pattern=""} 2`+"\n")
+}
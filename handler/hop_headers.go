@@ -0,0 +1,82 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// hopHeaders are the hop-by-hop headers of RFC 7230, section 6.1, which
+// concern a single connection and are not forwarded by proxies.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers from header, along with the
+// headers its Connection header names. The protocol of an upgrade is kept when
+// upgrade is set, as the upgraded connections are relayed, and so are the
+// trailers of TE, as the trailers are forwarded, e.g. for gRPC.
+func removeHopHeaders(header http.Header, upgrade bool) {
+	protocol := ""
+	if upgrade && headerContainsToken(header, "Connection", "upgrade") {
+		protocol = header.Get("Upgrade")
+	}
+	trailers := headerContainsToken(header, "Te", "trailers")
+
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+
+	if protocol != "" {
+		header.Set("Connection", "Upgrade")
+		header.Set("Upgrade", protocol)
+	}
+	if trailers {
+		header.Set("Te", "trailers")
+	}
+}
+
+// headerContainsToken returns whether the comma-separated values of the header
+// name contain token, case insensitively.
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			// Tokens may have parameters, as the qualities of TE.
+			t, _, _ = strings.Cut(t, ";")
+			if strings.EqualFold(textproto.TrimString(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
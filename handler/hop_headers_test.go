@@ -0,0 +1,79 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		upgrade bool
+		want    http.Header
+	}{
+		{
+			name: "hop-by-hop headers",
+			header: http.Header{
+				"Connection":          {"keep-alive"},
+				"Keep-Alive":          {"timeout=5"},
+				"Proxy-Authorization": {"Basic dXNlcjpwYXNz"},
+				"Proxy-Connection":    {"keep-alive"},
+				"Te":                  {"gzip"},
+				"Upgrade":             {"h2c"},
+				"Content-Type":        {"application/json"},
+			},
+			want: http.Header{"Content-Type": {"application/json"}},
+		},
+		{
+			name: "headers named by Connection",
+			header: http.Header{
+				"Connection":   {"close, X-Hop", "x-other"},
+				"X-Hop":        {"1"},
+				"X-Other":      {"2"},
+				"X-Amz-Target": {"DynamoDB_20120810.GetItem"},
+			},
+			want: http.Header{"X-Amz-Target": {"DynamoDB_20120810.GetItem"}},
+		},
+		{
+			name:    "upgrade kept",
+			header:  http.Header{"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"websocket"}, "Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="}},
+			upgrade: true,
+			want:    http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}, "Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="}},
+		},
+		{
+			name:   "upgrade not kept",
+			header: http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}},
+			want:   http.Header{},
+		},
+		{
+			name:   "trailers kept",
+			header: http.Header{"Te": {"trailers, deflate;q=0.5"}, "Content-Type": {"application/grpc"}},
+			want:   http.Header{"Te": {"trailers"}, "Content-Type": {"application/grpc"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			removeHopHeaders(tt.header, tt.upgrade)
+			assert.Equal(t, tt.want, tt.header)
+		})
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// The Host headers a ProxyClient can send upstream, and sign, along with
+// the host the requests are sent to.
+const (
+	// ForwardHostOriginal sends the Host header of the clients, e.g. for
+	// custom domains of API Gateway, or load balancers routing by host.
+	ForwardHostOriginal = "original"
+	// ForwardHostOverride sends the host the requests are sent to, the
+	// HostOverride, the host override of the client or its Host header.
+	ForwardHostOverride = "override"
+	// ForwardHostSigning sends the SigningHostOverride.
+	ForwardHostSigning = "signing"
+)
+
+// ValidateForwardHostHeader returns an error when mode, one of the
+// ForwardHost* constants or "" for the default, would send another Host
+// header than the one signed with signHost, the SigningHostOverride, which
+// upstreams always reject with SignatureDoesNotMatch.
+func ValidateForwardHostHeader(mode, signHost string) error {
+	switch mode {
+	case "":
+	case ForwardHostOriginal, ForwardHostOverride:
+		if signHost != "" {
+			return fmt.Errorf("the %s Host header is sent, it cannot be signed for sign-host %s", mode, signHost)
+		}
+	case ForwardHostSigning:
+		if signHost == "" {
+			return fmt.Errorf("the signing Host header requires a sign-host")
+		}
+	default:
+		return fmt.Errorf("unknown forward-host-header %q, expected original, override or signing", mode)
+	}
+	return nil
+}
+
+// forwardHostHeader returns the mode of the Host header of p, with the
+// default resolved: ForwardHostSigning with a SigningHostOverride, and
+// ForwardHostOverride otherwise.
+func (p *ProxyClient) forwardHostHeader() string {
+	if p.ForwardHostHeader != "" {
+		return p.ForwardHostHeader
+	}
+	if p.SigningHostOverride != "" {
+		return ForwardHostSigning
+	}
+	return ForwardHostOverride
+}
+
+// forwardedHost returns the Host header, both signed and sent, of the
+// upstream request of req sent to upstreamHost.
+func (p *ProxyClient) forwardedHost(req *http.Request, upstreamHost string) string {
+	switch p.forwardHostHeader() {
+	case ForwardHostOriginal:
+		if req.Host != "" {
+			return req.Host
+		}
+	case ForwardHostSigning:
+		if p.SigningHostOverride != "" {
+			return p.SigningHostOverride
+		}
+	}
+	return upstreamHost
+}
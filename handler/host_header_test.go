@@ -0,0 +1,152 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/awslabs/aws-sigv4-proxy/sigv4verifier"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+func TestValidateForwardHostHeader(t *testing.T) {
+	tests := []struct {
+		mode     string
+		signHost string
+		wantErr  string
+	}{
+		{mode: ""},
+		{mode: "", signHost: "api.example.com"},
+		{mode: ForwardHostOriginal},
+		{mode: ForwardHostOverride},
+		{mode: ForwardHostSigning, signHost: "api.example.com"},
+		{mode: ForwardHostOriginal, signHost: "api.example.com", wantErr: "the original Host header is sent, it cannot be signed for sign-host api.example.com"},
+		{mode: ForwardHostOverride, signHost: "api.example.com", wantErr: "the override Host header is sent, it cannot be signed for sign-host api.example.com"},
+		{mode: ForwardHostSigning, wantErr: "the signing Host header requires a sign-host"},
+		{mode: "client", wantErr: `unknown forward-host-header "client", expected original, override or signing`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.signHost, func(t *testing.T) {
+			err := ValidateForwardHostHeader(tt.mode, tt.signHost)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestProxyClient_ForwardHostHeader(t *testing.T) {
+	var received string
+	server := httptest.NewServer(&sigv4verifier.Verifier{
+		Credentials: map[string]string{"AKIDEXAMPLE": "secret"},
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.Host
+		}),
+	})
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	tests := []struct {
+		name     string
+		mode     string
+		host     string
+		signHost string
+		override string
+		want     string
+	}{
+		{
+			name: "host of the client by default",
+			host: serverURL.Host,
+			want: serverURL.Host,
+		},
+		{
+			name:     "upstream host by default",
+			override: serverURL.Host,
+			host:     "api.example.com",
+			want:     serverURL.Host,
+		},
+		{
+			name:     "signing host by default with a sign host",
+			override: serverURL.Host,
+			signHost: "abc123.execute-api.us-east-1.amazonaws.com",
+			host:     "api.example.com",
+			want:     "abc123.execute-api.us-east-1.amazonaws.com",
+		},
+		{
+			name:     "original",
+			mode:     ForwardHostOriginal,
+			override: serverURL.Host,
+			host:     "api.example.com",
+			want:     "api.example.com",
+		},
+		{
+			name:     "override",
+			mode:     ForwardHostOverride,
+			override: serverURL.Host,
+			host:     "api.example.com",
+			want:     serverURL.Host,
+		},
+		{
+			name:     "signing",
+			mode:     ForwardHostSigning,
+			override: serverURL.Host,
+			signHost: "api.example.com",
+			host:     "proxy.internal",
+			want:     "api.example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = ""
+			proxyClient := &ProxyClient{
+				Signer:              v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")),
+				Client:              http.DefaultClient,
+				SigningNameOverride: "execute-api",
+				RegionOverride:      "us-east-1",
+				HostOverride:        tt.override,
+				SigningHostOverride: tt.signHost,
+				ForwardHostHeader:   tt.mode,
+				SchemeOverride:      serverURL.Scheme,
+			}
+
+			resp, err := proxyClient.Do(&http.Request{
+				Method: http.MethodGet,
+				URL:    &url.URL{Path: "/prod/items"},
+				Host:   tt.host,
+				Header: http.Header{},
+				Body:   http.NoBody,
+			})
+			if assert.NoError(t, err) {
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+				assert.Equal(t, tt.want, received)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	log "github.com/sirupsen/logrus"
+)
+
+// regionName matches the names of the AWS regions, e.g. us-east-1,
+// us-gov-west-1 or eu-isoe-west-1.
+var regionName = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// heuristicDNSSuffixes are the partitions of the DNS suffixes of the
+// regional hosts the service and region are derived from.
+var heuristicDNSSuffixes = newSuffixIndex(map[string]string{
+	".amazonaws.com":    "aws",
+	".amazonaws.com.cn": "aws-cn",
+	".api.aws":          "aws",
+})
+
+// hostHeuristicsDisabled is set by DisableHostHeuristics.
+var hostHeuristicsDisabled bool
+
+// DisableHostHeuristics turns off the derivation of the service and region of
+// the regional hosts missing from the endpoints, so only the known hosts are
+// signed for. It must be called before any request is proxied.
+func DisableHostHeuristics() {
+	hostHeuristicsDisabled = true
+}
+
+// deriveServiceFromHost returns the service of the regional hosts of AWS
+// missing from the endpoints, in the <service>.<region>.amazonaws.com form,
+// or <region>.<service>.amazonaws.com as for OpenSearch domains, also under
+// amazonaws.com.cn and api.aws. The signing name is the endpoint prefix of
+// the host, which most services sign with. nil for other hosts.
+func deriveServiceFromHost(host string) *endpoints.ResolvedEndpoint {
+	if hostHeuristicsDisabled {
+		return nil
+	}
+	name, partition, ok := heuristicDNSSuffixes.cut(host)
+	if !ok {
+		return nil
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return nil
+	}
+	service, region := labels[len(labels)-2], labels[len(labels)-1]
+	if regionName.MatchString(service) && !regionName.MatchString(region) {
+		service, region = region, service
+	} else if service == "dualstack" && len(labels) > 2 {
+		service = labels[len(labels)-3]
+	}
+	service = strings.TrimSuffix(service, "-fips")
+	// The VPC endpoints are only resolved from their ID.
+	if !regionName.MatchString(region) || service == "" || service == "vpce" || regionName.MatchString(service) {
+		return nil
+	}
+
+	// e.g. aws-us-gov under amazonaws.com.
+	if p, ok := endpoints.PartitionForRegion(defaultPartitions, region); ok {
+		partition = p.ID()
+	}
+
+	if log.GetLevel() == log.DebugLevel {
+		log.WithFields(log.Fields{"host": host, "service": service, "region": region}).Debug("derived the service and region of an unknown host from its name")
+	}
+	return &endpoints.ResolvedEndpoint{
+		URL:           "https://" + host,
+		PartitionID:   partition,
+		SigningRegion: region,
+		SigningName:   service,
+		SigningMethod: "v4",
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeriveServiceFromHost(t *testing.T) {
+	tests := []struct {
+		host          string
+		partition     string
+		signingName   string
+		signingRegion string
+	}{
+		{host: "newservice.us-east-1.amazonaws.com", partition: "aws", signingName: "newservice", signingRegion: "us-east-1"},
+		{host: "newservice-fips.us-gov-west-1.amazonaws.com", partition: "aws-us-gov", signingName: "newservice", signingRegion: "us-gov-west-1"},
+		{host: "newservice.dualstack.eu-west-1.amazonaws.com", partition: "aws", signingName: "newservice", signingRegion: "eu-west-1"},
+		{host: "newservice.ap-southeast-7.api.aws", partition: "aws", signingName: "newservice", signingRegion: "ap-southeast-7"},
+		{host: "newservice.cn-northwest-1.amazonaws.com.cn", partition: "aws-cn", signingName: "newservice", signingRegion: "cn-northwest-1"},
+		{host: "search-logs-abc123.eu-west-1.es.amazonaws.com", partition: "aws", signingName: "es", signingRegion: "eu-west-1"},
+		{host: "abc123.newservice.us-east-1.amazonaws.com", partition: "aws", signingName: "newservice", signingRegion: "us-east-1"},
+		{host: "vpce-0abc123-xyz.newservice.us-east-1.vpce.amazonaws.com", partition: "aws", signingName: "newservice", signingRegion: "us-east-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			service := determineAWSServiceFromHost(tt.host)
+			if assert.NotNil(t, service) {
+				assert.Equal(t, "https://"+tt.host, service.URL)
+				assert.Equal(t, tt.partition, service.PartitionID)
+				assert.Equal(t, tt.signingName, service.SigningName)
+				assert.Equal(t, tt.signingRegion, service.SigningRegion)
+			}
+		})
+	}
+
+	for _, host := range []string{
+		"newservice.amazonaws.com",
+		"newservice.global.amazonaws.com",
+		"us-east-1.amazonaws.com",
+		"s3.us-west-2.vpce.amazonaws.com",
+		"newservice.us-east-1.example.com",
+	} {
+		assert.Nil(t, determineAWSServiceFromHost(host), host)
+	}
+}
+
+func TestDisableHostHeuristics(t *testing.T) {
+	defer func() { hostHeuristicsDisabled = false }()
+	DisableHostHeuristics()
+
+	assert.Nil(t, determineAWSServiceFromHost("newservice.us-east-1.amazonaws.com"))
+	assert.Nil(t, determineAWSServiceFromHost("vpce-0abc123-xyz.newservice.us-east-1.vpce.amazonaws.com"))
+	assert.NotNil(t, determineAWSServiceFromHost("execute-api.us-east-1.amazonaws.com"))
+}
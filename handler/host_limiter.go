@@ -0,0 +1,141 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostLimiter is a Client limiting the requests in flight to each upstream
+// host, so that a slow host cannot tie up every connection and goroutine of
+// the proxy while the other hosts are healthy. A request is in flight until
+// its response body is closed.
+type HostLimiter struct {
+	Client Client
+	// MaxInFlight is the limit of the hosts without one in HostLimits, 0
+	// for no limit.
+	MaxInFlight int
+	// HostLimits are the limits of specific hosts, see Limit.
+	HostLimits map[string]int
+	// Wait is how long a request waits for another one to complete when the
+	// limit of its host is reached, before failing with a 503.
+	Wait time.Duration
+
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func (l *HostLimiter) Do(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+	slots := l.hostSlots(host)
+	if slots == nil {
+		return l.Client.Do(req)
+	}
+
+	if err := l.acquire(req, host, slots); err != nil {
+		return nil, err
+	}
+	resp, err := l.Client.Do(req)
+	if err != nil {
+		<-slots
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { <-slots }}
+	return resp, nil
+}
+
+func (l *HostLimiter) acquire(req *http.Request, host string, slots chan struct{}) error {
+	select {
+	case slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(l.Wait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return &StatusError{
+			StatusCode: http.StatusServiceUnavailable,
+			Err:        fmt.Errorf("%d requests already in flight to %s", cap(slots), host),
+		}
+	case <-req.Context().Done():
+		return &StatusError{StatusCode: StatusClientClosedRequest, Err: req.Context().Err()}
+	}
+}
+
+// Limit sets the limit of host, with or without a port.
+func (l *HostLimiter) Limit(host string, maxInFlight int) {
+	if l.HostLimits == nil {
+		l.HostLimits = map[string]int{}
+	}
+	l.HostLimits[routeHost(host)] = maxInFlight
+}
+
+// hostSlots returns the semaphore of host, nil when it is not limited.
+func (l *HostLimiter) hostSlots(host string) chan struct{} {
+	limit, ok := l.HostLimits[routeHost(host)]
+	if !ok {
+		limit = l.MaxInFlight
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.slots == nil {
+		l.slots = map[string]chan struct{}{}
+	}
+	slots, ok := l.slots[host]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		l.slots[host] = slots
+	}
+	return slots
+}
+
+// InFlight returns the number of requests in flight to each limited host.
+func (l *HostLimiter) InFlight() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	inFlight := make(map[string]int, len(l.slots))
+	for host, slots := range l.slots {
+		inFlight[host] = len(slots)
+	}
+	return inFlight
+}
+
+// releasingBody releases the slot of a request once its body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
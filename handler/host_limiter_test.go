@@ -0,0 +1,110 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostLimiter(t *testing.T) {
+	limiter := &HostLimiter{
+		Client: clientFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host == "failing.internal" {
+				return nil, errors.New("connection refused")
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok"))}, nil
+		}),
+		MaxInFlight: 2,
+		Wait:        10 * time.Millisecond,
+	}
+	limiter.Limit("Slow.Internal:8443", 1)
+	limiter.Limit("unlimited.internal", 0)
+
+	do := func(host string) (*http.Response, error) {
+		return limiter.Do(httptest.NewRequest(http.MethodGet, "https://"+host+"/", nil))
+	}
+
+	// The limit of the host applies, and the other hosts are not affected.
+	slow, err := do("slow.internal:8443")
+	assert.NoError(t, err)
+	_, err = do("slow.internal:8443")
+	assert.Equal(t, http.StatusServiceUnavailable, errorStatusCode(err))
+	assert.EqualError(t, err, "1 requests already in flight to slow.internal:8443")
+
+	first, err := do("fast.internal")
+	assert.NoError(t, err)
+	second, err := do("fast.internal")
+	assert.NoError(t, err)
+	_, err = do("fast.internal")
+	assert.Equal(t, http.StatusServiceUnavailable, errorStatusCode(err))
+	assert.Equal(t, map[string]int{"slow.internal:8443": 1, "fast.internal": 2}, limiter.InFlight())
+
+	// Requests are in flight until their body is closed, once.
+	first.Body.Close()
+	first.Body.Close()
+	third, err := do("fast.internal")
+	assert.NoError(t, err)
+	second.Body.Close()
+	third.Body.Close()
+	slow.Body.Close()
+	assert.Equal(t, map[string]int{"slow.internal:8443": 0, "fast.internal": 0}, limiter.InFlight())
+
+	// Failed requests release their slot.
+	for i := 0; i < 3; i++ {
+		_, err = do("failing.internal")
+		assert.EqualError(t, err, "connection refused")
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err = do("unlimited.internal")
+		assert.NoError(t, err)
+	}
+	assert.NotContains(t, limiter.InFlight(), "unlimited.internal")
+}
+
+func TestHostLimiter_Wait(t *testing.T) {
+	limiter := &HostLimiter{
+		Client: clientFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok"))}, nil
+		}),
+		MaxInFlight: 1,
+		Wait:        time.Second,
+	}
+
+	resp, err := limiter.Do(httptest.NewRequest(http.MethodGet, "https://upstream.internal/", nil))
+	assert.NoError(t, err)
+
+	// A waiting request proceeds once the request in flight completes.
+	time.AfterFunc(10*time.Millisecond, func() { resp.Body.Close() })
+	resp, err = limiter.Do(httptest.NewRequest(http.MethodGet, "https://upstream.internal/", nil))
+	assert.NoError(t, err)
+
+	// A waiting request gives up when its client goes away.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = limiter.Do(httptest.NewRequest(http.MethodGet, "https://upstream.internal/", nil).WithContext(ctx))
+	assert.Equal(t, StatusClientClosedRequest, errorStatusCode(err))
+	resp.Body.Close()
+}
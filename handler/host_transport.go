@@ -0,0 +1,89 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HostTransport is a RoundTripper sending the requests to some upstream
+// hosts with their own transport, e.g. one limited to HTTP/1.1 for the
+// upstreams misbehaving on HTTP/2.
+type HostTransport struct {
+	// Transport sends the requests to the other hosts.
+	Transport http.RoundTripper
+	// Hosts are the transports of specific hosts, see Route.
+	Hosts map[string]http.RoundTripper
+}
+
+// Route sends the requests to host, with or without its port, with transport.
+func (t *HostTransport) Route(host string, transport http.RoundTripper) {
+	if t.Hosts == nil {
+		t.Hosts = make(map[string]http.RoundTripper)
+	}
+	t.Hosts[strings.ToLower(host)] = transport
+}
+
+func (t *HostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+	if transport, ok := t.Hosts[host]; ok {
+		return transport.RoundTrip(req)
+	}
+	if transport, ok := t.Hosts[strings.ToLower(req.URL.Hostname())]; ok {
+		return transport.RoundTrip(req)
+	}
+	return t.Transport.RoundTrip(req)
+}
+
+// HTTP1Transport returns a copy of transport that only speaks HTTP/1.1.
+func HTTP1Transport(transport *http.Transport) *http.Transport {
+	http1 := transport.Clone()
+	http1.Protocols = new(http.Protocols)
+	http1.Protocols.SetHTTP1(true)
+	// HTTP/2 must not be negotiated either.
+	if http1.TLSClientConfig != nil && len(http1.TLSClientConfig.NextProtos) > 0 {
+		var protos []string
+		for _, proto := range http1.TLSClientConfig.NextProtos {
+			if proto != "h2" {
+				protos = append(protos, proto)
+			}
+		}
+		http1.TLSClientConfig.NextProtos = protos
+	}
+	return http1
+}
+
+// HTTP2Transport returns a copy of transport that only speaks HTTP/2, over
+// TLS or, for the http URLs, without it (h2c, with prior knowledge), e.g. for
+// gRPC upstreams.
+func HTTP2Transport(transport *http.Transport) *http.Transport {
+	http2 := transport.Clone()
+	http2.Protocols = new(http.Protocols)
+	http2.Protocols.SetHTTP2(true)
+	http2.Protocols.SetUnencryptedHTTP2(true)
+	// HTTP/1.1 must not be negotiated either.
+	if http2.TLSClientConfig != nil && len(http2.TLSClientConfig.NextProtos) > 0 {
+		var protos []string
+		for _, proto := range http2.TLSClientConfig.NextProtos {
+			if proto != "http/1.1" {
+				protos = append(protos, proto)
+			}
+		}
+		http2.TLSClientConfig.NextProtos = protos
+	}
+	return http2
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostTransport(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	transport := upstream.Client().Transport.(*http.Transport)
+	transport.ForceAttemptHTTP2 = true
+
+	tests := []struct {
+		name      string
+		route     string
+		wantProto string
+	}{
+		{
+			name:      "other host",
+			route:     "upstream.internal",
+			wantProto: "HTTP/2.0",
+		},
+		{
+			name:      "host",
+			route:     "127.0.0.1",
+			wantProto: "HTTP/1.1",
+		},
+		{
+			name:      "host and port",
+			route:     strings.TrimPrefix(upstream.URL, "https://"),
+			wantProto: "HTTP/1.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostTransport := &HostTransport{Transport: transport}
+			hostTransport.Route(tt.route, HTTP1Transport(transport))
+			client := &http.Client{Transport: hostTransport}
+
+			resp, err := client.Get(upstream.URL)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, tt.wantProto, string(body))
+		})
+	}
+}
+
+func TestHTTP2Transport(t *testing.T) {
+	h2c := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetHTTP1(true)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+
+	tls := httptest.NewUnstartedServer(h2c.Config.Handler)
+	tls.EnableHTTP2 = true
+	tls.StartTLS()
+	defer tls.Close()
+
+	transport := tls.Client().Transport.(*http.Transport)
+	for _, url := range []string{h2c.URL, tls.URL} {
+		resp, err := (&http.Client{Transport: HTTP2Transport(transport)}).Get(url)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "HTTP/2.0", string(body), url)
+	}
+}
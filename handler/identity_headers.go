@@ -0,0 +1,59 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// NewIdentityHeaders returns the headers of headers, by name, identifying the
+// traffic of a proxy to the upstreams, such as its environment, cluster or
+// team, see ProxyClient.IdentityHeaders. The headers of the signature cannot
+// be set.
+func NewIdentityHeaders(headers map[string]string) (http.Header, error) {
+	identity := http.Header{}
+	for name, value := range headers {
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid identity header name %q", name)
+		}
+		canonical := http.CanonicalHeaderKey(name)
+		if canonical == "Host" || canonical == "Authorization" || strings.HasPrefix(canonical, "X-Amz-") {
+			return nil, fmt.Errorf("identity header %s is set by the signature", canonical)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return nil, errors.New("identity header " + canonical + " has a line break in its value")
+		}
+		identity.Set(canonical, strings.TrimSpace(value))
+	}
+	return identity, nil
+}
+
+// validHeaderName reports whether name is a token, as RFC 7230 requires of
+// header names.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c >= 0x7f || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
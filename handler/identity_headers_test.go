@@ -0,0 +1,125 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/awslabs/aws-sigv4-proxy/sigv4verifier"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewIdentityHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    http.Header
+		wantErr string
+	}{
+		{
+			name:    "headers",
+			headers: map[string]string{"x-environment": " production ", "X-Team": "payments"},
+			want:    http.Header{"X-Environment": []string{"production"}, "X-Team": []string{"payments"}},
+		},
+		{
+			name:    "none",
+			headers: map[string]string{},
+			want:    http.Header{},
+		},
+		{
+			name:    "invalid name",
+			headers: map[string]string{"X Team": "payments"},
+			wantErr: `invalid identity header name "X Team"`,
+		},
+		{
+			name:    "signature header",
+			headers: map[string]string{"x-amz-security-token": "token"},
+			wantErr: "identity header X-Amz-Security-Token is set by the signature",
+		},
+		{
+			name:    "line break",
+			headers: map[string]string{"X-Team": "payments\r\nX-Admin: true"},
+			wantErr: "identity header X-Team has a line break in its value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewIdentityHeaders(tt.headers)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestProxyClient_IdentityHeaders(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(&sigv4verifier.Verifier{
+		Credentials: map[string]string{"AKIDEXAMPLE": "secret"},
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.Header.Clone()
+			result, _ := (&sigv4verifier.Verifier{Credentials: map[string]string{"AKIDEXAMPLE": "secret"}}).Verify(r)
+			json.NewEncoder(w).Encode(result)
+		}),
+	})
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	identity, err := NewIdentityHeaders(map[string]string{"X-Environment": "production"})
+	assert.NoError(t, err)
+	proxyClient := &ProxyClient{
+		Signer:              v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")),
+		Client:              http.DefaultClient,
+		SigningNameOverride: "execute-api",
+		RegionOverride:      "us-east-1",
+		HostOverride:        serverURL.Host,
+		SchemeOverride:      serverURL.Scheme,
+		IdentityHeaders:     identity,
+	}
+
+	resp, err := proxyClient.Do(&http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: "/prod/items"},
+		Host:   "api.example.com",
+		Header: http.Header{"X-Environment": []string{"development"}, "X-Client": []string{"cli"}},
+		Body:   http.NoBody,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+
+	var result sigv4verifier.Result
+	assert.NoError(t, json.Unmarshal(body, &result))
+	assert.Contains(t, result.SignedHeaders, "x-environment")
+	assert.NotContains(t, result.SignedHeaders, "x-client")
+	assert.Equal(t, []string{"production"}, received["X-Environment"])
+	assert.Equal(t, "cli", received.Get("X-Client"))
+}
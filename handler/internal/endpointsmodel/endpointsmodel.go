@@ -0,0 +1,125 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+// Package endpointsmodel resolves the hosts of an endpoints model of the AWS
+// SDKs to the signing name and region of their service.
+package endpointsmodel
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+type candidate struct {
+	endpoint endpoints.ResolvedEndpoint
+	score    int
+}
+
+// variants are the options of the endpoint variants resolved besides the
+// default one: FIPS, dual-stack, and both.
+var variants = [][]func(*endpoints.Options){
+	{endpoints.UseFIPSEndpointOption},
+	{endpoints.UseDualStackEndpointOption},
+	{endpoints.UseFIPSEndpointOption, endpoints.UseDualStackEndpointOption},
+}
+
+// Resolve returns the resolved endpoint of every host of partitions, of the
+// default, FIPS and dual-stack variants of the endpoints. A host can be
+// modelled by several services (e.g. rds, neptune and docdb), in which case
+// the endpoint whose signing name and region appear in the host wins, falling
+// back to the first one in partition, service and endpoint order. The hosts
+// of the default variants are never taken over by another variant.
+func Resolve(partitions []endpoints.Partition) map[string]endpoints.ResolvedEndpoint {
+	best := resolveVariant(partitions)
+	variantBest := map[string]candidate{}
+	for _, opts := range variants {
+		for host, c := range resolveVariant(partitions, opts...) {
+			if _, ok := best[host]; ok {
+				continue
+			}
+			if current, ok := variantBest[host]; !ok || c.score > current.score {
+				variantBest[host] = c
+			}
+		}
+	}
+
+	resolved := make(map[string]endpoints.ResolvedEndpoint, len(best)+len(variantBest))
+	for host, c := range best {
+		resolved[host] = c.endpoint
+	}
+	for host, c := range variantBest {
+		resolved[host] = c.endpoint
+	}
+	return resolved
+}
+
+// resolveVariant returns the best candidate of every host of the variant of
+// the endpoints of partitions selected by opts.
+func resolveVariant(partitions []endpoints.Partition, opts ...func(*endpoints.Options)) map[string]candidate {
+	best := map[string]candidate{}
+	for _, partition := range partitions {
+		services := partition.Services()
+		for _, serviceID := range sortedKeys(services) {
+			serviceEndpoints := services[serviceID].Endpoints()
+			for _, endpointID := range sortedKeys(serviceEndpoints) {
+				// The variants of the FIPS pseudo-regions, e.g. fips-us-east-1,
+				// are FIPS already.
+				if len(opts) > 0 && strings.Contains(endpointID, "fips") {
+					continue
+				}
+				resolved, err := serviceEndpoints[endpointID].ResolveEndpoint(opts...)
+				if err != nil || !strings.HasPrefix(resolved.URL, "https://") {
+					continue
+				}
+				host := strings.TrimPrefix(resolved.URL, "https://")
+				// Endpoints without a hostname in the model resolve to
+				// "https://".
+				if host == "" {
+					continue
+				}
+				c := candidate{endpoint: resolved, score: score(host, resolved)}
+				if current, ok := best[host]; !ok || c.score > current.score {
+					best[host] = c
+				}
+			}
+		}
+	}
+	return best
+}
+
+func score(host string, endpoint endpoints.ResolvedEndpoint) int {
+	score := 0
+	for _, label := range strings.Split(host, ".") {
+		label = strings.TrimSuffix(label, "-fips")
+		if label == endpoint.SigningName {
+			score += 2
+		}
+		if label == endpoint.SigningRegion {
+			score++
+		}
+	}
+	return score
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
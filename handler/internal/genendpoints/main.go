@@ -0,0 +1,76 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+// Command genendpoints resolves every endpoint of the aws-sdk-go endpoints
+// model and writes them as a Go map literal, so the proxy does not have to
+// walk the model at startup. Run it with go generate after upgrading the SDK.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"os"
+	"sort"
+
+	"github.com/awslabs/aws-sigv4-proxy/handler/internal/endpointsmodel"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	output := flag.String("output", "endpoints_gen.go", "File to write the generated map to")
+	flag.Parse()
+
+	src, err := generate()
+	if err != nil {
+		log.WithError(err).Fatal("unable to generate endpoints")
+	}
+	if err := os.WriteFile(*output, src, 0644); err != nil {
+		log.WithError(err).Fatal("unable to write endpoints")
+	}
+}
+
+// resolve returns the resolved endpoint of every host in the SDK model.
+func resolve() map[string]endpoints.ResolvedEndpoint {
+	return endpointsmodel.Resolve(endpoints.DefaultPartitions())
+}
+
+func generate() ([]byte, error) {
+	resolved := resolve()
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by genendpoints from the aws-sdk-go endpoints model. DO NOT EDIT.\n\n")
+	buf.WriteString("package handler\n\n")
+	buf.WriteString("var generatedEndpoints = map[string]generatedEndpoint{\n")
+	for _, host := range sortedKeys(resolved) {
+		e := resolved[host]
+		fmt.Fprintf(&buf, "\t%q: {%q, %q, %q, %q, %t},\n", host, e.PartitionID, e.SigningRegion, e.SigningName, e.SigningMethod, e.SigningNameDerived)
+	}
+	buf.WriteString("}\n")
+
+	return format.Source(buf.Bytes())
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeneratedEndpointsAreUpToDate(t *testing.T) {
+	want, err := generate()
+	assert.NoError(t, err)
+
+	got, err := os.ReadFile("../../endpoints_gen.go")
+	assert.NoError(t, err)
+	assert.True(t, string(want) == string(got), "handler/endpoints_gen.go is stale, run go generate ./handler")
+}
+
+func TestResolvePrefersMatchingService(t *testing.T) {
+	resolved := resolve()
+
+	assert.Equal(t, "rds", resolved["rds.us-east-1.amazonaws.com"].SigningName)
+	assert.Equal(t, "iotwireless", resolved["api.iotwireless.eu-west-1.amazonaws.com"].SigningName)
+	assert.Equal(t, "us-gov-west-1", resolved["autoscaling-plans.us-gov-west-1.amazonaws.com"].SigningRegion)
+}
+
+func TestResolveVariants(t *testing.T) {
+	resolved := resolve()
+
+	for host, want := range map[string]string{
+		"lambda-fips.us-east-1.amazonaws.com":       "lambda",
+		"lambda.us-east-1.api.aws":                  "lambda",
+		"lambda-fips.us-east-1.api.aws":             "lambda",
+		"s3-fips.dualstack.us-east-1.amazonaws.com": "s3",
+	} {
+		assert.Equal(t, want, resolved[host].SigningName, host)
+		assert.Equal(t, "us-east-1", resolved[host].SigningRegion, host)
+	}
+	// The default variants keep their hosts.
+	assert.Equal(t, "rds", resolved["rds.us-east-1.amazonaws.com"].SigningName)
+	assert.NotContains(t, resolved, "s3-fips.fips-ca-west-1.amazonaws.com")
+	// The endpoints without a hostname, e.g. iam of aws-iso-global.
+	assert.NotContains(t, resolved, "")
+}
@@ -0,0 +1,418 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// jwksMaxAge is how long the keys of a JWKS are used before they are
+	// fetched again.
+	jwksMaxAge = time.Hour
+	// jwksMinRefresh is the minimum interval between two fetches of a JWKS,
+	// as tokens signed with an unknown key trigger one.
+	jwksMinRefresh = time.Minute
+)
+
+// JWTAuth is a Policy requiring clients to present a JSON Web Token, such as
+// an OIDC ID or access token, as a Bearer token of the Authorization header.
+// The token must be signed with a key of the JWKS of the issuer, and be
+// issued by Issuer for Audience. Its claims are exposed in the RequestInfo of
+// the request, e.g. to pick the role to sign with by ClaimRoleCredentials.
+type JWTAuth struct {
+	Issuer   string
+	Audience string
+	// JWKSURL is the URL of the JSON Web Key Set of the issuer, discovered
+	// from its OpenID configuration when empty.
+	JWKSURL string
+	// Leeway is the clock skew tolerated on the expiry and not-before times
+	// of the tokens.
+	Leeway time.Duration
+	// Client fetches the JWKS, http.DefaultClient when nil.
+	Client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	attempted time.Time
+}
+
+func (j *JWTAuth) Name() string {
+	return "jwt"
+}
+
+func (j *JWTAuth) Check(r *http.Request) *Rejection {
+	token := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(token) < 7 || !strings.EqualFold(token[:7], "Bearer ") {
+		return &Rejection{
+			StatusCode: http.StatusUnauthorized,
+			Message:    "missing bearer token",
+			Header:     http.Header{"Www-Authenticate": {"Bearer"}},
+		}
+	}
+	// The Authorization header is replaced by the signature anyway.
+	r.Header.Del("Authorization")
+
+	claims, err := j.verify(strings.TrimSpace(token[7:]), time.Now())
+	if err != nil {
+		return &Rejection{
+			StatusCode: http.StatusUnauthorized,
+			Message:    fmt.Sprintf("invalid bearer token: %v", err),
+			Header:     http.Header{"Www-Authenticate": {`Bearer error="invalid_token"`}},
+		}
+	}
+	if info := RequestInfoFromContext(r.Context()); info != nil {
+		info.Claims = claims
+	}
+	return nil
+}
+
+// verify checks the signature and the claims of token, and returns its
+// claims.
+func (j *JWTAuth) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	key, err := j.key(header.Kid, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != j.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if !jwtAudience(claims["aud"], j.Audience) {
+		return nil, fmt.Errorf("unexpected audience %v", claims["aud"])
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("missing expiry")
+	}
+	if now.Add(-j.Leeway).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(j.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwtAudience reports whether the aud claim, a string or an array of
+// strings, holds audience.
+func jwtAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwtHashes are the hashes of the supported signature algorithms. Symmetric
+// algorithms and "none" are deliberately not supported.
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	hash, ok := jwtHashes[alg]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	invalid := errors.New("invalid signature")
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[0] {
+		case 'R':
+			if rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+				return invalid
+			}
+			return nil
+		case 'P':
+			if rsa.VerifyPSS(key, hash, digest, signature, nil) != nil {
+				return invalid
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(signature) != 2*size {
+			break
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return invalid
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %s does not match the key", alg)
+}
+
+// key returns the key kid of the JWKS, fetching it when it is stale or does
+// not hold kid.
+func (j *JWTAuth) key(kid string, now time.Time) (crypto.PublicKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	key, ok := j.keys[kid]
+	if ok && now.Sub(j.fetched) <= jwksMaxAge {
+		return key, nil
+	}
+	// Stale keys are kept while the JWKS cannot be fetched.
+	if j.attempted.IsZero() || now.Sub(j.attempted) > jwksMinRefresh {
+		j.attempted = now
+		keys, err := j.fetchKeys()
+		if err != nil {
+			log.WithError(err).Warn("unable to fetch JWKS")
+		} else {
+			j.keys = keys
+			j.fetched = now
+		}
+	}
+	if key, ok := j.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchKeys fetches the signing keys of the JWKS, by key ID.
+func (j *JWTAuth) fetchKeys() (map[string]crypto.PublicKey, error) {
+	url := j.JWKSURL
+	if url == "" {
+		var config struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := j.getJSON(strings.TrimSuffix(j.Issuer, "/")+"/.well-known/openid-configuration", &config); err != nil {
+			return nil, err
+		}
+		if config.JWKSURI == "" {
+			return nil, errors.New("no jwks_uri in the OpenID configuration")
+		}
+		url = config.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := j.getJSON(url, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.WithError(err).WithField("kid", k.Kid).Warn("ignoring JWKS key")
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (j *JWTAuth) getJSON(url string, v interface{}) error {
+	client := j.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("GET %s: %w", url, err)
+	}
+	return nil
+}
+
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid %s key", k.Kty)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := jwkCurves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// ClaimRoleCredentials signs requests with the credentials of the role
+// mapped to a claim of their JWT, e.g. one role per group of the groups
+// claim. Requests whose claim maps to no role are forbidden.
+type ClaimRoleCredentials struct {
+	Claim string
+	// Roles are the credentials of the roles by claim value.
+	Roles map[string]*credentials.Credentials
+}
+
+// NewClaimRoleCredentials returns the ClaimRoleCredentials of roles, which
+// maps values of claim to role ARNs. newCredentials returns the credentials
+// of a role, and is called once per distinct role.
+func NewClaimRoleCredentials(claim string, roles map[string]string, newCredentials func(roleARN string) *credentials.Credentials) *ClaimRoleCredentials {
+	c := &ClaimRoleCredentials{Claim: claim, Roles: map[string]*credentials.Credentials{}}
+	byRole := map[string]*credentials.Credentials{}
+	for value, roleARN := range roles {
+		creds, ok := byRole[roleARN]
+		if !ok {
+			creds = newCredentials(roleARN)
+			byRole[roleARN] = creds
+		}
+		c.Roles[value] = creds
+	}
+	return c
+}
+
+// Credentials returns the credentials of the role of the claim value, or of
+// its first value with a role when the claim is an array.
+func (c *ClaimRoleCredentials) Credentials(req *http.Request) (*credentials.Credentials, error) {
+	var claim interface{}
+	if info := RequestInfoFromContext(req.Context()); info != nil {
+		claim = info.Claims[c.Claim]
+	}
+	values, ok := claim.([]interface{})
+	if !ok {
+		values = []interface{}{claim}
+	}
+	for _, value := range values {
+		if value, ok := value.(string); ok {
+			if creds, ok := c.Roles[value]; ok {
+				return creds, nil
+			}
+		}
+	}
+	return nil, &StatusError{StatusCode: http.StatusForbidden, Err: fmt.Errorf("no role is mapped to the %s claim of the token", c.Claim)}
+}
+
+func (c *ClaimRoleCredentials) ExpireCredentials() int {
+	expired := map[*credentials.Credentials]bool{}
+	for _, creds := range c.Roles {
+		if !expired[creds] {
+			creds.Expire()
+			expired[creds] = true
+		}
+	}
+	return len(expired)
+}
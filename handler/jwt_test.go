@@ -0,0 +1,257 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+// signJWT returns a token of claims signed with key, with PKCS #1 v1.5 and
+// SHA-256 for RSA keys and P-256 for EC keys, whatever alg says.
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTAuth_Check(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	fetches := 0
+	var issuer *httptest.Server
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.URL, "jwks_uri": issuer.URL + "/jwks"})
+		case "/jwks":
+			fetches++
+			b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+				{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+				{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer issuer.Close()
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    issuer.URL,
+			"aud":    "sigv4-proxy",
+			"sub":    "alice",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"groups": []string{"observability"},
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          string
+	}{
+		{
+			name:          "RS256",
+			authorization: "Bearer " + signJWT(t, "RS256", "rsa", rsaKey, claims(nil)),
+		},
+		{
+			name:          "ES256",
+			authorization: "bearer " + signJWT(t, "ES256", "ec", ecKey, claims(nil)),
+		},
+		{
+			name:          "audience in an array",
+			authorization: "Bearer " + signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": []string{"other", "sigv4-proxy"}})),
+		},
+		{
+			name: "missing token",
+			want: "missing bearer token",
+		},
+		{
+			name:          "basic authorization",
+			authorization: "Basic YWxpY2U6c2VjcmV0",
+			want:          "missing bearer token",
+		},
+		{
+			name:          "malformed token",
+			authorization: "Bearer token",
+			want:          "invalid bearer token: malformed token",
+		},
+		{
+			name:          "expired",
+			authorization: "Bearer " + signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})),
+			want:          "invalid bearer token: token expired",
+		},
+		{
+			name:          "not valid yet",
+			authorization: "Bearer " + signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})),
+			want:          "invalid bearer token: token not valid yet",
+		},
+		{
+			name:          "missing expiry",
+			authorization: "Bearer " + signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": nil})),
+			want:          "invalid bearer token: missing expiry",
+		},
+		{
+			name:          "other issuer",
+			authorization: "Bearer " + signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"iss": "https://example.com"})),
+			want:          `invalid bearer token: unexpected issuer "https://example.com"`,
+		},
+		{
+			name:          "other audience",
+			authorization: "Bearer " + signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": "other"})),
+			want:          "invalid bearer token: unexpected audience other",
+		},
+		{
+			name:          "signed with another key",
+			authorization: "Bearer " + signJWT(t, "RS256", "rsa", otherKey, claims(nil)),
+			want:          "invalid bearer token: invalid signature",
+		},
+		{
+			name:          "unknown key",
+			authorization: "Bearer " + signJWT(t, "RS256", "other", otherKey, claims(nil)),
+			want:          `invalid bearer token: unknown key "other"`,
+		},
+		{
+			name:          "algorithm of another key",
+			authorization: "Bearer " + signJWT(t, "ES256", "rsa", ecKey, claims(nil)),
+			want:          "invalid bearer token: algorithm ES256 does not match the key",
+		},
+		{
+			name:          "symmetric algorithm",
+			authorization: "Bearer " + signJWT(t, "HS256", "rsa", rsaKey, claims(nil)),
+			want:          `invalid bearer token: unsupported algorithm "HS256"`,
+		},
+		{
+			name:          "no algorithm",
+			authorization: "Bearer " + signJWT(t, "none", "rsa", rsaKey, claims(nil)),
+			want:          `invalid bearer token: unsupported algorithm "none"`,
+		},
+	}
+
+	auth := &JWTAuth{Issuer: issuer.URL, Audience: "sigv4-proxy"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &RequestInfo{}
+			r := WithRequestInfo(httptest.NewRequest(http.MethodGet, "/", nil), info)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+
+			rejection := auth.Check(r)
+			if tt.want != "" {
+				if assert.NotNil(t, rejection) {
+					assert.Equal(t, http.StatusUnauthorized, rejection.StatusCode)
+					assert.Equal(t, tt.want, rejection.Message)
+					assert.Contains(t, rejection.Header.Get("WWW-Authenticate"), "Bearer")
+				}
+				return
+			}
+			if assert.Nil(t, rejection) {
+				assert.Equal(t, "alice", info.Claims["sub"])
+				assert.Empty(t, r.Header.Get("Authorization"))
+			}
+		})
+	}
+	// The unknown key triggered no refetch within jwksMinRefresh.
+	assert.Equal(t, 1, fetches)
+}
+
+func TestClaimRoleCredentials(t *testing.T) {
+	newCredentials := func(roleARN string) *credentials.Credentials {
+		return credentials.NewStaticCredentials(roleARN, "SECRET", "")
+	}
+	provider := NewClaimRoleCredentials("groups", map[string]string{
+		"observability": "arn:aws:iam::123456789012:role/writer",
+		"admins":        "arn:aws:iam::123456789012:role/writer",
+		"readers":       "arn:aws:iam::123456789012:role/reader",
+	}, newCredentials)
+
+	tests := []struct {
+		name     string
+		claims   map[string]interface{}
+		wantRole string
+	}{
+		{
+			name:     "string claim",
+			claims:   map[string]interface{}{"groups": "readers"},
+			wantRole: "arn:aws:iam::123456789012:role/reader",
+		},
+		{
+			name:     "first mapped value of an array claim",
+			claims:   map[string]interface{}{"groups": []interface{}{"staff", "admins", "readers"}},
+			wantRole: "arn:aws:iam::123456789012:role/writer",
+		},
+		{
+			name:   "unmapped value",
+			claims: map[string]interface{}{"groups": []interface{}{"staff"}},
+		},
+		{
+			name: "missing claim",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := WithRequestInfo(httptest.NewRequest(http.MethodGet, "/", nil), &RequestInfo{Claims: tt.claims})
+			creds, err := provider.Credentials(r)
+			if tt.wantRole == "" {
+				assert.Equal(t, http.StatusForbidden, errorStatusCode(err))
+				return
+			}
+			if assert.NoError(t, err) {
+				value, _ := creds.Get()
+				assert.Equal(t, tt.wantRole, value.AccessKeyID)
+			}
+		})
+	}
+	assert.Equal(t, 2, provider.ExpireCredentials())
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// latticeSigningName is the signing name of the services of VPC Lattice,
+// which do not support payload signing.
+const latticeSigningName = "vpc-lattice-svcs"
+
+// determineLatticeService returns the service of the DNS name of a VPC
+// Lattice service, e.g.
+// my-service-0123456789abcdef0.7d67968.vpc-lattice-svcs.us-east-1.on.aws, nil
+// for other hosts. The custom domain names of the services are not detected.
+func determineLatticeService(host string) *endpoints.ResolvedEndpoint {
+	name, ok := strings.CutSuffix(host, ".on.aws")
+	if !ok {
+		return nil
+	}
+	labels := strings.Split(name, ".")
+	n := len(labels)
+	if n < 4 || labels[n-2] != latticeSigningName {
+		return nil
+	}
+	region := labels[n-1]
+	if !regionName.MatchString(region) {
+		return nil
+	}
+	partition, ok := endpoints.PartitionForRegion(defaultPartitions, region)
+	if !ok {
+		return nil
+	}
+	return &endpoints.ResolvedEndpoint{
+		URL:           "https://" + host,
+		PartitionID:   partition.ID(),
+		SigningName:   latticeSigningName,
+		SigningRegion: region,
+		SigningMethod: "v4",
+	}
+}
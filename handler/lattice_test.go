@@ -0,0 +1,77 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetermineLatticeService(t *testing.T) {
+	tests := []struct {
+		host          string
+		partition     string
+		signingRegion string
+	}{
+		{host: "my-service-0123456789abcdef0.7d67968.vpc-lattice-svcs.us-east-1.on.aws", partition: "aws", signingRegion: "us-east-1"},
+		{host: "billing-0abc.1a2b3c4.vpc-lattice-svcs.eu-central-1.on.aws", partition: "aws", signingRegion: "eu-central-1"},
+		{host: "billing-0abc.1a2b3c4.vpc-lattice-svcs.us-gov-west-1.on.aws", partition: "aws-us-gov", signingRegion: "us-gov-west-1"},
+		{host: "7d67968.vpc-lattice-svcs.us-east-1.on.aws"},
+		{host: "my-service.7d67968.vpc-lattice-svcs.moon.on.aws"},
+		{host: "my-service.7d67968.lambda-url.us-east-1.on.aws"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			service := determineAWSServiceFromHost(tt.host)
+			if tt.partition == "" {
+				assert.Nil(t, service)
+				return
+			}
+			if assert.NotNil(t, service) {
+				assert.Equal(t, "https://"+tt.host, service.URL)
+				assert.Equal(t, tt.partition, service.PartitionID)
+				assert.Equal(t, "vpc-lattice-svcs", service.SigningName)
+				assert.Equal(t, tt.signingRegion, service.SigningRegion)
+			}
+		})
+	}
+}
+
+func TestProxyClient_DoLatticeUnsignedPayload(t *testing.T) {
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+		Client: client,
+	}
+
+	_, err := proxyClient.Do(&http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/orders"},
+		Host:   "orders-0123456789abcdef0.7d67968.vpc-lattice-svcs.us-east-1.on.aws",
+		Header: http.Header{},
+		Body:   http.NoBody,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "UNSIGNED-PAYLOAD", client.Request.Header.Get("X-Amz-Content-Sha256"))
+	assert.Contains(t, client.Request.Header.Get("Authorization"), "/us-east-1/vpc-lattice-svcs/aws4_request")
+	assert.Contains(t, client.Request.Header.Get("Authorization"), "x-amz-content-sha256")
+}
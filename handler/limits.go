@@ -0,0 +1,89 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// serviceHeaderLimits are the known limits, in bytes, of the request line
+// and headers of a request to a service. Requests above them are rejected
+// with an opaque error by the service.
+var serviceHeaderLimits = map[string]int{
+	// API Gateway limits the request line and header values to 10KB.
+	"execute-api": 10240,
+}
+
+// largestHeadersReported is the number of headers listed when reporting
+// headers above the limit.
+const largestHeadersReported = 3
+
+// checkRequestLimits fails with a descriptive error when the signed request
+// exceeds the header or URL limits of the upstream, which would otherwise
+// reject it with an opaque 403 or 431.
+func (p *ProxyClient) checkRequestLimits(req *http.Request, signingName string) error {
+	if p.MaxURLLength > 0 {
+		if length := len(req.URL.String()); length > p.MaxURLLength {
+			return &StatusError{
+				StatusCode: http.StatusRequestURITooLong,
+				Err:        fmt.Errorf("signed URL is %d bytes, above the upstream limit of %d bytes", length, p.MaxURLLength),
+			}
+		}
+	}
+
+	limit := p.MaxHeaderBytes
+	if limit == 0 {
+		limit = serviceHeaderLimits[signingName]
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	type headerSize struct {
+		name string
+		size int
+	}
+	var sizes []headerSize
+	total := len(req.Method) + 1 + len(req.URL.RequestURI()) + len(" HTTP/1.1\r\n") + len("Host: \r\n") + len(req.Host)
+	for name, values := range req.Header {
+		size := 0
+		for _, value := range values {
+			size += len(name) + len(": \r\n") + len(value)
+		}
+		total += size
+		sizes = append(sizes, headerSize{name, size})
+	}
+	if total <= limit {
+		return nil
+	}
+
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i].size > sizes[j].size })
+	if len(sizes) > largestHeadersReported {
+		sizes = sizes[:largestHeadersReported]
+	}
+	largest := make([]string, len(sizes))
+	for i, s := range sizes {
+		largest[i] = fmt.Sprintf("%s (%d bytes)", s.name, s.size)
+	}
+	return &StatusError{
+		StatusCode: http.StatusRequestHeaderFieldsTooLarge,
+		Err: fmt.Errorf("signed request line and headers are %d bytes, above the upstream limit of %d bytes, largest headers: %s",
+			total, limit, strings.Join(largest, ", ")),
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyClient_DoRequestLimits(t *testing.T) {
+	tests := []struct {
+		name           string
+		host           string
+		header         http.Header
+		query          string
+		maxHeaderBytes int
+		maxURLLength   int
+		wantStatus     int
+		wantErr        string
+	}{
+		{
+			name: "accepts requests below the API Gateway limit",
+			host: "execute-api.us-east-1.amazonaws.com",
+		},
+		{
+			name:       "rejects requests above the API Gateway limit",
+			host:       "execute-api.us-east-1.amazonaws.com",
+			header:     http.Header{"Cookie": []string{strings.Repeat("a", 10240)}},
+			wantStatus: http.StatusRequestHeaderFieldsTooLarge,
+			wantErr:    "above the upstream limit of 10240 bytes, largest headers: Cookie (10250 bytes), Authorization",
+		},
+		{
+			name:   "has no limit for other services by default",
+			host:   "sqs.us-east-1.amazonaws.com",
+			header: http.Header{"Cookie": []string{strings.Repeat("a", 10240)}},
+		},
+		{
+			name:           "applies the configured limit",
+			host:           "sqs.us-east-1.amazonaws.com",
+			header:         http.Header{"X-Large": []string{strings.Repeat("a", 1024)}},
+			maxHeaderBytes: 1024,
+			wantStatus:     http.StatusRequestHeaderFieldsTooLarge,
+			wantErr:        "largest headers: X-Large (1035 bytes)",
+		},
+		{
+			name:           "disables the check with a negative limit",
+			host:           "execute-api.us-east-1.amazonaws.com",
+			header:         http.Header{"Cookie": []string{strings.Repeat("a", 10240)}},
+			maxHeaderBytes: -1,
+		},
+		{
+			name:         "rejects URLs above the limit",
+			host:         "sqs.us-east-1.amazonaws.com",
+			query:        "q=" + strings.Repeat("a", 100),
+			maxURLLength: 64,
+			wantStatus:   http.StatusRequestURITooLong,
+			wantErr:      "signed URL is 139 bytes, above the upstream limit of 64 bytes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyClient := &ProxyClient{
+				Signer:         v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+				Client:         &mockHTTPClient{},
+				MaxHeaderBytes: tt.maxHeaderBytes,
+				MaxURLLength:   tt.maxURLLength,
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/", RawQuery: tt.query},
+				Host:   tt.host,
+				Header: tt.header,
+			})
+			if tt.wantStatus == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Equal(t, tt.wantStatus, errorStatusCode(err))
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ListenAddress is an address the proxy serves the clients on.
+type ListenAddress struct {
+	// Addr is the host:port to listen on, all the interfaces when the host is
+	// empty.
+	Addr string
+	// Scheme is http or https, or empty to serve HTTPS when a certificate is
+	// configured, and HTTP otherwise.
+	Scheme string
+}
+
+// ParseListenAddress parses an address in the "[SCHEME://][HOST]:PORT"
+// format, e.g. "127.0.0.1:8080" or "https://:8443".
+func ParseListenAddress(s string) (ListenAddress, error) {
+	address := ListenAddress{Addr: strings.TrimSpace(s)}
+	if scheme, addr, ok := strings.Cut(address.Addr, "://"); ok {
+		address.Scheme, address.Addr = strings.ToLower(scheme), addr
+	}
+	if address.Scheme != "" && address.Scheme != "http" && address.Scheme != "https" {
+		return ListenAddress{}, fmt.Errorf("invalid listen address %q, expected an http or https scheme", s)
+	}
+	_, port, err := net.SplitHostPort(address.Addr)
+	if err != nil {
+		return ListenAddress{}, fmt.Errorf("invalid listen address %q, expected [http(s)://][host]:port", s)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return ListenAddress{}, fmt.Errorf("invalid port %q in listen address %q", port, s)
+	}
+	return address, nil
+}
+
+func (a ListenAddress) String() string {
+	if a.Scheme == "" {
+		return a.Addr
+	}
+	return a.Scheme + "://" + a.Addr
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    ListenAddress
+		wantErr bool
+	}{
+		{name: "port", s: ":8080", want: ListenAddress{Addr: ":8080"}},
+		{name: "loopback", s: "127.0.0.1:8080", want: ListenAddress{Addr: "127.0.0.1:8080"}},
+		{name: "IPv6", s: "[::1]:8080", want: ListenAddress{Addr: "[::1]:8080"}},
+		{name: "http", s: "http://localhost:8080", want: ListenAddress{Addr: "localhost:8080", Scheme: "http"}},
+		{name: "https", s: " HTTPS://:8443 ", want: ListenAddress{Addr: ":8443", Scheme: "https"}},
+		{name: "unknown scheme", s: "tcp://:8080", wantErr: true},
+		{name: "no port", s: "127.0.0.1", wantErr: true},
+		{name: "bare port", s: "8080", wantErr: true},
+		{name: "invalid port", s: ":http", wantErr: true},
+		{name: "port out of range", s: ":70000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseListenAddress(tt.s)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestListenAddress_String(t *testing.T) {
+	assert.Equal(t, "127.0.0.1:8080", ListenAddress{Addr: "127.0.0.1:8080"}.String())
+	assert.Equal(t, "https://:8443", ListenAddress{Addr: ":8443", Scheme: "https"}.String())
+}
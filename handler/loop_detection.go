@@ -0,0 +1,52 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// LoopHeader marks the upstream requests signed by a proxy with
+// ProxyClient.LoopMarker. It is set once the request is signed, unsigned, so
+// intermediaries may drop it without breaking the signature.
+const LoopHeader = "X-Sigv4-Proxy-Signed-By"
+
+// LoopDetection is a Policy rejecting the requests already signed by a proxy,
+// with a 508. Such requests come from a proxy sending its requests to itself,
+// e.g. with a host override pointing to its own address, or to another proxy:
+// the signature of the first one is replaced, the request signed twice is
+// signed for the wrong host and always fails upstream.
+type LoopDetection struct{}
+
+func (l *LoopDetection) Name() string {
+	return "loop-detection"
+}
+
+func (l *LoopDetection) Check(r *http.Request) *Rejection {
+	marker := r.Header.Get(LoopHeader)
+	if marker == "" {
+		return nil
+	}
+	return &Rejection{
+		StatusCode: http.StatusLoopDetected,
+		Message:    fmt.Sprintf("request already signed by %s, the upstream of a proxy must not be a proxy", marker),
+	}
+}
+
+func (l *LoopDetection) Preview(r *http.Request) *Rejection {
+	return l.Check(r)
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/awslabs/aws-sigv4-proxy/sigv4verifier"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoopDetection_Check(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   *Rejection
+	}{
+		{
+			name:   "unsigned request",
+			header: http.Header{},
+		},
+		{
+			name:   "request signed by a client",
+			header: http.Header{"Authorization": []string{"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240101/us-east-1/s3/aws4_request"}},
+		},
+		{
+			name:   "request signed by a proxy",
+			header: http.Header{LoopHeader: []string{"aws-sigv4-proxy-ip-10-0-1-23"}},
+			want: &Rejection{
+				StatusCode: http.StatusLoopDetected,
+				Message:    "request already signed by aws-sigv4-proxy-ip-10-0-1-23, the upstream of a proxy must not be a proxy",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header = tt.header
+			assert.Equal(t, tt.want, (&LoopDetection{}).Check(r))
+		})
+	}
+}
+
+func TestProxyClient_LoopMarker(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(&sigv4verifier.Verifier{
+		Credentials: map[string]string{"AKIDEXAMPLE": "secret"},
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.Header.Clone()
+			result, _ := (&sigv4verifier.Verifier{Credentials: map[string]string{"AKIDEXAMPLE": "secret"}}).Verify(r)
+			json.NewEncoder(w).Encode(result)
+		}),
+	})
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	proxyClient := &ProxyClient{
+		Signer:              v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")),
+		Client:              http.DefaultClient,
+		SigningNameOverride: "execute-api",
+		RegionOverride:      "us-east-1",
+		HostOverride:        serverURL.Host,
+		SchemeOverride:      serverURL.Scheme,
+		LoopMarker:          "aws-sigv4-proxy-a",
+	}
+
+	resp, err := proxyClient.Do(&http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: "/prod/items"},
+		Host:   "api.example.com",
+		Header: http.Header{LoopHeader: []string{"forged"}},
+		Body:   http.NoBody,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+
+	var result sigv4verifier.Result
+	assert.NoError(t, json.Unmarshal(body, &result))
+	assert.NotContains(t, result.SignedHeaders, "x-sigv4-proxy-signed-by")
+	assert.Equal(t, []string{"aws-sigv4-proxy-a"}, received[LoopHeader])
+}
+
+func TestHandler_ProxyLoop(t *testing.T) {
+	proxy := &Handler{Policies: []Policy{&LoopDetection{}}}
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	// The proxy sends its requests to itself.
+	proxy.ProxyClient = &ProxyClient{
+		Signer:              v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")),
+		Client:              http.DefaultClient,
+		SigningNameOverride: "execute-api",
+		RegionOverride:      "us-east-1",
+		HostOverride:        serverURL.Host,
+		SchemeOverride:      serverURL.Scheme,
+		LoopMarker:          "aws-sigv4-proxy-a",
+	}
+
+	resp, err := http.Get(server.URL + "/prod/items")
+	if !assert.NoError(t, err) {
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusLoopDetected, resp.StatusCode)
+	assert.Contains(t, string(body), "request already signed by aws-sigv4-proxy-a")
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Headers clients set to override the signing parameters of a request.
+const (
+	ServiceOverrideHeader = "X-Sigv4-Proxy-Service"
+	RegionOverrideHeader  = "X-Sigv4-Proxy-Region"
+	HostOverrideHeader    = "X-Sigv4-Proxy-Host"
+)
+
+// Names of the per-request overrides, as allowed in
+// ProxyClient.AllowedOverrides.
+const (
+	OverrideService = "service"
+	OverrideRegion  = "region"
+	OverrideHost    = "host"
+)
+
+var overrideHeaders = map[string]string{
+	OverrideService: ServiceOverrideHeader,
+	OverrideRegion:  RegionOverrideHeader,
+	OverrideHost:    HostOverrideHeader,
+}
+
+// requestOverrides are the signing parameters a client overrode for a
+// single request.
+type requestOverrides struct {
+	Service string
+	Region  string
+	Host    string
+}
+
+// requestOverrides removes the override headers from req and returns their
+// values. Overrides are ignored unless some are allowed, in which case using
+// one that is not allowed is forbidden.
+func (p *ProxyClient) requestOverrides(req *http.Request) (*requestOverrides, error) {
+	values := map[string]string{}
+	for name, header := range overrideHeaders {
+		if value := req.Header.Get(header); value != "" {
+			values[name] = value
+		}
+		req.Header.Del(header)
+	}
+	if len(p.AllowedOverrides) == 0 {
+		return &requestOverrides{}, nil
+	}
+
+	allowed := map[string]bool{}
+	for _, name := range p.AllowedOverrides {
+		allowed[name] = true
+	}
+	for name := range values {
+		if !allowed[name] {
+			return nil, &StatusError{StatusCode: http.StatusForbidden, Err: fmt.Errorf("overriding the signing %s with %s is not allowed", name, overrideHeaders[name])}
+		}
+	}
+
+	return &requestOverrides{
+		Service: values[OverrideService],
+		Region:  values[OverrideRegion],
+		Host:    values[OverrideHost],
+	}, nil
+}
+
+// SigningName returns the name of the service p would sign req for, the
+// DefaultSigningName when it cannot be determined, without removing the
+// override headers of req.
+func (p *ProxyClient) SigningName(req *http.Request) string {
+	for _, name := range p.AllowedOverrides {
+		if name == OverrideService {
+			if service := req.Header.Get(ServiceOverrideHeader); service != "" {
+				return service
+			}
+		}
+	}
+	if p.SigningNameOverride != "" {
+		return p.SigningNameOverride
+	}
+	if service := determineAWSServiceFromHost(req.Host); service != nil {
+		return service.SigningName
+	}
+	return p.DefaultSigningName
+}
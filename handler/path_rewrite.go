@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PathRewrite rewrites the paths of the upstream requests matching a regular
+// expression before they are signed, e.g. to map /api/v1/(.*) to
+// /workspaces/ws-123/api/v1/$1. The escaped paths are rewritten, so that the
+// escaped slashes of S3 keys stay escaped.
+type PathRewrite struct {
+	// Match is the regular expression of the paths to rewrite.
+	Match string `yaml:"match"`
+	// Replace replaces the matches of Match, $1 or ${name} standing for the
+	// submatches.
+	Replace string `yaml:"replace"`
+
+	regexp *regexp.Regexp
+}
+
+// NewPathRewrite returns the PathRewrite replacing the matches of match with
+// replace.
+func NewPathRewrite(match, replace string) (*PathRewrite, error) {
+	rewrite := &PathRewrite{Match: match, Replace: replace}
+	if err := rewrite.compile(); err != nil {
+		return nil, err
+	}
+	return rewrite, nil
+}
+
+// NewStripPathPrefix returns the PathRewrite removing prefix from the paths
+// that are prefix or below it, keeping the slashes that follow it.
+func NewStripPathPrefix(prefix string) (*PathRewrite, error) {
+	if !pathPrefix.MatchString(prefix) {
+		return nil, fmt.Errorf("invalid path prefix %q, expected /segment[/segment...]", prefix)
+	}
+	return NewPathRewrite("^"+regexp.QuoteMeta(routePathPrefix(prefix))+"(/|$)", "/")
+}
+
+func (r *PathRewrite) compile() error {
+	if r.Match == "" {
+		return fmt.Errorf("path rewrite has no match")
+	}
+	re, err := regexp.Compile(r.Match)
+	if err != nil {
+		return fmt.Errorf("invalid path rewrite match %q: %w", r.Match, err)
+	}
+	r.regexp = re
+	return nil
+}
+
+// rewritePath rewrites the path of u with rewrites, in order.
+func rewritePath(u *url.URL, rewrites []*PathRewrite) error {
+	original := u.EscapedPath()
+	path := original
+	for _, rewrite := range rewrites {
+		path = rewrite.regexp.ReplaceAllString(path, rewrite.Replace)
+	}
+	if path == original {
+		return nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return badRequest(fmt.Errorf("invalid rewritten path %q: %w", path, err))
+	}
+	log.WithFields(log.Fields{"path": original, "rewritten_path": path}).Debug("rewrote path")
+	u.Path, u.RawPath = unescaped, path
+	return nil
+}
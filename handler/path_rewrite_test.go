@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewritePath(t *testing.T) {
+	strip, _ := NewStripPathPrefix("/proxy/")
+	workspace, _ := NewPathRewrite(`^/prometheus/api/v1/(.*)$`, "/workspaces/ws-123/api/v1/$1")
+	relative, _ := NewPathRewrite(`^/v1/`, "v2/")
+
+	tests := []struct {
+		name     string
+		rewrites []*PathRewrite
+		path     string
+		want     string
+	}{
+		{name: "strips a prefix", rewrites: []*PathRewrite{strip}, path: "/proxy/bucket/key", want: "/bucket/key"},
+		{name: "strips a whole prefix", rewrites: []*PathRewrite{strip}, path: "/proxy", want: "/"},
+		{name: "keeps leading slashes of keys", rewrites: []*PathRewrite{strip}, path: "/proxy//key", want: "//key"},
+		{name: "matches whole segments", rewrites: []*PathRewrite{strip}, path: "/proxyx/key", want: "/proxyx/key"},
+		{name: "regex", rewrites: []*PathRewrite{workspace}, path: "/prometheus/api/v1/remote_write", want: "/workspaces/ws-123/api/v1/remote_write"},
+		{name: "in order", rewrites: []*PathRewrite{strip, workspace}, path: "/proxy/prometheus/api/v1/query", want: "/workspaces/ws-123/api/v1/query"},
+		{name: "keeps escaping", rewrites: []*PathRewrite{strip}, path: "/proxy/bucket/a%2Fb", want: "/bucket/a%2Fb"},
+		{name: "absolute", rewrites: []*PathRewrite{relative}, path: "/v1/items", want: "/v2/items"},
+		{name: "no match", rewrites: []*PathRewrite{workspace}, path: "/api/v1/query", want: "/api/v1/query"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, _ := url.Parse("https://upstream.internal" + tt.path)
+			assert.NoError(t, rewritePath(u, tt.rewrites))
+			assert.Equal(t, tt.want, u.EscapedPath())
+		})
+	}
+
+	invalid, _ := NewPathRewrite(`^/(.*)$`, "/%zz/$1")
+	u, _ := url.Parse("https://upstream.internal/key")
+	assert.Equal(t, http.StatusBadRequest, errorStatusCode(rewritePath(u, []*PathRewrite{invalid})))
+}
+
+func TestNewPathRewrite(t *testing.T) {
+	_, err := NewPathRewrite("", "/")
+	assert.Error(t, err)
+	_, err = NewPathRewrite("^/(", "/")
+	assert.Error(t, err)
+	_, err = NewStripPathPrefix("/")
+	assert.Error(t, err)
+	_, err = NewStripPathPrefix("proxy")
+	assert.Error(t, err)
+}
+
+func TestProxyClient_PathRewrites(t *testing.T) {
+	strip, _ := NewStripPathPrefix("/proxy")
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer:       v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+		Client:       client,
+		PathRewrites: []*PathRewrite{strip},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/proxy/my-bucket/my-key", nil)
+	req.Host = "s3.us-east-1.amazonaws.com"
+	_, err := proxyClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "https://s3.us-east-1.amazonaws.com/my-bucket/my-key", client.Request.URL.String())
+	assert.Equal(t, "/proxy/my-bucket/my-key", req.URL.Path)
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net"
+	"net/http"
+)
+
+// Policy decides whether an incoming request may be proxied. Policies are
+// evaluated by the Handler, in order, before the request is signed.
+type Policy interface {
+	// Name identifies the policy in logs and error responses.
+	Name() string
+	// Check returns a Rejection when the request must not be proxied.
+	Check(r *http.Request) *Rejection
+}
+
+// PolicyObserver is implemented by policies accounting for the requests they
+// allowed, once the response has been written.
+type PolicyObserver interface {
+	Observe(r *http.Request, bytesIn, bytesOut int64)
+}
+
+// PolicyPreviewer is implemented by policies able to tell whether they would
+// reject a request without accounting for it, e.g. without counting it
+// against a quota. The Handler previews the policies following the one
+// rejecting a request, to list every rule the request breaks.
+type PolicyPreviewer interface {
+	Preview(r *http.Request) *Rejection
+}
+
+// Rejection describes why a policy refused a request.
+type Rejection struct {
+	StatusCode int
+	Message    string
+	// Header is added to the error response.
+	Header http.Header
+}
+
+// policyError is the body of the response to a rejected request.
+type policyError struct {
+	Message string `json:"message"`
+	// Policy is the decisive policy, which rejected the request first.
+	Policy     string            `json:"policy"`
+	Rejections []policyRejection `json:"rejections"`
+}
+
+type policyRejection struct {
+	Policy     string `json:"policy"`
+	StatusCode int    `json:"status_code"`
+	Message    string `json:"message"`
+}
+
+// clientIP returns the IP address of the downstream client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
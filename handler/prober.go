@@ -0,0 +1,189 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ProbeTarget is a request the Prober sends.
+type ProbeTarget struct {
+	Method string
+	URL    string
+}
+
+// ParseProbeTarget parses a target in the "[METHOD ]URL" format, e.g.
+// "HEAD https://my-bucket.s3.us-east-1.amazonaws.com/", GET by default.
+func ParseProbeTarget(s string) (ProbeTarget, error) {
+	target := ProbeTarget{Method: http.MethodGet, URL: strings.TrimSpace(s)}
+	if method, rawURL, ok := strings.Cut(target.URL, " "); ok {
+		target.Method, target.URL = strings.ToUpper(method), strings.TrimSpace(rawURL)
+	}
+	u, err := url.Parse(target.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ProbeTarget{}, fmt.Errorf("invalid probe %q, expected [METHOD ]http(s)://host/path", s)
+	}
+	return target, nil
+}
+
+func (t ProbeTarget) String() string {
+	return t.Method + " " + t.URL
+}
+
+// ProbeResult is the outcome of the probes of a target.
+type ProbeResult struct {
+	Target string `json:"target"`
+	// Up is whether the last probe got a response below 400.
+	Up         bool          `json:"up"`
+	StatusCode int           `json:"status_code,omitempty"`
+	Latency    time.Duration `json:"latency"`
+	Error      string        `json:"error,omitempty"`
+	Time       time.Time     `json:"time"`
+	Probes     int64         `json:"probes"`
+	Failures   int64         `json:"failures"`
+}
+
+// Prober periodically sends cheap signed requests to the upstreams, such as
+// STS GetCallerIdentity or HEAD requests to a bucket, to warn of IAM or
+// network regressions before the traffic of the clients fails. The requests
+// are signed and sent by Client, as the ones of the clients, the policies
+// aside.
+type Prober struct {
+	Client   Client
+	Targets  []ProbeTarget
+	Interval time.Duration
+	// Timeout bounds each probe, Interval when zero.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	results map[string]*ProbeResult
+}
+
+// Run probes the targets right away, then at every interval, until stop is
+// closed.
+func (p *Prober) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.ProbeAll()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ProbeAll probes the targets concurrently, and returns once they are all
+// probed.
+func (p *Prober) ProbeAll() {
+	var wg sync.WaitGroup
+	for _, target := range p.Targets {
+		wg.Add(1)
+		go func(target ProbeTarget) {
+			defer wg.Done()
+			p.probe(target)
+		}(target)
+	}
+	wg.Wait()
+}
+
+// Results returns the results of the targets, in the order of Targets, the
+// targets not probed yet left out.
+func (p *Prober) Results() []ProbeResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var results []ProbeResult
+	for _, target := range p.Targets {
+		if result, ok := p.results[target.String()]; ok {
+			results = append(results, *result)
+		}
+	}
+	return results
+}
+
+func (p *Prober) probe(target ProbeTarget) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = p.Interval
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	statusCode, err := p.send(ctx, target)
+	latency := time.Since(start)
+	if err == nil && statusCode >= 400 {
+		err = fmt.Errorf("upstream responded %d %s", statusCode, http.StatusText(statusCode))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.results == nil {
+		p.results = map[string]*ProbeResult{}
+	}
+	result, ok := p.results[target.String()]
+	if !ok {
+		// Considered up before the first probe, to log its failure.
+		result = &ProbeResult{Target: target.String(), Up: true}
+		p.results[target.String()] = result
+	}
+	wasUp := result.Up
+	result.Up, result.StatusCode, result.Latency, result.Time, result.Error = err == nil, statusCode, latency, start, ""
+	result.Probes++
+
+	entry := log.WithFields(log.Fields{"target": result.Target, "status_code": statusCode, "latency": latency.Round(time.Millisecond)})
+	if err != nil {
+		result.Error = err.Error()
+		result.Failures++
+		if wasUp {
+			entry.WithError(err).Warn("upstream probe failed")
+		} else {
+			entry.WithError(err).Debug("upstream probe failed")
+		}
+		return
+	}
+	if !wasUp {
+		entry.Info("upstream probe recovered")
+		return
+	}
+	entry.Debug("upstream probe succeeded")
+}
+
+func (p *Prober) send(ctx context.Context, target ProbeTarget) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, target.Method, target.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
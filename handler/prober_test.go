@@ -0,0 +1,110 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProbeTarget(t *testing.T) {
+	target, err := ParseProbeTarget("https://sts.us-east-1.amazonaws.com/?Action=GetCallerIdentity&Version=2011-06-15")
+	assert.NoError(t, err)
+	assert.Equal(t, ProbeTarget{Method: http.MethodGet, URL: "https://sts.us-east-1.amazonaws.com/?Action=GetCallerIdentity&Version=2011-06-15"}, target)
+
+	target, err = ParseProbeTarget("head https://my-bucket.s3.us-east-1.amazonaws.com/")
+	assert.NoError(t, err)
+	assert.Equal(t, ProbeTarget{Method: http.MethodHead, URL: "https://my-bucket.s3.us-east-1.amazonaws.com/"}, target)
+
+	for _, s := range []string{"", "sts.amazonaws.com", "HEAD /path", "ftp://host/"} {
+		_, err := ParseProbeTarget(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestProber(t *testing.T) {
+	statusCode := http.StatusOK
+	var probed []string
+	prober := &Prober{
+		Client: clientFunc(func(req *http.Request) (*http.Response, error) {
+			probed = append(probed, req.Method+" "+req.Host+req.URL.Path)
+			if req.Host == "down.example.com" {
+				return nil, errors.New("connection refused")
+			}
+			return &http.Response{StatusCode: statusCode, Body: http.NoBody}, nil
+		}),
+		Targets: []ProbeTarget{
+			{Method: http.MethodHead, URL: "https://up.example.com/bucket"},
+			{Method: http.MethodGet, URL: "https://down.example.com/"},
+		},
+		Interval: time.Minute,
+	}
+
+	assert.Empty(t, prober.Results())
+	for _, target := range prober.Targets {
+		// Probed one at a time, the client is not safe for concurrent use.
+		prober.probe(target)
+	}
+	assert.Equal(t, []string{"HEAD up.example.com/bucket", "GET down.example.com/"}, probed)
+
+	results := prober.Results()
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, "HEAD https://up.example.com/bucket", results[0].Target)
+		assert.True(t, results[0].Up)
+		assert.Equal(t, http.StatusOK, results[0].StatusCode)
+		assert.Equal(t, int64(1), results[0].Probes)
+		assert.Zero(t, results[0].Failures)
+
+		assert.False(t, results[1].Up)
+		assert.Zero(t, results[1].StatusCode)
+		assert.Equal(t, "connection refused", results[1].Error)
+		assert.Equal(t, int64(1), results[1].Failures)
+	}
+
+	// Access denied, as after an IAM regression.
+	statusCode = http.StatusForbidden
+	prober.probe(prober.Targets[0])
+	result := prober.Results()[0]
+	assert.False(t, result.Up)
+	assert.Equal(t, http.StatusForbidden, result.StatusCode)
+	assert.Equal(t, "upstream responded 403 Forbidden", result.Error)
+	assert.Equal(t, int64(2), result.Probes)
+	assert.Equal(t, int64(1), result.Failures)
+
+	admin := &Admin{Prober: prober}
+	r := httptest.NewRecorder()
+	admin.ServeHTTP(r, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := r.Body.String()
+	for _, line := range []string{
+		"# TYPE sigv4_proxy_probe_up gauge",
+		`sigv4_proxy_probe_up{target="HEAD https://up.example.com/bucket"} 0`,
+		`sigv4_proxy_probe_status_code{target="HEAD https://up.example.com/bucket"} 403`,
+		`sigv4_proxy_probes_total{target="HEAD https://up.example.com/bucket"} 2`,
+		`sigv4_proxy_probe_failures_total{target="GET https://down.example.com/"} 1`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+
+	r = httptest.NewRecorder()
+	admin.ServeHTTP(r, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.True(t, strings.Contains(r.Body.String(), "upstream responded 403 Forbidden"))
+}
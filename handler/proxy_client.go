@@ -16,19 +16,29 @@
 package handler
 
 import (
-	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/awslabs/aws-sigv4-proxy/sigv4a"
+
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	log "github.com/sirupsen/logrus"
 )
 
+// Signing algorithms of ProxyClient.SigningAlgorithm.
+const (
+	SigningAlgorithmV4  = "v4"
+	SigningAlgorithmV4A = "v4a"
+)
+
 // Client is an interface to make testing http.Client calls easier
 type Client interface {
 	Do(req *http.Request) (*http.Response, error)
@@ -44,41 +54,167 @@ type ProxyClient struct {
 	SigningNameOverride     string
 	SigningHostOverride     string
 	HostOverride            string
-	RegionOverride          string
-	LogFailedRequest        bool
-	SchemeOverride          string
+	// ForwardHostHeader is the Host header sent upstream, and signed, one of
+	// ForwardHostOriginal, ForwardHostOverride or ForwardHostSigning. It
+	// defaults to ForwardHostSigning with a SigningHostOverride, and to
+	// ForwardHostOverride otherwise, see ValidateForwardHostHeader.
+	ForwardHostHeader string
+	RegionOverride    string
+	LogFailedRequest  bool
+	SchemeOverride    string
+	// LogFailedRequestMaxBytes bounds the bytes of the failed response bodies
+	// logged, DefaultLogFailedRequestMaxBytes when zero.
+	LogFailedRequestMaxBytes int
+	// CredentialsProvider, when set, selects the credentials used to sign
+	// each request instead of the credentials of Signer.
+	CredentialsProvider CredentialsProvider
+	// PathRewrites rewrite the paths of the upstream requests, in order,
+	// before they are signed.
+	PathRewrites []*PathRewrite
+	// PreserveHeaderCasing lists header names, in the exact casing they must
+	// be sent with. Only HTTP/1.x preserves casing on the wire.
+	PreserveHeaderCasing []string
+	// IdentityHeaders are set on every upstream request before it is signed,
+	// replacing the headers of the clients with the same names, so that the
+	// upstreams can attribute the traffic of shared proxies, e.g. to an
+	// environment or a team. Unlike CustomHeaders, they are signed.
+	IdentityHeaders http.Header
+	// ClientCertHeader, when set, forwards the identity of the certificate
+	// of the clients connected with mutual TLS, signed.
+	ClientCertHeader *ClientCertHeader
+	// HeaderLogSampleRate is the fraction, from 0 to 1, of the requests whose
+	// header changes are logged at info level, see HeaderChange. They are
+	// logged at debug level for every request.
+	HeaderLogSampleRate float64
+	// LoopMarker, when set, identifies the proxy in the LoopHeader of the
+	// upstream requests, for the LoopDetection of another proxy, or of this
+	// one, receiving them.
+	LoopMarker string
+	// PreserveRequestURI forwards the path of the requests exactly as
+	// received, e.g. with the %2F of S3 keys or API Gateway path parameters,
+	// instead of escaping it again, and signs it as sent.
+	PreserveRequestURI bool
+	// PreserveQueryString forwards the query string of the requests exactly
+	// as received, with the order, escaping and + of the client, instead of
+	// encoding its parameters again, and signs it as sent.
+	PreserveQueryString bool
+	// UnsignedPayloadHeader, when set, lets a trusted caller sign a single
+	// request with an unsigned payload by setting this header to "true". The
+	// header is never sent upstream.
+	UnsignedPayloadHeader string
+	// AllowedOverrides lists the signing parameters clients may override per
+	// request with the X-Sigv4-Proxy-* headers, see OverrideService,
+	// OverrideRegion and OverrideHost.
+	AllowedOverrides []string
+	// RequireExplicitSigningConfig disables the detection of the service and
+	// region from the Host header: requests must be signed for an explicit
+	// service and region, from overrides or config sets.
+	RequireExplicitSigningConfig bool
+	// DefaultSigningName and DefaultRegion, when both set, sign the requests
+	// to the hosts whose service and region cannot be detected, instead of
+	// failing them. Unlike SigningNameOverride and RegionOverride, they do
+	// not apply to the known hosts.
+	DefaultSigningName string
+	DefaultRegion      string
+	// SigningAlgorithm is SigningAlgorithmV4, the default, or
+	// SigningAlgorithmV4A to sign with SigV4A for the comma separated region
+	// set of the signing region, e.g. "*" for S3 Multi-Region Access Points.
+	SigningAlgorithm string
+	// MaxHeaderBytes is the limit of the size of the request line and headers
+	// of signed requests, defaulting to the known limit of the service, e.g.
+	// 10KB for API Gateway. Negative disables the check.
+	MaxHeaderBytes int
+	// MaxURLLength, when positive, is the limit of the length of signed URLs,
+	// including presigned query parameters.
+	MaxURLLength int
+	// Retry, when set, retries the requests failing with a throttling or
+	// server error.
+	Retry *RetryPolicy
+	// Timeout, when positive, fails each attempt of an upstream request that
+	// is not complete within it with a 504. Streaming responses are only
+	// bounded by it until their headers are received.
+	Timeout time.Duration
+	// StreamingIdleTimeout, when positive, fails the streaming responses, such
+	// as server-sent events, that send nothing for longer than it.
+	StreamingIdleTimeout time.Duration
+	// ForwardUpgrades forwards the protocol upgrades of the clients, such as
+	// WebSocket handshakes, the upgraded connections being relayed by the
+	// Handler. The Upgrade header is removed otherwise.
+	ForwardUpgrades bool
+	// DynamoDBSimpleJSON converts the items of the DynamoDB requests sent
+	// with the application/json content type from plain JSON to attribute
+	// values, and the items of their responses back.
+	DynamoDBSimpleJSON bool
+	// StreamingUploadThreshold, when positive, is the size from which the
+	// bodies of S3 PUT requests are streamed upstream, signed chunk by chunk,
+	// instead of buffered to hash them. Streaming uploads are not retried.
+	StreamingUploadThreshold int64
+	// MaxRequestBodyMemory, when positive, is the size of the largest request
+	// body buffered in memory. Larger bodies are spilled to a temporary file
+	// of RequestBodySpillDir, or rejected with a 413 when it is empty.
+	MaxRequestBodyMemory int64
+	RequestBodySpillDir  string
+	// BodyMemory, when set, accounts for the bytes of the request bodies
+	// buffered in memory, shared by the config sets, and sheds the requests
+	// whose body does not fit its limit with a 503.
+	BodyMemory *BodyMemory
+	// FollowRegionRedirects sends the S3 requests redirected to the region of
+	// their bucket, with the BucketRegionHeader, again, signed for that region,
+	// instead of returning the redirect.
+	FollowRegionRedirects bool
+	// AllowedUpstreamHosts, when set, are the hosts the requests may be sent
+	// to when the client picks the host, with the Host header or the host
+	// override, so the proxy cannot be made to sign for and reach arbitrary
+	// hosts. * matches any characters, e.g. *.amazonaws.com. Patterns without
+	// a port match the host on any port.
+	AllowedUpstreamHosts []string
 }
 
-func (p *ProxyClient) sign(req *http.Request, service *endpoints.ResolvedEndpoint) error {
-	body := bytes.NewReader([]byte{})
+// signerFor returns the signer to use for the downstream request req.
+func (p *ProxyClient) signerFor(req *http.Request) (*v4.Signer, error) {
+	if p.CredentialsProvider == nil {
+		return p.Signer, nil
+	}
 
-	if req.Body != nil {
-		b, err := ioutil.ReadAll(req.Body)
-		if err != nil {
-			return err
-		}
+	creds, err := p.CredentialsProvider.Credentials(req)
+	if err != nil {
+		return nil, err
+	}
 
-		body = bytes.NewReader(b)
+	signer := *p.Signer
+	signer.Credentials = creds
+	return &signer, nil
+}
+
+// sign signs req, whose payload is body.
+func (p *ProxyClient) sign(req *http.Request, body io.ReadSeeker, signer *v4.Signer, service *endpoints.ResolvedEndpoint) error {
+	if service.SigningName == latticeSigningName && !signer.UnsignedPayload {
+		unsignedSigner := *signer
+		unsignedSigner.UnsignedPayload = true
+		signer = &unsignedSigner
+	}
+
+	if p.SigningAlgorithm == SigningAlgorithmV4A {
+		return signV4A(req, body, signer, service)
 	}
 
 	// S3 service should not have any escaping applied.
 	// https://github.com/aws/aws-sdk-go/blob/main/aws/signer/v4/v4.go#L467-L470
-	if service.SigningName == "s3" {
-		p.Signer.DisableURIPathEscaping = true
-
-		// Enable URI escaping for subsequent calls.
-		defer func() {
-			p.Signer.DisableURIPathEscaping = false
-		}()
+	// The signer is shared by concurrent requests, the option is set on a
+	// copy of it.
+	if signsUnescapedPath(service.SigningName) {
+		s3Signer := *signer
+		s3Signer.DisableURIPathEscaping = true
+		signer = &s3Signer
 	}
 
 	var err error
 	switch service.SigningMethod {
 	case "v4", "s3v4":
-		_, err = p.Signer.Sign(req, body, service.SigningName, service.SigningRegion, time.Now())
+		_, err = signer.Sign(req, body, service.SigningName, service.SigningRegion, time.Now())
 		break
 	case "s3":
-		_, err = p.Signer.Presign(req, body, service.SigningName, service.SigningRegion, time.Duration(time.Hour), time.Now())
+		_, err = signer.Presign(req, body, service.SigningName, service.SigningRegion, time.Duration(time.Hour), time.Now())
 		break
 	default:
 		err = fmt.Errorf("unable to sign with specified signing method %s for service %s", service.SigningMethod, service.SigningName)
@@ -92,6 +228,34 @@ func (p *ProxyClient) sign(req *http.Request, service *endpoints.ResolvedEndpoin
 	return err
 }
 
+// signsUnescapedPath reports whether the requests of the service of
+// signingName are signed with their path as is, as for S3 and its Object
+// Lambda access points.
+func signsUnescapedPath(signingName string) bool {
+	return signingName == "s3" || signingName == "s3-object-lambda"
+}
+
+// signV4A signs req with SigV4A, with the credentials and payload settings of
+// signer.
+func signV4A(req *http.Request, body io.ReadSeeker, signer *v4.Signer, service *endpoints.ResolvedEndpoint) error {
+	if service.SigningMethod == "s3" {
+		return fmt.Errorf("unable to presign with SigV4A for service %s", service.SigningName)
+	}
+
+	v4aSigner := &sigv4a.Signer{
+		Credentials:            signer.Credentials,
+		DisableURIPathEscaping: signsUnescapedPath(service.SigningName),
+		UnsignedPayload:        signer.UnsignedPayload,
+	}
+	regionSet := strings.Split(service.SigningRegion, ",")
+	if err := v4aSigner.Sign(req, body, service.SigningName, regionSet, time.Now()); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{"service": service.SigningName, "region_set": service.SigningRegion}).Debug("signed request with SigV4A")
+	return nil
+}
+
 func copyHeaderWithoutOverwrite(dst, src http.Header) {
 	for k, vv := range src {
 		if _, ok := dst[k]; !ok {
@@ -121,71 +285,413 @@ func chunked(transferEncoding []string) bool {
 	return false
 }
 
-func readDownStreamRequestBody(req *http.Request) ([]byte, error) {
-	if req.Body == nil {
-		return []byte{}, nil
+// stripHeaders removes the headers matching patterns from header. A pattern
+// is a header name, case insensitive, where * matches any characters, e.g.
+// X-Internal-*. Plain names are removed directly, the header names are only
+// scanned once for every pattern with a wildcard. It returns the headers
+// removed.
+func stripHeaders(header http.Header, patterns []string) []HeaderChange {
+	var changes []HeaderChange
+	var wildcards []string
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "*") {
+			log.WithField("StripHeader", pattern).Debug("Stripping Header:")
+			name := http.CanonicalHeaderKey(pattern)
+			if _, ok := header[name]; ok {
+				changes = append(changes, HeaderChange{Rule: HeaderRuleStrip, Pattern: pattern, Header: name})
+			}
+			header.Del(pattern)
+			continue
+		}
+		wildcards = append(wildcards, pattern)
+	}
+	if len(wildcards) == 0 {
+		return changes
+	}
+
+	for name := range header {
+		lower := strings.ToLower(name)
+		for _, pattern := range wildcards {
+			if matchWildcard(strings.ToLower(pattern), lower) {
+				log.WithField("StripHeader", name).Debug("Stripping Header:")
+				changes = append(changes, HeaderChange{Rule: HeaderRuleStrip, Pattern: pattern, Header: name})
+				delete(header, name)
+				break
+			}
+		}
+	}
+	return changes
+}
+
+// matchWildcard reports whether s matches pattern, where * matches any
+// characters.
+func matchWildcard(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
 	}
-	defer req.Body.Close()
-	return io.ReadAll(req.Body)
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return len(s) >= len(last) && strings.HasSuffix(s, last)
+}
+
+// upstreamHostAllowed reports whether host, with an optional port, matches
+// AllowedUpstreamHosts.
+func (p *ProxyClient) upstreamHostAllowed(host string) bool {
+	if len(p.AllowedUpstreamHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, pattern := range p.AllowedUpstreamHosts {
+		pattern = strings.ToLower(pattern)
+		if strings.Contains(pattern, ":") {
+			if matchWildcard(pattern, host) {
+				return true
+			}
+		} else if matchWildcard(pattern, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// preserveHeaderCasing rewrites the canonical MIME keys of the given headers
+// to their configured casing. The http.Header map must not be accessed with
+// Get/Set for those headers afterwards, as they are no longer canonical.
+func preserveHeaderCasing(header http.Header, names []string) {
+	for _, name := range names {
+		canonical := http.CanonicalHeaderKey(name)
+		if canonical == name {
+			continue
+		}
+		if vals, ok := header[canonical]; ok {
+			delete(header, canonical)
+			header[name] = vals
+		}
+	}
+}
+
+// escapedPathAsReceived returns the path of u escaped as it was parsed. Unlike
+// EscapedPath, it does not escape the whole path again when some of it is
+// not escaped the default way, which turns a %2F into a /.
+func escapedPathAsReceived(u *url.URL) string {
+	if u.RawPath != "" {
+		return u.RawPath
+	}
+	return u.EscapedPath()
 }
 
 func (p *ProxyClient) Do(req *http.Request) (*http.Response, error) {
 	proxyURL := *req.URL
+	proxyURL.Scheme = "https"
+	if scheme := upstreamScheme(req.Context()); scheme != "" {
+		proxyURL.Scheme = scheme
+	}
+	if p.SchemeOverride != "" {
+		proxyURL.Scheme = p.SchemeOverride
+	}
 	if p.HostOverride != "" {
 		proxyURL.Host = p.HostOverride
-
 	} else {
-		proxyURL.Host = req.Host
+		proxyURL.Host = normalizeHost(req.Host, proxyURL.Scheme)
 	}
-	proxyURL.Scheme = "https"
-	if p.SchemeOverride != "" {
-		proxyURL.Scheme = p.SchemeOverride
+
+	overrides, err := p.requestOverrides(req)
+	if err != nil {
+		return nil, err
+	}
+	if overrides.Host != "" {
+		proxyURL.Host = normalizeHost(overrides.Host, proxyURL.Scheme)
+	}
+	if (p.HostOverride == "" || overrides.Host != "") && !p.upstreamHostAllowed(proxyURL.Host) {
+		return nil, &StatusError{StatusCode: http.StatusForbidden, Err: fmt.Errorf("upstream host %s is not allowed", proxyURL.Host)}
+	}
+
+	// The hop-by-hop headers concern the connection of the client, they are
+	// neither signed nor sent upstream.
+	removeHopHeaders(req.Header, p.ForwardUpgrades)
+
+	if err := rewritePath(&proxyURL, p.PathRewrites); err != nil {
+		return nil, err
 	}
 
 	if log.GetLevel() == log.DebugLevel {
-		initialReqDump, err := httputil.DumpRequest(req, true)
+		// Bodies that may be streamed are not buffered to be dumped.
+		dumpBody := p.StreamingUploadThreshold <= 0 || req.ContentLength < p.StreamingUploadThreshold
+		initialReqDump, err := httputil.DumpRequest(req, dumpBody)
 		if err != nil {
 			log.WithError(err).Error("unable to dump request")
 		}
 		log.WithField("request", string(initialReqDump)).Debug("Initial request dump:")
 	}
 
-	// Save the request body into memory so that it's rewindable during retry.
-	// See https://github.com/awslabs/aws-sigv4-proxy/issues/185
-	// This may increase memory demand, but the demand should be ok for most cases. If there
-	// are cases proven to be very problematic, we can consider adding a flag to disable this.
-	proxyReqBody, err := readDownStreamRequestBody(req)
+	var service *endpoints.ResolvedEndpoint
+	signingName, region := p.SigningNameOverride, p.RegionOverride
+	if overrides.Service != "" {
+		signingName = overrides.Service
+	}
+	if overrides.Region != "" {
+		region = overrides.Region
+	}
+	if signingName != "" && region != "" {
+		service = &endpoints.ResolvedEndpoint{URL: fmt.Sprintf("%s://%s", proxyURL.Scheme, proxyURL.Host), SigningMethod: "v4", SigningRegion: signingRegion(region), SigningName: signingName}
+	} else if p.RequireExplicitSigningConfig {
+		return nil, &StatusError{StatusCode: http.StatusForbidden, Err: fmt.Errorf("no explicit signing config for host %s, service detection is disabled", req.Host)}
+	} else {
+		service = determineAWSServiceFromHost(req.Host)
+		if service == nil && p.DefaultSigningName != "" && p.DefaultRegion != "" {
+			service = &endpoints.ResolvedEndpoint{URL: fmt.Sprintf("%s://%s", proxyURL.Scheme, proxyURL.Host), SigningMethod: "v4", SigningRegion: signingRegion(p.DefaultRegion), SigningName: p.DefaultSigningName}
+		}
+		if service != nil && overrides.Service != "" {
+			service.SigningName = overrides.Service
+		}
+		if service != nil && overrides.Region != "" {
+			service.SigningRegion = signingRegion(overrides.Region)
+		}
+	}
+	if service == nil {
+		return nil, fmt.Errorf("unable to determine service from host: %s", req.Host)
+	}
+
+	if info := RequestInfoFromContext(req.Context()); info != nil {
+		info.Service = service.SigningName
+		info.Region = service.SigningRegion
+		info.Host = proxyURL.Host
+	}
+
+	signer, err := p.signerFor(req)
 	if err != nil {
 		return nil, err
 	}
 
-	proxyReq, err := http.NewRequest(req.Method, proxyURL.String(), bytes.NewReader(proxyReqBody))
+	if p.UnsignedPayloadHeader != "" {
+		if value := req.Header.Get(p.UnsignedPayloadHeader); value != "" {
+			unsignedPayload, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, badRequest(fmt.Errorf("invalid %s header %q", p.UnsignedPayloadHeader, value))
+			}
+			if unsignedPayload && !signer.UnsignedPayload {
+				log.WithField("header", p.UnsignedPayloadHeader).Debug("signing with an unsigned payload")
+				unsignedSigner := *signer
+				unsignedSigner.UnsignedPayload = true
+				signer = &unsignedSigner
+			}
+		}
+		req.Header.Del(p.UnsignedPayloadHeader)
+	}
+
+	appSync := newAppSyncRealtime(req, proxyURL.Host, signer, service.SigningRegion)
+	if appSync != nil {
+		if proxyURL.RawQuery, err = appSync.connectQuery(proxyURL.Query()); err != nil {
+			return nil, err
+		}
+		// The start messages are only authorized uncompressed.
+		req.Header.Del("Sec-WebSocket-Extensions")
+	}
+
+	var upload *streamingUpload
+	proxyReqBody := &requestBody{}
+	var reqChunked = chunked(req.TransferEncoding)
+	if p.shouldStreamUpload(req, service, signer) {
+		upload, signer, err = newStreamingUpload(req, signer)
+		if err != nil {
+			return nil, err
+		}
+		log.WithFields(log.Fields{"content_length": req.ContentLength}).Debug("streaming upload with chunked payload signing")
+	} else {
+		// Save the request body so that it's rewindable during retry.
+		// See https://github.com/awslabs/aws-sigv4-proxy/issues/185
+		// Bodies are kept in memory unless MaxRequestBodyMemory caps it.
+		proxyReqBody, err = p.readRequestBody(req)
+		if err != nil {
+			return nil, err
+		}
+		defer proxyReqBody.Close()
+
+		// Signing a body that does not match its declared length produces a
+		// payload hash the upstream rejects with a confusing signature error.
+		if !reqChunked && req.ContentLength >= 0 && proxyReqBody.size != req.ContentLength {
+			return nil, badRequest(fmt.Errorf("request body of %d bytes does not match its Content-Length of %d", proxyReqBody.size, req.ContentLength))
+		}
+	}
+
+	simpleDynamoDBJSON := p.DynamoDBSimpleJSON && service.SigningName == "dynamodb" && isSimpleDynamoDBJSON(req)
+	if simpleDynamoDBJSON {
+		data, err := proxyReqBody.bytes()
+		if err != nil {
+			return nil, err
+		}
+		data, err = dynamoDBRequestFromJSON(data)
+		if err != nil {
+			return nil, badRequest(fmt.Errorf("invalid DynamoDB request: %w", err))
+		}
+		proxyReqBody = &requestBody{data: data, size: int64(len(data))}
+		req.ContentLength = proxyReqBody.size
+		reqChunked = false
+		req.Header.Set("Content-Type", dynamoDBContentType)
+		// The response is converted, it must not be compressed.
+		req.Header.Del("Accept-Encoding")
+	}
+
+	resp, err := p.send(req, proxyURL.String(), proxyReqBody, upload, reqChunked, signer, service)
 	if err != nil {
 		return nil, err
 	}
+	if p.FollowRegionRedirects && upload == nil {
+		if resp, err = p.followRegionRedirect(req, proxyURL, resp, proxyReqBody, reqChunked, signer, service); err != nil {
+			return nil, err
+		}
+	}
+	removeHopHeaders(resp.Header, resp.StatusCode == http.StatusSwitchingProtocols)
+	if upstream, ok := resp.Body.(io.ReadWriteCloser); ok && appSync != nil && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = appSync.conn(upstream)
+	}
+	if simpleDynamoDBJSON {
+		if err := toSimpleDynamoDBResponse(resp); err != nil {
+			return nil, err
+		}
+	}
 
-	var reqChunked = chunked(req.TransferEncoding)
+	if (p.LogFailedRequest || log.GetLevel() == log.DebugLevel) && resp.StatusCode >= 400 {
+		maxBytes := p.LogFailedRequestMaxBytes
+		if maxBytes <= 0 {
+			maxBytes = DefaultLogFailedRequestMaxBytes
+		}
+		// Logged once the caller is done with the body, which is streamed.
+		entry := log.WithField("request", fmt.Sprintf("%s %s", req.Method, proxyURL.String())).
+			WithField("status_code", resp.StatusCode)
+		resp.Body = newFailedResponseBody(resp.Body, entry, resp.Header.Get("Content-Encoding"), maxBytes)
+	}
+
+	return resp, nil
+}
+
+// send sends the upstream request of req, retrying it as configured by Retry.
+// The request is signed again for each attempt. Streaming uploads are not
+// retried, their body is consumed by the first attempt.
+func (p *ProxyClient) send(req *http.Request, url string, body *requestBody, upload *streamingUpload, chunked bool, signer *v4.Signer, service *endpoints.ResolvedEndpoint) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		proxyReq, changes, err := p.newUpstreamRequest(req, url, body, upload, chunked, signer, service)
+		if err != nil {
+			return nil, err
+		}
+		// The headers of req are only stripped by the first attempt.
+		if attempt == 1 {
+			p.reportHeaderChanges(req, changes)
+		}
+
+		proxyReq, timeout := p.withTimeout(proxyReq)
+		resp, err := timeout.done(p.Client.Do(proxyReq))
+		if err != nil && req.Context().Err() != nil {
+			return nil, &StatusError{StatusCode: StatusClientClosedRequest, Err: fmt.Errorf("client went away: %w", err)}
+		}
+		delay, retry := p.Retry.backoff(req, attempt, resp, err)
+		if !retry || upload != nil {
+			return resp, err
+		}
+
+		entry := log.WithFields(log.Fields{"request": fmt.Sprintf("%s %s", req.Method, url), "attempt": attempt, "delay": delay})
+		if err != nil {
+			entry.WithError(err).Warn("retrying upstream request")
+		} else {
+			entry.WithField("status_code", resp.StatusCode).Warn("retrying upstream request")
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, &StatusError{StatusCode: StatusClientClosedRequest, Err: fmt.Errorf("client went away while retrying: %w", req.Context().Err())}
+		}
+	}
+}
+
+// newUpstreamRequest returns the signed upstream request of req, with the
+// given URL and buffered body, or streaming upload, and the changes of the
+// header rules to the headers of req.
+func (p *ProxyClient) newUpstreamRequest(req *http.Request, url string, body *requestBody, upload *streamingUpload, reqChunked bool, signer *v4.Signer, service *endpoints.ResolvedEndpoint) (*http.Request, []HeaderChange, error) {
+	proxyReq, err := http.NewRequestWithContext(req.Context(), req.Method, url, body.reader())
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Ignore ContentLength if "chunked" transfer-coding is used.
 	if !reqChunked && req.ContentLength >= 0 {
 		proxyReq.ContentLength = req.ContentLength
 	}
 
-	var service *endpoints.ResolvedEndpoint
-	if p.SigningHostOverride != "" {
-		proxyReq.Host = p.SigningHostOverride
+	proxyReq.Host = p.forwardedHost(req, proxyReq.URL.Host)
+
+	if upload != nil {
+		upload.prepare(proxyReq, req)
+	}
+
+	var changes []HeaderChange
+	for name, values := range p.IdentityHeaders {
+		proxyReq.Header[name] = append([]string(nil), values...)
+		changes = append(changes, HeaderChange{Rule: HeaderRuleIdentity, Pattern: name, Header: name})
 	}
-	if p.SigningNameOverride != "" && p.RegionOverride != "" {
-		service = &endpoints.ResolvedEndpoint{URL: fmt.Sprintf("%s://%s", proxyURL.Scheme, proxyURL.Host), SigningMethod: "v4", SigningRegion: p.RegionOverride, SigningName: p.SigningNameOverride}
+	if h := p.ClientCertHeader; h != nil {
+		if _, ok := req.Header[h.Name]; ok {
+			req.Header.Del(h.Name)
+			changes = append(changes, HeaderChange{Rule: HeaderRuleStrip, Pattern: h.Name, Header: h.Name})
+		}
+		if value := h.value(req); value != "" {
+			proxyReq.Header.Set(h.Name, value)
+			changes = append(changes, HeaderChange{Rule: HeaderRuleIdentity, Pattern: h.Name, Header: h.Name})
+		}
+	}
+
+	var rawPath string
+	if p.PreserveRequestURI {
+		rawPath = escapedPathAsReceived(req.URL)
+		// The signers sign the path of the "//host/path" opaque form as is.
+		proxyReq.URL.Opaque = "//" + proxyReq.URL.Host + rawPath
+	}
+
+	query := forwardedQuery(proxyReq.URL)
+	if p.PreserveQueryString {
+		query = proxyReq.URL.RawQuery
+		if proxyReq.URL.RawQuery, err = rawQuerySigningForm(query); err != nil {
+			return nil, nil, err
+		}
 	} else {
-		service = determineAWSServiceFromHost(req.Host)
+		proxyReq.URL.RawQuery = query
 	}
-	if service == nil {
-		return nil, fmt.Errorf("unable to determine service from host: %s", req.Host)
+	if err := p.sign(proxyReq, body.reader(), signer, service); err != nil {
+		return nil, nil, &signingError{err: err}
+	}
+	// The opaque form is sent as an absolute URI, only needed when the path
+	// starts with "//".
+	if rawPath != "" && !strings.HasPrefix(rawPath, "//") {
+		proxyReq.URL.Opaque = rawPath
+	}
+	// Presigned requests carry the signature in their query.
+	if service.SigningMethod != "s3" {
+		proxyReq.URL.RawQuery = query
 	}
 
-	if err := p.sign(proxyReq, service); err != nil {
-		return nil, err
+	if upload != nil {
+		if err := upload.attach(proxyReq, service); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	// go Documentation net/http, func (*Request) Write: If Body is present,
@@ -205,10 +711,7 @@ func (p *ProxyClient) Do(req *http.Request) (*http.Response, error) {
 	}
 
 	// Remove any headers specified
-	for _, header := range p.StripRequestHeaders {
-		log.WithField("StripHeader", string(header)).Debug("Stripping Header:")
-		req.Header.Del(header)
-	}
+	changes = append(changes, stripHeaders(req.Header, p.StripRequestHeaders)...)
 
 	// Duplicate the header value for any headers specified into a new header
 	// with an "X-Original-" prefix.
@@ -222,38 +725,46 @@ func (p *ProxyClient) Do(req *http.Request) (*http.Response, error) {
 		log.WithField("DuplicateHeader", string(header)).Debug("Duplicate Header to X-Original-* Prefix:")
 		newHeaderName := fmt.Sprintf("X-Original-%s", header)
 		proxyReq.Header.Set(newHeaderName, headerValue)
+		changes = append(changes, HeaderChange{Rule: HeaderRuleDuplicate, Pattern: header, Header: http.CanonicalHeaderKey(newHeaderName)})
 	}
 
 	// Add origin headers after request is signed (no overwrite)
+	for name := range req.Header {
+		rule, pattern := HeaderRuleUnsigned, ""
+		if _, ok := proxyReq.Header[name]; ok {
+			rule, pattern = HeaderRuleDropped, name
+		}
+		changes = append(changes, HeaderChange{Rule: rule, Pattern: pattern, Header: name})
+	}
 	copyHeaderWithoutOverwrite(proxyReq.Header, req.Header)
 
 	// Add custom headers (no overwrite)
+	for name := range p.CustomHeaders {
+		if _, ok := proxyReq.Header[name]; !ok {
+			changes = append(changes, HeaderChange{Rule: HeaderRuleCustom, Pattern: name, Header: name})
+		}
+	}
 	copyHeaderWithoutOverwrite(proxyReq.Header, p.CustomHeaders)
 
-	if log.GetLevel() == log.DebugLevel {
-		proxyReqDump, err := httputil.DumpRequest(proxyReq, true)
-		if err != nil {
-			log.WithError(err).Error("unable to dump request")
-		}
-		log.WithField("request", string(proxyReqDump)).Debug("proxying request")
+	if p.LoopMarker != "" {
+		proxyReq.Header.Set(LoopHeader, p.LoopMarker)
 	}
 
-	resp, err := p.Client.Do(proxyReq)
-	if err != nil {
-		return nil, err
+	if err := p.checkRequestLimits(proxyReq, service.SigningName); err != nil {
+		return nil, nil, err
 	}
 
-	if (p.LogFailedRequest || log.GetLevel() == log.DebugLevel) && resp.StatusCode >= 400 {
-		b, _ := io.ReadAll(resp.Body)
-		log.WithField("request", fmt.Sprintf("%s %s", proxyReq.Method, proxyReq.URL)).
-			WithField("status_code", resp.StatusCode).
-			WithField("message", string(b)).
-			Error("error proxying request")
+	// Signing is case insensitive, so casing can be restored once every other
+	// header manipulation is done.
+	preserveHeaderCasing(proxyReq.Header, p.PreserveHeaderCasing)
 
-		// Need to "reset" the response body because we consumed the stream above, otherwise caller will
-		// get empty body.
-		resp.Body = io.NopCloser(bytes.NewBuffer(b))
+	if log.GetLevel() == log.DebugLevel {
+		proxyReqDump, err := httputil.DumpRequest(proxyReq, upload == nil)
+		if err != nil {
+			log.WithError(err).Error("unable to dump request")
+		}
+		log.WithField("request", string(proxyReqDump)).Debug("proxying request")
 	}
 
-	return resp, nil
+	return proxyReq, changes, nil
 }
@@ -16,13 +16,19 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/awslabs/aws-sigv4-proxy/sigv4verifier"
+
 	"github.com/stretchr/testify/assert"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -43,6 +49,14 @@ func (m *mockHTTPClient) Do(req *http.Request) (*http.Response, error) {
 	return &http.Response{}, nil
 }
 
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
 type mockProvider struct {
 	credentials.Provider
 	Fail bool
@@ -123,6 +137,48 @@ func TestProxyClient_Do(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "should fail if service detection is disabled without explicit signing config",
+			request: &http.Request{
+				Method: "GET",
+				URL:    &url.URL{},
+				Host:   "execute-api.us-west-2.amazonaws.com",
+				Body:   nil,
+			},
+			proxyClient: &ProxyClient{
+				Signer:                       v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:                       &mockHTTPClient{},
+				RequireExplicitSigningConfig: true,
+			},
+			want: &want{
+				resp:    nil,
+				err:     &StatusError{StatusCode: http.StatusForbidden, Err: fmt.Errorf("no explicit signing config for host execute-api.us-west-2.amazonaws.com, service detection is disabled")},
+				request: nil,
+			},
+		},
+		{
+			name: "should sign with explicit signing config when service detection is disabled",
+			request: &http.Request{
+				Method: "GET",
+				URL:    &url.URL{},
+				Host:   "execute-api.us-west-2.amazonaws.com",
+				Body:   nil,
+			},
+			proxyClient: &ProxyClient{
+				Signer:                       v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:                       &mockHTTPClient{},
+				SigningNameOverride:          "execute-api",
+				RegionOverride:               "us-west-2",
+				RequireExplicitSigningConfig: true,
+			},
+			want: &want{
+				resp: &http.Response{},
+				err:  nil,
+				request: &http.Request{
+					Host: "execute-api.us-west-2.amazonaws.com",
+				},
+			},
+		},
 		{
 			name: "should use HostOverride if provided",
 			request: &http.Request{
@@ -160,7 +216,7 @@ func TestProxyClient_Do(t *testing.T) {
 			},
 			want: &want{
 				resp: nil,
-				err:  fmt.Errorf(`mockProvider.Retrieve failed`),
+				err:  &signingError{err: fmt.Errorf(`mockProvider.Retrieve failed`)},
 			},
 		},
 		{
@@ -180,7 +236,7 @@ func TestProxyClient_Do(t *testing.T) {
 			want: &want{
 				resp:    nil,
 				request: nil,
-				err:     fmt.Errorf(`mockProvider.Retrieve failed`),
+				err:     &signingError{err: fmt.Errorf(`mockProvider.Retrieve failed`)},
 			},
 		},
 		{
@@ -265,6 +321,69 @@ func TestProxyClient_Do(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "should fail if the body is shorter than its content length",
+			request: &http.Request{
+				Method:        "PUT",
+				URL:           &url.URL{},
+				Host:          "not.important.host",
+				ContentLength: 10,
+				Body:          io.NopCloser(strings.NewReader("hello")),
+			},
+			proxyClient: &ProxyClient{
+				Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				SigningNameOverride: "ec2",
+				RegionOverride:      "us-west-2",
+				Client:              &mockHTTPClient{},
+			},
+			want: &want{
+				resp:    nil,
+				err:     badRequest(fmt.Errorf("request body of 5 bytes does not match its Content-Length of 10")),
+				request: nil,
+			},
+		},
+		{
+			name: "should fail if the body is longer than its content length",
+			request: &http.Request{
+				Method:        "PUT",
+				URL:           &url.URL{},
+				Host:          "not.important.host",
+				ContentLength: 0,
+				Body:          io.NopCloser(strings.NewReader("hello")),
+			},
+			proxyClient: &ProxyClient{
+				Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				SigningNameOverride: "ec2",
+				RegionOverride:      "us-west-2",
+				Client:              &mockHTTPClient{},
+			},
+			want: &want{
+				resp:    nil,
+				err:     badRequest(fmt.Errorf("request body of 5 bytes does not match its Content-Length of 0")),
+				request: nil,
+			},
+		},
+		{
+			name: "should classify a failure to read the request body as a client abort",
+			request: &http.Request{
+				Method:        "PUT",
+				URL:           &url.URL{},
+				Host:          "not.important.host",
+				ContentLength: 5,
+				Body:          io.NopCloser(io.MultiReader(strings.NewReader("he"), errorReader{io.ErrUnexpectedEOF})),
+			},
+			proxyClient: &ProxyClient{
+				Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				SigningNameOverride: "ec2",
+				RegionOverride:      "us-west-2",
+				Client:              &mockHTTPClient{},
+			},
+			want: &want{
+				resp:    nil,
+				err:     &StatusError{StatusCode: StatusClientClosedRequest, Err: fmt.Errorf("unable to read request body: %w", io.ErrUnexpectedEOF)},
+				request: nil,
+			},
+		},
 		{
 			name: "should propagate content length when it's zero",
 			request: &http.Request{
@@ -479,6 +598,112 @@ func TestProxyClient_Do(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "should preserve the configured header casing",
+			request: &http.Request{
+				Method: "GET",
+				URL:    &url.URL{},
+				Host:   "execute-api.us-west-2.amazonaws.com",
+				Header: http.Header{
+					"X-Custom-Header": []string{"customValue"},
+					"User-Agent":      []string{"customAgent"},
+				},
+				Body: nil,
+			},
+			proxyClient: &ProxyClient{
+				Signer:               v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:               &mockHTTPClient{},
+				PreserveHeaderCasing: []string{"x-custom-HEADER", "X-Not-Present"},
+			},
+			want: &want{
+				resp: &http.Response{},
+				err:  nil,
+				request: &http.Request{
+					Host: "execute-api.us-west-2.amazonaws.com",
+					Header: http.Header{
+						"x-custom-HEADER": []string{"customValue"},
+						"X-Custom-Header": nil,
+						"User-Agent":      []string{"customAgent"},
+					},
+				},
+			},
+		},
+		{
+			name: "should sign with an unsigned payload when requested by header",
+			request: &http.Request{
+				Method: "PUT",
+				URL:    &url.URL{},
+				Host:   "execute-api.us-west-2.amazonaws.com",
+				Header: http.Header{
+					"X-Unsigned-Payload": []string{"true"},
+				},
+				Body: nil,
+			},
+			proxyClient: &ProxyClient{
+				Signer:                v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:                &mockHTTPClient{},
+				UnsignedPayloadHeader: "X-Unsigned-Payload",
+			},
+			want: &want{
+				resp: &http.Response{},
+				err:  nil,
+				request: &http.Request{
+					Host: "execute-api.us-west-2.amazonaws.com",
+					Header: http.Header{
+						"X-Amz-Content-Sha256": []string{"UNSIGNED-PAYLOAD"},
+						"X-Unsigned-Payload":   nil,
+					},
+				},
+			},
+		},
+		{
+			name: "should ignore the unsigned payload header when not enabled",
+			request: &http.Request{
+				Method: "PUT",
+				URL:    &url.URL{},
+				Host:   "execute-api.us-west-2.amazonaws.com",
+				Header: http.Header{
+					"X-Unsigned-Payload": []string{"true"},
+				},
+				Body: nil,
+			},
+			proxyClient: &ProxyClient{
+				Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client: &mockHTTPClient{},
+			},
+			want: &want{
+				resp: &http.Response{},
+				err:  nil,
+				request: &http.Request{
+					Host: "execute-api.us-west-2.amazonaws.com",
+					Header: http.Header{
+						"X-Amz-Content-Sha256": nil,
+					},
+				},
+			},
+		},
+		{
+			name: "should fail on an invalid unsigned payload header",
+			request: &http.Request{
+				Method: "PUT",
+				URL:    &url.URL{},
+				Host:   "execute-api.us-west-2.amazonaws.com",
+				Header: http.Header{
+					"X-Unsigned-Payload": []string{"maybe"},
+				},
+				Body: nil,
+			},
+			proxyClient: &ProxyClient{
+				Signer:                v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:                &mockHTTPClient{},
+				UnsignedPayloadHeader: "X-Unsigned-Payload",
+			},
+			want: &want{
+				resp:    nil,
+				err:     badRequest(fmt.Errorf("invalid X-Unsigned-Payload header \"maybe\"")),
+				request: nil,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -540,3 +765,653 @@ func verifyRequest(received *http.Request, expected *http.Request) bool {
 
 	return received.Host == expected.Host
 }
+
+func TestProxyClient_DoProducesValidSignature(t *testing.T) {
+	server := sigv4verifier.NewServer(map[string]string{"AKIDEXAMPLE": "secret"})
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	tests := []struct {
+		name             string
+		signingAlgorithm string
+		signingName      string
+		region           string
+		wantRegion       string
+	}{
+		{
+			name:        "SigV4",
+			signingName: "execute-api",
+			region:      "us-west-2",
+			wantRegion:  `"region":"us-west-2"`,
+		},
+		{
+			name:             "SigV4A",
+			signingAlgorithm: SigningAlgorithmV4A,
+			signingName:      "execute-api",
+			region:           "us-east-1,us-west-2",
+			wantRegion:       `"region":"us-east-1,us-west-2"`,
+		},
+		{
+			name:             "SigV4A for all regions",
+			signingAlgorithm: SigningAlgorithmV4A,
+			signingName:      "s3",
+			region:           "*",
+			wantRegion:       `"region":"*"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyClient := &ProxyClient{
+				Signer:              v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")),
+				Client:              http.DefaultClient,
+				SigningNameOverride: tt.signingName,
+				RegionOverride:      tt.region,
+				HostOverride:        serverURL.Host,
+				SchemeOverride:      serverURL.Scheme,
+				SigningAlgorithm:    tt.signingAlgorithm,
+			}
+
+			request := &http.Request{
+				Method:        "POST",
+				URL:           &url.URL{Path: "/stage/some path", RawQuery: "b=2&a=1"},
+				Host:          "api.example.com",
+				Header:        http.Header{"Content-Type": []string{"application/json"}},
+				ContentLength: 17,
+				Body:          io.NopCloser(strings.NewReader(`{"hello":"world"}`)),
+			}
+
+			resp, err := proxyClient.Do(request)
+			assert.NoError(t, err)
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+			assert.Contains(t, string(body), tt.wantRegion)
+		})
+	}
+}
+
+func TestProxyClient_PreserveRequestURI(t *testing.T) {
+	server := httptest.NewServer(&sigv4verifier.Verifier{
+		Credentials: map[string]string{"AKIDEXAMPLE": "secret"},
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.RequestURI)
+		}),
+	})
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	tests := []struct {
+		name               string
+		signingAlgorithm   string
+		signingName        string
+		preserveRequestURI bool
+		requestURI         string
+		want               string
+	}{
+		{
+			name:        "encoded slash",
+			signingName: "execute-api",
+			requestURI:  "/prod/items/a%2Fb",
+			want:        "/prod/items/a%2Fb",
+		},
+		{
+			name:        "escaped again without the option",
+			signingName: "execute-api",
+			requestURI:  "/prod/items/a%2fb|c",
+			want:        "/prod/items/a/b%7Cc",
+		},
+		{
+			name:               "API Gateway",
+			signingName:        "execute-api",
+			preserveRequestURI: true,
+			requestURI:         "/prod/items/a%2fb|c",
+			want:               "/prod/items/a%2fb|c",
+		},
+		{
+			name:               "S3",
+			signingName:        "s3",
+			preserveRequestURI: true,
+			requestURI:         "/bucket/dir%2Fkey%7c{1}.txt?versionId=1",
+			want:               "/bucket/dir%2Fkey%7c{1}.txt?versionId=1",
+		},
+		{
+			name:               "S3 Object Lambda",
+			signingName:        "s3-object-lambda",
+			preserveRequestURI: true,
+			requestURI:         "/dir%2Fkey%7c{1}.txt",
+			want:               "/dir%2Fkey%7c{1}.txt",
+		},
+		{
+			name:               "SigV4A",
+			signingAlgorithm:   SigningAlgorithmV4A,
+			signingName:        "s3",
+			preserveRequestURI: true,
+			requestURI:         "/bucket/dir%2Fkey%7c{1}.txt",
+			want:               "/bucket/dir%2Fkey%7c{1}.txt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyClient := &ProxyClient{
+				Signer:              v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")),
+				Client:              http.DefaultClient,
+				SigningNameOverride: tt.signingName,
+				RegionOverride:      "us-east-1",
+				HostOverride:        serverURL.Host,
+				SchemeOverride:      serverURL.Scheme,
+				SigningAlgorithm:    tt.signingAlgorithm,
+				PreserveRequestURI:  tt.preserveRequestURI,
+			}
+
+			requestURL, err := url.ParseRequestURI(tt.requestURI)
+			assert.NoError(t, err)
+			request := &http.Request{Method: "GET", URL: requestURL, Host: "upstream.example.com", Header: http.Header{}, Body: http.NoBody}
+
+			resp, err := proxyClient.Do(request)
+			assert.NoError(t, err)
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+			assert.Equal(t, tt.want, string(body))
+		})
+	}
+}
+
+func TestStripHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+	}{
+		{
+			name:     "names",
+			patterns: []string{"cookie", "X-Internal-Trace"},
+			want:     []string{"Content-Type", "X-Internal-User", "X-Request-Id"},
+		},
+		{
+			name:     "prefix",
+			patterns: []string{"x-internal-*", "Cookie"},
+			want:     []string{"Content-Type", "X-Request-Id"},
+		},
+		{
+			name:     "wildcards",
+			patterns: []string{"*-ID", "x-*-user"},
+			want:     []string{"Content-Type", "Cookie", "X-Internal-Trace"},
+		},
+		{
+			name:     "everything",
+			patterns: []string{"*"},
+			want:     []string{},
+		},
+		{
+			name: "none",
+			want: []string{"Content-Type", "Cookie", "X-Internal-Trace", "X-Internal-User", "X-Request-Id"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{
+				"Content-Type":     {"application/json"},
+				"Cookie":           {"session=1"},
+				"X-Internal-Trace": {"1"},
+				"X-Internal-User":  {"alice"},
+				"X-Request-Id":     {"2"},
+			}
+			stripHeaders(header, tt.patterns)
+
+			names := []string{}
+			for name := range header {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			assert.Equal(t, tt.want, names)
+		})
+	}
+}
+
+// TestProxyClient_DoConcurrentSigning signs S3 and other requests
+// concurrently with the same signer: the S3 signing options must not leak to
+// the other requests. Run with -race.
+func TestProxyClient_DoConcurrentSigning(t *testing.T) {
+	server := sigv4verifier.NewServer(map[string]string{"AKIDEXAMPLE": "secret"})
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	proxyClient := &ProxyClient{
+		Signer:           v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")),
+		Client:           http.DefaultClient,
+		RegionOverride:   "us-west-2",
+		HostOverride:     serverURL.Host,
+		SchemeOverride:   serverURL.Scheme,
+		AllowedOverrides: []string{OverrideService},
+	}
+
+	var wg sync.WaitGroup
+	codes := make([]int, 40)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			service := "execute-api"
+			if i%2 == 0 {
+				service = "s3"
+			}
+			resp, err := proxyClient.Do(&http.Request{
+				Method: http.MethodGet,
+				URL:    &url.URL{Path: "/stage/some path"},
+				Host:   "api.example.com",
+				Header: http.Header{ServiceOverrideHeader: {service}},
+				Body:   http.NoBody,
+			})
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			codes[i] = resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	for i, code := range codes {
+		assert.Equal(t, http.StatusOK, code, "request %d", i)
+	}
+}
+
+func TestProxyClient_DoRepeatedQueryKeys(t *testing.T) {
+	var forwarded string
+	verifier := &sigv4verifier.Verifier{Credentials: map[string]string{"AKIDEXAMPLE": "secret"}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.URL.RawQuery
+		verifier.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	queries := []struct {
+		name     string
+		rawQuery string
+		want     string
+	}{
+		{
+			name:     "repeated key",
+			rawQuery: "attr=b&attr=a",
+			want:     "attr=b&attr=a",
+		},
+		{
+			name:     "repeated key among others",
+			rawQuery: "list-type=2&prefix=photos%2F&delimiter=%2F&prefix=a+b&acl",
+			want:     "list-type=2&prefix=photos%2F&delimiter=%2F&prefix=a%20b&acl",
+		},
+		{
+			name:     "repeated member keys",
+			rawQuery: "Action=GetMetricStatistics&Statistics.member.1=Sum&Statistics.member.1=Average&Dimensions.member.1.Name=InstanceId",
+			want:     "Action=GetMetricStatistics&Statistics.member.1=Sum&Statistics.member.1=Average&Dimensions.member.1.Name=InstanceId",
+		},
+		{
+			name:     "invalid escape",
+			rawQuery: "b=2&a=%zz&b=1",
+			want:     "b=2&b=1",
+		},
+	}
+
+	for _, algorithm := range []string{SigningAlgorithmV4, SigningAlgorithmV4A} {
+		for _, tt := range queries {
+			t.Run(algorithm+" "+tt.name, func(t *testing.T) {
+				proxyClient := &ProxyClient{
+					Signer:              v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")),
+					Client:              http.DefaultClient,
+					SigningNameOverride: "s3",
+					RegionOverride:      "us-west-2",
+					HostOverride:        serverURL.Host,
+					SchemeOverride:      serverURL.Scheme,
+					SigningAlgorithm:    algorithm,
+				}
+
+				resp, err := proxyClient.Do(&http.Request{
+					Method: http.MethodGet,
+					URL:    &url.URL{Path: "/bucket", RawQuery: tt.rawQuery},
+					Host:   "bucket.s3.amazonaws.com",
+					Header: http.Header{},
+					Body:   http.NoBody,
+				})
+				if !assert.NoError(t, err) {
+					return
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+				assert.Equal(t, tt.want, forwarded)
+			})
+		}
+	}
+}
+
+func TestProxyClient_DoPreserveQueryString(t *testing.T) {
+	var forwarded string
+	verifier := &sigv4verifier.Verifier{Credentials: map[string]string{"AKIDEXAMPLE": "secret"}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.URL.RawQuery
+		verifier.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	queries := []struct {
+		name     string
+		rawQuery string
+	}{
+		{
+			name:     "plus and asterisk",
+			rawQuery: "q=title:a+b*&size=10",
+		},
+		{
+			name:     "repeated key",
+			rawQuery: "match[]=up&match[]=process_start_time_seconds&start=1",
+		},
+		{
+			name:     "lowercase escapes",
+			rawQuery: "q=%7e%2a&empty=&flag",
+		},
+	}
+
+	for _, algorithm := range []string{SigningAlgorithmV4, SigningAlgorithmV4A} {
+		for _, tt := range queries {
+			t.Run(algorithm+" "+tt.name, func(t *testing.T) {
+				proxyClient := &ProxyClient{
+					Signer:              v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")),
+					Client:              http.DefaultClient,
+					SigningNameOverride: "es",
+					RegionOverride:      "us-west-2",
+					HostOverride:        serverURL.Host,
+					SchemeOverride:      serverURL.Scheme,
+					SigningAlgorithm:    algorithm,
+					PreserveQueryString: true,
+				}
+
+				resp, err := proxyClient.Do(&http.Request{
+					Method: http.MethodGet,
+					URL:    &url.URL{Path: "/_search", RawQuery: tt.rawQuery},
+					Host:   "search-domain.us-west-2.es.amazonaws.com",
+					Header: http.Header{},
+					Body:   http.NoBody,
+				})
+				if !assert.NoError(t, err) {
+					return
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+				assert.Equal(t, tt.rawQuery, forwarded)
+			})
+		}
+	}
+}
+
+func TestProxyClient_DoPreserveQueryStringInvalidEscape(t *testing.T) {
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer:              v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")),
+		Client:              client,
+		PreserveQueryString: true,
+	}
+
+	_, err := proxyClient.Do(&http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: "/_search", RawQuery: "b=2&a=%zz"},
+		Host:   "search-domain.us-west-2.es.amazonaws.com",
+		Header: http.Header{},
+		Body:   http.NoBody,
+	})
+	var statusErr *StatusError
+	if assert.ErrorAs(t, err, &statusErr) {
+		assert.Equal(t, http.StatusBadRequest, statusErr.StatusCode)
+	}
+	assert.Nil(t, client.Request)
+}
+
+func TestProxyClient_DoSigningOverrides(t *testing.T) {
+	tests := []struct {
+		name             string
+		allowedOverrides []string
+		header           http.Header
+		wantHost         string
+		wantScope        string
+		wantStatus       int
+	}{
+		{
+			name:      "ignores override headers when overrides are not allowed",
+			header:    http.Header{ServiceOverrideHeader: []string{"es"}, RegionOverrideHeader: []string{"eu-west-1"}},
+			wantHost:  "sqs.us-east-1.amazonaws.com",
+			wantScope: "/us-east-1/sqs/aws4_request",
+		},
+		{
+			name:             "overrides the service and region",
+			allowedOverrides: []string{OverrideService, OverrideRegion},
+			header:           http.Header{ServiceOverrideHeader: []string{"es"}, RegionOverrideHeader: []string{"eu-west-1"}},
+			wantHost:         "sqs.us-east-1.amazonaws.com",
+			wantScope:        "/eu-west-1/es/aws4_request",
+		},
+		{
+			name:             "overrides the region of the detected service",
+			allowedOverrides: []string{OverrideRegion},
+			header:           http.Header{RegionOverrideHeader: []string{"fips-us-west-2"}},
+			wantHost:         "sqs.us-east-1.amazonaws.com",
+			wantScope:        "/us-west-2/sqs/aws4_request",
+		},
+		{
+			name:             "overrides the upstream host",
+			allowedOverrides: []string{OverrideHost},
+			header:           http.Header{HostOverrideHeader: []string{"sqs.eu-west-1.amazonaws.com"}},
+			wantHost:         "sqs.eu-west-1.amazonaws.com",
+			wantScope:        "/us-east-1/sqs/aws4_request",
+		},
+		{
+			name:             "forbids overrides that are not allowed",
+			allowedOverrides: []string{OverrideRegion},
+			header:           http.Header{HostOverrideHeader: []string{"example.com"}},
+			wantStatus:       http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:           v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+				Client:           client,
+				AllowedOverrides: tt.allowedOverrides,
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: "GET",
+				URL:    &url.URL{},
+				Host:   "sqs.us-east-1.amazonaws.com",
+				Header: tt.header,
+			})
+			if tt.wantStatus != 0 {
+				assert.Equal(t, tt.wantStatus, errorStatusCode(err))
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantHost, client.Request.URL.Host)
+			assert.Contains(t, client.Request.Header.Get("Authorization"), tt.wantScope)
+			for header := range overrideHeaders {
+				assert.Empty(t, client.Request.Header.Get(overrideHeaders[header]))
+			}
+		})
+	}
+}
+
+func TestProxyClient_DoDefaultSigning(t *testing.T) {
+	tests := []struct {
+		name             string
+		host             string
+		defaultName      string
+		defaultRegion    string
+		allowedOverrides []string
+		header           http.Header
+		wantScope        string
+		wantErr          bool
+	}{
+		{
+			name:          "detected service of known hosts",
+			host:          "sqs.us-east-1.amazonaws.com",
+			defaultName:   "execute-api",
+			defaultRegion: "eu-west-1",
+			wantScope:     "/us-east-1/sqs/aws4_request",
+		},
+		{
+			name:          "default of unknown hosts",
+			host:          "api.internal.example",
+			defaultName:   "execute-api",
+			defaultRegion: "eu-west-1",
+			wantScope:     "/eu-west-1/execute-api/aws4_request",
+		},
+		{
+			name:             "overridden default",
+			host:             "api.internal.example",
+			defaultName:      "execute-api",
+			defaultRegion:    "eu-west-1",
+			allowedOverrides: []string{OverrideRegion},
+			header:           http.Header{RegionOverrideHeader: []string{"us-west-2"}},
+			wantScope:        "/us-west-2/execute-api/aws4_request",
+		},
+		{
+			name:        "unknown hosts without a default region",
+			host:        "api.internal.example",
+			defaultName: "execute-api",
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:             v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+				Client:             client,
+				DefaultSigningName: tt.defaultName,
+				DefaultRegion:      tt.defaultRegion,
+				AllowedOverrides:   tt.allowedOverrides,
+			}
+			header := tt.header
+			if header == nil {
+				header = http.Header{}
+			}
+
+			_, err := proxyClient.Do(&http.Request{Method: "GET", URL: &url.URL{}, Host: tt.host, Header: header})
+			if tt.wantErr {
+				assert.EqualError(t, err, "unable to determine service from host: "+tt.host)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.host, client.Request.URL.Host)
+			assert.Contains(t, client.Request.Header.Get("Authorization"), tt.wantScope)
+		})
+	}
+
+	proxyClient := &ProxyClient{DefaultSigningName: "execute-api", DefaultRegion: "eu-west-1"}
+	assert.Equal(t, "sqs", proxyClient.SigningName(&http.Request{Host: "sqs.us-east-1.amazonaws.com", Header: http.Header{}}))
+	assert.Equal(t, "execute-api", proxyClient.SigningName(&http.Request{Host: "api.internal.example", Header: http.Header{}}))
+}
+
+func TestProxyClient_DoNormalizesHost(t *testing.T) {
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+		Client: client,
+	}
+
+	_, err := proxyClient.Do(&http.Request{Method: "GET", URL: &url.URL{}, Host: "SQS.us-east-1.amazonaws.com:443", Header: http.Header{}})
+	assert.NoError(t, err)
+	assert.Equal(t, "sqs.us-east-1.amazonaws.com", client.Request.URL.Host)
+	assert.Equal(t, "sqs.us-east-1.amazonaws.com", client.Request.Host)
+	assert.Contains(t, client.Request.Header.Get("Authorization"), "/us-east-1/sqs/aws4_request")
+}
+
+func TestProxyClient_DoAllowedUpstreamHosts(t *testing.T) {
+	tests := []struct {
+		name         string
+		host         string
+		hostOverride string
+		header       http.Header
+		want         string
+	}{
+		{
+			name: "allowed host",
+			host: "execute-api.us-west-2.amazonaws.com",
+		},
+		{
+			name: "allowed host case insensitive",
+			host: "Execute-API.us-west-2.AmazonAWS.com",
+		},
+		{
+			name: "allowed host on any port",
+			host: "execute-api.us-west-2.amazonaws.com:8443",
+		},
+		{
+			name: "allowed host with port",
+			host: "localhost:4566",
+		},
+		{
+			name: "other port of a host allowed with a port",
+			host: "localhost:22",
+			want: "upstream host localhost:22 is not allowed",
+		},
+		{
+			name: "other host",
+			host: "169.254.169.254",
+			want: "upstream host 169.254.169.254 is not allowed",
+		},
+		{
+			name: "allowed suffix of another domain",
+			host: "execute-api.us-west-2.amazonaws.com.example.com",
+			want: "upstream host execute-api.us-west-2.amazonaws.com.example.com is not allowed",
+		},
+		{
+			name:         "host chosen by the operator",
+			host:         "execute-api.us-west-2.amazonaws.com",
+			hostOverride: "internal.example.com",
+		},
+		{
+			name:         "host override of the client",
+			host:         "execute-api.us-west-2.amazonaws.com",
+			hostOverride: "internal.example.com",
+			header:       http.Header{HostOverrideHeader: {"metadata.example.com"}},
+			want:         "upstream host metadata.example.com is not allowed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:               v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:               client,
+				SigningNameOverride:  "execute-api",
+				RegionOverride:       "us-west-2",
+				HostOverride:         tt.hostOverride,
+				AllowedOverrides:     []string{OverrideHost},
+				AllowedUpstreamHosts: []string{"*.amazonaws.com", "localhost:4566"},
+			}
+			header := http.Header{}
+			for k, v := range tt.header {
+				header[k] = v
+			}
+
+			_, err := proxyClient.Do(&http.Request{Method: http.MethodGet, URL: &url.URL{}, Host: tt.host, Header: header})
+			if tt.want == "" {
+				assert.NoError(t, err)
+				assert.NotNil(t, client.Request)
+				return
+			}
+			assert.Equal(t, &StatusError{StatusCode: http.StatusForbidden, Err: errors.New(tt.want)}, err)
+			assert.Nil(t, client.Request)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/private/protocol/rest"
+)
+
+// forwardedQuery returns the query of u to send upstream. v4.Signer
+// replaces the query with its canonical form, sorted by key and then by
+// value, which reorders the values of repeated keys such as ?attr=b&attr=a.
+// The parameters are forwarded in the order of the client instead, URI
+// encoded like the canonical query, as the upstream canonicalizes the query
+// itself. Queries that cannot be parsed are sent in canonical form, without
+// the invalid parameters, as v4.Signer does.
+func forwardedQuery(u *url.URL) string {
+	if query, ok := orderedQuery(u.RawQuery); ok {
+		return query
+	}
+	return strings.Replace(u.Query().Encode(), "+", "%20", -1)
+}
+
+// orderedQuery URI encodes the parameters of rawQuery in order, ok is false
+// when some cannot be parsed.
+func orderedQuery(rawQuery string) (query string, ok bool) {
+	// url.ParseQuery drops the parameters with a semicolon.
+	if strings.Contains(rawQuery, ";") {
+		return "", false
+	}
+	query, err := encodeQuery(rawQuery)
+	return query, err == nil
+}
+
+// rawQuerySigningForm returns the query to sign rawQuery with when it is sent
+// as is. The signers decode the query to canonicalize it, the parameters of
+// rawQuery are URI encoded so they decode to the parameters the upstream
+// reads from rawQuery, the ones with a semicolon included.
+func rawQuerySigningForm(rawQuery string) (string, error) {
+	query, err := encodeQuery(rawQuery)
+	if err != nil {
+		return "", badRequest(fmt.Errorf("invalid query: %w", err))
+	}
+	return query, nil
+}
+
+// encodeQuery URI encodes the parameters of rawQuery in order.
+func encodeQuery(rawQuery string) (string, error) {
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		key, value, hasValue := strings.Cut(param, "=")
+		key, err := url.QueryUnescape(key)
+		if err != nil {
+			return "", err
+		}
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			return "", err
+		}
+		if key == "" {
+			continue
+		}
+
+		param = rest.EscapePath(key, true)
+		if hasValue {
+			param += "=" + rest.EscapePath(value, true)
+		}
+		params = append(params, param)
+	}
+	return strings.Join(params, "&"), nil
+}
@@ -0,0 +1,358 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QuotaWindow is the calendar period, in UTC, a quota applies to.
+type QuotaWindow string
+
+const (
+	QuotaDaily   QuotaWindow = "day"
+	QuotaMonthly QuotaWindow = "month"
+)
+
+// QuotaLimit caps the usage of a tenant within a window. Zero values are
+// unlimited.
+type QuotaLimit struct {
+	Window   QuotaWindow
+	Requests int64
+	Bytes    int64
+}
+
+// ParseQuotaLimit parses limits in the "requests/day=1000" or
+// "bytes/month=1073741824" format.
+func ParseQuotaLimit(s string) (QuotaLimit, error) {
+	kv := strings.SplitN(s, "=", 2)
+	unitWindow := strings.SplitN(kv[0], "/", 2)
+	if len(kv) != 2 || len(unitWindow) != 2 {
+		return QuotaLimit{}, fmt.Errorf("invalid quota %q, expected <requests|bytes>/<day|month>=<limit>", s)
+	}
+
+	limit, err := strconv.ParseInt(kv[1], 10, 64)
+	if err != nil || limit <= 0 {
+		return QuotaLimit{}, fmt.Errorf("invalid quota limit %q", kv[1])
+	}
+
+	quota := QuotaLimit{Window: QuotaWindow(unitWindow[1])}
+	if quota.Window != QuotaDaily && quota.Window != QuotaMonthly {
+		return QuotaLimit{}, fmt.Errorf("invalid quota window %q, expected day or month", unitWindow[1])
+	}
+	switch unitWindow[0] {
+	case "requests":
+		quota.Requests = limit
+	case "bytes":
+		quota.Bytes = limit
+	default:
+		return QuotaLimit{}, fmt.Errorf("invalid quota unit %q, expected requests or bytes", unitWindow[0])
+	}
+	return quota, nil
+}
+
+// maxQuotaTenants bounds the tenants a Quota tracks, as they may be derived
+// from client input.
+const maxQuotaTenants = 10000
+
+type windowUsage struct {
+	Start    time.Time `json:"start"`
+	Requests int64     `json:"requests"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// Quota is a Policy enforcing long-window usage limits per tenant. Tenants
+// are identified by TenantHeader, or by client IP when the header is unset.
+// Request and response bytes both count towards byte limits. At most
+// maxQuotaTenants tenants are tracked, the least used ones are forgotten to
+// track new ones.
+type Quota struct {
+	Limits []QuotaLimit
+	// TenantHeader is set by the clients, it must be authenticated, or set
+	// by a trusted proxy in front of this one, for clients not to pick
+	// another tenant once theirs is over quota.
+	TenantHeader string
+	// StatePath is the file usage is persisted to, see Load and Save.
+	StatePath string
+
+	now   func() time.Time
+	mu    sync.Mutex
+	usage map[string]map[QuotaWindow]*windowUsage
+	// pruned is the start of the day the windows that ended were last
+	// pruned, windows only end at midnight.
+	pruned time.Time
+}
+
+func (q *Quota) Name() string {
+	return "quota"
+}
+
+func (q *Quota) Check(r *http.Request) *Rejection {
+	return q.check(r, true)
+}
+
+func (q *Quota) Preview(r *http.Request) *Rejection {
+	return q.check(r, false)
+}
+
+// check rejects r when its tenant exceeded a limit, and otherwise counts it
+// when count is set. It only tracks new tenants when counting, for previews
+// not to evict the tenants tracked.
+func (q *Quota) check(r *http.Request, count bool) *Rejection {
+	tenant := q.tenant(r)
+	now := q.currentTime()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, limit := range q.Limits {
+		usage := q.currentUsage(tenant, limit.Window, now)
+		exceeded := ""
+		if limit.Requests > 0 && usage.Requests >= limit.Requests {
+			exceeded = fmt.Sprintf("%d requests per %s", limit.Requests, limit.Window)
+		} else if limit.Bytes > 0 && usage.Bytes >= limit.Bytes {
+			exceeded = fmt.Sprintf("%d bytes per %s", limit.Bytes, limit.Window)
+		}
+		if exceeded == "" {
+			continue
+		}
+
+		reset := windowEnd(limit.Window, now)
+		retryAfter := strconv.FormatInt(int64(reset.Sub(now).Seconds())+1, 10)
+		return &Rejection{
+			StatusCode: http.StatusTooManyRequests,
+			Message:    fmt.Sprintf("quota of %s exceeded for tenant %s", exceeded, tenant),
+			Header: http.Header{
+				"X-Quota-Limit":     []string{exceeded},
+				"X-Quota-Remaining": []string{"0"},
+				"X-Quota-Reset":     []string{reset.Format(time.RFC3339)},
+				"Retry-After":       []string{retryAfter},
+			},
+		}
+	}
+
+	if !count {
+		return nil
+	}
+	for _, window := range q.windows() {
+		q.windowUsage(tenant, window, now).Requests++
+	}
+	return nil
+}
+
+func (q *Quota) Observe(r *http.Request, bytesIn, bytesOut int64) {
+	tenant := q.tenant(r)
+	now := q.currentTime()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, window := range q.windows() {
+		q.windowUsage(tenant, window, now).Bytes += bytesIn + bytesOut
+	}
+}
+
+// Load restores the usage persisted in StatePath, if it exists.
+func (q *Quota) Load() error {
+	b, err := os.ReadFile(q.StatePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	usage := map[string]map[QuotaWindow]*windowUsage{}
+	if err := json.Unmarshal(b, &usage); err != nil {
+		return fmt.Errorf("unable to parse quota state %s: %w", q.StatePath, err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.usage = usage
+	q.prune(q.currentTime())
+	return nil
+}
+
+// Save atomically persists the usage to StatePath.
+func (q *Quota) Save() error {
+	q.mu.Lock()
+	q.prune(q.currentTime())
+	b, err := json.Marshal(q.usage)
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(q.StatePath), filepath.Base(q.StatePath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), q.StatePath)
+}
+
+// PersistEvery saves the usage to StatePath at every interval, until stop is
+// closed.
+func (q *Quota) PersistEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := q.Save(); err != nil {
+				log.WithError(err).Error("unable to persist quota usage")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (q *Quota) tenant(r *http.Request) string {
+	if q.TenantHeader != "" {
+		if tenant := r.Header.Get(q.TenantHeader); tenant != "" {
+			return tenant
+		}
+	}
+	return clientIP(r)
+}
+
+func (q *Quota) windows() []QuotaWindow {
+	var windows []QuotaWindow
+	seen := map[QuotaWindow]bool{}
+	for _, limit := range q.Limits {
+		if !seen[limit.Window] {
+			seen[limit.Window] = true
+			windows = append(windows, limit.Window)
+		}
+	}
+	return windows
+}
+
+// currentUsage returns the usage of tenant in the current window, zero when
+// it is not tracked. Unlike windowUsage, it does not track the tenant. It
+// must be called with the lock held.
+func (q *Quota) currentUsage(tenant string, window QuotaWindow, now time.Time) windowUsage {
+	usage := q.usage[tenant][window]
+	if usage == nil || !usage.Start.Equal(windowStart(window, now)) {
+		return windowUsage{}
+	}
+	return *usage
+}
+
+// windowUsage must be called with the lock held.
+func (q *Quota) windowUsage(tenant string, window QuotaWindow, now time.Time) *windowUsage {
+	if q.usage == nil {
+		q.usage = map[string]map[QuotaWindow]*windowUsage{}
+	}
+	if day := windowStart(QuotaDaily, now); !q.pruned.Equal(day) {
+		q.prune(now)
+		q.pruned = day
+	}
+	if q.usage[tenant] == nil {
+		if len(q.usage) >= maxQuotaTenants {
+			q.evictLeastUsed()
+		}
+		q.usage[tenant] = map[QuotaWindow]*windowUsage{}
+	}
+
+	start := windowStart(window, now)
+	usage := q.usage[tenant][window]
+	if usage == nil || !usage.Start.Equal(start) {
+		usage = &windowUsage{Start: start}
+		q.usage[tenant][window] = usage
+	}
+	return usage
+}
+
+// prune forgets the windows that ended before now, and the tenants without
+// windows left. It must be called with the lock held.
+func (q *Quota) prune(now time.Time) {
+	for tenant, windows := range q.usage {
+		for window, usage := range windows {
+			if usage == nil || usage.Start.Before(windowStart(window, now)) {
+				delete(windows, window)
+			}
+		}
+		if len(windows) == 0 {
+			delete(q.usage, tenant)
+		}
+	}
+}
+
+// evictLeastUsed forgets the tenth of the tenants with the fewest requests
+// in their windows, which are the least likely to be over quota. It must be
+// called with the lock held.
+func (q *Quota) evictLeastUsed() {
+	type tenantRequests struct {
+		tenant   string
+		requests int64
+	}
+	tenants := make([]tenantRequests, 0, len(q.usage))
+	for tenant, windows := range q.usage {
+		var requests int64
+		for _, usage := range windows {
+			requests += usage.Requests
+		}
+		tenants = append(tenants, tenantRequests{tenant, requests})
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].requests < tenants[j].requests })
+	for _, t := range tenants[:len(tenants)/10+1] {
+		delete(q.usage, t.tenant)
+	}
+}
+
+func (q *Quota) currentTime() time.Time {
+	if q.now != nil {
+		return q.now().UTC()
+	}
+	return time.Now().UTC()
+}
+
+func windowStart(window QuotaWindow, now time.Time) time.Time {
+	if window == QuotaMonthly {
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func windowEnd(window QuotaWindow, now time.Time) time.Time {
+	if window == QuotaMonthly {
+		return windowStart(window, now).AddDate(0, 1, 0)
+	}
+	return windowStart(window, now).AddDate(0, 0, 1)
+}
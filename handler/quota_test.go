@@ -0,0 +1,154 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQuotaLimit(t *testing.T) {
+	limit, err := ParseQuotaLimit("requests/day=100")
+	assert.NoError(t, err)
+	assert.Equal(t, QuotaLimit{Window: QuotaDaily, Requests: 100}, limit)
+
+	limit, err = ParseQuotaLimit("bytes/month=2048")
+	assert.NoError(t, err)
+	assert.Equal(t, QuotaLimit{Window: QuotaMonthly, Bytes: 2048}, limit)
+
+	for _, invalid := range []string{"requests=1", "requests/week=1", "calls/day=1", "requests/day=-1"} {
+		_, err := ParseQuotaLimit(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestQuota_Check(t *testing.T) {
+	now := time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC)
+	quota := &Quota{
+		Limits:       []QuotaLimit{{Window: QuotaDaily, Requests: 2}, {Window: QuotaMonthly, Bytes: 100}},
+		TenantHeader: "X-Tenant",
+		now:          func() time.Time { return now },
+	}
+	tenantA := &http.Request{Header: http.Header{"X-Tenant": []string{"a"}}, RemoteAddr: "10.0.0.1:1234"}
+	tenantB := &http.Request{Header: http.Header{"X-Tenant": []string{"b"}}, RemoteAddr: "10.0.0.1:1234"}
+
+	assert.Nil(t, quota.Check(tenantA))
+	// Previews are not counted.
+	assert.Nil(t, quota.Preview(tenantA))
+	assert.Nil(t, quota.Preview(tenantA))
+	assert.Nil(t, quota.Check(tenantA))
+	assert.NotNil(t, quota.Preview(tenantA))
+
+	rejection := quota.Check(tenantA)
+	assert.Equal(t, http.StatusTooManyRequests, rejection.StatusCode)
+	assert.Equal(t, "2024-02-01T00:00:00Z", rejection.Header.Get("X-Quota-Reset"))
+	assert.Equal(t, "3601", rejection.Header.Get("Retry-After"))
+
+	assert.Nil(t, quota.Check(tenantB))
+
+	// The daily window resets, the monthly one does not.
+	now = now.Add(2 * time.Hour)
+	assert.Nil(t, quota.Check(tenantA))
+	quota.Observe(tenantA, 60, 40)
+	rejection = quota.Check(tenantA)
+	assert.Equal(t, "100 bytes per month", rejection.Header.Get("X-Quota-Limit"))
+	assert.Nil(t, quota.Check(tenantB))
+}
+
+func TestQuota_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	now := func() time.Time { return time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC) }
+	limits := []QuotaLimit{{Window: QuotaDaily, Requests: 1}}
+	request := &http.Request{RemoteAddr: "10.0.0.1:1234"}
+
+	quota := &Quota{Limits: limits, StatePath: path, now: now}
+	assert.NoError(t, quota.Load())
+	assert.Nil(t, quota.Check(request))
+	assert.NoError(t, quota.Save())
+
+	restored := &Quota{Limits: limits, StatePath: path, now: now}
+	assert.NoError(t, restored.Load())
+	assert.NotNil(t, restored.Check(request))
+}
+
+func TestQuota_MaxTenants(t *testing.T) {
+	now := func() time.Time { return time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC) }
+	quota := &Quota{Limits: []QuotaLimit{{Window: QuotaDaily, Requests: 2}}, TenantHeader: "X-Tenant", now: now}
+	tenant := func(name string) *http.Request {
+		return &http.Request{Header: http.Header{"X-Tenant": []string{name}}, RemoteAddr: "10.0.0.1:1234"}
+	}
+
+	assert.Nil(t, quota.Check(tenant("busy")))
+	assert.Nil(t, quota.Check(tenant("busy")))
+	for i := 0; i < 2*maxQuotaTenants; i++ {
+		quota.Check(tenant(fmt.Sprintf("forged-%d", i)))
+	}
+
+	assert.LessOrEqual(t, len(quota.usage), maxQuotaTenants)
+	// The tenant over quota is not the one forgotten.
+	assert.NotNil(t, quota.Check(tenant("busy")))
+}
+
+func TestQuota_PreviewDoesNotTrackTenants(t *testing.T) {
+	now := func() time.Time { return time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC) }
+	quota := &Quota{Limits: []QuotaLimit{{Window: QuotaDaily, Requests: 1}}, TenantHeader: "X-Tenant", now: now}
+	tenant := func(name string) *http.Request {
+		return &http.Request{Header: http.Header{"X-Tenant": []string{name}}, RemoteAddr: "10.0.0.1:1234"}
+	}
+
+	assert.Nil(t, quota.Check(tenant("busy")))
+	for i := 0; i < 2*maxQuotaTenants; i++ {
+		assert.Nil(t, quota.Preview(tenant(fmt.Sprintf("forged-%d", i))))
+	}
+
+	assert.Len(t, quota.usage, 1)
+	assert.NotNil(t, quota.Preview(tenant("busy")))
+}
+
+func TestQuota_PrunesEndedWindows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	now := time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC)
+	quota := &Quota{
+		Limits:       []QuotaLimit{{Window: QuotaDaily, Requests: 10}, {Window: QuotaMonthly, Requests: 100}},
+		TenantHeader: "X-Tenant",
+		StatePath:    path,
+		now:          func() time.Time { return now },
+	}
+	tenant := func(name string) *http.Request {
+		return &http.Request{Header: http.Header{"X-Tenant": []string{name}}, RemoteAddr: "10.0.0.1:1234"}
+	}
+
+	assert.Nil(t, quota.Check(tenant("a")))
+	now = now.Add(2 * time.Hour)
+	assert.Nil(t, quota.Check(tenant("b")))
+	assert.NotContains(t, quota.usage, "a")
+
+	assert.Nil(t, quota.Check(tenant("a")))
+	now = now.Add(24 * time.Hour)
+	assert.NoError(t, quota.Save())
+	state, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"a": {"month": {"start": "2024-02-01T00:00:00Z", "requests": 1, "bytes": 0}},
+		"b": {"month": {"start": "2024-02-01T00:00:00Z", "requests": 1, "bytes": 0}}
+	}`, string(state))
+}
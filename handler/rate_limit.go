@@ -0,0 +1,287 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitKey is what the requests sharing a token bucket of a RateLimit
+// have in common.
+type RateLimitKey string
+
+const (
+	// RateLimitGlobal limits all the requests together.
+	RateLimitGlobal RateLimitKey = ""
+	// RateLimitClientIP limits the requests of each client IP address.
+	RateLimitClientIP RateLimitKey = "client-ip"
+	// RateLimitHeader limits the requests of each value of a header, such as
+	// an API key, or of each client IP address without it.
+	RateLimitHeader RateLimitKey = "header"
+	// RateLimitService limits the requests to each AWS service, by signing
+	// name.
+	RateLimitService RateLimitKey = "service"
+)
+
+// maxRateLimitBuckets bounds the token buckets of a RateLimit, so clients
+// cannot grow it without limit by varying a header.
+const maxRateLimitBuckets = 10000
+
+// ServiceResolver is implemented by the clients able to tell the service a
+// request will be signed for before sending it, such as ProxyClient.
+type ServiceResolver interface {
+	SigningName(req *http.Request) string
+}
+
+// RateLimit is a Policy limiting the rate of the requests with a token bucket
+// per key, so a noisy client or a busy service does not starve the others.
+// Requests above the rate are rejected with a 429.
+type RateLimit struct {
+	Key RateLimitKey `yaml:"key"`
+	// Header is the header the requests are keyed by with RateLimitHeader.
+	Header string `yaml:"header"`
+	// Rate is the sustained rate in requests per second of each key, Burst
+	// the number of requests allowed at once, Rate when zero.
+	Rate  float64 `yaml:"rate"`
+	Burst float64 `yaml:"burst"`
+	// Services resolves the signing name of the requests with
+	// RateLimitService, the requests of unknown services share a bucket.
+	Services ServiceResolver `yaml:"-"`
+	// MaxWait is how long requests above the rate wait for a token before
+	// being rejected, rejected right away when zero.
+	MaxWait time.Duration `yaml:"-"`
+
+	now     func() time.Time
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// nextFull is when the first of the buckets will be full again, the
+	// buckets are not scanned for room before.
+	nextFull time.Time
+}
+
+// Validate returns an error when the limit is misconfigured.
+func (l *RateLimit) Validate() error {
+	switch l.Key {
+	case RateLimitGlobal, RateLimitClientIP, RateLimitService:
+		if l.Header != "" {
+			return errors.New("only the rate limits by header can set a header")
+		}
+	case RateLimitHeader:
+		if l.Header == "" {
+			return errors.New("rate limit by header must set the header")
+		}
+	default:
+		return fmt.Errorf("unknown rate limit key %q, expected client-ip, header or service", l.Key)
+	}
+	if l.Rate <= 0 || math.IsInf(l.Rate, 0) {
+		return errors.New("rate limit must set a positive rate")
+	}
+	if l.Burst != 0 && l.Burst < 1 {
+		return errors.New("rate limit burst must be at least 1, or 0 for the rate")
+	}
+	return nil
+}
+
+func (l *RateLimit) Name() string {
+	return "rate-limit"
+}
+
+func (l *RateLimit) Check(r *http.Request) *Rejection {
+	return l.check(r, true)
+}
+
+func (l *RateLimit) Preview(r *http.Request) *Rejection {
+	return l.check(r, false)
+}
+
+// check rejects r when the bucket of its key has no token within MaxWait,
+// and otherwise takes one from it, waiting for it, when take is set.
+func (l *RateLimit) check(r *http.Request, take bool) *Rejection {
+	key, subject := l.key(r)
+	burst := rateLimitBurst(l.Rate, l.Burst)
+	now := l.currentTime()
+
+	l.mu.Lock()
+	bucket, ok := l.buckets[key]
+	if !ok && !take {
+		// A new bucket is full, previews do not track the key.
+		l.mu.Unlock()
+		return nil
+	}
+	if !ok {
+		if bucket = l.newBucket(key, burst, now); bucket == nil {
+			retryAfter := l.nextFull.Sub(now)
+			l.mu.Unlock()
+			return &Rejection{
+				StatusCode: http.StatusTooManyRequests,
+				Message:    fmt.Sprintf("rate limit of %g requests per second is tracking too many keys", l.Rate),
+				Header:     http.Header{"Retry-After": []string{strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))}},
+			}
+		}
+	}
+	wait, ok := bucket.reserve(l.Rate, burst, now, l.MaxWait, take)
+	tokens := bucket.available(l.Rate, burst, now)
+	l.mu.Unlock()
+
+	if ok && !take {
+		return nil
+	}
+	if ok {
+		return waitToken(r, wait)
+	}
+	message := fmt.Sprintf("rate limit of %g requests per second exceeded", l.Rate)
+	if subject != "" {
+		message += " for " + subject
+	}
+	return &Rejection{
+		StatusCode: http.StatusTooManyRequests,
+		Message:    message,
+		Header:     http.Header{"Retry-After": []string{retryAfterTokens(tokens, l.Rate)}},
+	}
+}
+
+// key returns the key of the bucket of r, and how to name it in messages,
+// which never includes the values of headers as they may be secrets.
+func (l *RateLimit) key(r *http.Request) (key, subject string) {
+	switch l.Key {
+	case RateLimitClientIP:
+		ip := clientIP(r)
+		return ip, "client " + ip
+	case RateLimitHeader:
+		if value := r.Header.Get(l.Header); value != "" {
+			return "header " + value, "header " + l.Header
+		}
+		ip := clientIP(r)
+		return "client " + ip, "client " + ip
+	case RateLimitService:
+		if l.Services == nil {
+			return "", ""
+		}
+		if service := l.Services.SigningName(r); service != "" {
+			return service, "service " + service
+		}
+	}
+	return "", ""
+}
+
+// newBucket returns a new bucket for key, or nil when there is no room for
+// it: only the full buckets, which are the same as new ones, are forgotten to
+// make room, so that clients cannot reset their own buckets by sending many
+// keys. It must be called with the lock held.
+func (l *RateLimit) newBucket(key string, burst float64, now time.Time) *tokenBucket {
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+	}
+	if len(l.buckets) >= maxRateLimitBuckets {
+		if now.Before(l.nextFull) {
+			return nil
+		}
+		l.nextFull = time.Time{}
+		for k, bucket := range l.buckets {
+			tokens := bucket.available(l.Rate, burst, now)
+			if tokens >= burst {
+				delete(l.buckets, k)
+				continue
+			}
+			full := now.Add(time.Duration((burst - tokens) / l.Rate * float64(time.Second)))
+			if l.nextFull.IsZero() || full.Before(l.nextFull) {
+				l.nextFull = full
+			}
+		}
+		if len(l.buckets) >= maxRateLimitBuckets {
+			return nil
+		}
+	}
+	bucket := &tokenBucket{}
+	l.buckets[key] = bucket
+	return bucket
+}
+
+func (l *RateLimit) currentTime() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// tokenBucket holds the tokens of a rate limit, refilled at its rate up to its
+// burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// available returns the tokens of the bucket at now.
+func (b *tokenBucket) available(rate, burst float64, now time.Time) float64 {
+	if b.last.IsZero() {
+		return burst
+	}
+	return math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+}
+
+// reserve returns how long to wait for a token of the bucket at now, false
+// when it is longer than maxWait. The token is taken when take is set, the
+// bucket going into debt for the tokens of the waiting requests.
+func (b *tokenBucket) reserve(rate, burst float64, now time.Time, maxWait time.Duration, take bool) (time.Duration, bool) {
+	tokens := b.available(rate, burst, now)
+	wait := time.Duration(0)
+	if tokens < 1 {
+		wait = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return 0, false
+	}
+	if take {
+		b.tokens, b.last = tokens-1, now
+	}
+	return wait, true
+}
+
+// waitToken waits for the token reserved for r, rejecting r when the client
+// goes away first.
+func waitToken(r *http.Request, wait time.Duration) *Rejection {
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-r.Context().Done():
+		return &Rejection{StatusCode: StatusClientClosedRequest, Message: "client went away while waiting for the rate limit"}
+	}
+}
+
+// rateLimitBurst returns burst, or rate and at least one when it is zero.
+func rateLimitBurst(rate, burst float64) float64 {
+	if burst <= 0 {
+		return math.Max(rate, 1)
+	}
+	return burst
+}
+
+// retryAfterTokens returns the Retry-After, in seconds, of a bucket with
+// tokens left.
+func retryAfterTokens(tokens, rate float64) string {
+	return strconv.Itoa(int(math.Ceil((1 - tokens) / rate)))
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+	request := func(host, remoteAddr, apiKey string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "https://"+host+"/", nil)
+		r.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			r.Header.Set("X-Api-Key", apiKey)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name  string
+		limit *RateLimit
+		// first exhausts the bucket of its key, other is a request of another
+		// key, same a request of the same key.
+		first, other, same *http.Request
+		want               string
+	}{
+		{
+			name:  "global",
+			limit: &RateLimit{Rate: 1},
+			first: request("sqs.us-east-1.amazonaws.com", "10.0.0.1:1234", ""),
+			same:  request("s3.us-east-1.amazonaws.com", "10.0.0.2:1234", ""),
+			want:  "rate limit of 1 requests per second exceeded",
+		},
+		{
+			name:  "client IP",
+			limit: &RateLimit{Key: RateLimitClientIP, Rate: 1},
+			first: request("sqs.us-east-1.amazonaws.com", "10.0.0.1:1234", ""),
+			other: request("sqs.us-east-1.amazonaws.com", "10.0.0.2:1234", ""),
+			same:  request("s3.us-east-1.amazonaws.com", "10.0.0.1:5678", ""),
+			want:  "rate limit of 1 requests per second exceeded for client 10.0.0.1",
+		},
+		{
+			name:  "header",
+			limit: &RateLimit{Key: RateLimitHeader, Header: "X-Api-Key", Rate: 1},
+			first: request("sqs.us-east-1.amazonaws.com", "10.0.0.1:1234", "key-a"),
+			other: request("sqs.us-east-1.amazonaws.com", "10.0.0.1:1234", "key-b"),
+			same:  request("sqs.us-east-1.amazonaws.com", "10.0.0.2:1234", "key-a"),
+			want:  "rate limit of 1 requests per second exceeded for header X-Api-Key",
+		},
+		{
+			name:  "header falls back to the client IP",
+			limit: &RateLimit{Key: RateLimitHeader, Header: "X-Api-Key", Rate: 1},
+			first: request("sqs.us-east-1.amazonaws.com", "10.0.0.1:1234", ""),
+			other: request("sqs.us-east-1.amazonaws.com", "10.0.0.1:1234", "key-a"),
+			same:  request("sqs.us-east-1.amazonaws.com", "10.0.0.1:5678", ""),
+			want:  "rate limit of 1 requests per second exceeded for client 10.0.0.1",
+		},
+		{
+			name:  "service",
+			limit: &RateLimit{Key: RateLimitService, Rate: 1, Services: &ProxyClient{}},
+			first: request("sqs.us-east-1.amazonaws.com", "10.0.0.1:1234", ""),
+			other: request("s3.us-east-1.amazonaws.com", "10.0.0.1:1234", ""),
+			same:  request("sqs.eu-west-1.amazonaws.com", "10.0.0.2:1234", ""),
+			want:  "rate limit of 1 requests per second exceeded for service sqs",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			tt.limit.now = func() time.Time { return now }
+
+			assert.Nil(t, tt.limit.Preview(tt.first))
+			assert.Nil(t, tt.limit.Check(tt.first))
+			assert.NotNil(t, tt.limit.Preview(tt.first))
+			if tt.other != nil {
+				assert.Nil(t, tt.limit.Check(tt.other))
+			}
+			rejection := tt.limit.Check(tt.same)
+			if assert.NotNil(t, rejection) {
+				assert.Equal(t, http.StatusTooManyRequests, rejection.StatusCode)
+				assert.Equal(t, "1", rejection.Header.Get("Retry-After"))
+				assert.Equal(t, tt.want, rejection.Message)
+			}
+
+			now = now.Add(time.Second)
+			assert.Nil(t, tt.limit.Check(tt.same))
+		})
+	}
+}
+
+func TestRateLimit_MaxWait(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limit := &RateLimit{Rate: 20, Burst: 1, MaxWait: 100 * time.Millisecond, now: func() time.Time { return now }}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	start := time.Now()
+	assert.Nil(t, limit.Check(r))
+	assert.Nil(t, limit.Preview(r))
+	assert.Nil(t, limit.Check(r))
+	assert.Nil(t, limit.Check(r))
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	// The next token is 150ms away.
+	assert.NotNil(t, limit.Preview(r))
+	rejection := limit.Check(r)
+	if assert.NotNil(t, rejection) {
+		assert.Equal(t, http.StatusTooManyRequests, rejection.StatusCode)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	now = now.Add(100 * time.Millisecond)
+	rejection = limit.Check(r.WithContext(ctx))
+	if assert.NotNil(t, rejection) {
+		assert.Equal(t, StatusClientClosedRequest, rejection.StatusCode)
+	}
+}
+
+func TestRateLimit_Buckets(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limit := &RateLimit{Key: RateLimitHeader, Header: "X-Api-Key", Rate: 1, now: func() time.Time { return now }}
+	check := func(key string) *Rejection {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Api-Key", key)
+		return limit.Check(r)
+	}
+
+	for i := 0; i < maxRateLimitBuckets; i++ {
+		assert.Nil(t, check(strconv.Itoa(i)))
+	}
+	assert.Len(t, limit.buckets, maxRateLimitBuckets)
+
+	// The buckets in use are kept until refilled, the new keys are rejected
+	// meanwhile.
+	rejection := check("new")
+	if assert.NotNil(t, rejection) {
+		assert.Equal(t, http.StatusTooManyRequests, rejection.StatusCode)
+		assert.Equal(t, "1", rejection.Header.Get("Retry-After"))
+	}
+	assert.NotNil(t, check("0"))
+	assert.Len(t, limit.buckets, maxRateLimitBuckets)
+
+	now = now.Add(time.Second)
+	assert.Nil(t, check("new"))
+	assert.Len(t, limit.buckets, 1)
+}
+
+func TestRateLimit_Validate(t *testing.T) {
+	assert.NoError(t, (&RateLimit{Rate: 1}).Validate())
+	assert.NoError(t, (&RateLimit{Rate: 0.5, Burst: 1}).Validate())
+	assert.Error(t, (&RateLimit{Rate: 1, Burst: 0.5}).Validate())
+	assert.Error(t, (&RateLimit{Rate: 1, Burst: -1}).Validate())
+}
+
+func TestRouter_SigningName(t *testing.T) {
+	router := NewRouter(&ProxyClient{})
+	router.Route("search.internal", &ProxyClient{SigningNameOverride: "es", RegionOverride: "eu-west-1"})
+	router.RoutePath("/s3", true, &ProxyClient{SigningNameOverride: "s3", RegionOverride: "eu-west-1"})
+
+	assert.Equal(t, "es", router.SigningName(httptest.NewRequest(http.MethodGet, "http://search.internal/_search", nil)))
+	assert.Equal(t, "s3", router.SigningName(httptest.NewRequest(http.MethodGet, "http://proxy.internal/s3/bucket/key", nil)))
+	assert.Equal(t, "sqs", router.SigningName(httptest.NewRequest(http.MethodGet, "http://sqs.us-east-1.amazonaws.com/", nil)))
+	assert.Equal(t, "", router.SigningName(httptest.NewRequest(http.MethodGet, "http://proxy.internal/", nil)))
+
+	overridable := &ProxyClient{AllowedOverrides: []string{OverrideService}}
+	r := httptest.NewRequest(http.MethodGet, "http://sqs.us-east-1.amazonaws.com/", nil)
+	r.Header.Set(ServiceOverrideHeader, "execute-api")
+	assert.Equal(t, "execute-api", overridable.SigningName(r))
+	assert.Equal(t, "sqs", (&ProxyClient{}).SigningName(r))
+	assert.Equal(t, "execute-api", r.Header.Get(ServiceOverrideHeader))
+}
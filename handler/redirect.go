@@ -0,0 +1,90 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// signingHeaders are the headers set by signing, bound to the URL of the
+// signed request and never sent to the target of a redirect. The session
+// token in particular must not reach another host.
+var signingHeaders = []string{"Authorization", "X-Amz-Date", "X-Amz-Security-Token", "X-Amz-Content-Sha256", "X-Amz-Region-Set"}
+
+// RedirectPolicy follows the redirects of the upstream responses to
+// downloads, such as the presigned S3 URLs ECR redirects image layers to, for
+// clients unable to follow them. Redirects are followed up to MaxHops times,
+// to the hosts of the original request and of AllowedDomains only, so the
+// proxy cannot be pointed at arbitrary hosts. Other redirects are returned to
+// the client.
+type RedirectPolicy struct {
+	// MaxHops is the number of redirects followed, 0 follows none.
+	MaxHops int
+	// AllowedDomains are the domains, with their subdomains, redirects may
+	// target besides the host of the original request.
+	AllowedDomains []string
+}
+
+// CheckRedirect is the CheckRedirect function of the http.Client sending the
+// upstream requests.
+func (p *RedirectPolicy) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if p == nil || p.MaxHops <= 0 {
+		return http.ErrUseLastResponse
+	}
+
+	original := via[0]
+	fields := log.Fields{"from": via[len(via)-1].URL.Redacted(), "to": req.URL.Redacted(), "hops": len(via)}
+	switch {
+	case original.Method != http.MethodGet && original.Method != http.MethodHead:
+		return http.ErrUseLastResponse
+	case len(via) > p.MaxHops:
+		log.WithFields(fields).Warn("too many redirects, returning the redirect to the client")
+		return http.ErrUseLastResponse
+	case original.URL.Scheme == "https" && req.URL.Scheme != "https":
+		log.WithFields(fields).Warn("redirect downgrading to http, returning the redirect to the client")
+		return http.ErrUseLastResponse
+	case !p.allowed(req.URL.Hostname(), original.URL.Hostname()):
+		log.WithFields(fields).Warn("redirect to a host that is not allowed, returning the redirect to the client")
+		return http.ErrUseLastResponse
+	}
+
+	// The signature is bound to the original URL, a presigned target carries
+	// its own.
+	for _, header := range signingHeaders {
+		req.Header.Del(header)
+	}
+	// The original URL may be presigned itself.
+	req.Header.Del("Referer")
+	log.WithFields(fields).Debug("following redirect")
+	return nil
+}
+
+func (p *RedirectPolicy) allowed(host, originalHost string) bool {
+	host = strings.ToLower(host)
+	if host == strings.ToLower(originalHost) {
+		return true
+	}
+	for _, domain := range p.AllowedDomains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
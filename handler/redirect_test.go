@@ -0,0 +1,128 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectPolicy_CheckRedirect(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *RedirectPolicy
+		method string
+		// targetHost replaces the host of the redirect target, 127.0.0.1
+		// like the original request.
+		targetHost string
+		// hops are the redirects before the target.
+		hops     int
+		wantCode int
+	}{
+		{
+			name:     "no policy",
+			method:   http.MethodGet,
+			hops:     1,
+			wantCode: http.StatusFound,
+		},
+		{
+			name:     "same host",
+			policy:   &RedirectPolicy{MaxHops: 2},
+			method:   http.MethodGet,
+			hops:     2,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "too many hops",
+			policy:   &RedirectPolicy{MaxHops: 1},
+			method:   http.MethodGet,
+			hops:     2,
+			wantCode: http.StatusFound,
+		},
+		{
+			name:       "host not allowed",
+			policy:     &RedirectPolicy{MaxHops: 1},
+			method:     http.MethodGet,
+			targetHost: "localhost",
+			hops:       1,
+			wantCode:   http.StatusFound,
+		},
+		{
+			name:       "allowed domain",
+			policy:     &RedirectPolicy{MaxHops: 1, AllowedDomains: []string{"LOCALHOST"}},
+			method:     http.MethodGet,
+			targetHost: "localhost",
+			hops:       1,
+			wantCode:   http.StatusOK,
+		},
+		{
+			name:     "not a download",
+			policy:   &RedirectPolicy{MaxHops: 1},
+			method:   http.MethodPost,
+			hops:     1,
+			wantCode: http.StatusFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var targetHeader http.Header
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				targetHeader = r.Header
+			}))
+			defer target.Close()
+			targetURL := target.URL + "/layer?X-Amz-Signature=abc"
+			if tt.targetHost != "" {
+				targetURL = strings.Replace(targetURL, "127.0.0.1", tt.targetHost, 1)
+			}
+
+			var upstream *httptest.Server
+			upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if hop := len(r.URL.Path) - 1; hop < tt.hops-1 {
+					http.Redirect(w, r, upstream.URL+r.URL.Path+"x", http.StatusFound)
+					return
+				}
+				http.Redirect(w, r, targetURL, http.StatusFound)
+			}))
+			defer upstream.Close()
+
+			client := &http.Client{CheckRedirect: tt.policy.CheckRedirect}
+			req, _ := http.NewRequest(tt.method, upstream.URL+"/", nil)
+			req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=AKID/...")
+			req.Header.Set("X-Amz-Security-Token", "token")
+			req.Header.Set("Accept", "application/octet-stream")
+			resp, err := client.Do(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp.Body.Close()
+
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+			if tt.wantCode != http.StatusOK {
+				assert.Nil(t, targetHeader)
+				return
+			}
+			assert.Empty(t, targetHeader.Get("Authorization"))
+			assert.Empty(t, targetHeader.Get("X-Amz-Security-Token"))
+			assert.Empty(t, targetHeader.Get("Referer"))
+			assert.Equal(t, "application/octet-stream", targetHeader.Get("Accept"))
+		})
+	}
+}
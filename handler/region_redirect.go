@@ -0,0 +1,113 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// BucketRegionHeader is the header of the S3 responses naming the region of
+// the bucket.
+const BucketRegionHeader = "X-Amz-Bucket-Region"
+
+// followRegionRedirect sends req again, signed for the region of the bucket,
+// when S3 redirected it there because it was signed for another region,
+// which clients cannot do as they do not sign. It returns resp otherwise,
+// e.g. for streaming uploads, whose body cannot be sent again.
+func (p *ProxyClient) followRegionRedirect(req *http.Request, proxyURL url.URL, resp *http.Response, body *requestBody, chunked bool, signer *v4.Signer, service *endpoints.ResolvedEndpoint) (*http.Response, error) {
+	if resp.StatusCode != http.StatusMovedPermanently && resp.StatusCode != http.StatusTemporaryRedirect {
+		return resp, nil
+	}
+	region := resp.Header.Get(BucketRegionHeader)
+	if service.SigningName != "s3" || region == service.SigningRegion || !regionName.MatchString(region) {
+		return resp, nil
+	}
+	host, ok := regionalS3Host(proxyURL.Host, region)
+	entry := log.WithFields(log.Fields{"host": proxyURL.Host, "region": service.SigningRegion, "bucket_region": region})
+	if !ok || !p.upstreamHostAllowed(host) {
+		entry.Warn("unable to follow the S3 region redirect, returning it to the client")
+		return resp, nil
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	entry.WithField("regional_host", host).Info("following S3 region redirect")
+
+	proxyURL.Host = host
+	regional := *service
+	regional.URL = proxyURL.Scheme + "://" + host
+	regional.SigningRegion = region
+	if info := RequestInfoFromContext(req.Context()); info != nil {
+		info.Region = region
+		info.Host = host
+	}
+	return p.send(req, proxyURL.String(), body, nil, chunked, signer, &regional)
+}
+
+// regionalS3Host returns the endpoint of region of host, an S3 endpoint with
+// a bucket or not, e.g. bucket.s3.eu-west-1.amazonaws.com for
+// bucket.s3.amazonaws.com or bucket.s3.us-east-1.amazonaws.com, false when
+// host is not in the s3.<region>.<DNS suffix of a partition> form.
+func regionalS3Host(host, region string) (string, bool) {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname, port = host, ""
+	}
+	labels := strings.Split(hostname, ".")
+	// The last s3 label, bucket names may have some too.
+	for i := len(labels) - 2; i >= 0; i-- {
+		if labels[i] != "s3" && labels[i] != "s3-fips" {
+			continue
+		}
+		next := i + 1
+		if labels[next] == "dualstack" {
+			next++
+		}
+		suffix := next
+		if suffix < len(labels) && regionName.MatchString(labels[suffix]) {
+			suffix++
+		}
+		if !partitionDNSSuffix(strings.Join(labels[suffix:], ".")) {
+			return "", false
+		}
+		labels = append(labels[:next], append([]string{region}, labels[suffix:]...)...)
+		hostname = strings.Join(labels, ".")
+		if port != "" {
+			return net.JoinHostPort(hostname, port), true
+		}
+		return hostname, true
+	}
+	return "", false
+}
+
+// partitionDNSSuffix reports whether suffix is the DNS suffix of a partition,
+// e.g. amazonaws.com.
+func partitionDNSSuffix(suffix string) bool {
+	for _, partition := range defaultPartitions {
+		if partition.DNSSuffix() == suffix {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegionalS3Host(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "my-bucket.s3.amazonaws.com", want: "my-bucket.s3.eu-west-1.amazonaws.com"},
+		{host: "my-bucket.s3.us-east-1.amazonaws.com", want: "my-bucket.s3.eu-west-1.amazonaws.com"},
+		{host: "s3.us-east-1.amazonaws.com", want: "s3.eu-west-1.amazonaws.com"},
+		{host: "s3.amazonaws.com:443", want: "s3.eu-west-1.amazonaws.com:443"},
+		{host: "my.s3.bucket.s3.dualstack.us-east-1.amazonaws.com", want: "my.s3.bucket.s3.dualstack.eu-west-1.amazonaws.com"},
+		{host: "my-bucket.s3-fips.us-east-1.amazonaws.com", want: "my-bucket.s3-fips.eu-west-1.amazonaws.com"},
+		{host: "my-bucket.s3-external-1.amazonaws.com"},
+		{host: "s3.us-east-1.example.com:9000"},
+		{host: "s3.amazonaws.com.cn", want: "s3.eu-west-1.amazonaws.com.cn"},
+		{host: "example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			host, ok := regionalS3Host(tt.host, "eu-west-1")
+			assert.Equal(t, tt.want != "", ok)
+			assert.Equal(t, tt.want, host)
+		})
+	}
+}
+
+// regionRedirectClient redirects the requests not sent to a host of region
+// there.
+type regionRedirectClient struct {
+	region   string
+	requests []*http.Request
+}
+
+func (c *regionRedirectClient) Do(req *http.Request) (*http.Response, error) {
+	c.requests = append(c.requests, req)
+	if !strings.Contains(req.URL.Host, "."+c.region+".") {
+		return &http.Response{
+			StatusCode: http.StatusMovedPermanently,
+			Header:     http.Header{BucketRegionHeader: []string{c.region}},
+			Body:       io.NopCloser(strings.NewReader("<Error><Code>PermanentRedirect</Code></Error>")),
+		}, nil
+	}
+	body, _ := io.ReadAll(req.Body)
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(string(body)))}, nil
+}
+
+func TestProxyClient_DoFollowsRegionRedirects(t *testing.T) {
+	tests := []struct {
+		name       string
+		host       string
+		overrides  bool
+		follow     bool
+		allowed    []string
+		wantStatus int
+		wantHost   string
+	}{
+		{name: "follows the redirect", host: "my-bucket.s3.us-east-1.amazonaws.com", follow: true, wantStatus: http.StatusOK, wantHost: "my-bucket.s3.eu-west-1.amazonaws.com"},
+		{name: "global endpoint", host: "my-bucket.s3.amazonaws.com", overrides: true, follow: true, wantStatus: http.StatusOK, wantHost: "my-bucket.s3.eu-west-1.amazonaws.com"},
+		{name: "disabled", host: "my-bucket.s3.us-east-1.amazonaws.com", wantStatus: http.StatusMovedPermanently},
+		{name: "regional host not allowed", host: "my-bucket.s3.us-east-1.amazonaws.com", follow: true, allowed: []string{"*.s3.us-east-1.amazonaws.com"}, wantStatus: http.StatusMovedPermanently},
+		{name: "not S3", host: "sqs.us-east-1.amazonaws.com", follow: true, wantStatus: http.StatusMovedPermanently},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &regionRedirectClient{region: "eu-west-1"}
+			proxyClient := &ProxyClient{
+				Signer:                v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+				Client:                client,
+				FollowRegionRedirects: tt.follow,
+				AllowedUpstreamHosts:  tt.allowed,
+			}
+			if tt.overrides {
+				proxyClient.SigningNameOverride, proxyClient.RegionOverride = "s3", "us-east-1"
+			}
+
+			resp, err := proxyClient.Do(&http.Request{
+				Method:        http.MethodPut,
+				URL:           &url.URL{Path: "/key"},
+				Host:          tt.host,
+				Header:        http.Header{},
+				Body:          io.NopCloser(strings.NewReader("data")),
+				ContentLength: 4,
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantStatus != http.StatusOK {
+				assert.Len(t, client.requests, 1)
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, "data", string(body))
+			if assert.Len(t, client.requests, 2) {
+				redirected := client.requests[1]
+				assert.Equal(t, tt.wantHost, redirected.URL.Host)
+				assert.Equal(t, tt.wantHost, redirected.Host)
+				assert.Contains(t, redirected.Header.Get("Authorization"), "/eu-west-1/s3/aws4_request")
+			}
+		})
+	}
+}
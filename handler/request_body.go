@@ -0,0 +1,188 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// requestBody is the buffered body of a downstream request, read again to
+// hash it for the signature and for every attempt of the upstream request.
+// Bodies larger than the MaxRequestBodyMemory of the ProxyClient are spilled
+// to a temporary file.
+type requestBody struct {
+	data []byte
+	file *os.File
+	size int64
+	// memory holds the bytes of data reserved from the BodyMemory of the
+	// ProxyClient.
+	memory *reservingReader
+}
+
+// readRequestBody buffers the body of req, in memory up to
+// MaxRequestBodyMemory bytes, and beyond in a temporary file of
+// RequestBodySpillDir. Larger bodies are rejected with a 413 when no spill
+// directory is set, and the bodies not fitting the BodyMemory with a 503.
+// The body a policy buffered already, e.g. to verify its hash, is reused.
+func (p *ProxyClient) readRequestBody(req *http.Request) (body *requestBody, err error) {
+	if req.Body == nil {
+		return &requestBody{}, nil
+	}
+	defer req.Body.Close()
+
+	if buffered := unwrapBufferedBody(req.Body); buffered != nil {
+		// The body is still read through the wrappers, for them to count or
+		// capture it.
+		if _, err := buffered.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("unable to read buffered request body: %w", err)
+		}
+		if _, err := io.Copy(io.Discard, req.Body); err != nil {
+			return nil, fmt.Errorf("unable to read buffered request body: %w", err)
+		}
+		return buffered.take(), nil
+	}
+
+	memory := &reservingReader{Reader: req.Body, memory: p.BodyMemory}
+	defer func() {
+		if err != nil {
+			memory.release()
+		}
+	}()
+
+	if p.MaxRequestBodyMemory <= 0 {
+		data, err := io.ReadAll(memory)
+		if err != nil {
+			return nil, p.bodyReadError(err)
+		}
+		return &requestBody{data: data, size: int64(len(data)), memory: memory}, nil
+	}
+
+	tooLarge := &StatusError{StatusCode: http.StatusRequestEntityTooLarge, Err: fmt.Errorf("request body exceeds %d bytes", p.MaxRequestBodyMemory)}
+	if p.RequestBodySpillDir == "" && req.ContentLength > p.MaxRequestBodyMemory {
+		return nil, tooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(memory, p.MaxRequestBodyMemory+1))
+	if err != nil {
+		return nil, p.bodyReadError(err)
+	}
+	if int64(len(data)) <= p.MaxRequestBodyMemory {
+		return &requestBody{data: data, size: int64(len(data)), memory: memory}, nil
+	}
+	if p.RequestBodySpillDir == "" {
+		return nil, tooLarge
+	}
+
+	file, err := os.CreateTemp(p.RequestBodySpillDir, "aws-sigv4-proxy-body-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to spill request body: %w", err)
+	}
+	body = &requestBody{file: file}
+	if _, err := file.Write(data); err != nil {
+		body.Close()
+		return nil, fmt.Errorf("unable to spill request body: %w", err)
+	}
+	// The rest of the body goes to disk only.
+	memory.release()
+	downstream := &downstreamReader{Reader: req.Body}
+	n, err := io.Copy(file, downstream)
+	if err != nil {
+		body.Close()
+		if downstream.err != nil {
+			return nil, downstreamBodyError(downstream.err)
+		}
+		return nil, fmt.Errorf("unable to spill request body: %w", err)
+	}
+	body.size = int64(len(data)) + n
+	log.WithFields(log.Fields{"size": body.size, "file": file.Name()}).Debug("spilled request body to disk")
+	return body, nil
+}
+
+// unwrapBufferedBody returns the bufferedBody under the wrappers of body,
+// if any.
+func unwrapBufferedBody(body io.ReadCloser) *bufferedBody {
+	for {
+		switch b := body.(type) {
+		case *bufferedBody:
+			return b
+		case *countingBody:
+			body = b.ReadCloser
+		case *capturedBody:
+			body = b.ReadCloser
+		default:
+			return nil
+		}
+	}
+}
+
+// bodyReadError classifies a failure to read the body of a downstream
+// request into memory.
+func (p *ProxyClient) bodyReadError(err error) error {
+	if errors.Is(err, errBodyMemoryExhausted) {
+		return p.BodyMemory.shedError()
+	}
+	return downstreamBodyError(err)
+}
+
+// reader returns a reader of the whole body, independent of the other
+// readers.
+func (b *requestBody) reader() io.ReadSeeker {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+	return bytes.NewReader(b.data)
+}
+
+// bytes returns the body, read back into memory when it was spilled.
+func (b *requestBody) bytes() ([]byte, error) {
+	if b.file == nil {
+		return b.data, nil
+	}
+	return io.ReadAll(b.reader())
+}
+
+// Close releases the memory of a buffered body, and removes the temporary
+// file of a spilled body.
+func (b *requestBody) Close() error {
+	b.memory.release()
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// downstreamReader records the read error of a downstream body, to tell it
+// apart from the write errors of the spill file.
+type downstreamReader struct {
+	io.Reader
+	err error
+}
+
+func (r *downstreamReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
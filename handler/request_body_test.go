@@ -0,0 +1,190 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyClient_ReadRequestBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxMemory     int64
+		spill         bool
+		body          string
+		contentLength int64
+		wantSpilled   bool
+		wantCode      int
+	}{
+		{
+			name:          "no limit",
+			body:          strings.Repeat("a", 100),
+			contentLength: 100,
+		},
+		{
+			name:          "within the limit",
+			maxMemory:     10,
+			body:          strings.Repeat("a", 10),
+			contentLength: 10,
+		},
+		{
+			name:          "spilled",
+			maxMemory:     10,
+			spill:         true,
+			body:          strings.Repeat("a", 100),
+			contentLength: 100,
+			wantSpilled:   true,
+		},
+		{
+			name:          "declared too large",
+			maxMemory:     10,
+			body:          strings.Repeat("a", 100),
+			contentLength: 100,
+			wantCode:      http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "chunked too large",
+			maxMemory:     10,
+			body:          strings.Repeat("a", 100),
+			contentLength: -1,
+			wantCode:      http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			p := &ProxyClient{MaxRequestBodyMemory: tt.maxMemory}
+			if tt.spill {
+				p.RequestBodySpillDir = dir
+			}
+
+			body, err := p.readRequestBody(&http.Request{
+				ContentLength: tt.contentLength,
+				Body:          io.NopCloser(strings.NewReader(tt.body)),
+			})
+			if tt.wantCode != 0 {
+				var statusErr *StatusError
+				if assert.True(t, errors.As(err, &statusErr)) {
+					assert.Equal(t, tt.wantCode, statusErr.StatusCode)
+				}
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.Equal(t, tt.wantSpilled, body.file != nil)
+			assert.Equal(t, int64(len(tt.body)), body.size)
+			for i := 0; i < 2; i++ {
+				got, _ := io.ReadAll(body.reader())
+				assert.Equal(t, tt.body, string(got))
+			}
+
+			assert.NoError(t, body.Close())
+			files, _ := os.ReadDir(dir)
+			assert.Empty(t, files)
+		})
+	}
+}
+
+func TestProxyClient_SpilledRequestBody(t *testing.T) {
+	dir := t.TempDir()
+	var sentBodies []string
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+		Client: clientFunc(func(req *http.Request) (*http.Response, error) {
+			body, _ := io.ReadAll(req.Body)
+			sentBodies = append(sentBodies, string(body))
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}, nil
+		}),
+		Retry:                &RetryPolicy{MaxAttempts: 2},
+		MaxRequestBodyMemory: 10,
+		RequestBodySpillDir:  dir,
+	}
+
+	body := strings.Repeat("a", 100)
+	resp, err := proxyClient.Do(&http.Request{
+		Method:        http.MethodPost,
+		URL:           &url.URL{Path: "/"},
+		Host:          "es.eu-west-1.amazonaws.com",
+		Header:        http.Header{},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+
+	assert.Equal(t, []string{body, body}, sentBodies)
+	files, _ := os.ReadDir(dir)
+	assert.Empty(t, files)
+}
+
+func TestProxyClient_ReusesBufferedRequestBody(t *testing.T) {
+	memory := &BodyMemory{Limit: 40}
+	body := strings.Repeat("a", 32)
+	var sentBody string
+	var used int64
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+		Client: clientFunc(func(req *http.Request) (*http.Response, error) {
+			b, _ := io.ReadAll(req.Body)
+			sentBody, used = string(b), memory.Used()
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}, nil
+		}),
+		BodyMemory: memory,
+	}
+	req := &http.Request{
+		Method:        http.MethodPost,
+		URL:           &url.URL{Path: "/"},
+		Host:          "es.eu-west-1.amazonaws.com",
+		Header:        http.Header{},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+
+	// The body verified by SignatureAuth, counted and captured by the
+	// Handler, is only buffered once.
+	assert.NoError(t, (&SignatureAuth{BodyMemory: memory}).bufferBody(req))
+	counted := &countingBody{ReadCloser: req.Body}
+	captured := &capturedBody{ReadCloser: counted}
+	req.Body = captured
+
+	resp, err := proxyClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	req.Body.Close()
+
+	assert.Equal(t, body, sentBody)
+	assert.Equal(t, int64(32), used)
+	assert.Equal(t, int64(32), counted.n)
+	assert.Equal(t, body, captured.buf.String())
+	assert.Zero(t, memory.Used())
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type requestInfoKey struct{}
+
+// RequestInfo describes how a downstream request was proxied. The Handler
+// attaches it to the request context and the ProxyClient fills it in, so it
+// can be used for logging and statistics once the request completes.
+type RequestInfo struct {
+	Service string
+	Region  string
+	Host    string
+	// Fields are the fields extracted from the request by the Extractor.
+	Fields map[string]string
+	// Client is the protocol the downstream client connected with.
+	Client ClientProtocol
+	// Claims are the claims of the JWT the client authenticated with.
+	Claims map[string]interface{}
+	// HeaderChanges are the changes of the header rules of the ProxyClient
+	// to the headers of the request.
+	HeaderChanges []HeaderChange
+}
+
+// ClientProtocol is the HTTP version, and the TLS version and ALPN protocol
+// negotiated, of the connection of a downstream client. TLSVersion and ALPN
+// are empty without TLS.
+type ClientProtocol struct {
+	Proto      string
+	TLSVersion string
+	ALPN       string
+}
+
+// legacyTLSVersions are the deprecated TLS versions (RFC 8996).
+var legacyTLSVersions = map[string]bool{
+	tls.VersionName(tls.VersionSSL30): true,
+	tls.VersionName(tls.VersionTLS10): true,
+	tls.VersionName(tls.VersionTLS11): true,
+}
+
+// clientProtocol returns the protocol of the connection r was received on.
+func clientProtocol(r *http.Request) ClientProtocol {
+	p := ClientProtocol{Proto: r.Proto}
+	if r.TLS != nil {
+		p.TLSVersion = tls.VersionName(r.TLS.Version)
+		p.ALPN = r.TLS.NegotiatedProtocol
+	}
+	return p
+}
+
+// Legacy reports whether the client connected with HTTP/1.0, or a TLS
+// version below 1.2.
+func (p ClientProtocol) Legacy() bool {
+	return p.Proto == "HTTP/1.0" || legacyTLSVersions[p.TLSVersion]
+}
+
+func (p ClientProtocol) logFields() log.Fields {
+	fields := log.Fields{"proto": p.Proto}
+	if p.TLSVersion != "" {
+		fields["tls_version"] = p.TLSVersion
+		fields["alpn"] = p.ALPN
+	}
+	return fields
+}
+
+// WithRequestInfo returns a shallow copy of r carrying info in its context.
+func WithRequestInfo(r *http.Request, info *RequestInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+}
+
+// logFields returns the extracted fields of the request as log fields.
+func (info *RequestInfo) logFields() log.Fields {
+	fields := log.Fields{}
+	for name, value := range info.Fields {
+		fields[name] = value
+	}
+	return fields
+}
+
+// RequestInfoFromContext returns the RequestInfo attached to ctx, or nil.
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"strings"
+)
+
+// EssentialResponseHeaders are the response headers a ResponseHeaderAllowlist
+// always passes downstream, which HTTP clients and caches rely on.
+var EssentialResponseHeaders = []string{
+	"Accept-Ranges",
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"Date",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Location",
+	"Retry-After",
+	"Vary",
+	// Set by Throttling.
+	"X-Original-Status-Code",
+}
+
+// ResponseHeaderAllowlist only passes the allowed headers of the upstream
+// responses downstream, so internal headers of the upstream such as
+// x-amz-id-2 or server tokens do not leak to untrusted clients.
+type ResponseHeaderAllowlist struct {
+	// Allowed are the headers passed besides EssentialResponseHeaders, *
+	// matching any characters, e.g. X-Amz-Meta-*.
+	Allowed []string
+}
+
+// Filter removes the headers that are not allowed from header, and returns
+// their names.
+func (a *ResponseHeaderAllowlist) Filter(header http.Header) []string {
+	var removed []string
+	for name := range header {
+		if !a.allowed(name) {
+			delete(header, name)
+			removed = append(removed, name)
+		}
+	}
+	return removed
+}
+
+func (a *ResponseHeaderAllowlist) allowed(name string) bool {
+	for _, essential := range EssentialResponseHeaders {
+		if strings.EqualFold(essential, name) {
+			return true
+		}
+	}
+	for _, pattern := range a.Allowed {
+		if matchWildcard(strings.ToLower(pattern), strings.ToLower(name)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseHeaderAllowlist_Filter(t *testing.T) {
+	header := http.Header{
+		"Content-Type":         []string{"application/json"},
+		"Etag":                 []string{`"abc"`},
+		"X-Amz-Id-2":           []string{"internal"},
+		"X-Amz-Request-Id":     []string{"internal"},
+		"Server":               []string{"AmazonS3"},
+		"X-Amz-Meta-Owner":     []string{"team-a"},
+		"X-Amz-Version-Id":     []string{"v1"},
+		"x-amzn-custom-header": []string{"not canonical"},
+	}
+	allowlist := &ResponseHeaderAllowlist{Allowed: []string{"x-amz-meta-*", "X-Amz-Version-Id"}}
+
+	removed := allowlist.Filter(header)
+	sort.Strings(removed)
+	assert.Equal(t, []string{"Server", "X-Amz-Id-2", "X-Amz-Request-Id", "x-amzn-custom-header"}, removed)
+	assert.Equal(t, http.Header{
+		"Content-Type":     []string{"application/json"},
+		"Etag":             []string{`"abc"`},
+		"X-Amz-Meta-Owner": []string{"team-a"},
+		"X-Amz-Version-Id": []string{"v1"},
+	}, header)
+}
+
+func TestHandler_ResponseHeaders(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/plain"}, "X-Amz-Id-2": []string{"internal"}},
+		Body:       io.NopCloser(strings.NewReader("ok")),
+	}
+	h := &Handler{ProxyClient: &mockProxyClient{Response: resp}, ResponseHeaders: &ResponseHeaderAllowlist{}}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+	assert.Empty(t, w.Header().Get("X-Amz-Id-2"))
+	// The upstream response keeps its headers, for the tee.
+	assert.Equal(t, "internal", resp.Header.Get("X-Amz-Id-2"))
+}
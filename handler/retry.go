@@ -0,0 +1,97 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy retries the upstream requests failing with a throttling or
+// server error, or a network error, with exponential backoff and full jitter.
+//
+// Throttling (429) and unavailability (503) responses are retried whatever
+// the method, as the upstream did not process the request. Other 5xx
+// responses and network errors are only retried for idempotent methods, a
+// POST may have been processed.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first one.
+	MaxAttempts int
+	// BaseDelay is the delay before the second attempt, doubled for each
+	// further attempt up to MaxDelay. The delay is drawn at random below it.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// idempotentMethods are the methods whose requests can be sent again once
+// the upstream may have processed them.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// backoff reports whether the attempt of req that returned resp and err must
+// be retried, and after which delay.
+func (p *RetryPolicy) backoff(req *http.Request, attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	if p == nil || attempt >= p.MaxAttempts || req.Context().Err() != nil {
+		return 0, false
+	}
+
+	switch {
+	case err != nil:
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) || errors.Is(err, context.Canceled) || !idempotentMethods[req.Method] {
+			return 0, false
+		}
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		// A Retry-After above MaxDelay is left to the client to honor.
+		if delay, ok := retryAfter(resp); ok {
+			return delay, delay <= p.MaxDelay
+		}
+	case resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented:
+		if !idempotentMethods[req.Method] {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	ceiling := p.BaseDelay << (attempt - 1)
+	if ceiling > p.MaxDelay || ceiling <= 0 {
+		ceiling = p.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0, true
+	}
+	return time.Duration(rand.Int63n(int64(ceiling))), true
+}
+
+// retryAfter returns the delay of the Retry-After header of resp, when set
+// in seconds.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
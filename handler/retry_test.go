@@ -0,0 +1,139 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: 5 * time.Second}
+	response := func(statusCode int, retryAfter string) *http.Response {
+		resp := &http.Response{StatusCode: statusCode, Header: http.Header{}}
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name      string
+		policy    *RetryPolicy
+		method    string
+		attempt   int
+		resp      *http.Response
+		err       error
+		wantRetry bool
+		wantDelay time.Duration
+	}{
+		{name: "no policy", method: "GET", attempt: 1, resp: response(503, ""), wantRetry: false},
+		{name: "success", policy: policy, method: "GET", attempt: 1, resp: response(200, ""), wantRetry: false},
+		{name: "client error", policy: policy, method: "GET", attempt: 1, resp: response(404, ""), wantRetry: false},
+		{name: "throttled post", policy: policy, method: "POST", attempt: 1, resp: response(429, ""), wantRetry: true},
+		{name: "unavailable post", policy: policy, method: "POST", attempt: 2, resp: response(503, ""), wantRetry: true},
+		{name: "retry after", policy: policy, method: "POST", attempt: 1, resp: response(503, "2"), wantRetry: true, wantDelay: 2 * time.Second},
+		{name: "retry after above the max delay", policy: policy, method: "GET", attempt: 1, resp: response(429, "60"), wantRetry: false},
+		{name: "server error get", policy: policy, method: "GET", attempt: 1, resp: response(500, ""), wantRetry: true},
+		{name: "server error post", policy: policy, method: "POST", attempt: 1, resp: response(502, ""), wantRetry: false},
+		{name: "not implemented", policy: policy, method: "GET", attempt: 1, resp: response(501, ""), wantRetry: false},
+		{name: "last attempt", policy: policy, method: "GET", attempt: 3, resp: response(503, ""), wantRetry: false},
+		{name: "network error put", policy: policy, method: "PUT", attempt: 1, err: errors.New("connection reset by peer"), wantRetry: true},
+		{name: "network error post", policy: policy, method: "POST", attempt: 1, err: errors.New("connection reset by peer"), wantRetry: false},
+		{name: "rejected request", policy: policy, method: "GET", attempt: 1, err: &StatusError{StatusCode: 503, Err: errors.New("too many requests in flight")}, wantRetry: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			delay, retry := tt.policy.backoff(req, tt.attempt, tt.resp, tt.err)
+			assert.Equal(t, tt.wantRetry, retry)
+			if tt.wantDelay != 0 {
+				assert.Equal(t, tt.wantDelay, delay)
+			}
+			if retry && tt.wantDelay == 0 {
+				assert.Less(t, delay, policy.BaseDelay<<(tt.attempt-1))
+			}
+		})
+	}
+
+	// Delays are capped.
+	for attempt := 1; attempt < 70; attempt++ {
+		delay, retry := (&RetryPolicy{MaxAttempts: 100, BaseDelay: time.Second, MaxDelay: 3 * time.Second}).backoff(httptest.NewRequest("GET", "/", nil), attempt, response(500, ""), nil)
+		assert.True(t, retry)
+		assert.GreaterOrEqual(t, delay, time.Duration(0))
+		assert.Less(t, delay, 3*time.Second)
+	}
+}
+
+func TestProxyClient_Retry(t *testing.T) {
+	var attempts []*http.Request
+	var bodies []string
+	statuses := []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK}
+	client := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+		Client: clientFunc(func(req *http.Request) (*http.Response, error) {
+			body, _ := io.ReadAll(req.Body)
+			attempts = append(attempts, req)
+			bodies = append(bodies, string(body))
+			statusCode := statuses[len(attempts)-1]
+			return &http.Response{StatusCode: statusCode, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(http.StatusText(statusCode)))}, nil
+		}),
+		Retry: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond},
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "https://execute-api.us-west-2.amazonaws.com/items/1", strings.NewReader(`{"name":"a"}`))
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Len(t, attempts, 3)
+	for i, attempt := range attempts {
+		assert.Equal(t, `{"name":"a"}`, bodies[i], "the body is sent again")
+		assert.Equal(t, int64(12), attempt.ContentLength)
+		assert.Contains(t, attempt.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/")
+	}
+}
+
+func TestProxyClient_RetryCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	client := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+		Client: clientFunc(func(req *http.Request) (*http.Response, error) {
+			attempts++
+			// The client goes away while the retry waits.
+			time.AfterFunc(10*time.Millisecond, cancel)
+			return &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"5"}}, Body: http.NoBody}, nil
+		}),
+		Retry: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://execute-api.us-west-2.amazonaws.com/items", nil).WithContext(ctx)
+	_, err := client.Do(req)
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, StatusClientClosedRequest, errorStatusCode(err))
+}
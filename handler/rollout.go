@@ -0,0 +1,305 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultRolloutMinRequests is the number of requests a configuration on
+// probation serves before its error rate is compared.
+const DefaultRolloutMinRequests = 20
+
+// signingErrorCodes are the error codes of the AWS services rejecting the
+// signature or the credentials of a request.
+var signingErrorCodes = []string{
+	"SignatureDoesNotMatch",
+	"InvalidSignatureException",
+	"IncompleteSignature",
+	"IncompleteSignatureException",
+	"InvalidClientTokenId",
+	"UnrecognizedClientException",
+	"InvalidAccessKeyId",
+	"ExpiredToken",
+	"ExpiredTokenException",
+	"AuthFailure",
+}
+
+// maxErrorCodePeek is the most bytes of the body of an error response read
+// to find its error code.
+const maxErrorCodePeek = 1024
+
+// ConfigVersion is a configuration installed by a Rollout.
+type ConfigVersion struct {
+	Version   int
+	Client    Client
+	AppliedAt time.Time
+
+	requests atomic.Int64
+	failures atomic.Int64
+}
+
+// ErrorRate returns the fraction of the requests of the configuration that
+// failed to be signed, or whose signature or credentials the upstream
+// rejected.
+func (v *ConfigVersion) ErrorRate() float64 {
+	requests := v.requests.Load()
+	if requests == 0 {
+		return 0
+	}
+	return float64(v.failures.Load()) / float64(requests)
+}
+
+// Rollout implements the Client interface by proxying through the current
+// configuration, such as the Router of a reloaded config. The requests in
+// flight complete with the configuration they started with. It keeps the
+// last-known-good configuration and rolls back to it when the signing error
+// rate of a newly applied configuration exceeds the one of the last-known-good
+// configuration by more than MaxErrorRate during its probation window.
+type Rollout struct {
+	// Validate builds the configuration of a reload, e.g. from the config
+	// file, and returns an error when it is invalid.
+	Validate func() (Client, error)
+	// Probation is how long a new configuration is monitored before it
+	// becomes the last-known-good configuration.
+	Probation time.Duration
+	// MaxErrorRate is how much higher than the error rate of the
+	// last-known-good configuration the one of a configuration on probation
+	// can be, e.g. 0.05 for 5 points, see rolloutFailure. 1 disables
+	// automatic rollback.
+	MaxErrorRate float64
+	// MinRequests is the number of requests a configuration on probation
+	// serves before its error rate is compared, DefaultRolloutMinRequests
+	// when zero.
+	MinRequests int64
+
+	mu            sync.RWMutex
+	current       *ConfigVersion
+	lastKnownGood *ConfigVersion
+	versions      int
+}
+
+// NewRollout returns a Rollout serving the initial configuration, which is
+// trusted as last-known-good.
+func NewRollout(initial Client, probation time.Duration, maxErrorRate float64) *Rollout {
+	version := &ConfigVersion{Version: 1, Client: initial, AppliedAt: time.Now()}
+	return &Rollout{
+		Probation:     probation,
+		MaxErrorRate:  maxErrorRate,
+		current:       version,
+		lastKnownGood: version,
+		versions:      1,
+	}
+}
+
+// Reload builds a new configuration with Validate and applies it. The
+// current configuration is kept when it is invalid.
+func (r *Rollout) Reload() error {
+	if r.Validate == nil {
+		return errors.New("no configuration to reload")
+	}
+	c, err := r.Validate()
+	if err != nil {
+		return err
+	}
+	r.Apply(c)
+	return nil
+}
+
+// Apply installs a new configuration, starting its probation.
+func (r *Rollout) Apply(c Client) *ConfigVersion {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.promote()
+	r.versions++
+	r.current = &ConfigVersion{Version: r.versions, Client: c, AppliedAt: time.Now()}
+
+	log.WithFields(log.Fields{"version": r.current.Version, "probation": r.Probation}).Info("applied configuration")
+	return r.current
+}
+
+// Rollback reinstalls the last-known-good configuration, it fails when the
+// current configuration is the last-known-good one.
+func (r *Rollout) Rollback() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.promote()
+	if r.current == r.lastKnownGood {
+		return fmt.Errorf("version %d is the last-known-good configuration", r.current.Version)
+	}
+	r.rollback("requested")
+	return nil
+}
+
+// Current returns the configuration used to proxy requests.
+func (r *Rollout) Current() *ConfigVersion {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current
+}
+
+// LastKnownGood returns the configuration Rollback reverts to.
+func (r *Rollout) LastKnownGood() *ConfigVersion {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.promote()
+	return r.lastKnownGood
+}
+
+func (r *Rollout) Do(req *http.Request) (*http.Response, error) {
+	version := r.Current()
+
+	resp, err := version.Client.Do(req)
+	version.requests.Add(1)
+	if rolloutFailure(resp, err) {
+		version.failures.Add(1)
+		r.checkErrorRate(version)
+	}
+	return resp, err
+}
+
+func (r *Rollout) SigningName(req *http.Request) string {
+	if resolver, ok := r.Current().Client.(ServiceResolver); ok {
+		return resolver.SigningName(req)
+	}
+	return ""
+}
+
+// RoutingTable returns the routes of client, the Router of a config or a
+// single ProxyClient, nil for other clients.
+func RoutingTable(client Client) []RouteInfo {
+	if target, ok := client.(*TargetInPath); ok {
+		client = target.Client
+	}
+	if rollout, ok := client.(*Rollout); ok {
+		client = rollout.Current().Client
+	}
+	switch c := client.(type) {
+	case *Router:
+		return c.Routes()
+	case *ProxyClient:
+		return []RouteInfo{describeRoute(RouteInfo{Default: true}, c)}
+	}
+	return nil
+}
+
+// rolloutFailure reports whether a request failed because of the
+// credentials or the signing settings of the configuration it was sent with:
+// it could not be signed, e.g. without credentials, or the upstream rejected
+// its signature or credentials. The other errors, such as an AccessDenied on
+// a resource, are not failures of the configuration.
+func rolloutFailure(resp *http.Response, err error) bool {
+	var signingErr *signingError
+	if err != nil {
+		return errors.As(err, &signingErr)
+	}
+	return signingErrorResponse(resp)
+}
+
+// signingErrorResponse reports whether resp rejects the signature or the
+// credentials of its request, from its X-Amzn-ErrorType or the error code at
+// the start of its body, which is read again by the next readers.
+func signingErrorResponse(resp *http.Response) bool {
+	if resp == nil || (resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusForbidden) {
+		return false
+	}
+	// The error type may be followed by a colon and a namespace URI.
+	if errorType := resp.Header.Get("X-Amzn-ErrorType"); errorType != "" {
+		errorType, _, _ = strings.Cut(errorType, ":")
+		return slices.Contains(signingErrorCodes, errorType)
+	}
+	if resp.Body == nil {
+		return false
+	}
+
+	peek := make([]byte, maxErrorCodePeek)
+	n, _ := io.ReadFull(resp.Body, peek)
+	peek = peek[:n]
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peek), resp.Body), resp.Body}
+	for _, code := range signingErrorCodes {
+		if bytes.Contains(peek, []byte(code)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkErrorRate rolls back version when it is on probation and its error
+// rate exceeds the one of the last-known-good configuration by more than
+// MaxErrorRate.
+func (r *Rollout) checkErrorRate(version *ConfigVersion) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.current != version || r.current == r.lastKnownGood {
+		return
+	}
+	if time.Since(version.AppliedAt) > r.Probation {
+		r.promote()
+		return
+	}
+
+	minRequests := r.MinRequests
+	if minRequests <= 0 {
+		minRequests = DefaultRolloutMinRequests
+	}
+	if version.requests.Load() < minRequests {
+		return
+	}
+	rate, baseline := version.ErrorRate(), r.lastKnownGood.ErrorRate()
+	if rate > baseline+r.MaxErrorRate {
+		r.rollback(fmt.Sprintf("signing error rate of %.1f%% during probation, %.1f%% for version %d", rate*100, baseline*100, r.lastKnownGood.Version))
+	}
+}
+
+// promote marks the current configuration as last-known-good once it has
+// survived its probation window. Must be called with the lock held.
+func (r *Rollout) promote() {
+	if r.current != r.lastKnownGood && time.Since(r.current.AppliedAt) > r.Probation {
+		r.lastKnownGood = r.current
+	}
+}
+
+// rollback must be called with the lock held.
+func (r *Rollout) rollback(reason string) {
+	if r.current == r.lastKnownGood {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"from_version": r.current.Version,
+		"to_version":   r.lastKnownGood.Version,
+		"reason":       reason,
+	}).Warn("rolling back configuration")
+	r.current = r.lastKnownGood
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollout_ReloadKeepsCurrentWhenValidationFails(t *testing.T) {
+	initial := &mockProxyClient{Response: &http.Response{StatusCode: http.StatusOK}}
+	rollout := NewRollout(initial, time.Minute, 0.05)
+	rollout.Validate = func() (Client, error) { return nil, fmt.Errorf("bad config") }
+
+	err := rollout.Reload()
+
+	assert.EqualError(t, err, "bad config")
+	assert.Equal(t, initial, rollout.Current().Client)
+	assert.Equal(t, 1, rollout.Current().Version)
+}
+
+func TestRollout_RollsBackOnSigningErrorsDuringProbation(t *testing.T) {
+	initial := &mockProxyClient{Response: &http.Response{StatusCode: http.StatusOK}}
+	broken := &mockProxyClient{Response: &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{"X-Amzn-Errortype": {"InvalidSignatureException"}}}}
+	rollout := NewRollout(initial, time.Minute, 0.25)
+	rollout.MinRequests = 4
+	rollout.Validate = func() (Client, error) { return broken, nil }
+	for i := 0; i < 4; i++ {
+		rollout.Do(&http.Request{})
+	}
+
+	assert.NoError(t, rollout.Reload())
+	assert.Equal(t, 2, rollout.Current().Version)
+
+	// The error rate is only compared after MinRequests requests.
+	for i := 0; i < 3; i++ {
+		resp, _ := rollout.Do(&http.Request{})
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+	assert.Equal(t, broken, rollout.Current().Client)
+
+	rollout.Do(&http.Request{})
+	assert.Equal(t, initial, rollout.Current().Client)
+	assert.Zero(t, rollout.LastKnownGood().ErrorRate())
+
+	version := rollout.Apply(initial)
+	assert.Equal(t, 3, version.Version)
+}
+
+func TestRollout_ComparesErrorRates(t *testing.T) {
+	// A fifth of the requests of the initial configuration fail already.
+	failures := 0
+	flaky := clientFunc(func(req *http.Request) (*http.Response, error) {
+		failures++
+		if failures%5 == 0 {
+			return nil, &signingError{err: errors.New("NoCredentialProviders: no valid providers in chain")}
+		}
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	denied := &mockProxyClient{Response: &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{"X-Amzn-Errortype": {"AccessDeniedException"}}}}
+	rollout := NewRollout(flaky, time.Minute, 0.1)
+	rollout.MinRequests = 5
+	for i := 0; i < 10; i++ {
+		rollout.Do(&http.Request{})
+	}
+
+	rollout.Apply(flaky)
+	for i := 0; i < 10; i++ {
+		rollout.Do(&http.Request{})
+	}
+	assert.Equal(t, 2, rollout.Current().Version)
+
+	// Denied requests are not signing errors.
+	rollout.Apply(denied)
+	for i := 0; i < 10; i++ {
+		rollout.Do(&http.Request{})
+	}
+	assert.Equal(t, 3, rollout.Current().Version)
+}
+
+func TestRollout_PromotesAfterProbation(t *testing.T) {
+	initial := &mockProxyClient{Response: &http.Response{StatusCode: http.StatusOK}}
+	next := &mockProxyClient{Err: &signingError{err: errors.New("no credentials")}}
+	rollout := NewRollout(initial, 0, 0)
+	rollout.MinRequests = 1
+
+	rollout.Apply(next)
+	time.Sleep(time.Millisecond)
+
+	rollout.Do(&http.Request{})
+	rollout.Do(&http.Request{})
+	assert.Equal(t, next, rollout.Current().Client)
+	assert.Equal(t, next, rollout.LastKnownGood().Client)
+}
+
+func TestRollout_Rollback(t *testing.T) {
+	initial := &mockProxyClient{}
+	rollout := NewRollout(initial, time.Minute, 1)
+	assert.EqualError(t, rollout.Rollback(), "version 1 is the last-known-good configuration")
+
+	rollout.Apply(&mockProxyClient{})
+
+	assert.NoError(t, rollout.Rollback())
+	assert.Equal(t, 1, rollout.Current().Version)
+	assert.Equal(t, initial, rollout.Current().Client)
+}
+
+func TestRollout_SigningName(t *testing.T) {
+	router := NewRouter(namedClient("default"))
+	router.Route("search.internal", &ProxyClient{RegionOverride: "eu-west-1", SigningNameOverride: "es"})
+	rollout := NewRollout(namedClient("first"), time.Minute, 1)
+
+	resp, err := rollout.Do(&http.Request{})
+	assert.NoError(t, err)
+	assert.Equal(t, "first", resp.Status)
+	assert.Empty(t, rollout.SigningName(&http.Request{Host: "search.internal"}))
+	assert.Nil(t, RoutingTable(rollout))
+
+	rollout.Apply(router)
+	resp, err = rollout.Do(&http.Request{Host: "other.internal"})
+	assert.NoError(t, err)
+	assert.Equal(t, "default", resp.Status)
+	assert.Equal(t, "es", rollout.SigningName(&http.Request{Host: "search.internal"}))
+	assert.Equal(t, router.Routes(), RoutingTable(rollout))
+}
+
+func TestRolloutFailure(t *testing.T) {
+	xmlError := func(code string) *http.Response {
+		return &http.Response{StatusCode: http.StatusForbidden, Body: io.NopCloser(strings.NewReader(
+			`<?xml version="1.0" encoding="UTF-8"?><Error><Code>` + code + `</Code><Message>denied</Message></Error>`))}
+	}
+	tests := []struct {
+		name string
+		resp *http.Response
+		err  error
+		want bool
+	}{
+		{name: "ok", resp: &http.Response{StatusCode: http.StatusOK}},
+		{name: "not found", resp: &http.Response{StatusCode: http.StatusNotFound}},
+		{name: "signature refused", resp: xmlError("SignatureDoesNotMatch"), want: true},
+		{name: "unknown access key", resp: &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{"X-Amzn-Errortype": {"UnrecognizedClientException:http://internal.amazon.com/coral/com.amazon.coral.service/"}}}, want: true},
+		{name: "access denied", resp: xmlError("AccessDenied")},
+		{name: "access denied by type", resp: &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{"X-Amzn-Errortype": {"AccessDeniedException"}}}},
+		{name: "signing error", err: &signingError{err: errors.New("NoCredentialProviders: no valid providers in chain")}, want: true},
+		{name: "no role for the account", err: &StatusError{StatusCode: http.StatusForbidden, Err: errors.New("no role")}},
+		{name: "body memory exhausted", err: &StatusError{StatusCode: http.StatusServiceUnavailable, Err: errBodyMemoryExhausted}},
+		{name: "upstream unreachable", err: errors.New("connection refused")},
+		{name: "invalid request", err: badRequest(errors.New("invalid query"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, rolloutFailure(tt.resp, tt.err))
+			if tt.resp != nil && tt.resp.Body != nil {
+				// The body is read again in full.
+				body, _ := io.ReadAll(tt.resp.Body)
+				assert.True(t, strings.HasPrefix(string(body), "<?xml"))
+			}
+		})
+	}
+}
+
+func TestRoutingTable(t *testing.T) {
+	assert.Equal(t, []RouteInfo{{Default: true, Upstream: "upstream.internal", Region: "us-east-1"}},
+		RoutingTable(&ProxyClient{HostOverride: "upstream.internal", RegionOverride: "us-east-1"}))
+	assert.Equal(t, []RouteInfo{{Default: true, Region: "us-east-1"}},
+		RoutingTable(&TargetInPath{Client: &ProxyClient{RegionOverride: "us-east-1"}}))
+	assert.Nil(t, RoutingTable(namedClient("other")))
+}
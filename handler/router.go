@@ -0,0 +1,174 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Router is a Client routing each request to the client configured for its
+// Host header, then to the client of the longest path prefix it matches, or
+// to Default.
+type Router struct {
+	routes  map[string]Client
+	paths   []pathRoute
+	Default Client
+}
+
+// pathRoute routes the requests under a path prefix.
+type pathRoute struct {
+	prefix string
+	strip  bool
+	client Client
+}
+
+// match reports whether path is the prefix or below it.
+func (p pathRoute) match(path string) bool {
+	return path == p.prefix || strings.HasPrefix(path, p.prefix+"/")
+}
+
+// NewRouter returns a Router without routes.
+func NewRouter(defaultClient Client) *Router {
+	return &Router{routes: map[string]Client{}, Default: defaultClient}
+}
+
+// Route routes the requests with the given Host header, with or without a
+// port, to client.
+func (r *Router) Route(host string, client Client) {
+	r.routes[routeHost(host)] = client
+}
+
+// RoutePath routes the requests whose path is prefix or below it, such as
+// /s3/bucket/key for /s3, to client. With strip, the prefix is removed from
+// the path of the requests.
+func (r *Router) RoutePath(prefix string, strip bool, client Client) {
+	r.paths = append(r.paths, pathRoute{prefix: routePathPrefix(prefix), strip: strip, client: client})
+	// Longest prefixes first, for nested prefixes to take precedence.
+	sort.SliceStable(r.paths, func(i, j int) bool { return len(r.paths[i].prefix) > len(r.paths[j].prefix) })
+}
+
+func (r *Router) Do(req *http.Request) (*http.Response, error) {
+	client, route := r.route(req)
+	if client == nil {
+		return nil, &StatusError{StatusCode: http.StatusNotFound, Err: fmt.Errorf("no config set for host %s", req.Host)}
+	}
+	if route != nil && route.strip {
+		req = stripPathPrefix(req, route.prefix)
+	}
+	return client.Do(req)
+}
+
+// SigningName returns the name of the service the client routed req would
+// sign it for.
+func (r *Router) SigningName(req *http.Request) string {
+	client, _ := r.route(req)
+	if resolver, ok := client.(ServiceResolver); ok {
+		return resolver.SigningName(req)
+	}
+	return ""
+}
+
+// route returns the client of req, and the path route it matched if it was
+// not routed by host.
+func (r *Router) route(req *http.Request) (Client, *pathRoute) {
+	if client, ok := r.routes[routeHost(req.Host)]; ok {
+		return client, nil
+	}
+	for i := range r.paths {
+		if r.paths[i].match(req.URL.Path) {
+			return r.paths[i].client, &r.paths[i]
+		}
+	}
+	return r.Default, nil
+}
+
+// RouteInfo describes a route, for the admin endpoints.
+type RouteInfo struct {
+	Host        string `json:"host,omitempty"`
+	PathPrefix  string `json:"path_prefix,omitempty"`
+	StripPrefix bool   `json:"strip_prefix,omitempty"`
+	// Default is set for the route of the requests matching no other.
+	Default bool `json:"default,omitempty"`
+	// Upstream is the host the requests are sent to, the Host header of the
+	// requests when empty. Region and Service are resolved from it when
+	// empty.
+	Upstream         string `json:"upstream,omitempty"`
+	SigningHost      string `json:"signing_host,omitempty"`
+	Region           string `json:"region,omitempty"`
+	Service          string `json:"service,omitempty"`
+	SigningAlgorithm string `json:"signing_algorithm,omitempty"`
+}
+
+// Routes returns the routes of r, by host then by path prefix in the order
+// they are matched, and the default route last.
+func (r *Router) Routes() []RouteInfo {
+	hosts := make([]string, 0, len(r.routes))
+	for host := range r.routes {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var routes []RouteInfo
+	for _, host := range hosts {
+		routes = append(routes, describeRoute(RouteInfo{Host: host}, r.routes[host]))
+	}
+	for _, path := range r.paths {
+		routes = append(routes, describeRoute(RouteInfo{PathPrefix: path.prefix, StripPrefix: path.strip}, path.client))
+	}
+	if r.Default != nil {
+		routes = append(routes, describeRoute(RouteInfo{Default: true}, r.Default))
+	}
+	return routes
+}
+
+// describeRoute completes route with the signing settings of client.
+func describeRoute(route RouteInfo, client Client) RouteInfo {
+	if p, ok := client.(*ProxyClient); ok {
+		route.Upstream = p.HostOverride
+		route.SigningHost = p.SigningHostOverride
+		route.Region = p.RegionOverride
+		route.Service = p.SigningNameOverride
+		route.SigningAlgorithm = p.SigningAlgorithm
+	}
+	return route
+}
+
+// stripPathPrefix returns a copy of req without prefix in its path.
+func stripPathPrefix(req *http.Request, prefix string) *http.Request {
+	stripped := req.Clone(req.Context())
+	stripped.URL.Path = trimPathPrefix(req.URL.Path, prefix)
+	if req.URL.RawPath != "" {
+		stripped.URL.RawPath = trimPathPrefix(req.URL.RawPath, prefix)
+	}
+	return stripped
+}
+
+// trimPathPrefix removes prefix from path, keeping the slashes that follow
+// it, which are significant in S3 keys.
+func trimPathPrefix(path, prefix string) string {
+	if rest := strings.TrimPrefix(path, prefix); rest != "" {
+		return rest
+	}
+	return "/"
+}
+
+// routePathPrefix normalizes a path prefix for routing.
+func routePathPrefix(prefix string) string {
+	return "/" + strings.Trim(prefix, "/")
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type namedClient string
+
+func (c namedClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{Status: string(c)}, nil
+}
+
+func TestRouter_Do(t *testing.T) {
+	router := NewRouter(namedClient("default"))
+	router.Route("search.internal", namedClient("search"))
+	router.Route("[::1]:8080", namedClient("ipv6"))
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "search.internal", want: "search"},
+		{host: "Search.Internal:8080", want: "search"},
+		{host: "[::1]", want: "ipv6"},
+		{host: "other.internal", want: "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			resp, err := router.Do(&http.Request{Host: tt.host})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, resp.Status)
+		})
+	}
+
+	router.Default = nil
+	_, err := router.Do(&http.Request{Host: "other.internal"})
+	assert.Equal(t, http.StatusNotFound, errorStatusCode(err))
+}
+
+// pathClient returns its name and the path of the requests.
+type pathClient string
+
+func (c pathClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{Status: string(c) + " " + req.URL.EscapedPath()}, nil
+}
+
+func TestRouter_RoutePath(t *testing.T) {
+	router := NewRouter(pathClient("default"))
+	router.Route("search.internal", pathClient("search"))
+	router.RoutePath("/s3", true, pathClient("s3"))
+	router.RoutePath("/s3/logs/", true, pathClient("logs"))
+	router.RoutePath("/aps", false, pathClient("aps"))
+
+	tests := []struct {
+		name string
+		host string
+		path string
+		want string
+	}{
+		{name: "strips the prefix", path: "/s3/bucket/key", want: "s3 /bucket/key"},
+		{name: "prefix only", path: "/s3", want: "s3 /"},
+		{name: "keeps leading slashes of keys", path: "/s3/bucket//key", want: "s3 /bucket//key"},
+		{name: "keeps escaping", path: "/s3/bucket/a%2Fb", want: "s3 /bucket/a%2Fb"},
+		{name: "longest prefix", path: "/s3/logs/2024", want: "logs /2024"},
+		{name: "keeps the prefix", path: "/aps/workspaces/ws-1/api/v1/remote_write", want: "aps /aps/workspaces/ws-1/api/v1/remote_write"},
+		{name: "matches whole segments", path: "/s3x/bucket", want: "default /s3x/bucket"},
+		{name: "host routes first", host: "search.internal", path: "/s3/bucket", want: "search /s3/bucket"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			resp, err := router.Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, resp.Status)
+			assert.Equal(t, tt.path, req.URL.EscapedPath(), "the incoming request is left untouched")
+		})
+	}
+}
+
+func TestRouter_Routes(t *testing.T) {
+	search := &ProxyClient{HostOverride: "search-domain.eu-west-1.es.amazonaws.com", RegionOverride: "eu-west-1", SigningNameOverride: "es"}
+	router := NewRouter(&ProxyClient{})
+	router.Route("search.internal", search)
+	router.Route("api.internal", namedClient("api"))
+	router.RoutePath("/s3/", true, &ProxyClient{HostOverride: "s3.eu-west-1.amazonaws.com", SigningAlgorithm: SigningAlgorithmV4A})
+	router.RoutePath("/s3/logs", false, search)
+
+	assert.Equal(t, []RouteInfo{
+		{Host: "api.internal"},
+		{Host: "search.internal", Upstream: "search-domain.eu-west-1.es.amazonaws.com", Region: "eu-west-1", Service: "es"},
+		{PathPrefix: "/s3/logs", Upstream: "search-domain.eu-west-1.es.amazonaws.com", Region: "eu-west-1", Service: "es"},
+		{PathPrefix: "/s3", StripPrefix: true, Upstream: "s3.eu-west-1.amazonaws.com", SigningAlgorithm: SigningAlgorithmV4A},
+		{Default: true},
+	}, router.Routes())
+}
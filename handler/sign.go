@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// captureClient is a Client keeping the request instead of sending it.
+type captureClient struct {
+	req *http.Request
+}
+
+func (c *captureClient) Do(req *http.Request) (*http.Response, error) {
+	c.req = req
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+}
+
+// SignRequest returns the upstream request p would send for req, signed,
+// without sending it.
+func SignRequest(p *ProxyClient, req *http.Request) (*http.Request, error) {
+	client := *p
+	capture := &captureClient{}
+	client.Client = capture
+	client.Retry = nil
+	client.Timeout = 0
+	if _, err := client.Do(req); err != nil {
+		return nil, err
+	}
+	return capture.req, nil
+}
+
+// SignedHeaders returns the headers of req, Host first, one "Name: value"
+// per line.
+func SignedHeaders(req *http.Request) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Host: %s\n", requestHost(req))
+	for _, name := range sortedHeaderNames(req.Header) {
+		for _, value := range req.Header[name] {
+			fmt.Fprintf(&b, "%s: %s\n", name, value)
+		}
+	}
+	return b.String()
+}
+
+// CurlCommand returns a curl command sending req, with the content of
+// bodyFile as its body when it is not empty.
+func CurlCommand(req *http.Request, bodyFile string) string {
+	command := "curl "
+	if req.Method != http.MethodGet || bodyFile != "" {
+		command += "-X " + shellQuote(req.Method) + " "
+	}
+	lines := []string{command + shellQuote(req.URL.String())}
+	if req.Host != "" && req.Host != req.URL.Host {
+		lines = append(lines, "-H "+shellQuote("Host: "+req.Host))
+	}
+	for _, name := range sortedHeaderNames(req.Header) {
+		for _, value := range req.Header[name] {
+			lines = append(lines, "-H "+shellQuote(name+": "+value))
+		}
+	}
+	if bodyFile != "" {
+		lines = append(lines, "--data-binary "+shellQuote("@"+bodyFile))
+	}
+	return strings.Join(lines, " \\\n  ")
+}
+
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+func sortedHeaderNames(header http.Header) []string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
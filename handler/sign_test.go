@@ -0,0 +1,84 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/aws-sigv4-proxy/sigv4verifier"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignRequest(t *testing.T) {
+	sent := false
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")),
+		Client: clientFunc(func(req *http.Request) (*http.Response, error) {
+			sent = true
+			return nil, nil
+		}),
+	}
+
+	signed, err := SignRequest(proxyClient, &http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Path: "/", RawQuery: "b=2&a=1"},
+		Host:   "dynamodb.us-west-2.amazonaws.com",
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   http.NoBody,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, sent)
+	assert.Equal(t, "https://dynamodb.us-west-2.amazonaws.com/?b=2&a=1", signed.URL.String())
+	assert.Contains(t, signed.Header.Get("Authorization"), "Credential=AKIDEXAMPLE/")
+	assert.Contains(t, signed.Header.Get("Authorization"), "/us-west-2/dynamodb/aws4_request")
+
+	// The signature is valid for the request sent by curl.
+	verifier := &sigv4verifier.Verifier{Credentials: map[string]string{"AKIDEXAMPLE": "secret"}}
+	signed.Body = http.NoBody
+	result, err := verifier.Verify(signed)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "dynamodb", result.Service)
+	}
+
+	headers := SignedHeaders(signed)
+	assert.True(t, strings.HasPrefix(headers, "Host: dynamodb.us-west-2.amazonaws.com\nAuthorization: AWS4-HMAC-SHA256 "), headers)
+	assert.Contains(t, headers, "\nContent-Type: application/json\n")
+}
+
+func TestCurlCommand(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/a?b=it's", nil)
+	req.Header.Set("X-Amz-Date", "20240101T000000Z")
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=AKID/20240101/us-east-1/es/aws4_request")
+	assert.Equal(t, `curl 'https://example.amazonaws.com/a?b=it'\''s' \
+  -H 'Authorization: AWS4-HMAC-SHA256 Credential=AKID/20240101/us-east-1/es/aws4_request' \
+  -H 'X-Amz-Date: 20240101T000000Z'`, CurlCommand(req, ""))
+
+	req.Method = http.MethodPut
+	req.Host = "signed.example.com"
+	assert.Equal(t, `curl -X 'PUT' 'https://example.amazonaws.com/a?b=it'\''s' \
+  -H 'Host: signed.example.com' \
+  -H 'Authorization: AWS4-HMAC-SHA256 Credential=AKID/20240101/us-east-1/es/aws4_request' \
+  -H 'X-Amz-Date: 20240101T000000Z' \
+  --data-binary '@body.json'`, CurlCommand(req, "body.json"))
+}
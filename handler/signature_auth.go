@@ -0,0 +1,400 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awslabs/aws-sigv4-proxy/sigv4verifier"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// presignedQueryParams are the query parameters of a presigned request.
+var presignedQueryParams = map[string]bool{
+	"X-Amz-Algorithm":      true,
+	"X-Amz-Credential":     true,
+	"X-Amz-Date":           true,
+	"X-Amz-Expires":        true,
+	"X-Amz-SignedHeaders":  true,
+	"X-Amz-Signature":      true,
+	"X-Amz-Security-Token": true,
+	"X-Amz-Region-Set":     true,
+}
+
+// SignatureAuth is a Policy requiring clients to sign their requests with
+// SigV4 or SigV4A, with the access keys of Credentials. Their signature is
+// stripped and the request signed again with the credentials of the proxy,
+// which then translates the credentials of its clients rather than signing
+// for anyone.
+type SignatureAuth struct {
+	// Credentials maps the access key IDs of the clients to their secret
+	// access keys.
+	Credentials map[string]string
+	// MaxRequestBodyMemory, RequestBodySpillDir and BodyMemory bound the
+	// bodies buffered to hash them, as the ones of the ProxyClient, since
+	// they are read before the signature is verified.
+	MaxRequestBodyMemory int64
+	RequestBodySpillDir  string
+	BodyMemory           *BodyMemory
+}
+
+// LoadAccessKeys reads the access keys of the file at path, one
+// <access key id>:<secret access key> pair per line. Blank lines and lines
+// starting with # are ignored.
+func LoadAccessKeys(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, secret, ok := strings.Cut(line, ":")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid access key at line %d of %s, expected <access key id>:<secret access key>", n, path)
+		}
+		keys[id] = secret
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read access keys %s: %w", path, err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no access keys in %s", path)
+	}
+	return keys, nil
+}
+
+func (s *SignatureAuth) Name() string {
+	return "sigv4"
+}
+
+func (s *SignatureAuth) Check(r *http.Request) *Rejection {
+	// The verifier hashes the body of the requests without the hash.
+	if r.Header.Get("X-Amz-Content-Sha256") == "" {
+		if err := s.bufferBody(r); err != nil {
+			return &Rejection{StatusCode: errorStatusCode(err), Message: err.Error()}
+		}
+	}
+	verifier := &sigv4verifier.Verifier{Credentials: s.Credentials}
+	result, err := verifier.Verify(r)
+	if err == nil {
+		err = s.checkSignedRequest(r, result)
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return &Rejection{StatusCode: statusErr.StatusCode, Message: err.Error()}
+	}
+	if err != nil {
+		return &Rejection{StatusCode: http.StatusForbidden, Message: fmt.Sprintf("invalid signature: %v", err)}
+	}
+	log.WithFields(log.Fields{"access_key_id": result.AccessKeyID}).Debug("verified client signature")
+
+	for _, header := range signingHeaders {
+		r.Header.Del(header)
+	}
+	if result.Presigned {
+		stripPresignedQuery(r.URL)
+	}
+	return nil
+}
+
+// checkSignedRequest checks what the signature of the verified request r
+// must cover, since the upstream only sees the signature of the proxy.
+func (s *SignatureAuth) checkSignedRequest(r *http.Request, result *sigv4verifier.Result) error {
+	signedHost := false
+	for _, header := range result.SignedHeaders {
+		signedHost = signedHost || header == "host"
+	}
+	// The upstream may be picked from the Host header.
+	if !signedHost {
+		return errors.New("the host header is not signed")
+	}
+
+	hash := r.Header.Get("X-Amz-Content-Sha256")
+	switch {
+	case hash == "" || hash == "UNSIGNED-PAYLOAD":
+		// The verifier hashed the body itself, or the client did not sign
+		// it.
+		return nil
+	case strings.HasPrefix(hash, "STREAMING-"):
+		return errors.New("streaming payloads cannot be verified")
+	}
+	// The body must match the hash the client signed.
+	if err := s.bufferBody(r); err != nil {
+		return err
+	}
+	sum := sha256.New()
+	if body, ok := r.Body.(*bufferedBody); ok {
+		if _, err := io.Copy(sum, body); err != nil {
+			return &StatusError{StatusCode: http.StatusInternalServerError, Err: fmt.Errorf("unable to hash request body: %w", err)}
+		}
+		body.Seek(0, io.SeekStart)
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != hash {
+		return errors.New("the body does not match X-Amz-Content-Sha256")
+	}
+	return nil
+}
+
+// bufferBody buffers the body of r, with the limits of the bodies of the
+// ProxyClient, so that it can be hashed and then read again. It is released
+// once the request is served.
+func (s *SignatureAuth) bufferBody(r *http.Request) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	if _, ok := r.Body.(*bufferedBody); ok {
+		return nil
+	}
+	limits := &ProxyClient{MaxRequestBodyMemory: s.MaxRequestBodyMemory, RequestBodySpillDir: s.RequestBodySpillDir, BodyMemory: s.BodyMemory}
+	body, err := limits.readRequestBody(r)
+	if err != nil {
+		if errorStatusCode(err) == http.StatusBadGateway {
+			return &StatusError{StatusCode: http.StatusInternalServerError, Err: err}
+		}
+		return err
+	}
+	r.Body = &bufferedBody{ReadSeeker: body.reader(), body: body}
+	return nil
+}
+
+// bufferedBody is a request body buffered by a policy, released when closed
+// unless the ProxyClient took it over.
+type bufferedBody struct {
+	io.ReadSeeker
+	body  *requestBody
+	taken bool
+}
+
+// take hands the body over to the caller, which releases it.
+func (b *bufferedBody) take() *requestBody {
+	b.taken = true
+	return b.body
+}
+
+func (b *bufferedBody) Close() error {
+	if b.taken {
+		return nil
+	}
+	return b.body.Close()
+}
+
+// stripPresignedQuery removes the signature of a presigned request from u.
+func stripPresignedQuery(u *url.URL) {
+	var params []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		if key, err := url.QueryUnescape(key); err == nil && presignedQueryParams[key] {
+			continue
+		}
+		params = append(params, param)
+	}
+	u.RawQuery = strings.Join(params, "&")
+}
+
+// DefaultCallerIdentityHeader is the header clients present their presigned
+// GetCallerIdentity request in.
+const DefaultCallerIdentityHeader = "X-Sigv4-Proxy-Caller-Identity"
+
+// DefaultCallerIdentityAudienceHeader is the header the presigned
+// GetCallerIdentity requests sign the audience of the proxy in, like the
+// x-k8s-aws-id header signed with the cluster ID for EKS.
+const DefaultCallerIdentityAudienceHeader = "X-Sigv4-Proxy-Id"
+
+const (
+	// callerIdentityCacheTTL is how long the identity of a presigned
+	// GetCallerIdentity request is cached.
+	callerIdentityCacheTTL = time.Minute
+	// maxCallerIdentityExpiry is the longest validity of a presigned
+	// GetCallerIdentity request, like for the tokens of
+	// aws-iam-authenticator.
+	maxCallerIdentityExpiry = 15 * time.Minute
+)
+
+// stsHost matches the hosts of the global and regional STS endpoints.
+var stsHost = regexp.MustCompile(`^sts(\.[a-z0-9-]+)?\.amazonaws\.com(\.cn)?$`)
+
+// CallerIdentityAuth is a Policy authenticating clients with their IAM
+// identity, like aws-iam-authenticator does for EKS: clients present a
+// presigned STS GetCallerIdentity request, which the proxy sends to STS to
+// learn the ARN of the caller. Only the callers of AllowedARNs are allowed.
+// The presigned requests must sign the AudienceHeader with the Audience of
+// the proxy, so that the requests presented to another service that verifies
+// caller identities cannot be replayed to this one, and the other way round.
+type CallerIdentityAuth struct {
+	// Header holds the presigned URL, DefaultCallerIdentityHeader when
+	// empty.
+	Header string
+	// AudienceHeader is the header the presigned requests sign with
+	// Audience, DefaultCallerIdentityAudienceHeader when empty.
+	AudienceHeader string
+	// Audience identifies this proxy, e.g. its name. It is required, the
+	// requests are rejected when it is empty.
+	Audience string
+	// AllowedARNs are the ARNs of the allowed callers, where * matches any
+	// characters, e.g. arn:aws:sts::123456789012:assumed-role/reader/*.
+	AllowedARNs []string
+	// Client sends the GetCallerIdentity requests.
+	Client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedCallerIdentity
+}
+
+type cachedCallerIdentity struct {
+	arn     string
+	expires time.Time
+}
+
+func (c *CallerIdentityAuth) Name() string {
+	return "caller-identity"
+}
+
+func (c *CallerIdentityAuth) header() string {
+	if c.Header == "" {
+		return DefaultCallerIdentityHeader
+	}
+	return c.Header
+}
+
+func (c *CallerIdentityAuth) audienceHeader() string {
+	if c.AudienceHeader == "" {
+		return DefaultCallerIdentityAudienceHeader
+	}
+	return c.AudienceHeader
+}
+
+func (c *CallerIdentityAuth) Check(r *http.Request) *Rejection {
+	presigned := r.Header.Get(c.header())
+	r.Header.Del(c.header())
+	if presigned == "" {
+		return &Rejection{StatusCode: http.StatusUnauthorized, Message: fmt.Sprintf("missing presigned GetCallerIdentity request in header %s", c.header())}
+	}
+
+	arn, err := c.callerARN(r, presigned)
+	if err != nil {
+		return &Rejection{StatusCode: http.StatusUnauthorized, Message: fmt.Sprintf("unable to verify the caller identity: %v", err)}
+	}
+	for _, pattern := range c.AllowedARNs {
+		if matchWildcard(pattern, arn) {
+			log.WithFields(log.Fields{"caller": arn}).Debug("verified caller identity")
+			return nil
+		}
+	}
+	return &Rejection{StatusCode: http.StatusForbidden, Message: fmt.Sprintf("caller %s is not allowed", arn)}
+}
+
+// callerARN returns the ARN of the caller of the presigned GetCallerIdentity
+// request.
+func (c *CallerIdentityAuth) callerARN(r *http.Request, presigned string) (string, error) {
+	now := time.Now()
+	c.mu.Lock()
+	cached, ok := c.cache[presigned]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.arn, nil
+	}
+
+	u, err := url.Parse(presigned)
+	if err != nil {
+		return "", errors.New("malformed presigned URL")
+	}
+	query := u.Query()
+	// The request must not be sent anywhere but to STS.
+	if u.Scheme != "https" || !stsHost.MatchString(u.Host) || (u.Path != "" && u.Path != "/") {
+		return "", fmt.Errorf("%s is not an STS endpoint", u.Host)
+	}
+	if query.Get("Action") != "GetCallerIdentity" {
+		return "", errors.New("not a GetCallerIdentity request")
+	}
+	if query.Get("X-Amz-Signature") == "" {
+		return "", errors.New("the GetCallerIdentity request is not presigned")
+	}
+	if expires, err := strconv.Atoi(query.Get("X-Amz-Expires")); err != nil || time.Duration(expires)*time.Second > maxCallerIdentityExpiry {
+		return "", fmt.Errorf("the GetCallerIdentity request must expire within %v", maxCallerIdentityExpiry)
+	}
+	// STS verifies the audience, sent along, is the one that was signed.
+	if c.Audience == "" {
+		return "", errors.New("no audience configured")
+	}
+	audienceHeader := strings.ToLower(c.audienceHeader())
+	if !slices.Contains(strings.Split(query.Get("X-Amz-SignedHeaders"), ";"), audienceHeader) {
+		return "", fmt.Errorf("the GetCallerIdentity request must sign the %s header", audienceHeader)
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(audienceHeader, c.Audience)
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("STS responded %s", resp.Status)
+	}
+	var identity struct {
+		GetCallerIdentityResponse struct {
+			GetCallerIdentityResult struct {
+				Arn string
+			}
+		}
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&identity); err != nil {
+		return "", fmt.Errorf("malformed GetCallerIdentity response: %w", err)
+	}
+	arn := identity.GetCallerIdentityResponse.GetCallerIdentityResult.Arn
+	if arn == "" {
+		return "", errors.New("no ARN in the GetCallerIdentity response")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil || len(c.cache) >= maxCachedCredentials {
+		c.cache = map[string]cachedCallerIdentity{}
+	}
+	c.cache[presigned] = cachedCallerIdentity{arn: arn, expires: now.Add(callerIdentityCacheTTL)}
+	return arn, nil
+}
@@ -0,0 +1,366 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awslabs/aws-sigv4-proxy/sigv4verifier"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignatureAuth_Check(t *testing.T) {
+	sign := func(id, secret string) func(r *http.Request) {
+		return func(r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			r.Body = io.NopCloser(strings.NewReader(string(body)))
+			v4.NewSigner(credentials.NewStaticCredentials(id, secret, "")).Sign(r, strings.NewReader(string(body)), "execute-api", "us-east-1", time.Now())
+		}
+	}
+
+	tests := []struct {
+		name      string
+		body      string
+		prepare   func(r *http.Request)
+		want      string
+		wantQuery string
+	}{
+		{
+			name:    "valid signature",
+			body:    `{"a":1}`,
+			prepare: sign("AKIDCLIENT", "client-secret"),
+		},
+		{
+			name: "signed body hash",
+			body: `{"a":1}`,
+			prepare: func(r *http.Request) {
+				r.Header.Set("X-Amz-Content-Sha256", "015abd7f5cc57a2dd94b7590f04ad8084273905ee33ec5cebeae62276a97f862")
+				sign("AKIDCLIENT", "client-secret")(r)
+			},
+		},
+		{
+			name: "presigned",
+			prepare: func(r *http.Request) {
+				r.URL.RawQuery = "b=2&a=1"
+				v4.NewSigner(credentials.NewStaticCredentials("AKIDCLIENT", "client-secret", "")).Presign(r, nil, "execute-api", "us-east-1", time.Minute, time.Now())
+			},
+			wantQuery: "a=1&b=2",
+		},
+		{
+			name: "unsigned",
+			want: "invalid signature: request is not signed",
+		},
+		{
+			name:    "unknown access key",
+			prepare: sign("AKIDOTHER", "client-secret"),
+			want:    `invalid signature: unknown access key id "AKIDOTHER"`,
+		},
+		{
+			name:    "wrong secret",
+			prepare: sign("AKIDCLIENT", "other-secret"),
+			want:    "invalid signature: ",
+		},
+		{
+			name: "body does not match the signed hash",
+			body: `{"a":2}`,
+			prepare: func(r *http.Request) {
+				r.Header.Set("X-Amz-Content-Sha256", "015abd7f5cc57a2dd94b7590f04ad8084273905ee33ec5cebeae62276a97f862")
+				sign("AKIDCLIENT", "client-secret")(r)
+			},
+			want: "invalid signature: the body does not match X-Amz-Content-Sha256",
+		},
+		{
+			name: "streaming payload",
+			prepare: func(r *http.Request) {
+				r.Header.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+				sign("AKIDCLIENT", "client-secret")(r)
+			},
+			want: "invalid signature: streaming payloads cannot be verified",
+		},
+	}
+
+	auth := &SignatureAuth{Credentials: map[string]string{"AKIDCLIENT": "client-secret"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "https://api.example.com/prod/items", strings.NewReader(tt.body))
+			if tt.prepare != nil {
+				tt.prepare(r)
+			}
+
+			rejection := auth.Check(r)
+			if tt.want != "" {
+				if assert.NotNil(t, rejection) {
+					assert.Equal(t, http.StatusForbidden, rejection.StatusCode)
+					assert.True(t, strings.HasPrefix(rejection.Message, tt.want), rejection.Message)
+				}
+				return
+			}
+			if !assert.Nil(t, rejection) {
+				return
+			}
+			for _, header := range signingHeaders {
+				assert.Empty(t, r.Header.Get(header))
+			}
+			assert.Equal(t, tt.wantQuery, r.URL.RawQuery)
+			body, _ := io.ReadAll(r.Body)
+			assert.Equal(t, tt.body, string(body))
+		})
+	}
+}
+
+func TestSignatureAuth_CheckBodyLimits(t *testing.T) {
+	body := strings.Repeat("a", 32)
+	sign := func(hash string) func(r *http.Request) {
+		return func(r *http.Request) {
+			if hash != "" {
+				r.Header.Set("X-Amz-Content-Sha256", hash)
+			}
+			v4.NewSigner(credentials.NewStaticCredentials("AKIDCLIENT", "client-secret", "")).Sign(r, strings.NewReader(body), "execute-api", "us-east-1", time.Now())
+		}
+	}
+	forged := func(r *http.Request) {
+		r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=AKIDCLIENT/"+time.Now().UTC().Format("20060102")+"/us-east-1/execute-api/aws4_request, SignedHeaders=host;x-amz-date, Signature=00")
+		r.Header.Set("X-Amz-Date", time.Now().UTC().Format("20060102T150405Z"))
+	}
+	spillDir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		auth    SignatureAuth
+		prepare func(r *http.Request)
+		want    int
+	}{
+		{
+			name:    "hashed by the verifier within the limit",
+			auth:    SignatureAuth{MaxRequestBodyMemory: 32},
+			prepare: sign(""),
+		},
+		{
+			name:    "hashed by the verifier over the limit",
+			auth:    SignatureAuth{MaxRequestBodyMemory: 8},
+			prepare: sign(""),
+			want:    http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:    "forged signature over the limit",
+			auth:    SignatureAuth{MaxRequestBodyMemory: 8},
+			prepare: forged,
+			want:    http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:    "signed hash over the limit",
+			auth:    SignatureAuth{MaxRequestBodyMemory: 8},
+			prepare: sign("3ba3f5f43b92602683c19aee62a20342b084dd5971ddd33808d81a328879a547"),
+			want:    http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:    "over the limit spilled to disk",
+			auth:    SignatureAuth{MaxRequestBodyMemory: 8, RequestBodySpillDir: spillDir},
+			prepare: sign(""),
+		},
+		{
+			name:    "not fitting the memory left",
+			auth:    SignatureAuth{BodyMemory: &BodyMemory{Limit: 8}},
+			prepare: sign(""),
+			want:    http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.auth.Credentials = map[string]string{"AKIDCLIENT": "client-secret"}
+			memory := &BodyMemory{}
+			if tt.auth.BodyMemory == nil {
+				tt.auth.BodyMemory = memory
+			}
+			r := httptest.NewRequest(http.MethodPost, "https://api.example.com/prod/items", strings.NewReader(body))
+			tt.prepare(r)
+
+			rejection := tt.auth.Check(r)
+			if tt.want != 0 {
+				if assert.NotNil(t, rejection) {
+					assert.Equal(t, tt.want, rejection.StatusCode, rejection.Message)
+				}
+				return
+			}
+			if !assert.Nil(t, rejection) {
+				return
+			}
+			forwarded, _ := io.ReadAll(r.Body)
+			assert.Equal(t, body, string(forwarded))
+
+			// The buffered body is released once the request is served.
+			r.Body.Close()
+			assert.Zero(t, memory.Used())
+			spilled, _ := os.ReadDir(spillDir)
+			assert.Empty(t, spilled)
+		})
+	}
+}
+
+func TestCheckSignedRequest_UnsignedHost(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "https://api.example.com/prod/items", nil)
+	err := (&SignatureAuth{}).checkSignedRequest(r, &sigv4verifier.Result{SignedHeaders: []string{"x-amz-date"}})
+	assert.EqualError(t, err, "the host header is not signed")
+	assert.NoError(t, (&SignatureAuth{}).checkSignedRequest(r, &sigv4verifier.Result{SignedHeaders: []string{"host", "x-amz-date"}}))
+}
+
+func TestLoadAccessKeys(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys")
+	os.WriteFile(path, []byte("# team a\nAKIDA:secret-a\n\n  AKIDB:secret:b  \n"), 0600)
+
+	keys, err := LoadAccessKeys(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"AKIDA": "secret-a", "AKIDB": "secret:b"}, keys)
+
+	invalid := filepath.Join(dir, "invalid")
+	os.WriteFile(invalid, []byte("AKIDA:secret-a\nAKIDB\n"), 0600)
+	_, err = LoadAccessKeys(invalid)
+	assert.EqualError(t, err, "invalid access key at line 2 of "+invalid+", expected <access key id>:<secret access key>")
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCallerIdentityAuth_Check(t *testing.T) {
+	const presigned = "https://sts.us-east-1.amazonaws.com/?Action=GetCallerIdentity&Version=2011-06-15&X-Amz-SignedHeaders=host%3Bx-sigv4-proxy-id&X-Amz-Expires=60&X-Amz-Signature=abc"
+
+	tests := []struct {
+		name       string
+		header     string
+		statusCode int
+		want       string
+	}{
+		{
+			name:   "allowed caller",
+			header: presigned,
+		},
+		{
+			name:       "missing header",
+			statusCode: http.StatusUnauthorized,
+			want:       "missing presigned GetCallerIdentity request in header X-Sigv4-Proxy-Caller-Identity",
+		},
+		{
+			name:       "not STS",
+			header:     "https://sts.example.com/?Action=GetCallerIdentity&X-Amz-SignedHeaders=host%3Bx-sigv4-proxy-id&X-Amz-Expires=60&X-Amz-Signature=abc",
+			statusCode: http.StatusUnauthorized,
+			want:       "unable to verify the caller identity: sts.example.com is not an STS endpoint",
+		},
+		{
+			name:       "not https",
+			header:     "http://sts.amazonaws.com/?Action=GetCallerIdentity&X-Amz-SignedHeaders=host%3Bx-sigv4-proxy-id&X-Amz-Expires=60&X-Amz-Signature=abc",
+			statusCode: http.StatusUnauthorized,
+			want:       "unable to verify the caller identity: sts.amazonaws.com is not an STS endpoint",
+		},
+		{
+			name:       "other action",
+			header:     "https://sts.amazonaws.com/?Action=AssumeRole&X-Amz-SignedHeaders=host%3Bx-sigv4-proxy-id&X-Amz-Expires=60&X-Amz-Signature=abc",
+			statusCode: http.StatusUnauthorized,
+			want:       "unable to verify the caller identity: not a GetCallerIdentity request",
+		},
+		{
+			name:       "long expiry",
+			header:     "https://sts.amazonaws.com/?Action=GetCallerIdentity&X-Amz-SignedHeaders=host%3Bx-sigv4-proxy-id&X-Amz-Expires=3600&X-Amz-Signature=abc",
+			statusCode: http.StatusUnauthorized,
+			want:       "unable to verify the caller identity: the GetCallerIdentity request must expire within 15m0s",
+		},
+		{
+			name:       "audience not signed",
+			header:     "https://sts.amazonaws.com/?Action=GetCallerIdentity&X-Amz-SignedHeaders=host&X-Amz-Expires=60&X-Amz-Signature=abc",
+			statusCode: http.StatusUnauthorized,
+			want:       "unable to verify the caller identity: the GetCallerIdentity request must sign the x-sigv4-proxy-id header",
+		},
+		{
+			name:       "rejected by STS",
+			header:     "https://sts.amazonaws.com/?Action=GetCallerIdentity&X-Amz-SignedHeaders=host%3Bx-sigv4-proxy-id&X-Amz-Expires=60&X-Amz-Signature=bad",
+			statusCode: http.StatusUnauthorized,
+			want:       "unable to verify the caller identity: STS responded 403 Forbidden",
+		},
+		{
+			name:       "caller not allowed",
+			header:     "https://sts.amazonaws.com/?Action=GetCallerIdentity&X-Amz-SignedHeaders=host%3Bx-sigv4-proxy-id&X-Amz-Expires=60&X-Amz-Signature=other",
+			statusCode: http.StatusForbidden,
+			want:       "caller arn:aws:sts::123456789012:assumed-role/writer/session is not allowed",
+		},
+	}
+
+	calls := 0
+	auth := &CallerIdentityAuth{
+		Audience:    "proxy-a",
+		AllowedARNs: []string{"arn:aws:sts::123456789012:assumed-role/reader/*"},
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			assert.Equal(t, "application/json", req.Header.Get("Accept"))
+			assert.Equal(t, "proxy-a", req.Header.Get("X-Sigv4-Proxy-Id"))
+			rec := httptest.NewRecorder()
+			switch req.URL.Query().Get("X-Amz-Signature") {
+			case "abc":
+				io.WriteString(rec, `{"GetCallerIdentityResponse":{"GetCallerIdentityResult":{"Account":"123456789012","Arn":"arn:aws:sts::123456789012:assumed-role/reader/session"}}}`)
+			case "other":
+				io.WriteString(rec, `{"GetCallerIdentityResponse":{"GetCallerIdentityResult":{"Account":"123456789012","Arn":"arn:aws:sts::123456789012:assumed-role/writer/session"}}}`)
+			default:
+				rec.WriteHeader(http.StatusForbidden)
+			}
+			return rec.Result(), nil
+		})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set(DefaultCallerIdentityHeader, tt.header)
+			}
+
+			rejection := auth.Check(r)
+			if tt.want == "" {
+				assert.Nil(t, rejection)
+			} else if assert.NotNil(t, rejection) {
+				assert.Equal(t, tt.statusCode, rejection.StatusCode)
+				assert.Equal(t, tt.want, rejection.Message)
+			}
+			assert.Empty(t, r.Header.Get(DefaultCallerIdentityHeader))
+		})
+	}
+
+	// The identity of the first request is cached.
+	before := calls
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(DefaultCallerIdentityHeader, presigned)
+	assert.Nil(t, auth.Check(r))
+	assert.Equal(t, before, calls)
+
+	// The requests are not verified without an audience.
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(DefaultCallerIdentityHeader, presigned)
+	rejection := (&CallerIdentityAuth{AllowedARNs: auth.AllowedARNs, Client: auth.Client}).Check(r)
+	if assert.NotNil(t, rejection) {
+		assert.Equal(t, "unable to verify the caller identity: no audience configured", rejection.Message)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// SourceAllowlist is a Policy only allowing clients from some networks, for
+// deployments where the port of the proxy is reachable from more networks
+// than should use it, such as on the host network. The address of the client
+// is the address of the connection, X-Forwarded-For is not trusted.
+type SourceAllowlist struct {
+	networks []*net.IPNet
+}
+
+// NewSourceAllowlist returns a SourceAllowlist of the networks in CIDR
+// notation, e.g. 10.0.0.0/8, or of single IP addresses.
+func NewSourceAllowlist(cidrs []string) (*SourceAllowlist, error) {
+	if len(cidrs) == 0 {
+		return nil, errors.New("no allowed networks")
+	}
+	s := &SourceAllowlist{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid CIDR or IP address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			s.networks = append(s.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR or IP address %q", cidr)
+		}
+		s.networks = append(s.networks, network)
+	}
+	return s, nil
+}
+
+func (s *SourceAllowlist) Name() string {
+	return "source"
+}
+
+func (s *SourceAllowlist) Check(r *http.Request) *Rejection {
+	address := clientIP(r)
+	if s.Allowed(net.ParseIP(address)) {
+		return nil
+	}
+	return &Rejection{StatusCode: http.StatusForbidden, Message: fmt.Sprintf("source address %s is not allowed", address)}
+}
+
+func (s *SourceAllowlist) Preview(r *http.Request) *Rejection {
+	return s.Check(r)
+}
+
+// Allowed returns whether ip belongs to an allowed network.
+func (s *SourceAllowlist) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceAllowlist_Check(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       string
+	}{
+		{
+			name:       "allowed network",
+			remoteAddr: "10.1.2.3:41234",
+		},
+		{
+			name:       "allowed address",
+			remoteAddr: "192.168.1.10:41234",
+		},
+		{
+			name:       "IPv4-mapped IPv6 address",
+			remoteAddr: "[::ffff:10.1.2.3]:41234",
+		},
+		{
+			name:       "allowed IPv6 network",
+			remoteAddr: "[fd00::1]:41234",
+		},
+		{
+			name:       "other network",
+			remoteAddr: "172.16.0.1:41234",
+			want:       "source address 172.16.0.1 is not allowed",
+		},
+		{
+			name:       "neighbour of the allowed address",
+			remoteAddr: "192.168.1.11:41234",
+			want:       "source address 192.168.1.11 is not allowed",
+		},
+		{
+			name:       "other IPv6 network",
+			remoteAddr: "[2001:db8::1]:41234",
+			want:       "source address 2001:db8::1 is not allowed",
+		},
+		{
+			name:       "unparsable address",
+			remoteAddr: "pipe",
+			want:       "source address pipe is not allowed",
+		},
+	}
+
+	allowlist, err := NewSourceAllowlist([]string{"10.0.0.0/8", "192.168.1.10", "fd00::/8"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+			rejection := allowlist.Check(r)
+			if tt.want == "" {
+				assert.Nil(t, rejection)
+			} else if assert.NotNil(t, rejection) {
+				assert.Equal(t, http.StatusForbidden, rejection.StatusCode)
+				assert.Equal(t, tt.want, rejection.Message)
+			}
+		})
+	}
+}
+
+func TestNewSourceAllowlist(t *testing.T) {
+	_, err := NewSourceAllowlist(nil)
+	assert.EqualError(t, err, "no allowed networks")
+	_, err = NewSourceAllowlist([]string{"10.0.0.0/33"})
+	assert.EqualError(t, err, `invalid CIDR or IP address "10.0.0.0/33"`)
+	_, err = NewSourceAllowlist([]string{"localhost"})
+	assert.EqualError(t, err, `invalid CIDR or IP address "localhost"`)
+}
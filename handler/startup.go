@@ -0,0 +1,146 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// startupMinBackoff and startupMaxBackoff bound the delay between two
+	// checks of a dependency while waiting for it.
+	startupMinBackoff = 250 * time.Millisecond
+	startupMaxBackoff = 5 * time.Second
+)
+
+// Startup waits for the dependencies of the proxy to be available before it
+// serves requests, such as a sidecar serving its credentials or a mesh proxy
+// its upstream goes through, which may start after the proxy. /readyz fails
+// until Done is called.
+type Startup struct {
+	mu      sync.Mutex
+	waiting string
+	done    bool
+}
+
+// Wait calls check until it succeeds, for up to timeout. name describes the
+// dependency in the logs and /readyz.
+func (s *Startup) Wait(ctx context.Context, name string, timeout time.Duration, check func(ctx context.Context) error) error {
+	s.mu.Lock()
+	s.waiting = name
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	backoff := startupMinBackoff
+	for {
+		err := check(ctx)
+		if err == nil {
+			log.WithFields(log.Fields{"dependency": name, "waited": time.Since(start).Round(time.Millisecond)}).Info("dependency available")
+			return nil
+		}
+		log.WithError(err).WithField("dependency", name).Info("waiting for dependency")
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s not available after %v: %w", name, timeout, err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > startupMaxBackoff {
+			backoff = startupMaxBackoff
+		}
+	}
+}
+
+// Done marks the dependencies as available.
+func (s *Startup) Done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waiting = ""
+	s.done = true
+}
+
+// Waiting returns the dependency waited for, "" once Done.
+func (s *Startup) Waiting() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return ""
+	}
+	if s.waiting == "" {
+		return "startup"
+	}
+	return s.waiting
+}
+
+// CredentialsCheck returns a check of Startup.Wait retrieving creds.
+func CredentialsCheck(creds *credentials.Credentials) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return checkCredentials(ctx, creds)
+	}
+}
+
+// UpstreamCheck returns a check of Startup.Wait connecting to the host of
+// rawURL, and completing the TLS handshake with tlsConfig for https URLs.
+func UpstreamCheck(rawURL string, tlsConfig *tls.Config) (func(ctx context.Context) error, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid upstream URL %q, expected http:// or https://", rawURL)
+	}
+	address := u.Host
+	if u.Port() == "" {
+		port := "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	return func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if u.Scheme == "http" {
+			return nil
+		}
+
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		return tls.Client(conn, config).HandshakeContext(ctx)
+	}, nil
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartup_Wait(t *testing.T) {
+	startup := &Startup{}
+	assert.Equal(t, "startup", startup.Waiting())
+
+	calls := 0
+	err := startup.Wait(context.Background(), "credentials", time.Second, func(ctx context.Context) error {
+		calls++
+		assert.Equal(t, "credentials", startup.Waiting())
+		if calls < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	err = startup.Wait(context.Background(), "upstream", 100*time.Millisecond, func(ctx context.Context) error {
+		return errors.New("connection refused")
+	})
+	assert.EqualError(t, err, "upstream not available after 100ms: connection refused")
+	assert.Equal(t, "upstream", startup.Waiting())
+
+	startup.Done()
+	assert.Equal(t, "", startup.Waiting())
+}
+
+func TestUpstreamCheck(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := listener.Addr().String()
+	listener.Close()
+
+	trusted := server.Client().Transport.(*http.Transport).TLSClientConfig
+	tests := []struct {
+		name      string
+		url       string
+		tlsConfig *tls.Config
+		wantErr   bool
+	}{
+		{
+			name:      "TLS handshake",
+			url:       server.URL,
+			tlsConfig: trusted,
+		},
+		{
+			name:    "untrusted certificate",
+			url:     server.URL,
+			wantErr: true,
+		},
+		{
+			name: "plain TCP",
+			url:  "http://" + server.Listener.Addr().String(),
+		},
+		{
+			name:      "connection refused",
+			url:       "https://" + closed,
+			tlsConfig: trusted,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check, err := UpstreamCheck(tt.url, tt.tlsConfig)
+			if !assert.NoError(t, err) {
+				return
+			}
+			err = check(context.Background())
+			assert.Equal(t, tt.wantErr, err != nil, "%v", err)
+		})
+	}
+
+	_, err := UpstreamCheck("aps-workspaces.us-east-1.amazonaws.com", nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,472 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// rateWindow is the period current rates are averaged over.
+	rateWindow = 60
+	// maxErrorSamples is the number of recent errors kept.
+	maxErrorSamples = 20
+	// maxFieldRoutes bounds the extracted field values tracked, further
+	// values are accounted for as "other".
+	maxFieldRoutes = 1000
+)
+
+// ErrorSample is a recently failed request.
+type ErrorSample struct {
+	Time       time.Time
+	Method     string
+	Path       string
+	Service    string
+	StatusCode int
+	Message    string
+}
+
+// RouteStats are the statistics of the requests proxied to a service.
+type RouteStats struct {
+	Route       string
+	Requests    int64
+	Errors      int64
+	StatusClass [6]int64
+	TotalTime   time.Duration
+}
+
+func (r *RouteStats) add(statusCode int, duration time.Duration) {
+	r.Requests++
+	r.TotalTime += duration
+	if class := statusCode / 100; class > 0 && class < len(r.StatusClass) {
+		r.StatusClass[class]++
+	}
+	if statusCode >= 500 {
+		r.Errors++
+	}
+}
+
+// AverageLatency returns the mean time taken to serve a request.
+func (r RouteStats) AverageLatency() time.Duration {
+	if r.Requests == 0 {
+		return 0
+	}
+	return r.TotalTime / time.Duration(r.Requests)
+}
+
+// latencyBuckets are the upper bounds of the buckets of LatencyHistogram.
+var latencyBuckets = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// LatencyHistogram counts durations in buckets, like the AssumeRole calls
+// made to refresh credentials.
+type LatencyHistogram struct {
+	// Counts are the number of durations up to each bound of Bounds, the
+	// last count being the durations above all of them.
+	Bounds []time.Duration
+	Counts []int64
+	Count  int64
+	Errors int64
+	Sum    time.Duration
+	Max    time.Duration
+}
+
+func newLatencyHistogram() LatencyHistogram {
+	return LatencyHistogram{Bounds: latencyBuckets, Counts: make([]int64, len(latencyBuckets)+1)}
+}
+
+func (h *LatencyHistogram) add(duration time.Duration, failed bool) {
+	i := sort.Search(len(h.Bounds), func(i int) bool { return duration <= h.Bounds[i] })
+	h.Counts[i]++
+	h.Count++
+	h.Sum += duration
+	if duration > h.Max {
+		h.Max = duration
+	}
+	if failed {
+		h.Errors++
+	}
+}
+
+// AverageLatency returns the mean duration.
+func (h LatencyHistogram) AverageLatency() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// LatencyBucket is a bucket of a LatencyHistogram.
+type LatencyBucket struct {
+	Label string
+	Count int64
+}
+
+// Buckets returns the buckets of the histogram, in increasing latency.
+func (h LatencyHistogram) Buckets() []LatencyBucket {
+	buckets := make([]LatencyBucket, len(h.Counts))
+	for i, count := range h.Counts {
+		if i < len(h.Bounds) {
+			buckets[i].Label = "≤ " + h.Bounds[i].String()
+		} else {
+			buckets[i].Label = "> " + h.Bounds[len(h.Bounds)-1].String()
+		}
+		buckets[i].Count = count
+	}
+	return buckets
+}
+
+// sizeBuckets are the upper bounds, in bytes, of the buckets of
+// SizeHistogram.
+var sizeBuckets = []int64{
+	1 << 10,
+	4 << 10,
+	16 << 10,
+	64 << 10,
+	256 << 10,
+	1 << 20,
+	4 << 20,
+	16 << 20,
+	64 << 20,
+}
+
+// SizeHistogram counts body sizes in buckets.
+type SizeHistogram struct {
+	// Counts are the number of sizes up to each bound of Bounds, the last
+	// count being the sizes above all of them.
+	Bounds []int64
+	Counts []int64
+	Count  int64
+	Sum    int64
+}
+
+func newSizeHistogram() SizeHistogram {
+	return SizeHistogram{Bounds: sizeBuckets, Counts: make([]int64, len(sizeBuckets)+1)}
+}
+
+func (h *SizeHistogram) add(size int64) {
+	i := sort.Search(len(h.Bounds), func(i int) bool { return size <= h.Bounds[i] })
+	h.Counts[i]++
+	h.Count++
+	h.Sum += size
+}
+
+func (h SizeHistogram) clone() SizeHistogram {
+	h.Counts = append([]int64(nil), h.Counts...)
+	return h
+}
+
+// RouteSizes are the sizes of the request and response bodies proxied to a
+// service, to size the memory buffering them.
+type RouteSizes struct {
+	Route    string
+	Request  SizeHistogram
+	Response SizeHistogram
+}
+
+// Stats collects in-memory request statistics, which are rendered by the
+// admin status page.
+type Stats struct {
+	Started time.Time
+
+	mu       sync.Mutex
+	routes   map[string]*RouteStats
+	fields   map[string]*RouteStats
+	errors   []ErrorSample
+	seconds  [rateWindow]int64
+	failures [rateWindow]int64
+	lastTick int64
+	aborts   int64
+	assumes  LatencyHistogram
+	clients  map[ClientProtocol]int64
+	sizes    map[string]*RouteSizes
+	headers  map[HeaderChange]int64
+}
+
+// NewStats returns an empty Stats starting now.
+func NewStats() *Stats {
+	return &Stats{
+		Started: time.Now(),
+		routes:  map[string]*RouteStats{},
+		fields:  map[string]*RouteStats{},
+		assumes: newLatencyHistogram(),
+		clients: map[ClientProtocol]int64{},
+		sizes:   map[string]*RouteSizes{},
+		headers: map[HeaderChange]int64{},
+	}
+}
+
+// statsRoute returns the route the statistics of a request are accounted
+// to.
+func statsRoute(info *RequestInfo) string {
+	if info != nil && info.Service != "" {
+		return info.Service
+	}
+	return "unknown"
+}
+
+// Record accounts for a request that completed with statusCode. Requests
+// with a 5xx status are recorded as errors.
+func (s *Stats) Record(method, path string, info *RequestInfo, statusCode int, duration time.Duration, message string) {
+	route := statsRoute(info)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats, ok := s.routes[route]
+	if !ok {
+		stats = &RouteStats{Route: route}
+		s.routes[route] = stats
+	}
+	stats.add(statusCode, duration)
+	if info != nil && info.Client.Proto != "" {
+		s.clients[info.Client]++
+	}
+	if info != nil {
+		for name, value := range info.Fields {
+			s.recordField(route, name, value, statusCode, duration)
+		}
+		for _, change := range info.HeaderChanges {
+			// Counted by rule, the headers of the clients are unbounded.
+			s.headers[HeaderChange{Rule: change.Rule, Pattern: change.Pattern}]++
+		}
+	}
+
+	s.advance(now)
+	bucket := now.Unix() % rateWindow
+	s.seconds[bucket]++
+
+	if statusCode == StatusClientClosedRequest {
+		s.aborts++
+	}
+
+	if statusCode < 500 {
+		return
+	}
+	s.failures[bucket]++
+	s.errors = append(s.errors, ErrorSample{
+		Time:       now,
+		Method:     method,
+		Path:       path,
+		Service:    route,
+		StatusCode: statusCode,
+		Message:    message,
+	})
+	if len(s.errors) > maxErrorSamples {
+		s.errors = s.errors[len(s.errors)-maxErrorSamples:]
+	}
+}
+
+// recordField accounts for a request in the statistics of the value of one
+// of its extracted fields. Must be called with the lock held.
+func (s *Stats) recordField(route, name, value string, statusCode int, duration time.Duration) {
+	key := route + " " + name + "=" + value
+	stats, ok := s.fields[key]
+	if !ok && len(s.fields) >= maxFieldRoutes {
+		key = route + " " + name + "=other"
+		stats, ok = s.fields[key]
+	}
+	if !ok {
+		stats = &RouteStats{Route: key}
+		s.fields[key] = stats
+	}
+	stats.add(statusCode, duration)
+}
+
+// RecordSizes accounts for the sizes of the request and response bodies of
+// a proxied request.
+func (s *Stats) RecordSizes(info *RequestInfo, requestBytes, responseBytes int64) {
+	route := statsRoute(info)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sizes, ok := s.sizes[route]
+	if !ok {
+		sizes = &RouteSizes{Route: route, Request: newSizeHistogram(), Response: newSizeHistogram()}
+		s.sizes[route] = sizes
+	}
+	sizes.Request.add(requestBytes)
+	sizes.Response.add(responseBytes)
+}
+
+// Sizes returns a snapshot of the body sizes per route, sorted by route.
+func (s *Stats) Sizes() []RouteSizes {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sizes := make([]RouteSizes, 0, len(s.sizes))
+	for _, r := range s.sizes {
+		sizes = append(sizes, RouteSizes{Route: r.Route, Request: r.Request.clone(), Response: r.Response.clone()})
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i].Route < sizes[j].Route })
+	return sizes
+}
+
+// Rates returns the requests and errors per second over the last minute.
+func (s *Stats) Rates() (requests, errors float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.advance(time.Now())
+	var r, e int64
+	for i := range s.seconds {
+		r += s.seconds[i]
+		e += s.failures[i]
+	}
+	return float64(r) / rateWindow, float64(e) / rateWindow
+}
+
+// ClientAborts returns the number of requests the downstream clients aborted
+// before they were proxied.
+func (s *Stats) ClientAborts() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.aborts
+}
+
+// RecordAssumeRole accounts for an AssumeRole call made to refresh
+// credentials, including its retries.
+func (s *Stats) RecordAssumeRole(duration time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.assumes.add(duration, failed)
+}
+
+// AssumeRoleLatency returns a snapshot of the AssumeRole latency histogram.
+func (s *Stats) AssumeRoleLatency() LatencyHistogram {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.assumes
+	h.Counts = append([]int64(nil), s.assumes.Counts...)
+	return h
+}
+
+// ClientProtocolStats counts the requests of the downstream clients connected
+// with a protocol.
+type ClientProtocolStats struct {
+	ClientProtocol
+	Requests int64
+}
+
+// ClientProtocols returns a snapshot of the requests per client protocol,
+// sorted by HTTP version, TLS version and ALPN protocol.
+func (s *Stats) ClientProtocols() []ClientProtocolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	protocols := make([]ClientProtocolStats, 0, len(s.clients))
+	for p, requests := range s.clients {
+		protocols = append(protocols, ClientProtocolStats{ClientProtocol: p, Requests: requests})
+	}
+	sort.Slice(protocols, func(i, j int) bool {
+		a, b := protocols[i], protocols[j]
+		if a.Proto != b.Proto {
+			return a.Proto < b.Proto
+		}
+		if a.TLSVersion != b.TLSVersion {
+			return a.TLSVersion < b.TLSVersion
+		}
+		return a.ALPN < b.ALPN
+	})
+	return protocols
+}
+
+// Routes returns a snapshot of the per-route statistics, sorted by route.
+func (s *Stats) Routes() []RouteStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	routes := make([]RouteStats, 0, len(s.routes))
+	for _, r := range s.routes {
+		routes = append(routes, *r)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Route < routes[j].Route })
+	return routes
+}
+
+// Fields returns a snapshot of the statistics per extracted field value,
+// sorted by route, field and value.
+func (s *Stats) Fields() []RouteStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fields := make([]RouteStats, 0, len(s.fields))
+	for _, f := range s.fields {
+		fields = append(fields, *f)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Route < fields[j].Route })
+	return fields
+}
+
+// HeaderRules returns the number of headers changed by each header rule, by
+// rule and pattern.
+func (s *Stats) HeaderRules() []HeaderRuleCount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make([]HeaderRuleCount, 0, len(s.headers))
+	for rule, n := range s.headers {
+		counts = append(counts, HeaderRuleCount{Rule: rule.Rule, Pattern: rule.Pattern, Headers: n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Rule != counts[j].Rule {
+			return counts[i].Rule < counts[j].Rule
+		}
+		return counts[i].Pattern < counts[j].Pattern
+	})
+	return counts
+}
+
+// RecentErrors returns the latest error samples, most recent first.
+func (s *Stats) RecentErrors() []ErrorSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	samples := make([]ErrorSample, len(s.errors))
+	for i, e := range s.errors {
+		samples[len(s.errors)-1-i] = e
+	}
+	return samples
+}
+
+// advance clears the rate buckets of the seconds elapsed since the last
+// record. Must be called with the lock held.
+func (s *Stats) advance(now time.Time) {
+	tick := now.Unix()
+	if s.lastTick == 0 || tick-s.lastTick >= rateWindow {
+		s.seconds = [rateWindow]int64{}
+		s.failures = [rateWindow]int64{}
+	} else {
+		for t := s.lastTick + 1; t <= tick; t++ {
+			s.seconds[t%rateWindow] = 0
+			s.failures[t%rateWindow] = 0
+		}
+	}
+	s.lastTick = tick
+}
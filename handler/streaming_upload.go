@@ -0,0 +1,199 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+const (
+	// streamingPayload is the payload hash of the requests whose body is
+	// signed chunk by chunk (aws-chunked content encoding).
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	// streamingChunkSize is the size of the chunks of streamed uploads. S3
+	// requires at least 8KB for every chunk but the last one.
+	streamingChunkSize = 64 << 10
+
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// streamingUpload streams the body of a downstream request upstream with
+// SigV4 chunked payload signing, instead of buffering it to hash it.
+type streamingUpload struct {
+	body          io.Reader
+	decodedLength int64
+	credentials   credentials.Value
+}
+
+// newStreamingUpload returns the streaming upload of req, and the signer to
+// sign its seed request with, bound to the credentials the chunks are signed
+// with.
+func newStreamingUpload(req *http.Request, signer *v4.Signer) (*streamingUpload, *v4.Signer, error) {
+	value, err := signer.Credentials.GetWithContext(req.Context())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uploadSigner := *signer
+	uploadSigner.Credentials = credentials.NewStaticCredentialsFromCreds(value)
+	return &streamingUpload{body: req.Body, decodedLength: req.ContentLength, credentials: value}, &uploadSigner, nil
+}
+
+// shouldStreamUpload reports whether the body of req is large enough to be
+// streamed to service rather than buffered.
+func (p *ProxyClient) shouldStreamUpload(req *http.Request, service *endpoints.ResolvedEndpoint, signer *v4.Signer) bool {
+	return p.StreamingUploadThreshold > 0 &&
+		req.Method == http.MethodPut &&
+		!chunked(req.TransferEncoding) &&
+		req.ContentLength >= p.StreamingUploadThreshold &&
+		service.SigningName == "s3" &&
+		(service.SigningMethod == "v4" || service.SigningMethod == "s3v4") &&
+		p.SigningAlgorithm != SigningAlgorithmV4A &&
+		!signer.UnsignedPayload
+}
+
+// prepare sets the headers of the seed request, signed along with it.
+func (u *streamingUpload) prepare(proxyReq *http.Request, req *http.Request) {
+	// The body cannot be sent again.
+	proxyReq.Body, proxyReq.GetBody = nil, nil
+	proxyReq.ContentLength = encodedChunksLength(u.decodedLength, streamingChunkSize)
+	proxyReq.Header.Set("X-Amz-Content-Sha256", streamingPayload)
+	proxyReq.Header.Set("X-Amz-Decoded-Content-Length", strconv.FormatInt(u.decodedLength, 10))
+	contentEncoding := "aws-chunked"
+	if encoding := req.Header.Get("Content-Encoding"); encoding != "" {
+		contentEncoding += "," + encoding
+	}
+	proxyReq.Header.Set("Content-Encoding", contentEncoding)
+}
+
+// attach sets the body of the signed seed request, chunks signed in a chain
+// starting with the seed signature.
+func (u *streamingUpload) attach(proxyReq *http.Request, service *endpoints.ResolvedEndpoint) error {
+	authorization := proxyReq.Header.Get("Authorization")
+	i := strings.Index(authorization, "Signature=")
+	if i < 0 {
+		return fmt.Errorf("unable to find the seed signature of the streaming upload")
+	}
+	timestamp := proxyReq.Header.Get("X-Amz-Date")
+	if len(timestamp) < 8 {
+		return fmt.Errorf("unable to find the timestamp of the streaming upload")
+	}
+	date := timestamp[:8]
+
+	proxyReq.Body = io.NopCloser(&chunkSigner{
+		body:      u.body,
+		remaining: u.decodedLength,
+		key:       signingKey(u.credentials.SecretAccessKey, date, service.SigningRegion, service.SigningName),
+		timestamp: timestamp,
+		scope:     strings.Join([]string{date, service.SigningRegion, service.SigningName, "aws4_request"}, "/"),
+		previous:  authorization[i+len("Signature="):],
+	})
+	return nil
+}
+
+// encodedChunksLength returns the length of a body of length bytes encoded in
+// signed chunks of chunkSize bytes.
+func encodedChunksLength(length, chunkSize int64) int64 {
+	chunkLength := func(size int64) int64 {
+		// <hex size>;chunk-signature=<signature>\r\n<data>\r\n
+		return int64(len(strconv.FormatInt(size, 16))) + int64(len(";chunk-signature=")) + 64 + 2 + size + 2
+	}
+	encoded := (length / chunkSize) * chunkLength(chunkSize)
+	if rest := length % chunkSize; rest > 0 {
+		encoded += chunkLength(rest)
+	}
+	return encoded + chunkLength(0)
+}
+
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// chunkSigner encodes a body in chunks, each signed with the signature of the
+// previous one.
+type chunkSigner struct {
+	body      io.Reader
+	remaining int64
+	key       []byte
+	timestamp string
+	scope     string
+	previous  string
+
+	buf   []byte
+	chunk []byte
+	out   []byte
+	done  bool
+}
+
+func (c *chunkSigner) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func (c *chunkSigner) nextChunk() error {
+	size := c.remaining
+	if size > streamingChunkSize {
+		size = streamingChunkSize
+	}
+	if c.buf == nil {
+		c.buf = make([]byte, streamingChunkSize)
+	}
+	data := c.buf[:size]
+	if _, err := io.ReadFull(c.body, data); err != nil {
+		return downstreamBodyError(err)
+	}
+	c.remaining -= size
+	c.done = size == 0
+
+	hash := sha256.Sum256(data)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256-PAYLOAD", c.timestamp, c.scope, c.previous, emptySHA256, hex.EncodeToString(hash[:])}, "\n")
+	c.previous = hex.EncodeToString(hmacSHA256(c.key, stringToSign))
+
+	c.chunk = append(c.chunk[:0], strconv.FormatInt(size, 16)+";chunk-signature="+c.previous+"\r\n"...)
+	c.chunk = append(c.chunk, data...)
+	c.chunk = append(c.chunk, "\r\n"...)
+	c.out = c.chunk
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestChunkSigner checks the chunk signatures of the example of the S3
+// documentation for uploads in multiple chunks.
+func TestChunkSigner(t *testing.T) {
+	body := strings.Repeat("a", 66560)
+	signer := &chunkSigner{
+		body:      strings.NewReader(body),
+		remaining: int64(len(body)),
+		key:       signingKey("wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", "20130524", "us-east-1", "s3"),
+		timestamp: "20130524T000000Z",
+		scope:     "20130524/us-east-1/s3/aws4_request",
+		previous:  "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9",
+	}
+
+	encoded, err := io.ReadAll(signer)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	want := "10000;chunk-signature=ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648\r\n" + body[:65536] + "\r\n" +
+		"400;chunk-signature=0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497\r\n" + body[65536:] + "\r\n" +
+		"0;chunk-signature=b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9\r\n\r\n"
+	assert.Equal(t, want, string(encoded))
+	assert.Equal(t, int64(66824), encodedChunksLength(int64(len(body)), streamingChunkSize))
+}
+
+func TestEncodedChunksLength(t *testing.T) {
+	for _, length := range []int64{0, 1, streamingChunkSize - 1, streamingChunkSize, 3*streamingChunkSize + 17} {
+		signer := &chunkSigner{body: bytes.NewReader(make([]byte, length)), remaining: length, key: []byte("key")}
+		encoded, err := io.ReadAll(signer)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(encoded)), encodedChunksLength(length, streamingChunkSize), "length %d", length)
+	}
+}
+
+func TestProxyClient_StreamingUpload(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		service       string
+		size          int
+		wantStreaming bool
+	}{
+		{
+			name:          "large S3 upload",
+			method:        http.MethodPut,
+			service:       "s3",
+			size:          100 << 10,
+			wantStreaming: true,
+		},
+		{
+			name:    "small S3 upload",
+			method:  http.MethodPut,
+			service: "s3",
+			size:    1 << 10,
+		},
+		{
+			name:    "large S3 POST",
+			method:  http.MethodPost,
+			service: "s3",
+			size:    100 << 10,
+		},
+		{
+			name:    "large upload to another service",
+			method:  http.MethodPut,
+			service: "es",
+			size:    100 << 10,
+		},
+	}
+
+	chunkHeader := regexp.MustCompile(`^10000;chunk-signature=[0-9a-f]{64}\r\n`)
+	lastChunks := regexp.MustCompile(`\r\n9000;chunk-signature=[0-9a-f]{64}\r\na+\r\n0;chunk-signature=[0-9a-f]{64}\r\n\r\n$`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent *http.Request
+			var sentBody []byte
+			proxyClient := &ProxyClient{
+				Signer: v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+				Client: clientFunc(func(req *http.Request) (*http.Response, error) {
+					sent = req
+					sentBody, _ = io.ReadAll(req.Body)
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}, nil
+				}),
+				SigningNameOverride:      tt.service,
+				RegionOverride:           "eu-west-1",
+				StreamingUploadThreshold: 64 << 10,
+			}
+
+			body := strings.Repeat("a", tt.size)
+			_, err := proxyClient.Do(&http.Request{
+				Method:        tt.method,
+				URL:           &url.URL{Path: "/bucket/key"},
+				Host:          tt.service + ".eu-west-1.amazonaws.com",
+				Header:        http.Header{"Content-Encoding": {"gzip"}},
+				ContentLength: int64(len(body)),
+				Body:          io.NopCloser(strings.NewReader(body)),
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			if !tt.wantStreaming {
+				assert.Equal(t, body, string(sentBody))
+				assert.NotEqual(t, streamingPayload, sent.Header.Get("X-Amz-Content-Sha256"))
+				return
+			}
+			assert.Equal(t, streamingPayload, sent.Header.Get("X-Amz-Content-Sha256"))
+			assert.Equal(t, "102400", sent.Header.Get("X-Amz-Decoded-Content-Length"))
+			assert.Equal(t, "aws-chunked,gzip", sent.Header.Get("Content-Encoding"))
+			assert.Contains(t, sent.Header.Get("Authorization"), "content-encoding;")
+			assert.Equal(t, int64(len(sentBody)), sent.ContentLength)
+			assert.Regexp(t, chunkHeader, string(sentBody))
+			assert.Regexp(t, lastChunks, string(sentBody))
+		})
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+	log "github.com/sirupsen/logrus"
+)
+
+// InstrumentAssumeRole records the latency of the AssumeRole calls of the STS
+// clients created with handlers, such as the ones of a session, in stats.
+// Credentials are refreshed synchronously by the first request after their
+// expiry, which waits for the call.
+func InstrumentAssumeRole(handlers *request.Handlers, stats *Stats) {
+	handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "sigv4proxy.AssumeRoleLatency",
+		Fn: func(r *request.Request) {
+			if r.ClientInfo.ServiceName != sts.ServiceName || !strings.HasPrefix(r.Operation.Name, "AssumeRole") {
+				return
+			}
+
+			duration := time.Since(r.Time)
+			stats.RecordAssumeRole(duration, r.Error != nil)
+			entry := log.WithFields(log.Fields{
+				"operation": r.Operation.Name,
+				"endpoint":  r.ClientInfo.Endpoint,
+				"duration":  duration,
+				"retries":   r.RetryCount,
+			})
+			if r.Error != nil {
+				entry.WithError(r.Error).Warn("unable to assume role")
+				return
+			}
+			entry.Info("assumed role")
+		},
+	})
+}
+
+// STSKeepAlive keeps a connection to the STS endpoint warm, so credential
+// refreshes do not pay for a DNS lookup and TLS handshake after the idle
+// connections have been closed.
+type STSKeepAlive struct {
+	// Endpoint is the URL of the STS endpoint the roles are assumed with.
+	Endpoint string
+	// Client must share the transport of the STS client for its connections
+	// to be reused.
+	Client   *http.Client
+	Interval time.Duration
+}
+
+// Run sends a HEAD request to Endpoint at every interval, until stop is
+// closed. STS answers them without authentication, and the connection goes
+// back to the idle pool.
+func (k *STSKeepAlive) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(k.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := k.ping(); err != nil {
+				log.WithError(err).WithField("endpoint", k.Endpoint).Debug("unable to keep the STS connection alive")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (k *STSKeepAlive) ping() error {
+	req, err := http.NewRequest(http.MethodHead, k.Endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := k.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	// The connection is only reused once the body is read to the end.
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+const assumeRoleResponse = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+<AssumeRoleResult><Credentials>
+<AccessKeyId>ASIAEXAMPLE</AccessKeyId><SecretAccessKey>SECRET</SecretAccessKey><SessionToken>TOKEN</SessionToken>
+<Expiration>%s</Expiration>
+</Credentials></AssumeRoleResult>
+</AssumeRoleResponse>`
+
+const assumeRoleError = `<ErrorResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+<Error><Type>Sender</Type><Code>AccessDenied</Code><Message>not authorized</Message></Error>
+</ErrorResponse>`
+
+func TestInstrumentAssumeRole(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("RoleArn") == "arn:aws:iam::123456789012:role/denied" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, assumeRoleError)
+			return
+		}
+		fmt.Fprintf(w, assumeRoleResponse, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	stats := NewStats()
+	InstrumentAssumeRole(&sess.Handlers, stats)
+	client := sts.New(sess)
+
+	_, err := client.AssumeRole(&sts.AssumeRoleInput{RoleArn: aws.String("arn:aws:iam::123456789012:role/proxy"), RoleSessionName: aws.String("test")})
+	assert.NoError(t, err)
+	_, err = client.AssumeRole(&sts.AssumeRoleInput{RoleArn: aws.String("arn:aws:iam::123456789012:role/denied"), RoleSessionName: aws.String("test")})
+	assert.Error(t, err)
+	// Other operations are not recorded.
+	client.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+
+	latency := stats.AssumeRoleLatency()
+	assert.Equal(t, int64(2), latency.Count)
+	assert.Equal(t, int64(1), latency.Errors)
+	assert.Equal(t, int64(2), latency.Counts[0], "local calls take less than the first bucket")
+	assert.Equal(t, "≤ 50ms", latency.Buckets()[0].Label)
+	assert.Equal(t, "> 10s", latency.Buckets()[len(latencyBuckets)].Label)
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram()
+	h.add(10*time.Millisecond, false)
+	h.add(100*time.Millisecond, false)
+	h.add(700*time.Millisecond, true)
+	h.add(time.Minute, true)
+
+	assert.Equal(t, []int64{1, 1, 0, 0, 1, 0, 0, 0, 1}, h.Counts)
+	assert.Equal(t, int64(4), h.Count)
+	assert.Equal(t, int64(2), h.Errors)
+	assert.Equal(t, time.Minute, h.Max)
+	assert.Equal(t, (time.Minute+810*time.Millisecond)/4, h.AverageLatency())
+}
+
+func TestSTSKeepAlive(t *testing.T) {
+	var pings, connections int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+		atomic.AddInt32(&pings, 1)
+		w.Header().Set("Location", "https://aws.amazon.com/iam")
+		w.WriteHeader(http.StatusFound)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	keepAlive := &STSKeepAlive{
+		Endpoint: server.URL,
+		Client: &http.Client{
+			Transport: &http.Transport{},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		Interval: 10 * time.Millisecond,
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		keepAlive.Run(stop)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&pings) >= 3 }, time.Second, 5*time.Millisecond)
+	close(stop)
+	<-done
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections), "pings reuse the connection")
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TargetInPath is a Client sending the requests whose path starts with the
+// scheme and host of their upstream, e.g.
+// /https/dynamodb.us-east-1.amazonaws.com/, to that host without them, so
+// one proxy serves any endpoint without setting the Host header. The other
+// requests are sent to Client as is.
+type TargetInPath struct {
+	Client Client
+}
+
+func (t *TargetInPath) Do(req *http.Request) (*http.Response, error) {
+	return t.Client.Do(targetFromPath(req))
+}
+
+// SigningName returns the name of the service the client would sign req for,
+// once sent to the host of its path.
+func (t *TargetInPath) SigningName(req *http.Request) string {
+	if resolver, ok := t.Client.(ServiceResolver); ok {
+		return resolver.SigningName(targetFromPath(req))
+	}
+	return ""
+}
+
+type upstreamSchemeKey struct{}
+
+// upstreamScheme returns the scheme of the upstream of the requests with ctx
+// picked by the path of the request, empty when it was not.
+func upstreamScheme(ctx context.Context) string {
+	scheme, _ := ctx.Value(upstreamSchemeKey{}).(string)
+	return scheme
+}
+
+// targetFromPath returns a copy of req sent to the scheme and host its path
+// starts with, without them, or req when it does not start with any.
+func targetFromPath(req *http.Request) *http.Request {
+	scheme, host, ok := pathTarget(req.URL.Path)
+	if !ok {
+		return req
+	}
+	prefix := "/" + scheme + "/" + host
+	target := stripPathPrefix(req, prefix)
+	if req.URL.RawPath != "" && !strings.HasPrefix(req.URL.RawPath, prefix) {
+		// The host was escaped, the path is escaped again from scratch.
+		target.URL.RawPath = ""
+	}
+	target = target.WithContext(context.WithValue(req.Context(), upstreamSchemeKey{}, scheme))
+	target.Host = strings.ToLower(host)
+	return target
+}
+
+// pathTarget returns the scheme and the host of the upstream path starts
+// with, as in /https/dynamodb.us-east-1.amazonaws.com/.
+func pathTarget(path string) (scheme, host string, ok bool) {
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	if len(segments) < 2 || (segments[0] != "http" && segments[0] != "https") {
+		return "", "", false
+	}
+	u, err := url.Parse("//" + segments[1])
+	if err != nil || u.Host == "" || u.Host != segments[1] || u.User != nil {
+		return "", "", false
+	}
+	return segments[0], u.Host, true
+}
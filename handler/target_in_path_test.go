@@ -0,0 +1,126 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetInPath_Do(t *testing.T) {
+	tests := []struct {
+		name       string
+		host       string
+		path       string
+		wantHost   string
+		wantPath   string
+		wantScheme string
+	}{
+		{
+			name:       "https",
+			host:       "proxy:8080",
+			path:       "/https/dynamodb.us-east-1.amazonaws.com/",
+			wantHost:   "dynamodb.us-east-1.amazonaws.com",
+			wantPath:   "/",
+			wantScheme: "https",
+		},
+		{
+			name:       "http with a port",
+			host:       "proxy:8080",
+			path:       "/http/search.internal:9200/logs/_search?q=error",
+			wantHost:   "search.internal:9200",
+			wantPath:   "/logs/_search",
+			wantScheme: "http",
+		},
+		{
+			name:       "host only",
+			path:       "/https/STS.amazonaws.com",
+			wantHost:   "sts.amazonaws.com",
+			wantPath:   "/",
+			wantScheme: "https",
+		},
+		{
+			name:       "keeps escaping",
+			path:       "/https/s3.us-east-1.amazonaws.com/bucket/a%2Fb",
+			wantHost:   "s3.us-east-1.amazonaws.com",
+			wantPath:   "/bucket/a%2Fb",
+			wantScheme: "https",
+		},
+		{
+			name:     "other scheme",
+			host:     "proxy:8080",
+			path:     "/ftp/example.com/file",
+			wantHost: "proxy:8080",
+			wantPath: "/ftp/example.com/file",
+		},
+		{
+			name:     "user info",
+			host:     "proxy:8080",
+			path:     "/https/user@example.com/",
+			wantHost: "proxy:8080",
+			wantPath: "/https/user@example.com/",
+		},
+		{
+			name:     "no host",
+			host:     "proxy:8080",
+			path:     "/https/",
+			wantHost: "proxy:8080",
+			wantPath: "/https/",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			target := &TargetInPath{Client: clientFunc(func(req *http.Request) (*http.Response, error) {
+				got = req
+				return &http.Response{StatusCode: http.StatusOK}, nil
+			})}
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Host = tt.host
+
+			_, err := target.Do(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.wantHost, got.Host)
+			assert.Equal(t, tt.wantPath, got.URL.EscapedPath())
+			assert.Equal(t, tt.wantScheme, upstreamScheme(got.Context()))
+		})
+	}
+}
+
+func TestTargetInPath_ProxyClient(t *testing.T) {
+	client := &mockHTTPClient{}
+	target := &TargetInPath{Client: &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+		Client: client,
+	}}
+
+	req := httptest.NewRequest(http.MethodPost, "/http/dynamodb.us-east-1.amazonaws.com/", nil)
+	assert.Equal(t, "dynamodb", target.SigningName(req))
+	_, err := target.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "http://dynamodb.us-east-1.amazonaws.com/", client.Request.URL.String())
+	assert.Contains(t, client.Request.Header.Get("Authorization"), "/us-east-1/dynamodb/aws4_request")
+}
@@ -0,0 +1,275 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTeeMaxBodyBytes is the default of Tee.MaxBodyBytes.
+const DefaultTeeMaxBodyBytes = 1 << 20
+
+// DefaultTeeQueueSize is the default of Tee.QueueSize.
+const DefaultTeeQueueSize = 64
+
+// TeeRecord is a proxied response copied to a TeeSink.
+type TeeRecord struct {
+	Time       time.Time   `json:"time"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Host       string      `json:"host"`
+	Service    string      `json:"service,omitempty"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	// Body is base64 encoded in JSON, as it may be binary.
+	Body []byte `json:"body"`
+	// Truncated is set when Body is only the start of the response body.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// TeeSink stores copies of proxied responses for inspection.
+type TeeSink interface {
+	Write(record *TeeRecord) error
+}
+
+// Tee copies a sample of the proxied responses to Sink. The bodies are
+// copied as they are read from the upstream, and the records are written to
+// Sink one at a time, apart from the requests; the records copied while
+// QueueSize records are waiting are dropped, for a slow sink not to hold
+// the memory of the responses.
+type Tee struct {
+	Sink TeeSink
+	// SampleRate is the fraction of responses copied, between 0 and 1.
+	SampleRate float64
+	// MaxBodyBytes is the most bytes of a response body copied,
+	// DefaultTeeMaxBodyBytes when zero.
+	MaxBodyBytes int
+	// QueueSize is the number of records waiting to be written to Sink,
+	// DefaultTeeQueueSize when zero.
+	QueueSize int
+
+	random  func() float64
+	once    sync.Once
+	queue   chan *TeeRecord
+	dropped atomic.Int64
+}
+
+func (t *Tee) sampled() bool {
+	if t.SampleRate >= 1 {
+		return true
+	}
+	random := rand.Float64
+	if t.random != nil {
+		random = t.random
+	}
+	return random() < t.SampleRate
+}
+
+// start returns the writer copying the body of the response to r, or nil
+// when the response is not sampled.
+func (t *Tee) start(r *http.Request, statusCode int, header http.Header) *teeWriter {
+	if !t.sampled() {
+		return nil
+	}
+
+	record := &TeeRecord{
+		Time:       time.Now().UTC(),
+		Method:     r.Method,
+		Host:       r.Host,
+		StatusCode: statusCode,
+		Header:     header,
+	}
+	if r.URL != nil {
+		record.URL = r.URL.RequestURI()
+	}
+	if info := RequestInfoFromContext(r.Context()); info != nil {
+		record.Service = info.Service
+	}
+
+	maxBytes := t.MaxBodyBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultTeeMaxBodyBytes
+	}
+	return &teeWriter{tee: t, record: record, body: &cappedBuffer{max: maxBytes}}
+}
+
+// enqueue queues record to be written to the sink, unless the queue is full.
+func (t *Tee) enqueue(record *TeeRecord) {
+	t.once.Do(func() {
+		size := t.QueueSize
+		if size <= 0 {
+			size = DefaultTeeQueueSize
+		}
+		t.queue = make(chan *TeeRecord, size)
+		go t.run()
+	})
+
+	select {
+	case t.queue <- record:
+	default:
+		// Logged once in a while, as the sink is then slower than the
+		// responses.
+		if dropped := t.dropped.Add(1); dropped%100 == 1 {
+			log.WithField("dropped", dropped).Warn("tee sink queue full, dropping response copies")
+		}
+	}
+}
+
+func (t *Tee) run() {
+	for record := range t.queue {
+		if err := t.Sink.Write(record); err != nil {
+			log.WithError(err).Error("unable to copy response to the tee sink")
+		}
+	}
+}
+
+// teeWriter captures the start of a response body as it is read, see
+// Tee.start.
+type teeWriter struct {
+	tee    *Tee
+	record *TeeRecord
+	body   *cappedBuffer
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+// done queues the record of the response once its body was read in full.
+func (w *teeWriter) done() {
+	w.record.Body = w.body.buf.Bytes()
+	w.record.Truncated = w.body.truncated
+	w.tee.enqueue(w.record)
+}
+
+// NewTeeSink returns the sink described by rawURL, either file:///path to
+// append JSON lines to a file, or s3://bucket/prefix to store one object per
+// response, signed with signer for region.
+func NewTeeSink(rawURL string, signer *v4.Signer, region string, client Client) (TeeSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tee sink %q: %w", rawURL, err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		f, err := os.OpenFile(u.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return &FileTeeSink{Writer: f}, nil
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid tee sink %q, expected s3://bucket/prefix", rawURL)
+		}
+		return &S3TeeSink{
+			Bucket: u.Host,
+			Prefix: strings.TrimPrefix(u.Path, "/"),
+			Region: region,
+			Signer: signer,
+			Client: client,
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid tee sink %q, expected a file:// or s3:// URL", rawURL)
+	}
+}
+
+// FileTeeSink appends records as JSON lines.
+type FileTeeSink struct {
+	Writer io.Writer
+
+	mu sync.Mutex
+}
+
+func (s *FileTeeSink) Write(record *TeeRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.Writer.Write(append(b, '\n'))
+	return err
+}
+
+// S3TeeSink stores each record as a JSON object in an S3 bucket, under
+// <Prefix>/<yyyy>/<mm>/<dd>/.
+type S3TeeSink struct {
+	Bucket string
+	Prefix string
+	Region string
+	Signer *v4.Signer
+	Client Client
+	// Endpoint overrides the https://<bucket>.s3.<region>.amazonaws.com
+	// endpoint objects are uploaded to.
+	Endpoint string
+
+	sequence uint64
+}
+
+func (s *S3TeeSink) Write(record *TeeRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	key := path.Join(s.Prefix, record.Time.Format("2006/01/02"),
+		fmt.Sprintf("%d-%d.json", record.Time.UnixNano(), atomic.AddUint64(&s.sequence, 1)))
+
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", s.Bucket, s.Region)
+	}
+	req, err := http.NewRequest(http.MethodPut, endpoint+"/"+key, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// S3 object keys must not be escaped twice.
+	signer := *s.Signer
+	signer.DisableURIPathEscaping = true
+	if _, err := signer.Sign(req, bytes.NewReader(b), "s3", s.Region, time.Now()); err != nil {
+		return err
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unable to put s3://%s/%s: %s %s", s.Bucket, key, resp.Status, body)
+	}
+	return nil
+}
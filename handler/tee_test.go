@@ -0,0 +1,179 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awslabs/aws-sigv4-proxy/sigv4verifier"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingTeeSink sends the records written to it on records, after
+// waiting for unblock when set.
+type recordingTeeSink struct {
+	records chan *TeeRecord
+	unblock chan struct{}
+}
+
+func (s *recordingTeeSink) Write(record *TeeRecord) error {
+	if s.unblock != nil {
+		<-s.unblock
+	}
+	s.records <- record
+	return nil
+}
+
+func TestTee_Start(t *testing.T) {
+	sink := &recordingTeeSink{records: make(chan *TeeRecord, 1)}
+	tee := &Tee{Sink: sink, SampleRate: 0.5, MaxBodyBytes: 4}
+	r := WithRequestInfo(&http.Request{Method: "GET", URL: &url.URL{Path: "/a", RawQuery: "b=c"}, Host: "sqs.us-east-1.amazonaws.com"}, &RequestInfo{Service: "sqs"})
+
+	tee.random = func() float64 { return 0.7 }
+	assert.Nil(t, tee.start(r, http.StatusOK, http.Header{}))
+
+	tee.random = func() float64 { return 0.2 }
+	w := tee.start(r, http.StatusOK, http.Header{"Content-Type": []string{"text/plain"}})
+	body, err := io.ReadAll(io.TeeReader(strings.NewReader("copied"), w))
+	assert.NoError(t, err)
+	assert.Equal(t, "copied", string(body))
+	w.done()
+
+	record := <-sink.records
+	assert.Equal(t, "GET", record.Method)
+	assert.Equal(t, "/a?b=c", record.URL)
+	assert.Equal(t, "sqs.us-east-1.amazonaws.com", record.Host)
+	assert.Equal(t, "sqs", record.Service)
+	assert.Equal(t, http.StatusOK, record.StatusCode)
+	assert.Equal(t, []byte("copi"), record.Body)
+	assert.True(t, record.Truncated)
+}
+
+func TestTee_DropsRecordsWhenQueueFull(t *testing.T) {
+	sink := &recordingTeeSink{records: make(chan *TeeRecord, 10), unblock: make(chan struct{})}
+	tee := &Tee{Sink: sink, SampleRate: 1, QueueSize: 2}
+	r := &http.Request{Method: "GET", URL: &url.URL{Path: "/"}}
+
+	// The first record is written, blocking the sink, two are queued and
+	// the others dropped.
+	tee.start(r, http.StatusOK, http.Header{}).done()
+	assert.Eventually(t, func() bool { return len(tee.queue) == 0 }, time.Second, time.Millisecond)
+	for i := 0; i < 5; i++ {
+		tee.start(r, http.StatusOK, http.Header{}).done()
+	}
+	assert.Equal(t, int64(3), tee.dropped.Load())
+
+	close(sink.unblock)
+	for i := 0; i < 3; i++ {
+		<-sink.records
+	}
+	assert.Empty(t, sink.records)
+}
+
+func TestHandler_Tee(t *testing.T) {
+	sink := &recordingTeeSink{records: make(chan *TeeRecord, 1)}
+	h := &Handler{
+		ProxyClient: &mockProxyClient{Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{"X-Upstream": {"a"}}, Body: io.NopCloser(strings.NewReader("response"))}},
+		Tee:         &Tee{Sink: sink, SampleRate: 1},
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a", nil))
+	assert.Equal(t, "response", w.Body.String())
+
+	record := <-sink.records
+	assert.Equal(t, "/a", record.URL)
+	assert.Equal(t, "a", record.Header.Get("X-Upstream"))
+	assert.Equal(t, []byte("response"), record.Body)
+	assert.False(t, record.Truncated)
+}
+
+func TestFileTeeSink_Write(t *testing.T) {
+	var buf bytes.Buffer
+	sink := &FileTeeSink{Writer: &buf}
+
+	assert.NoError(t, sink.Write(&TeeRecord{Method: "GET", Body: []byte("one")}))
+	assert.NoError(t, sink.Write(&TeeRecord{Method: "PUT", Body: []byte("two")}))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		var record TeeRecord
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+		assert.Equal(t, "PUT", record.Method)
+		assert.Equal(t, []byte("two"), record.Body)
+	}
+}
+
+func TestS3TeeSink_Write(t *testing.T) {
+	var uploaded *http.Request
+	var uploadedBody []byte
+	server := httptest.NewServer(&sigv4verifier.Verifier{
+		Credentials: map[string]string{"AKIDEXAMPLE": "secret"},
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			uploaded = r
+			uploadedBody, _ = io.ReadAll(r.Body)
+		}),
+	})
+	defer server.Close()
+
+	sink := &S3TeeSink{
+		Bucket:   "bucket",
+		Prefix:   "responses",
+		Region:   "us-west-2",
+		Signer:   v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")),
+		Client:   http.DefaultClient,
+		Endpoint: server.URL,
+	}
+
+	assert.NoError(t, sink.Write(&TeeRecord{Method: "GET", Body: []byte("body")}))
+	if assert.NotNil(t, uploaded) {
+		assert.Equal(t, http.MethodPut, uploaded.Method)
+		assert.True(t, strings.HasPrefix(uploaded.URL.Path, "/responses/0001/01/01/"), uploaded.URL.Path)
+
+		var record TeeRecord
+		assert.NoError(t, json.Unmarshal(uploadedBody, &record))
+		assert.Equal(t, []byte("body"), record.Body)
+	}
+
+	sink.Signer = v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "wrong", ""))
+	assert.Error(t, sink.Write(&TeeRecord{Method: "GET"}))
+}
+
+func TestNewTeeSink(t *testing.T) {
+	signer := v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", ""))
+
+	sink, err := NewTeeSink("s3://bucket/some/prefix", signer, "eu-west-1", http.DefaultClient)
+	assert.NoError(t, err)
+	assert.Equal(t, &S3TeeSink{Bucket: "bucket", Prefix: "some/prefix", Region: "eu-west-1", Signer: signer, Client: http.DefaultClient}, sink)
+
+	sink, err = NewTeeSink("file://"+t.TempDir()+"/responses.jsonl", signer, "eu-west-1", http.DefaultClient)
+	assert.NoError(t, err)
+	assert.IsType(t, &FileTeeSink{}, sink)
+
+	_, err = NewTeeSink("http://example.com", signer, "eu-west-1", http.DefaultClient)
+	assert.Error(t, err)
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// throttlingErrorTypes are the X-Amzn-ErrorType values AWS services return
+// when throttling a request.
+var throttlingErrorTypes = map[string]bool{
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"Throttling":                             true,
+	"TooManyRequestsException":               true,
+	"RequestLimitExceeded":                   true,
+	"RequestThrottled":                       true,
+	"RequestThrottledException":              true,
+	"ProvisionedThroughputExceededException": true,
+	"SlowDown":                               true,
+}
+
+// Throttling translates the throttling responses of upstream services, such
+// as Amazon Managed Service for Prometheus or OpenSearch, into responses
+// clients back off on instead of dropping data.
+type Throttling struct {
+	// RetryAfter is set as the Retry-After of throttling responses that do
+	// not have one.
+	RetryAfter time.Duration
+	// StatusCode, when non-zero, replaces the status of throttling responses.
+	// Prometheus remote write, for example, only retries 429s when
+	// retry_on_http_429 is enabled but always retries 503s.
+	StatusCode int
+}
+
+// Translate rewrites resp in place when it is a throttling response, and
+// reports whether it was.
+func (t *Throttling) Translate(resp *http.Response) bool {
+	if !isThrottled(resp) {
+		return false
+	}
+
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	if resp.Header.Get("Retry-After") == "" && t.RetryAfter > 0 {
+		resp.Header.Set("Retry-After", strconv.FormatInt(int64(t.RetryAfter.Round(time.Second)/time.Second), 10))
+	}
+	if t.StatusCode != 0 && t.StatusCode != resp.StatusCode {
+		resp.Header.Set("X-Original-Status-Code", strconv.Itoa(resp.StatusCode))
+		resp.StatusCode = t.StatusCode
+		resp.Status = strconv.Itoa(t.StatusCode) + " " + http.StatusText(t.StatusCode)
+	}
+	return true
+}
+
+// isThrottled reports whether resp is a throttling response: a 429, or an
+// error whose AWS error type is a throttling one.
+func isThrottled(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	if resp.StatusCode < 400 {
+		return false
+	}
+
+	// The error type may be followed by a colon and a namespace URI.
+	errorType := resp.Header.Get("X-Amzn-ErrorType")
+	if i := strings.IndexByte(errorType, ':'); i >= 0 {
+		errorType = errorType[:i]
+	}
+	return throttlingErrorTypes[errorType]
+}
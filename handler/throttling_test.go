@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottling_Translate(t *testing.T) {
+	tests := []struct {
+		name       string
+		throttling *Throttling
+		resp       *http.Response
+		throttled  bool
+		statusCode int
+		header     http.Header
+	}{
+		{
+			name:       "leaves successful responses alone",
+			throttling: &Throttling{RetryAfter: time.Second, StatusCode: http.StatusServiceUnavailable},
+			resp:       &http.Response{StatusCode: http.StatusOK, Header: http.Header{}},
+			throttled:  false,
+			statusCode: http.StatusOK,
+			header:     http.Header{},
+		},
+		{
+			name:       "leaves other errors alone",
+			throttling: &Throttling{RetryAfter: time.Second, StatusCode: http.StatusServiceUnavailable},
+			resp:       &http.Response{StatusCode: http.StatusBadRequest, Header: http.Header{"X-Amzn-Errortype": []string{"ValidationException"}}},
+			throttled:  false,
+			statusCode: http.StatusBadRequest,
+			header:     http.Header{"X-Amzn-Errortype": []string{"ValidationException"}},
+		},
+		{
+			name:       "adds a Retry-After to 429s",
+			throttling: &Throttling{RetryAfter: 2 * time.Second},
+			resp:       &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}},
+			throttled:  true,
+			statusCode: http.StatusTooManyRequests,
+			header:     http.Header{"Retry-After": []string{"2"}},
+		},
+		{
+			name:       "keeps the upstream Retry-After",
+			throttling: &Throttling{RetryAfter: 2 * time.Second},
+			resp:       &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"10"}}},
+			throttled:  true,
+			statusCode: http.StatusTooManyRequests,
+			header:     http.Header{"Retry-After": []string{"10"}},
+		},
+		{
+			name:       "detects throttling from the AWS error type",
+			throttling: &Throttling{StatusCode: http.StatusServiceUnavailable},
+			resp:       &http.Response{StatusCode: http.StatusBadRequest, Header: http.Header{"X-Amzn-Errortype": []string{"ThrottlingException:http://internal.amazon.com/coral/com.amazon.coral.availability/"}}},
+			throttled:  true,
+			statusCode: http.StatusServiceUnavailable,
+			header: http.Header{
+				"X-Amzn-Errortype":       []string{"ThrottlingException:http://internal.amazon.com/coral/com.amazon.coral.availability/"},
+				"X-Original-Status-Code": []string{"400"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.throttled, tt.throttling.Translate(tt.resp))
+			assert.Equal(t, tt.statusCode, tt.resp.StatusCode)
+			assert.Equal(t, tt.header, tt.resp.Header)
+		})
+	}
+}
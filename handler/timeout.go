@@ -0,0 +1,137 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// isStreamingResponse reports whether the body of resp is a stream of events
+// sent as they are produced, which can last as long as the upstream has
+// events to send.
+func isStreamingResponse(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || mediaType == EventStreamContentType
+}
+
+// upstreamTimeout cancels an attempt of an upstream request that is not
+// complete within the Timeout of the ProxyClient. Streaming responses are
+// only bounded by the StreamingIdleTimeout between two reads once their
+// headers are received.
+type upstreamTimeout struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	timer  *time.Timer
+	idle   time.Duration
+}
+
+// withTimeout returns req bound to the timeouts of the ProxyClient, and the
+// timeout to pass the outcome of the attempt to. The timeout is nil when none
+// is configured.
+func (p *ProxyClient) withTimeout(req *http.Request) (*http.Request, *upstreamTimeout) {
+	if p.Timeout <= 0 && p.StreamingIdleTimeout <= 0 {
+		return req, nil
+	}
+
+	ctx, cancel := context.WithCancelCause(req.Context())
+	t := &upstreamTimeout{ctx: ctx, cancel: cancel, idle: p.StreamingIdleTimeout}
+	if p.Timeout > 0 {
+		err := &StatusError{StatusCode: http.StatusGatewayTimeout, Err: fmt.Errorf("upstream did not respond within %s", p.Timeout)}
+		t.timer = time.AfterFunc(p.Timeout, func() { cancel(err) })
+	}
+	return req.WithContext(ctx), t
+}
+
+// done returns the outcome of the attempt, with the error of the timeout
+// that cancelled it if any. The response body keeps the timeout running until
+// it is closed.
+func (t *upstreamTimeout) done(resp *http.Response, err error) (*http.Response, error) {
+	if t == nil {
+		return resp, err
+	}
+	if err != nil {
+		t.stop()
+		return nil, t.err(err)
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// The upgraded connection lasts as long as the client keeps it open,
+		// its body must stay writable.
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+		return resp, nil
+	}
+	if isStreamingResponse(resp) {
+		if t.timer != nil {
+			t.timer.Stop()
+			t.timer = nil
+		}
+		if t.idle > 0 {
+			err := &StatusError{StatusCode: http.StatusGatewayTimeout, Err: fmt.Errorf("upstream stream idle for %s", t.idle)}
+			t.timer = time.AfterFunc(t.idle, func() { t.cancel(err) })
+		}
+	} else {
+		t.idle = 0
+	}
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, timeout: t}
+	return resp, nil
+}
+
+// err returns the error of the timeout when it cancelled the attempt that
+// failed with err.
+func (t *upstreamTimeout) err(err error) error {
+	var statusErr *StatusError
+	if cause := context.Cause(t.ctx); errors.As(cause, &statusErr) {
+		return cause
+	}
+	return err
+}
+
+func (t *upstreamTimeout) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.cancel(nil)
+}
+
+type timeoutBody struct {
+	io.ReadCloser
+	timeout *upstreamTimeout
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.timeout.idle > 0 && n > 0 {
+		b.timeout.timer.Reset(b.timeout.idle)
+	}
+	if err != nil && err != io.EOF {
+		err = b.timeout.err(err)
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.timeout.stop()
+	return err
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyClient_Timeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		// events are written every interval, before blocking until the
+		// request is cancelled when stall is set.
+		events   int
+		interval time.Duration
+		stall    bool
+		idle     time.Duration
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "no response",
+			stall:    true,
+			wantCode: http.StatusGatewayTimeout,
+			wantBody: "unable to proxy request - upstream did not respond within 100ms",
+		},
+		{
+			name:     "slow response body",
+			events:   1,
+			stall:    true,
+			wantCode: http.StatusGatewayTimeout,
+			wantBody: "error while reading response from upstream - upstream did not respond within 100ms",
+		},
+		{
+			name:     "response in time",
+			events:   2,
+			interval: 10 * time.Millisecond,
+			wantCode: http.StatusOK,
+			wantBody: "event\nevent\n",
+		},
+		{
+			name:        "server-sent events outlasting the timeout",
+			contentType: "text/event-stream",
+			events:      6,
+			interval:    40 * time.Millisecond,
+			idle:        100 * time.Millisecond,
+			wantCode:    http.StatusOK,
+			wantBody:    strings.Repeat("event\n", 6),
+		},
+		{
+			name:        "event stream outlasting the timeout",
+			contentType: EventStreamContentType + "; charset=binary",
+			events:      6,
+			interval:    40 * time.Millisecond,
+			wantCode:    http.StatusOK,
+			wantBody:    strings.Repeat("event\n", 6),
+		},
+		{
+			name:        "idle server-sent events",
+			contentType: "text/event-stream",
+			events:      1,
+			stall:       true,
+			idle:        100 * time.Millisecond,
+			wantCode:    http.StatusGatewayTimeout,
+			wantBody:    "error while reading response from upstream - upstream stream idle for 100ms",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan struct{})
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				for i := 0; i < tt.events; i++ {
+					time.Sleep(tt.interval)
+					w.Write([]byte("event\n"))
+					w.(http.Flusher).Flush()
+				}
+				if tt.stall {
+					select {
+					case <-r.Context().Done():
+					case <-done:
+					}
+				}
+			}))
+			defer upstream.Close()
+			defer close(done)
+
+			proxy := httptest.NewServer(&Handler{ProxyClient: &ProxyClient{
+				Signer:               v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+				Client:               http.DefaultClient,
+				HostOverride:         strings.TrimPrefix(upstream.URL, "http://"),
+				SchemeOverride:       "http",
+				SigningNameOverride:  "execute-api",
+				RegionOverride:       "us-east-1",
+				Timeout:              100 * time.Millisecond,
+				StreamingIdleTimeout: tt.idle,
+			}})
+			defer proxy.Close()
+
+			resp, err := http.Get(proxy.URL + "/events")
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+			assert.Equal(t, tt.wantBody, string(body))
+		})
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tunnel relays the connection of the client of r, hijacked, to the upgraded
+// connection upstream of resp, such as a WebSocket connection whose handshake
+// was signed, until either side closes it.
+func (h *Handler) tunnel(w http.ResponseWriter, r *http.Request, resp *http.Response, start time.Time) {
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		err := fmt.Errorf("upstream connection upgraded to %s is not writable", resp.Header.Get("Upgrade"))
+		log.WithError(err).Error("unable to proxy upgraded connection")
+		h.write(w, http.StatusBadGateway, []byte(err.Error()))
+		h.record(r, http.StatusBadGateway, start, err.Error())
+		return
+	}
+	defer upstream.Close()
+
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.WithError(err).Error("unable to proxy upgraded connection")
+		h.write(w, http.StatusInternalServerError, []byte(err.Error()))
+		h.record(r, http.StatusInternalServerError, start, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(buffered, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(buffered)
+	buffered.WriteString("\r\n")
+	if err := buffered.Flush(); err != nil {
+		h.record(r, StatusClientClosedRequest, start, err.Error())
+		return
+	}
+	log.WithField("upgrade", resp.Header.Get("Upgrade")).Debug("relaying upgraded connection")
+
+	// The client may have sent its first messages along with the request,
+	// they are read from the buffer of the connection.
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, buffered)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+	h.record(r, resp.StatusCode, start, http.StatusText(resp.StatusCode))
+}
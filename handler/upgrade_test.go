@@ -0,0 +1,130 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// dialWebSocketThroughProxy serves upstream, and a Handler proxying every
+// host to it, and returns a WebSocket connection to host through the proxy.
+func dialWebSocketThroughProxy(t *testing.T, host, path string, upstream http.HandlerFunc) *websocket.Conn {
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+
+	transport := &http.Transport{DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}}
+	proxy := httptest.NewServer(&Handler{ProxyClient: &ProxyClient{
+		Signer:          v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+		Client:          &http.Client{Transport: transport},
+		SchemeOverride:  "http",
+		ForwardUpgrades: true,
+	}})
+	t.Cleanup(proxy.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http")+path, http.Header{"Host": []string{host}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestHandler_TunnelsUpgrades(t *testing.T) {
+	var authorization string
+	conn := dialWebSocketThroughProxy(t, "abc123.execute-api.us-east-1.amazonaws.com", "/prod", func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		upstream, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		for {
+			messageType, message, err := upstream.ReadMessage()
+			if err != nil {
+				return
+			}
+			upstream.WriteMessage(messageType, append([]byte("echo "), message...))
+		}
+	})
+
+	for _, message := range []string{"hello", strings.Repeat("a", 70000)} {
+		assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(message)))
+		_, echo, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, "echo "+message, string(echo))
+	}
+	assert.Contains(t, authorization, "/us-east-1/execute-api/aws4_request")
+}
+
+func TestHandler_UpgradeRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	proxy := httptest.NewServer(&Handler{ProxyClient: &ProxyClient{
+		Signer:         v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+		Client:         http.DefaultClient,
+		HostOverride:   server.Listener.Addr().String(),
+		SchemeOverride: "http",
+		RegionOverride: "us-east-1", SigningNameOverride: "execute-api",
+		ForwardUpgrades: true,
+	}})
+	defer proxy.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http"), nil)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestProxyClient_UpgradesNotForwarded(t *testing.T) {
+	var upstream *http.Request
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+		Client: clientFunc(func(req *http.Request) (*http.Response, error) {
+			upstream = req
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+		}),
+	}
+	header := http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}, "Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="}}
+
+	_, err := proxyClient.Do(&http.Request{Method: http.MethodGet, URL: &url.URL{Path: "/prod"}, Host: "abc123.execute-api.us-east-1.amazonaws.com", Header: header.Clone()})
+	if assert.NoError(t, err) {
+		assert.Empty(t, upstream.Header.Get("Upgrade"))
+		assert.Empty(t, upstream.Header.Get("Connection"))
+	}
+
+	proxyClient.ForwardUpgrades = true
+	_, err = proxyClient.Do(&http.Request{Method: http.MethodGet, URL: &url.URL{Path: "/prod"}, Host: "abc123.execute-api.us-east-1.amazonaws.com", Header: header.Clone()})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "websocket", upstream.Header.Get("Upgrade"))
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// vpceDNSSuffixes are the DNS suffixes of the interface VPC endpoints
+// (PrivateLink), by the DNS suffix of the public endpoints of their
+// partition.
+var vpceDNSSuffixes = newSuffixIndex(map[string]string{
+	".vpce.amazonaws.com":    ".amazonaws.com",
+	".vpce.amazonaws.com.cn": ".amazonaws.com.cn",
+})
+
+// determineVPCEndpointService returns the service of the DNS name of an
+// interface VPC endpoint, e.g. vpce-0abc123-xyz.execute-api.us-east-1.vpce.amazonaws.com
+// or bucket.vpce-0abc123-xyz.s3.us-west-2.vpce.amazonaws.com, nil for other
+// hosts. The service and region are the ones of the public endpoint named by
+// the labels following the ID of the endpoint, e.g.
+// execute-api.us-east-1.amazonaws.com.
+func determineVPCEndpointService(host string) *endpoints.ResolvedEndpoint {
+	name, publicSuffix, ok := vpceDNSSuffixes.cut(host)
+	if !ok {
+		return nil
+	}
+	labels := strings.Split(name, ".")
+	// The last ID, bucket names may start with vpce- too, followed by at
+	// least the service and the region.
+	vpce := -1
+	for i := len(labels) - 3; i >= 0; i-- {
+		if strings.HasPrefix(labels[i], "vpce-") {
+			vpce = i
+			break
+		}
+	}
+	if vpce < 0 {
+		return nil
+	}
+	public := strings.Join(labels[vpce+1:], ".") + publicSuffix
+	service := determineAWSServiceFromHost(public)
+	if service != nil {
+		service.URL = "https://" + host
+	}
+	return service
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetermineVPCEndpointService(t *testing.T) {
+	tests := []struct {
+		host          string
+		partition     string
+		signingName   string
+		signingRegion string
+	}{
+		{host: "vpce-0abc123-xyz.execute-api.us-east-1.vpce.amazonaws.com", partition: "aws", signingName: "execute-api", signingRegion: "us-east-1"},
+		{host: "vpce-0abc123-xyz-us-east-1a.execute-api.us-east-1.vpce.amazonaws.com", partition: "aws", signingName: "execute-api", signingRegion: "us-east-1"},
+		{host: "bucket.vpce-0abc123-xyz.s3.us-west-2.vpce.amazonaws.com", partition: "aws", signingName: "s3", signingRegion: "us-west-2"},
+		{host: "vpce-bucket.vpce-0abc123-xyz.s3.us-west-2.vpce.amazonaws.com", partition: "aws", signingName: "s3", signingRegion: "us-west-2"},
+		{host: "vpce-0abc123-xyz.sqs.eu-west-1.vpce.amazonaws.com", partition: "aws", signingName: "sqs", signingRegion: "eu-west-1"},
+		{host: "vpce-0abc123-xyz.sqs.cn-north-1.vpce.amazonaws.com.cn", partition: "aws-cn", signingName: "sqs", signingRegion: "cn-north-1"},
+		// Unknown to the endpoints model, see deriveServiceFromHost.
+		{host: "vpce-0abc123-xyz.newservice.us-east-1.vpce.amazonaws.com", partition: "aws", signingName: "newservice", signingRegion: "us-east-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			service := determineAWSServiceFromHost(tt.host)
+			if assert.NotNil(t, service) {
+				assert.Equal(t, "https://"+tt.host, service.URL)
+				assert.Equal(t, tt.partition, service.PartitionID)
+				assert.Equal(t, tt.signingName, service.SigningName)
+				assert.Equal(t, tt.signingRegion, service.SigningRegion)
+			}
+		})
+	}
+
+	for _, host := range []string{"vpce.amazonaws.com", "s3.us-west-2.vpce.amazonaws.com", "vpce-0abc123-xyz.us-east-1.vpce.amazonaws.com", "vpce-0abc123-xyz.s3.us-west-2.vpce.example.com"} {
+		assert.Nil(t, determineVPCEndpointService(host), host)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// webSocketReadLimit bounds the request body a client sends, large enough
+// for prompts with images.
+const webSocketReadLimit = 32 << 20
+
+// WebSocketBridge bridges WebSocket connections to HTTP response streams,
+// such as Bedrock's InvokeModelWithResponseStream and ConverseStream, so
+// browsers can consume them without dealing with CORS or SigV4.
+//
+// The first message of a connection is the body of a POST request to the path
+// of the WebSocket URL. Each event of the response stream is sent back as a
+// text message, Bedrock chunks being decoded to the model's own JSON, and the
+// connection is closed normally at the end of the stream. Failures close the
+// connection with an internal error, after sending the error body.
+type WebSocketBridge struct {
+	// AllowedOrigins lists the origins of the pages allowed to connect, "*"
+	// for any. Only same origin pages can connect when empty.
+	AllowedOrigins []string
+}
+
+func (b *WebSocketBridge) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range b.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// serve upgrades r and bridges it to client, returning the upstream status
+// code and a message for the handler statistics.
+func (b *WebSocketBridge) serve(w http.ResponseWriter, r *http.Request, client Client) (int, string) {
+	upgrader := websocket.Upgrader{CheckOrigin: b.checkOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already replied with an error.
+		if !b.checkOrigin(r) {
+			return http.StatusForbidden, err.Error()
+		}
+		return http.StatusBadRequest, err.Error()
+	}
+	defer conn.Close()
+	conn.SetReadLimit(webSocketReadLimit)
+
+	_, body, err := conn.ReadMessage()
+	if err != nil {
+		return StatusClientClosedRequest, err.Error()
+	}
+
+	// Closing the connection cancels the upstream request. Further messages
+	// are ignored.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		closeWebSocket(conn, websocket.CloseInternalServerErr, err.Error())
+		return http.StatusBadRequest, err.Error()
+	}
+	req.Host = r.Host
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", EventStreamContentType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.WithError(err).Error("unable to proxy websocket request")
+		closeWebSocket(conn, websocket.CloseInternalServerErr, err.Error())
+		return errorStatusCode(err), err.Error()
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errorBody, _ := io.ReadAll(resp.Body)
+		conn.WriteMessage(websocket.TextMessage, errorBody)
+		closeWebSocket(conn, websocket.CloseInternalServerErr, resp.Status)
+		return resp.StatusCode, http.StatusText(resp.StatusCode)
+	}
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), EventStreamContentType) {
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			closeWebSocket(conn, websocket.CloseInternalServerErr, err.Error())
+			return http.StatusBadGateway, err.Error()
+		}
+		conn.WriteMessage(websocket.TextMessage, respBody)
+		closeWebSocket(conn, websocket.CloseNormalClosure, "")
+		return resp.StatusCode, http.StatusText(resp.StatusCode)
+	}
+
+	for {
+		message, err := readEventStreamMessage(resp.Body)
+		if err == io.EOF {
+			closeWebSocket(conn, websocket.CloseNormalClosure, "")
+			return resp.StatusCode, http.StatusText(resp.StatusCode)
+		}
+		if err != nil && ctx.Err() != nil {
+			return StatusClientClosedRequest, "client closed the websocket connection"
+		}
+		if err != nil {
+			log.WithError(err).Error("unable to read upstream event stream")
+			closeWebSocket(conn, websocket.CloseInternalServerErr, err.Error())
+			return http.StatusBadGateway, err.Error()
+		}
+
+		payload, err := eventPayload(message)
+		if err != nil {
+			closeWebSocket(conn, websocket.CloseInternalServerErr, err.Error())
+			return http.StatusBadGateway, err.Error()
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+			return StatusClientClosedRequest, err.Error()
+		}
+		if message.Headers[":message-type"] == "exception" {
+			closeWebSocket(conn, websocket.CloseInternalServerErr, message.Headers[":exception-type"])
+			return http.StatusBadGateway, message.Headers[":exception-type"]
+		}
+	}
+}
+
+// eventPayload returns the payload of an event stream message as sent to
+// WebSocket clients. Bedrock chunk events carry the model's chunk base64
+// encoded in a JSON object, which is decoded.
+func eventPayload(message *eventStreamMessage) ([]byte, error) {
+	if message.Headers[":message-type"] != "event" || message.Headers[":event-type"] != "chunk" {
+		return message.Payload, nil
+	}
+
+	var chunk struct {
+		Bytes []byte `json:"bytes"`
+	}
+	if err := json.Unmarshal(message.Payload, &chunk); err != nil {
+		return nil, fmt.Errorf("invalid chunk event: %w", err)
+	}
+	return chunk.Bytes, nil
+}
+
+// closeWebSocket sends a close frame, truncating reason to the 123 bytes a
+// close frame can carry.
+func closeWebSocket(conn *websocket.Conn, code int, reason string) {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+}
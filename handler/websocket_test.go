@@ -0,0 +1,145 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func eventStreamResponse(messages ...[]byte) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{EventStreamContentType}},
+		Body:       io.NopCloser(bytes.NewReader(bytes.Join(messages, nil))),
+	}
+}
+
+type recordingClient struct {
+	Request  *http.Request
+	Body     string
+	Response *http.Response
+}
+
+func (c *recordingClient) Do(req *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(req.Body)
+	c.Request, c.Body = req, string(body)
+	return c.Response, nil
+}
+
+func TestWebSocketBridge(t *testing.T) {
+	chunk := func(payload string) []byte {
+		return encodeEventStreamMessage(map[string]string{":message-type": "event", ":event-type": "chunk"}, []byte(payload))
+	}
+
+	tests := []struct {
+		name          string
+		response      *http.Response
+		origin        string
+		wantMessages  []string
+		wantCloseCode int
+		wantStatus    int
+	}{
+		{
+			name: "streams decoded chunks and closes at the end of the stream",
+			response: eventStreamResponse(
+				chunk(`{"bytes":"eyJ0eXBlIjoiY29udGVudF9ibG9ja19kZWx0YSJ9"}`),
+				encodeEventStreamMessage(map[string]string{":message-type": "event", ":event-type": "messageStop"}, []byte(`{"stopReason":"end_turn"}`)),
+			),
+			wantMessages:  []string{`{"type":"content_block_delta"}`, `{"stopReason":"end_turn"}`},
+			wantCloseCode: websocket.CloseNormalClosure,
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name: "closes with an error on stream exceptions",
+			response: eventStreamResponse(
+				encodeEventStreamMessage(map[string]string{":message-type": "exception", ":exception-type": "throttlingException"}, []byte(`{"message":"slow down"}`)),
+			),
+			wantMessages:  []string{`{"message":"slow down"}`},
+			wantCloseCode: websocket.CloseInternalServerErr,
+			wantStatus:    http.StatusBadGateway,
+		},
+		{
+			name: "sends the body of upstream errors",
+			response: &http.Response{
+				StatusCode: http.StatusForbidden,
+				Status:     "403 Forbidden",
+				Body:       io.NopCloser(strings.NewReader(`{"message":"denied"}`)),
+			},
+			wantMessages:  []string{`{"message":"denied"}`},
+			wantCloseCode: websocket.CloseInternalServerErr,
+			wantStatus:    http.StatusForbidden,
+		},
+		{
+			name:       "rejects other origins",
+			origin:     "https://evil.example.com",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &recordingClient{Response: tt.response}
+			stats := NewStats()
+			server := httptest.NewServer(&Handler{ProxyClient: client, Stats: stats, WebSocket: &WebSocketBridge{AllowedOrigins: []string{"https://app.example.com"}}})
+			defer server.Close()
+
+			header := http.Header{"Origin": []string{"https://app.example.com"}}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+			url := "ws" + strings.TrimPrefix(server.URL, "http") + "/model/anthropic.claude/invoke-with-response-stream"
+			conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+			if tt.wantMessages == nil {
+				assert.Error(t, err)
+				assert.Equal(t, tt.wantStatus, resp.StatusCode)
+				return
+			}
+			assert.NoError(t, err)
+			defer conn.Close()
+
+			assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"prompt":"hi"}`)))
+			var messages []string
+			for {
+				_, message, err := conn.ReadMessage()
+				if err != nil {
+					assert.True(t, websocket.IsCloseError(err, tt.wantCloseCode), err.Error())
+					break
+				}
+				messages = append(messages, string(message))
+			}
+			assert.Equal(t, tt.wantMessages, messages)
+
+			assert.Equal(t, http.MethodPost, client.Request.Method)
+			assert.Equal(t, "/model/anthropic.claude/invoke-with-response-stream", client.Request.URL.Path)
+			assert.Equal(t, `{"prompt":"hi"}`, client.Body)
+			assert.Equal(t, EventStreamContentType, client.Request.Header.Get("Accept"))
+
+			// The handler records the request once the bridge returns.
+			conn.Close()
+			assert.Eventually(t, func() bool { return len(stats.Routes()) == 1 }, time.Second, 10*time.Millisecond)
+			assert.Equal(t, int64(1), stats.Routes()[0].StatusClass[tt.wantStatus/100])
+		})
+	}
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// event is the union of the Lambda function URL (payload format 2.0) and
+// Application Load Balancer request events.
+type event struct {
+	// Function URL fields.
+	Version        string            `json:"version"`
+	RawPath        string            `json:"rawPath"`
+	RawQueryString string            `json:"rawQueryString"`
+	Cookies        []string          `json:"cookies"`
+	Headers        map[string]string `json:"headers"`
+	RequestContext struct {
+		DomainName string `json:"domainName"`
+		HTTP       struct {
+			Method   string `json:"method"`
+			SourceIP string `json:"sourceIp"`
+		} `json:"http"`
+		ELB *struct {
+			TargetGroupArn string `json:"targetGroupArn"`
+		} `json:"elb"`
+	} `json:"requestContext"`
+
+	// ALB fields.
+	HTTPMethod                      string              `json:"httpMethod"`
+	Path                            string              `json:"path"`
+	QueryStringParameters           map[string]string   `json:"queryStringParameters"`
+	MultiValueQueryStringParameters map[string][]string `json:"multiValueQueryStringParameters"`
+	MultiValueHeaders               map[string][]string `json:"multiValueHeaders"`
+
+	Body            string `json:"body"`
+	IsBase64Encoded bool   `json:"isBase64Encoded"`
+}
+
+func (e *event) isALB() bool {
+	return e.RequestContext.ELB != nil
+}
+
+// response is the result returned to the function URL or load balancer.
+// Headers are set for function URLs and ALB target groups without
+// multi-value headers, MultiValueHeaders otherwise.
+type response struct {
+	StatusCode        int                 `json:"statusCode"`
+	StatusDescription string              `json:"statusDescription,omitempty"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Cookies           []string            `json:"cookies,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// newRequest converts an invocation event into the request it describes.
+func newRequest(ctx context.Context, payload []byte) (*http.Request, *event, error) {
+	var e event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return nil, nil, fmt.Errorf("unable to parse event: %w", err)
+	}
+
+	body := []byte(e.Body)
+	if e.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(e.Body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to decode event body: %w", err)
+		}
+		body = decoded
+	}
+
+	header := http.Header{}
+	method, path, rawQuery, remoteIP := "", "", "", ""
+	if e.isALB() {
+		method, path = e.HTTPMethod, e.Path
+		// The load balancer passes query parameters as received, still
+		// percent-encoded.
+		var query []string
+		if e.MultiValueQueryStringParameters != nil {
+			for _, k := range sortedKeys(e.MultiValueQueryStringParameters) {
+				for _, v := range e.MultiValueQueryStringParameters[k] {
+					query = append(query, k+"="+v)
+				}
+			}
+		} else {
+			for _, k := range sortedKeys(e.QueryStringParameters) {
+				query = append(query, k+"="+e.QueryStringParameters[k])
+			}
+		}
+		rawQuery = strings.Join(query, "&")
+
+		if e.MultiValueHeaders != nil {
+			for k, vals := range e.MultiValueHeaders {
+				for _, v := range vals {
+					header.Add(k, v)
+				}
+			}
+		} else {
+			for k, v := range e.Headers {
+				header.Set(k, v)
+			}
+		}
+		// The load balancer appends the address of its peer to the
+		// X-Forwarded-For the client sent, the first ones can be forged.
+		if forwardedFor := header.Values("X-Forwarded-For"); len(forwardedFor) > 0 {
+			addrs := strings.Split(forwardedFor[len(forwardedFor)-1], ",")
+			remoteIP = strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	} else {
+		method, path, rawQuery = e.RequestContext.HTTP.Method, e.RawPath, e.RawQueryString
+		// Repeated headers are joined with commas, which cannot be split
+		// back safely.
+		for k, v := range e.Headers {
+			header.Set(k, v)
+		}
+		if len(e.Cookies) > 0 {
+			header.Set("Cookie", strings.Join(e.Cookies, "; "))
+		}
+		remoteIP = e.RequestContext.HTTP.SourceIP
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	target := path
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid request path %q: %w", target, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.URL = u
+	req.RequestURI = target
+	req.Header = header
+	req.Host = header.Get("Host")
+	if req.Host == "" {
+		req.Host = e.RequestContext.DomainName
+	}
+	if remoteIP != "" {
+		req.RemoteAddr = net.JoinHostPort(remoteIP, "0")
+	}
+	return req, &e, nil
+}
+
+// newResponse converts what the handler wrote into the response expected
+// by the source of e. Bodies are always base64 encoded, as they may be
+// binary.
+func newResponse(e *event, w *responseWriter) *response {
+	resp := &response{
+		StatusCode:      w.status,
+		Body:            base64.StdEncoding.EncodeToString(w.body.Bytes()),
+		IsBase64Encoded: true,
+	}
+
+	switch {
+	case e.isALB() && e.MultiValueHeaders != nil:
+		resp.StatusDescription = fmt.Sprintf("%d %s", w.status, http.StatusText(w.status))
+		resp.MultiValueHeaders = w.header
+	case e.isALB():
+		resp.StatusDescription = fmt.Sprintf("%d %s", w.status, http.StatusText(w.status))
+		resp.Headers = map[string]string{}
+		for k, vals := range w.header {
+			resp.Headers[k] = strings.Join(vals, ",")
+		}
+	default:
+		resp.Headers = map[string]string{}
+		for k, vals := range w.header {
+			if k == "Set-Cookie" {
+				resp.Cookies = vals
+				continue
+			}
+			resp.Headers[k] = strings.Join(vals, ",")
+		}
+	}
+	return resp
+}
+
+// responseWriter buffers the response written by the handler.
+type responseWriter struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func newResponseWriter() *responseWriter {
+	return &responseWriter{header: http.Header{}, status: http.StatusOK}
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
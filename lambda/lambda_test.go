@@ -0,0 +1,172 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package lambda
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func echoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Uri", r.URL.RequestURI())
+		w.Header().Set("X-Host", r.Host)
+		w.Header().Set("X-Remote-Addr", r.RemoteAddr)
+		w.Header().Add("X-Multi", "a")
+		w.Header().Add("X-Multi", "b")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	})
+}
+
+func TestRuntime_Invoke(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		want  response
+	}{
+		{
+			name: "function url event",
+			event: `{"version":"2.0","rawPath":"/a%2Fb","rawQueryString":"x=1&y=2",
+				"headers":{"host":"abc.lambda-url.us-east-1.on.aws"},
+				"requestContext":{"domainName":"abc.lambda-url.us-east-1.on.aws","http":{"method":"PUT","sourceIp":"10.0.0.1"}},
+				"body":"aGVsbG8=","isBase64Encoded":true}`,
+			want: response{
+				StatusCode: http.StatusCreated,
+				Headers: map[string]string{
+					"X-Method":      "PUT",
+					"X-Uri":         "/a%2Fb?x=1&y=2",
+					"X-Host":        "abc.lambda-url.us-east-1.on.aws",
+					"X-Remote-Addr": "10.0.0.1:0",
+					"X-Multi":       "a,b",
+				},
+				Body:            base64.StdEncoding.EncodeToString([]byte("hello")),
+				IsBase64Encoded: true,
+			},
+		},
+		{
+			name: "alb event",
+			event: `{"requestContext":{"elb":{"targetGroupArn":"arn"}},"httpMethod":"POST","path":"/p",
+				"queryStringParameters":{"q":"a%20b"},
+				"headers":{"host":"internal.example.com","x-forwarded-for":"10.0.0.2, 10.0.0.3"},
+				"body":"hello","isBase64Encoded":false}`,
+			want: response{
+				StatusCode:        http.StatusCreated,
+				StatusDescription: "201 Created",
+				Headers: map[string]string{
+					"X-Method":      "POST",
+					"X-Uri":         "/p?q=a%20b",
+					"X-Host":        "internal.example.com",
+					"X-Remote-Addr": "10.0.0.3:0",
+					"X-Multi":       "a,b",
+				},
+				Body:            base64.StdEncoding.EncodeToString([]byte("hello")),
+				IsBase64Encoded: true,
+			},
+		},
+		{
+			name: "alb event with a forged x-forwarded-for",
+			event: `{"requestContext":{"elb":{"targetGroupArn":"arn"}},"httpMethod":"GET","path":"/",
+				"multiValueHeaders":{"host":["internal.example.com"],"x-forwarded-for":["10.0.0.1","127.0.0.1, 10.0.0.4"]},
+				"body":""}`,
+			want: response{
+				StatusCode:        http.StatusCreated,
+				StatusDescription: "201 Created",
+				MultiValueHeaders: map[string][]string{
+					"X-Method":      {"GET"},
+					"X-Uri":         {"/"},
+					"X-Host":        {"internal.example.com"},
+					"X-Remote-Addr": {"10.0.0.4:0"},
+					"X-Multi":       {"a", "b"},
+				},
+				Body:            "",
+				IsBase64Encoded: true,
+			},
+		},
+		{
+			name: "alb event with multi-value headers",
+			event: `{"requestContext":{"elb":{"targetGroupArn":"arn"}},"httpMethod":"GET","path":"/",
+				"multiValueQueryStringParameters":{"q":["1","2"]},
+				"multiValueHeaders":{"host":["internal.example.com"]},
+				"body":""}`,
+			want: response{
+				StatusCode:        http.StatusCreated,
+				StatusDescription: "201 Created",
+				MultiValueHeaders: map[string][]string{
+					"X-Method":      {"GET"},
+					"X-Uri":         {"/?q=1&q=2"},
+					"X-Host":        {"internal.example.com"},
+					"X-Remote-Addr": {""},
+					"X-Multi":       {"a", "b"},
+				},
+				Body:            "",
+				IsBase64Encoded: true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &Runtime{Handler: echoHandler()}
+			got, err := rt.invoke(context.Background(), []byte(tt.event))
+			assert.NoError(t, err)
+
+			var resp response
+			assert.NoError(t, json.Unmarshal(got, &resp))
+			assert.Equal(t, tt.want, resp)
+		})
+	}
+}
+
+func TestRuntime_Run(t *testing.T) {
+	results := make(chan string, 2)
+	served := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/2018-06-01/runtime/invocation/next" && served == 0:
+			served++
+			w.Header().Set("Lambda-Runtime-Aws-Request-Id", "req-1")
+			w.Write([]byte(`{"version":"2.0","rawPath":"/","requestContext":{"http":{"method":"GET"}}}`))
+		case r.URL.Path == "/2018-06-01/runtime/invocation/next" && served == 1:
+			served++
+			w.Header().Set("Lambda-Runtime-Aws-Request-Id", "req-2")
+			w.Write([]byte(`not json`))
+		case r.URL.Path == "/2018-06-01/runtime/invocation/next":
+			w.WriteHeader(http.StatusInternalServerError)
+		case strings.HasSuffix(r.URL.Path, "/response") || strings.HasSuffix(r.URL.Path, "/error"):
+			results <- r.URL.Path
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer api.Close()
+
+	rt := &Runtime{API: strings.TrimPrefix(api.URL, "http://"), Handler: echoHandler()}
+	err := rt.Run(context.Background())
+
+	assert.Error(t, err)
+	assert.Equal(t, "/2018-06-01/runtime/invocation/req-1/response", <-results)
+	assert.Equal(t, "/2018-06-01/runtime/invocation/req-2/error", <-results)
+}
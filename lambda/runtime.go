@@ -0,0 +1,148 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+// Package lambda serves AWS Lambda function URL and Application Load Balancer
+// invocations with an http.Handler, using the Lambda Runtime API.
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const runtimeAPIVersion = "2018-06-01"
+
+// Runtime polls the Lambda Runtime API for invocations and serves them with
+// Handler.
+type Runtime struct {
+	// API is the host and port of the Runtime API, AWS_LAMBDA_RUNTIME_API
+	// when empty.
+	API     string
+	Handler http.Handler
+	Client  *http.Client
+}
+
+// Start serves invocations with h until the Runtime API fails. It is meant to
+// be called from main when running inside a Lambda function.
+func Start(h http.Handler) error {
+	return (&Runtime{Handler: h}).Run(context.Background())
+}
+
+// Run processes invocations until ctx is done or the Runtime API fails.
+func (rt *Runtime) Run(ctx context.Context) error {
+	api := rt.API
+	if api == "" {
+		api = os.Getenv("AWS_LAMBDA_RUNTIME_API")
+	}
+	if api == "" {
+		return fmt.Errorf("AWS_LAMBDA_RUNTIME_API is not set, not running inside Lambda")
+	}
+	base := "http://" + api + "/" + runtimeAPIVersion + "/runtime/invocation/"
+
+	for {
+		if err := rt.next(ctx, base); err != nil {
+			return err
+		}
+	}
+}
+
+// next waits for an invocation, serves it and posts its result.
+func (rt *Runtime) next(ctx context.Context, base string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"next", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rt.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to get next invocation: %w", err)
+	}
+	payload, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("unable to read next invocation: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to get next invocation: %s", resp.Status)
+	}
+
+	requestID := resp.Header.Get("Lambda-Runtime-Aws-Request-Id")
+	if traceID := resp.Header.Get("Lambda-Runtime-Trace-Id"); traceID != "" {
+		os.Setenv("_X_AMZN_TRACE_ID", traceID)
+	}
+
+	invocationCtx := ctx
+	if deadline, err := strconv.ParseInt(resp.Header.Get("Lambda-Runtime-Deadline-Ms"), 10, 64); err == nil {
+		var cancel context.CancelFunc
+		invocationCtx, cancel = context.WithDeadline(ctx, time.UnixMilli(deadline))
+		defer cancel()
+	}
+
+	result, err := rt.invoke(invocationCtx, payload)
+	if err != nil {
+		log.WithError(err).WithField("request_id", requestID).Error("unable to serve invocation")
+		body, _ := json.Marshal(map[string]string{"errorMessage": err.Error(), "errorType": "InvalidEvent"})
+		return rt.post(ctx, base+requestID+"/error", body, "InvalidEvent")
+	}
+	return rt.post(ctx, base+requestID+"/response", result, "")
+}
+
+func (rt *Runtime) invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	req, e, err := newRequest(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	w := newResponseWriter()
+	rt.Handler.ServeHTTP(w, req)
+	return json.Marshal(newResponse(e, w))
+}
+
+func (rt *Runtime) post(ctx context.Context, url string, body []byte, errorType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if errorType != "" {
+		req.Header.Set("Lambda-Runtime-Function-Error-Type", errorType)
+	}
+	resp, err := rt.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to post invocation result: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("unable to post invocation result: %s", resp.Status)
+	}
+	return nil
+}
+
+func (rt *Runtime) client() *http.Client {
+	if rt.Client != nil {
+		return rt.Client
+	}
+	// Next invocation requests block until an event arrives, they must not
+	// time out.
+	return http.DefaultClient
+}
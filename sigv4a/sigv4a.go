@@ -0,0 +1,322 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+// Package sigv4a signs requests with SigV4A, the asymmetric variant of SigV4
+// used by multi-region services such as S3 Multi-Region Access Points. The
+// signature is an ECDSA P-256 signature made with a key derived from the
+// secret access key, and is valid in a set of regions rather than one.
+package sigv4a
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+const (
+	// Algorithm is the SigV4A signing algorithm, as set in the Authorization
+	// header.
+	Algorithm = "AWS4-ECDSA-P256-SHA256"
+
+	// RegionSetHeader carries the comma separated regions a signature is
+	// valid in, "*" for all of them.
+	RegionSetHeader = "X-Amz-Region-Set"
+
+	timeFormat      = "20060102T150405Z"
+	shortTimeFormat = "20060102"
+	scopeTerminator = "aws4_request"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// ignoredHeaders are never signed, as proxies and clients commonly rewrite
+// them.
+var ignoredHeaders = map[string]bool{
+	"Authorization":   true,
+	"User-Agent":      true,
+	"X-Amzn-Trace-Id": true,
+}
+
+// Signer signs requests with SigV4A, like v4.Signer does with SigV4.
+type Signer struct {
+	Credentials *credentials.Credentials
+	// DisableURIPathEscaping disables the second escaping of the path S3
+	// does not expect.
+	DisableURIPathEscaping bool
+	// UnsignedPayload signs the request without hashing its body.
+	UnsignedPayload bool
+}
+
+// NewSigner returns a Signer signing with creds.
+func NewSigner(creds *credentials.Credentials) *Signer {
+	return &Signer{Credentials: creds}
+}
+
+// Sign signs r for service in the regions of regionSet, adding the
+// Authorization, X-Amz-Date, X-Amz-Region-Set and, with session credentials,
+// X-Amz-Security-Token headers. body is read to hash the payload, rewound and
+// set as the body of r, like v4.Signer does.
+func (s *Signer) Sign(r *http.Request, body io.ReadSeeker, service string, regionSet []string, signTime time.Time) error {
+	if len(regionSet) == 0 {
+		return fmt.Errorf("sigv4a: empty region set")
+	}
+
+	creds, err := s.Credentials.Get()
+	if err != nil {
+		return err
+	}
+	key, err := DeriveKey(creds.AccessKeyID, creds.SecretAccessKey)
+	if err != nil {
+		return err
+	}
+
+	payloadHash := unsignedPayload
+	if !s.UnsignedPayload {
+		if payloadHash, err = hashBody(body); err != nil {
+			return err
+		}
+	}
+
+	signTime = signTime.UTC()
+	r.Header.Del("Authorization")
+	r.Header.Set("X-Amz-Date", signTime.Format(timeFormat))
+	r.Header.Set(RegionSetHeader, strings.Join(regionSet, ","))
+	if creds.SessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	if s.UnsignedPayload || strings.HasPrefix(service, "s3") {
+		r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	signedHeaders, canonicalHeaders := s.canonicalHeaders(r)
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		s.canonicalURI(r.URL),
+		canonicalQuery(r.URL),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{signTime.Format(shortTimeFormat), service, scopeTerminator}, "/")
+	stringToSign := StringToSign(signTime, scope, canonicalRequest)
+
+	digest := sha256.Sum256([]byte(stringToSign))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		Algorithm, creds.AccessKeyID, scope, signedHeaders, hex.EncodeToString(signature)))
+
+	r.Body = nil
+	if body != nil {
+		r.Body = io.NopCloser(body)
+	}
+	return nil
+}
+
+// StringToSign returns the SigV4A string to sign of a canonical request.
+func StringToSign(signTime time.Time, scope, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	return strings.Join([]string{
+		Algorithm,
+		signTime.UTC().Format(timeFormat),
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+}
+
+func (s *Signer) canonicalURI(u *url.URL) string {
+	path := u.EscapedPath()
+	if u.Opaque != "" {
+		// The path of the "//host/path" opaque form is signed as is, as
+		// v4.Signer does.
+		path = "/" + strings.Join(strings.Split(u.Opaque, "/")[3:], "/")
+	}
+	if path == "" {
+		path = "/"
+	}
+	if s.DisableURIPathEscaping {
+		return path
+	}
+	// The already escaped path is URI encoded a second time, as every
+	// service but S3 expects.
+	return escape(path, false)
+}
+
+func (s *Signer) canonicalHeaders(r *http.Request) (string, string) {
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	values := map[string]string{"host": host}
+	if r.ContentLength > 0 {
+		values["content-length"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	for name, vv := range r.Header {
+		if ignoredHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		trimmed := make([]string, len(vv))
+		for i, v := range vv {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		values[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + values[name] + "\n")
+	}
+	return strings.Join(names, ";"), b.String()
+}
+
+// canonicalQuery returns the query parameters of u URI encoded, sorted by
+// encoded key and then by encoded value, repeated keys included.
+func canonicalQuery(u *url.URL) string {
+	type pair struct{ key, value string }
+
+	var pairs []pair
+	for key, values := range u.Query() {
+		for _, value := range values {
+			pairs = append(pairs, pair{escape(key, true), escape(value, true)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].key != pairs[j].key {
+			return pairs[i].key < pairs[j].key
+		}
+		return pairs[i].value < pairs[j].value
+	})
+
+	encoded := make([]string, len(pairs))
+	for i, p := range pairs {
+		encoded[i] = p.key + "=" + p.value
+	}
+	return strings.Join(encoded, "&")
+}
+
+// escape URI encodes s, but for the unreserved characters and, unless
+// encodeSlash, the slashes.
+func escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hashBody(body io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if body != nil {
+		start, err := body.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(h, body); err != nil {
+			return "", err
+		}
+		if _, err := body.Seek(start, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// nMinusTwo is the order of the P-256 curve minus two, the exclusive upper
+// bound of the derived key candidates.
+var nMinusTwo = new(big.Int).Sub(elliptic.P256().Params().N, big.NewInt(2))
+
+// DeriveKey derives the ECDSA P-256 key pair of an access key pair, with the
+// NIST SP 800-108 HMAC-SHA256 counter mode KDF. Candidates not lower than
+// the curve order minus two are rejected with the next external counter.
+func DeriveKey(accessKeyID, secretAccessKey string) (*ecdsa.PrivateKey, error) {
+	inputKey := []byte("AWS4A" + secretAccessKey)
+	for counter := 1; counter <= 0xff; counter++ {
+		context := append([]byte(accessKeyID), byte(counter))
+		candidate := new(big.Int).SetBytes(kdf(inputKey, []byte(Algorithm), context, 256))
+		if candidate.Cmp(nMinusTwo) >= 0 {
+			continue
+		}
+
+		d := make([]byte, 32)
+		candidate.Add(candidate, big.NewInt(1)).FillBytes(d)
+		key, err := ecdh.P256().NewPrivateKey(d)
+		if err != nil {
+			return nil, err
+		}
+
+		// The ECDH public key is the uncompressed point 0x04 || X || Y.
+		point := key.PublicKey().Bytes()
+		return &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(point[1:33]),
+				Y:     new(big.Int).SetBytes(point[33:]),
+			},
+			D: new(big.Int).SetBytes(d),
+		}, nil
+	}
+	return nil, fmt.Errorf("sigv4a: unable to derive a key for access key id %s", accessKeyID)
+}
+
+// kdf is the NIST SP 800-108 KDF in counter mode with HMAC-SHA256.
+func kdf(key, label, context []byte, bitLen int) []byte {
+	h := hmac.New(sha256.New, key)
+	var output []byte
+	for i := uint32(1); len(output)*8 < bitLen; i++ {
+		var input bytes.Buffer
+		binary.Write(&input, binary.BigEndian, i)
+		input.Write(label)
+		input.WriteByte(0)
+		input.Write(context)
+		binary.Write(&input, binary.BigEndian, uint32(bitLen))
+
+		h.Reset()
+		h.Write(input.Bytes())
+		output = h.Sum(output)
+	}
+	return output[:bitLen/8]
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package sigv4a
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeriveKey(t *testing.T) {
+	// Test vector of the AWS SDKs.
+	key, err := DeriveKey("AKISORANDOMAASORANDOM", "q+jcrXGc+0zWN6uzclKVhvMmUsIfRPa4rlRandom")
+	assert.NoError(t, err)
+	assert.Equal(t, "15D242CEEBF8D8169FD6A8B5A746C41140414C3B07579038DA06AF89190FFFCB", fmt.Sprintf("%X", key.X))
+	assert.Equal(t, "515242CEDD82E94799482E4C0514B505AFCCF2C0C98D6A553BF539F424C5EC0", fmt.Sprintf("%X", key.Y))
+}
+
+func TestSigner_Sign(t *testing.T) {
+	tests := []struct {
+		name            string
+		signer          *Signer
+		service         string
+		regionSet       []string
+		wantCredential  string
+		wantHeaders     map[string]string
+		wantSignedNames string
+	}{
+		{
+			name:            "signs for a region set",
+			signer:          NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+			service:         "execute-api",
+			regionSet:       []string{"us-east-1", "us-west-2"},
+			wantCredential:  "Credential=AKID/20240102/execute-api/aws4_request,",
+			wantHeaders:     map[string]string{RegionSetHeader: "us-east-1,us-west-2", "X-Amz-Date": "20240102T030405Z"},
+			wantSignedNames: "SignedHeaders=content-length;host;x-amz-date;x-amz-region-set,",
+		},
+		{
+			name:            "signs the session token and payload hash of s3 requests",
+			signer:          NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "TOKEN")),
+			service:         "s3",
+			regionSet:       []string{"*"},
+			wantCredential:  "Credential=AKID/20240102/s3/aws4_request,",
+			wantHeaders:     map[string]string{RegionSetHeader: "*", "X-Amz-Security-Token": "TOKEN", "X-Amz-Content-Sha256": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+			wantSignedNames: "SignedHeaders=content-length;host;x-amz-content-sha256;x-amz-date;x-amz-region-set;x-amz-security-token,",
+		},
+		{
+			name:            "does not hash unsigned payloads",
+			signer:          &Signer{Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""), UnsignedPayload: true},
+			service:         "s3",
+			regionSet:       []string{"*"},
+			wantCredential:  "Credential=AKID/20240102/s3/aws4_request,",
+			wantHeaders:     map[string]string{"X-Amz-Content-Sha256": "UNSIGNED-PAYLOAD"},
+			wantSignedNames: "SignedHeaders=content-length;host;x-amz-content-sha256;x-amz-date;x-amz-region-set,",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.NewReader("hello")
+			req, _ := http.NewRequest(http.MethodPut, "https://example.com/a/b", body)
+			req.Header.Set("User-Agent", "test")
+
+			err := tt.signer.Sign(req, body, tt.service, tt.regionSet, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+			assert.NoError(t, err)
+
+			auth := req.Header.Get("Authorization")
+			assert.True(t, strings.HasPrefix(auth, Algorithm+" "))
+			assert.Contains(t, auth, tt.wantCredential)
+			assert.Contains(t, auth, tt.wantSignedNames)
+			for name, value := range tt.wantHeaders {
+				assert.Equal(t, value, req.Header.Get(name), name)
+			}
+			assert.Equal(t, int64(0), body.Size()-int64(body.Len()), "body must be rewound")
+		})
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	assert.EqualError(t, NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")).Sign(req, nil, "s3", nil, time.Now()), "sigv4a: empty region set")
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawQuery string
+		want     string
+	}{
+		{
+			name:     "sorted by key",
+			rawQuery: "b=2&a=1",
+			want:     "a=1&b=2",
+		},
+		{
+			name:     "repeated keys sorted by value",
+			rawQuery: "attr=b&list-type=2&attr=a",
+			want:     "attr=a&attr=b&list-type=2",
+		},
+		{
+			name:     "repeated keys sorted by encoded value",
+			rawQuery: "prefix=a&prefix=%7B&prefix=A",
+			want:     "prefix=%7B&prefix=A&prefix=a",
+		},
+		{
+			name:     "keys sorted once encoded",
+			rawQuery: "a=1&%7B=2",
+			want:     "%7B=2&a=1",
+		},
+		{
+			name:     "empty values and spaces",
+			rawQuery: "acl&prefix=a+b%2Fc~",
+			want:     "acl=&prefix=a%20b%2Fc~",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, canonicalQuery(&url.URL{RawQuery: tt.rawQuery}))
+		})
+	}
+}
@@ -0,0 +1,534 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+// Package sigv4verifier emulates the SigV4 and SigV4A validation performed by
+// AWS services. It recomputes the canonical request of an incoming request and
+// checks the signature against a set of known credentials, so the output of
+// the proxy can be verified without calling AWS.
+package sigv4verifier
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awslabs/aws-sigv4-proxy/sigv4a"
+)
+
+const (
+	algorithm       = "AWS4-HMAC-SHA256"
+	timeFormat      = "20060102T150405Z"
+	shortTimeFormat = "20060102"
+	scopeTerminator = "aws4_request"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// DefaultMaxSkew is the clock skew AWS tolerates between the signing time
+	// and the time the request is received.
+	DefaultMaxSkew = 15 * time.Minute
+)
+
+// Verifier validates SigV4 and SigV4A signed requests against known credentials.
+type Verifier struct {
+	// Credentials maps access key IDs to their secret access keys.
+	Credentials map[string]string
+
+	// MaxSkew is the tolerated difference between the signing time and now.
+	// DefaultMaxSkew is used when zero.
+	MaxSkew time.Duration
+
+	// Now returns the current time. time.Now is used when nil.
+	Now func() time.Time
+
+	// Next is called for requests with a valid signature. When nil, the
+	// verification result is written back as JSON.
+	Next http.Handler
+
+	// MaxBodySize, when positive, is the size of the largest body read to
+	// hash it, for the requests without X-Amz-Content-Sha256. Larger bodies
+	// fail with ErrBodyTooLarge. Bodies implementing io.Seeker are hashed in
+	// place instead, whatever their size.
+	MaxBodySize int64
+}
+
+// ErrBodyTooLarge is returned for the bodies larger than the MaxBodySize of
+// the Verifier.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// Result describes a successfully verified request.
+type Result struct {
+	AccessKeyID string `json:"accessKeyId"`
+	// Region is the comma separated region set of SigV4A signatures.
+	Region        string   `json:"region"`
+	Service       string   `json:"service"`
+	SignedHeaders []string `json:"signedHeaders"`
+	Presigned     bool     `json:"presigned"`
+}
+
+// SignatureMismatchError is returned when the signature does not match the
+// one computed by the verifier. It carries the canonical request and string
+// to sign so differences can be debugged, like AWS does.
+type SignatureMismatchError struct {
+	CanonicalRequest string
+	StringToSign     string
+}
+
+func (e *SignatureMismatchError) Error() string {
+	return fmt.Sprintf("signature does not match, canonical request:\n%s\nstring to sign:\n%s", e.CanonicalRequest, e.StringToSign)
+}
+
+// NewServer starts a test server that verifies every incoming request
+// against the provided access key ID to secret access key map.
+func NewServer(credentials map[string]string) *httptest.Server {
+	return httptest.NewServer(&Verifier{Credentials: credentials})
+}
+
+func (v *Verifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	result, err := v.Verify(r)
+	if err != nil {
+		statusCode := http.StatusForbidden
+		if errors.Is(err, ErrBodyTooLarge) {
+			statusCode = http.StatusRequestEntityTooLarge
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+		return
+	}
+
+	if v.Next != nil {
+		v.Next.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+type signature struct {
+	algorithm     string
+	accessKeyID   string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	expires       time.Duration
+	presigned     bool
+}
+
+// Verify checks the SigV4 signature of r, carried either in the
+// Authorization header or in presigned query parameters. The request body is
+// read to compute the payload hash and restored before returning.
+func (v *Verifier) Verify(r *http.Request) (*Result, error) {
+	sig, err := parseSignature(r)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, ok := v.Credentials[sig.accessKeyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown access key id %q", sig.accessKeyID)
+	}
+
+	signTime, err := time.Parse(timeFormat, sig.amzDate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X-Amz-Date %q: %v", sig.amzDate, err)
+	}
+	if signTime.Format(shortTimeFormat) != sig.date {
+		return nil, fmt.Errorf("credential scope date %s does not match X-Amz-Date %s", sig.date, sig.amzDate)
+	}
+	if err := v.checkTime(signTime, sig); err != nil {
+		return nil, err
+	}
+
+	payloadHash, err := v.payloadHash(r, sig)
+	if err != nil {
+		return nil, err
+	}
+
+	canonicalRequest, err := buildCanonicalRequest(r, sig, payloadHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if sig.algorithm == sigv4a.Algorithm {
+		if err := verifyV4A(sig, secret, signTime, canonicalRequest); err != nil {
+			return nil, err
+		}
+	} else {
+		scope := strings.Join([]string{sig.date, sig.region, sig.service, scopeTerminator}, "/")
+		stringToSign := strings.Join([]string{
+			algorithm,
+			sig.amzDate,
+			scope,
+			hex.EncodeToString(hashSHA256([]byte(canonicalRequest))),
+		}, "\n")
+
+		key := deriveSigningKey(secret, sig.date, sig.region, sig.service)
+		expected := hex.EncodeToString(hmacSHA256(key, []byte(stringToSign)))
+		if !hmac.Equal([]byte(expected), []byte(sig.signature)) {
+			return nil, &SignatureMismatchError{CanonicalRequest: canonicalRequest, StringToSign: stringToSign}
+		}
+	}
+
+	return &Result{
+		AccessKeyID:   sig.accessKeyID,
+		Region:        sig.region,
+		Service:       sig.service,
+		SignedHeaders: sig.signedHeaders,
+		Presigned:     sig.presigned,
+	}, nil
+}
+
+// verifyV4A checks the ECDSA signature of sig against the public key derived
+// from the secret access key.
+func verifyV4A(sig *signature, secret string, signTime time.Time, canonicalRequest string) error {
+	scope := strings.Join([]string{sig.date, sig.service, scopeTerminator}, "/")
+	stringToSign := sigv4a.StringToSign(signTime, scope, canonicalRequest)
+
+	key, err := sigv4a.DeriveKey(sig.accessKeyID, secret)
+	if err != nil {
+		return err
+	}
+	signature, err := hex.DecodeString(sig.signature)
+	if err != nil {
+		return fmt.Errorf("malformed signature %q", sig.signature)
+	}
+	digest := hashSHA256([]byte(stringToSign))
+	if !ecdsa.VerifyASN1(&key.PublicKey, digest, signature) {
+		return &SignatureMismatchError{CanonicalRequest: canonicalRequest, StringToSign: stringToSign}
+	}
+	return nil
+}
+
+func (v *Verifier) checkTime(signTime time.Time, sig *signature) error {
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+
+	if sig.presigned {
+		if now.Before(signTime.Add(-v.maxSkew())) {
+			return fmt.Errorf("request is not valid until %s", signTime.Format(timeFormat))
+		}
+		if now.After(signTime.Add(sig.expires)) {
+			return fmt.Errorf("request has expired at %s", signTime.Add(sig.expires).Format(timeFormat))
+		}
+		return nil
+	}
+
+	skew := now.Sub(signTime)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > v.maxSkew() {
+		return fmt.Errorf("signature time %s is too skewed from the server time %s", signTime.Format(timeFormat), now.UTC().Format(timeFormat))
+	}
+	return nil
+}
+
+func (v *Verifier) maxSkew() time.Duration {
+	if v.MaxSkew == 0 {
+		return DefaultMaxSkew
+	}
+	return v.MaxSkew
+}
+
+func parseSignature(r *http.Request) (*signature, error) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return parseAuthorizationHeader(r, auth)
+	}
+	if r.URL.Query().Get("X-Amz-Signature") != "" {
+		return parsePresignedQuery(r)
+	}
+	return nil, fmt.Errorf("request is not signed")
+}
+
+func parseAuthorizationHeader(r *http.Request, auth string) (*signature, error) {
+	name, params, _ := strings.Cut(auth, " ")
+	if name != algorithm && name != sigv4a.Algorithm {
+		return nil, fmt.Errorf("unsupported signing algorithm in authorization header %q", auth)
+	}
+
+	sig := &signature{algorithm: name}
+	for _, part := range strings.Split(params, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed authorization header component %q", part)
+		}
+		switch kv[0] {
+		case "Credential":
+			if err := sig.parseCredential(kv[1]); err != nil {
+				return nil, err
+			}
+		case "SignedHeaders":
+			sig.signedHeaders = strings.Split(kv[1], ";")
+		case "Signature":
+			sig.signature = kv[1]
+		}
+	}
+	if sig.accessKeyID == "" || sig.signedHeaders == nil || sig.signature == "" {
+		return nil, fmt.Errorf("authorization header is missing Credential, SignedHeaders or Signature")
+	}
+
+	sig.amzDate = r.Header.Get("X-Amz-Date")
+	if sig.amzDate == "" {
+		return nil, fmt.Errorf("missing X-Amz-Date header")
+	}
+	if sig.algorithm == sigv4a.Algorithm {
+		if sig.region = r.Header.Get(sigv4a.RegionSetHeader); sig.region == "" {
+			return nil, fmt.Errorf("missing %s header", sigv4a.RegionSetHeader)
+		}
+	}
+	return sig, nil
+}
+
+func parsePresignedQuery(r *http.Request) (*signature, error) {
+	query := r.URL.Query()
+	a := query.Get("X-Amz-Algorithm")
+	if a != algorithm && a != sigv4a.Algorithm {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", a)
+	}
+
+	sig := &signature{
+		algorithm: a,
+		signature: query.Get("X-Amz-Signature"),
+		amzDate:   query.Get("X-Amz-Date"),
+		presigned: true,
+	}
+	if err := sig.parseCredential(query.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+	if sig.algorithm == sigv4a.Algorithm {
+		if sig.region = query.Get(sigv4a.RegionSetHeader); sig.region == "" {
+			return nil, fmt.Errorf("missing %s query parameter", sigv4a.RegionSetHeader)
+		}
+	}
+
+	signedHeaders := query.Get("X-Amz-SignedHeaders")
+	if signedHeaders == "" {
+		return nil, fmt.Errorf("missing X-Amz-SignedHeaders query parameter")
+	}
+	sig.signedHeaders = strings.Split(signedHeaders, ";")
+
+	expires, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X-Amz-Expires query parameter: %v", err)
+	}
+	sig.expires = time.Duration(expires) * time.Second
+	return sig, nil
+}
+
+// parseCredential parses the credential scope of sig, which has no region
+// with SigV4A.
+func (sig *signature) parseCredential(credential string) error {
+	parts := strings.Split(credential, "/")
+	if sig.algorithm == sigv4a.Algorithm {
+		if len(parts) != 4 || parts[3] != scopeTerminator {
+			return fmt.Errorf("malformed credential %q", credential)
+		}
+		sig.accessKeyID, sig.date, sig.service = parts[0], parts[1], parts[2]
+		return nil
+	}
+	if len(parts) != 5 || parts[4] != scopeTerminator {
+		return fmt.Errorf("malformed credential %q", credential)
+	}
+	sig.accessKeyID, sig.date, sig.region, sig.service = parts[0], parts[1], parts[2], parts[3]
+	return nil
+}
+
+func (v *Verifier) payloadHash(r *http.Request, sig *signature) (string, error) {
+	if hash := r.Header.Get("X-Amz-Content-Sha256"); hash != "" {
+		return hash, nil
+	}
+	if sig.presigned && sig.service == "s3" {
+		return unsignedPayload, nil
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return hex.EncodeToString(hashSHA256(nil)), nil
+	}
+
+	if body, ok := r.Body.(io.ReadSeeker); ok {
+		hash := sha256.New()
+		if _, err := io.Copy(hash, body); err != nil {
+			return "", fmt.Errorf("unable to read request body: %v", err)
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return "", fmt.Errorf("unable to rewind request body: %v", err)
+		}
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+
+	reader := io.Reader(r.Body)
+	if v.MaxBodySize > 0 {
+		reader = io.LimitReader(r.Body, v.MaxBodySize+1)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return "", fmt.Errorf("unable to read request body: %v", err)
+	}
+	if v.MaxBodySize > 0 && int64(len(body)) > v.MaxBodySize {
+		return "", fmt.Errorf("%w, the body exceeds %d bytes", ErrBodyTooLarge, v.MaxBodySize)
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return hex.EncodeToString(hashSHA256(body)), nil
+}
+
+func buildCanonicalRequest(r *http.Request, sig *signature, payloadHash string) (string, error) {
+	headers, err := canonicalHeaders(r, sig.signedHeaders)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		canonicalURI(r.URL, sig.service),
+		canonicalQuery(r.URL, sig.presigned),
+		headers,
+		strings.Join(sig.signedHeaders, ";"),
+		payloadHash,
+	}, "\n"), nil
+}
+
+// canonicalURI returns the URI encoded path. Every service but S3, and its
+// Object Lambda access points, expects the already escaped path, as received,
+// to be encoded a second time.
+func canonicalURI(u *url.URL, service string) string {
+	path := u.RawPath
+	if path == "" {
+		path = u.EscapedPath()
+	}
+	if path == "" {
+		path = "/"
+	}
+	if service == "s3" || service == "s3-object-lambda" {
+		return path
+	}
+	return escape(path, false)
+}
+
+func canonicalQuery(u *url.URL, presigned bool) string {
+	type pair struct{ key, value string }
+
+	var pairs []pair
+	for key, values := range u.Query() {
+		if presigned && key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, pair{escape(key, true), escape(value, true)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].key != pairs[j].key {
+			return pairs[i].key < pairs[j].key
+		}
+		return pairs[i].value < pairs[j].value
+	})
+
+	encoded := make([]string, len(pairs))
+	for i, p := range pairs {
+		encoded[i] = p.key + "=" + p.value
+	}
+	return strings.Join(encoded, "&")
+}
+
+func canonicalHeaders(r *http.Request, signedHeaders []string) (string, error) {
+	var b strings.Builder
+	hasHost := false
+	for _, name := range signedHeaders {
+		var values []string
+		switch name {
+		case "host":
+			hasHost = true
+			values = []string{r.Host}
+		case "content-length":
+			values = append(values, r.Header.Values(name)...)
+			if len(values) == 0 {
+				values = []string{strconv.FormatInt(r.ContentLength, 10)}
+			}
+		default:
+			values = append(values, r.Header.Values(name)...)
+		}
+		if len(values) == 0 {
+			return "", fmt.Errorf("signed header %q is not present in the request", name)
+		}
+
+		for i, v := range values {
+			values[i] = collapseSpaces(strings.TrimSpace(v))
+		}
+		b.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	if !hasHost {
+		return "", fmt.Errorf("host header must be signed")
+	}
+	return b.String(), nil
+}
+
+func collapseSpaces(s string) string {
+	for strings.Contains(s, "  ") {
+		s = strings.ReplaceAll(s, "  ", " ")
+	}
+	return s
+}
+
+// escape URI encodes every byte except the unreserved characters defined by
+// RFC 3986, and optionally '/'.
+func escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func deriveSigningKey(secret, date, region, service string) []byte {
+	kDate := hmacSHA256([]byte("AWS4"+secret), []byte(date))
+	kRegion := hmacSHA256(kDate, []byte(region))
+	kService := hmacSHA256(kRegion, []byte(service))
+	return hmacSHA256(kService, []byte(scopeTerminator))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func hashSHA256(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
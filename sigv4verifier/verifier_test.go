@@ -0,0 +1,237 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package sigv4verifier
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awslabs/aws-sigv4-proxy/sigv4a"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+var testCredentials = map[string]string{"AKIDEXAMPLE": "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+
+func newSigner(secret string) *v4.Signer {
+	return v4.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", secret, ""))
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	tests := []struct {
+		name    string
+		sign    func(r *http.Request, body io.ReadSeeker) error
+		tamper  func(r *http.Request)
+		body    string
+		wantErr string
+	}{
+		{
+			name: "accepts a signed request",
+			sign: func(r *http.Request, body io.ReadSeeker) error {
+				_, err := newSigner(testCredentials["AKIDEXAMPLE"]).Sign(r, body, "execute-api", "us-west-2", time.Now())
+				return err
+			},
+			body: `{"hello":"world"}`,
+		},
+		{
+			name: "accepts a signed request with an escaped path and query",
+			sign: func(r *http.Request, body io.ReadSeeker) error {
+				r.URL.RawPath = "/a%20path/with%2Fslash"
+				r.URL.Path = "/a path/with/slash"
+				r.URL.RawQuery = "b=2&a=1&a=0&c=with+space"
+				_, err := newSigner(testCredentials["AKIDEXAMPLE"]).Sign(r, body, "execute-api", "us-west-2", time.Now())
+				return err
+			},
+		},
+		{
+			name: "accepts a presigned s3 request",
+			sign: func(r *http.Request, body io.ReadSeeker) error {
+				s := newSigner(testCredentials["AKIDEXAMPLE"])
+				s.DisableURIPathEscaping = true
+				_, err := s.Presign(r, body, "s3", "us-east-1", time.Hour, time.Now())
+				return err
+			},
+		},
+		{
+			name: "accepts a SigV4A signed request",
+			sign: func(r *http.Request, body io.ReadSeeker) error {
+				r.URL.RawQuery = "list-type=2&prefix=a%20b~"
+				s := sigv4a.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", testCredentials["AKIDEXAMPLE"], "token"))
+				s.DisableURIPathEscaping = true
+				return s.Sign(r, body, "s3", []string{"*"}, time.Now())
+			},
+			body: "hello",
+		},
+		{
+			name: "rejects a SigV4A signature for another region set",
+			sign: func(r *http.Request, body io.ReadSeeker) error {
+				s := sigv4a.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", testCredentials["AKIDEXAMPLE"], ""))
+				return s.Sign(r, body, "execute-api", []string{"us-east-1"}, time.Now())
+			},
+			tamper: func(r *http.Request) {
+				r.Header.Set(sigv4a.RegionSetHeader, "us-east-1,us-west-2")
+			},
+			wantErr: "signature does not match",
+		},
+		{
+			name: "rejects a SigV4A signature computed with the wrong secret",
+			sign: func(r *http.Request, body io.ReadSeeker) error {
+				s := sigv4a.NewSigner(credentials.NewStaticCredentials("AKIDEXAMPLE", "wrong", ""))
+				return s.Sign(r, body, "execute-api", []string{"us-east-1"}, time.Now())
+			},
+			wantErr: "signature does not match",
+		},
+		{
+			name:    "rejects an unsigned request",
+			sign:    func(r *http.Request, body io.ReadSeeker) error { return nil },
+			wantErr: "request is not signed",
+		},
+		{
+			name: "rejects an unknown access key",
+			sign: func(r *http.Request, body io.ReadSeeker) error {
+				s := v4.NewSigner(credentials.NewStaticCredentials("AKIDUNKNOWN", "secret", ""))
+				_, err := s.Sign(r, body, "execute-api", "us-west-2", time.Now())
+				return err
+			},
+			wantErr: `unknown access key id "AKIDUNKNOWN"`,
+		},
+		{
+			name: "rejects a signature computed with the wrong secret",
+			sign: func(r *http.Request, body io.ReadSeeker) error {
+				_, err := newSigner("wrong").Sign(r, body, "execute-api", "us-west-2", time.Now())
+				return err
+			},
+			wantErr: "signature does not match",
+		},
+		{
+			name: "rejects a tampered body",
+			sign: func(r *http.Request, body io.ReadSeeker) error {
+				_, err := newSigner(testCredentials["AKIDEXAMPLE"]).Sign(r, body, "execute-api", "us-west-2", time.Now())
+				return err
+			},
+			tamper: func(r *http.Request) {
+				r.Body = io.NopCloser(strings.NewReader("tampered"))
+			},
+			body:    "original",
+			wantErr: "signature does not match",
+		},
+		{
+			name: "rejects a stale signature",
+			sign: func(r *http.Request, body io.ReadSeeker) error {
+				_, err := newSigner(testCredentials["AKIDEXAMPLE"]).Sign(r, body, "execute-api", "us-west-2", time.Now().Add(-time.Hour))
+				return err
+			},
+			wantErr: "too skewed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result *Result
+			var verifyErr error
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.tamper != nil {
+					tt.tamper(r)
+				}
+				result, verifyErr = (&Verifier{Credentials: testCredentials}).Verify(r)
+			}))
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodPost, server.URL+"/", nil)
+			assert.NoError(t, err)
+			assert.NoError(t, tt.sign(req, strings.NewReader(tt.body)))
+
+			resp, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			resp.Body.Close()
+
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, verifyErr, tt.wantErr)
+				return
+			}
+			assert.NoError(t, verifyErr)
+			assert.Equal(t, "AKIDEXAMPLE", result.AccessKeyID)
+		})
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	server := NewServer(testCredentials)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp.Body.Close()
+
+	req, _ = http.NewRequest(http.MethodGet, server.URL+"/", nil)
+	_, err = newSigner(testCredentials["AKIDEXAMPLE"]).Sign(req, nil, "es", "eu-west-1", time.Now())
+	assert.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `"service":"es"`)
+}
+
+type seekableBody struct {
+	*strings.Reader
+}
+
+func (seekableBody) Close() error { return nil }
+
+func TestVerifier_MaxBodySize(t *testing.T) {
+	const body = `{"hello":"world"}`
+	tests := []struct {
+		name        string
+		maxBodySize int64
+		seekable    bool
+		want        int
+	}{
+		{name: "unlimited", want: http.StatusOK},
+		{name: "within the limit", maxBodySize: int64(len(body)), want: http.StatusOK},
+		{name: "over the limit", maxBodySize: 8, want: http.StatusRequestEntityTooLarge},
+		{name: "seekable body over the limit", maxBodySize: 8, seekable: true, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "https://abc.execute-api.us-west-2.amazonaws.com/prod", strings.NewReader(body))
+			_, err := newSigner(testCredentials["AKIDEXAMPLE"]).Sign(r, strings.NewReader(body), "execute-api", "us-west-2", time.Now())
+			assert.NoError(t, err)
+			if tt.seekable {
+				r.Body = seekableBody{strings.NewReader(body)}
+			}
+
+			w := httptest.NewRecorder()
+			(&Verifier{Credentials: testCredentials, MaxBodySize: tt.maxBodySize}).ServeHTTP(w, r)
+			assert.Equal(t, tt.want, w.Code, w.Body.String())
+			if tt.want == http.StatusOK {
+				// The body is restored for the next handler.
+				forwarded, _ := io.ReadAll(r.Body)
+				assert.Equal(t, body, string(forwarded))
+			}
+		})
+	}
+}